@@ -0,0 +1,382 @@
+package cart
+
+import (
+  "archive/tar"
+  "compress/gzip"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "time"
+
+	"github.com/boltdb/bolt"
+)
+
+// The name of the archive entry describing the backup.
+const ManifestFileName = "manifest.json"
+
+// Describes a backup archive.
+type Manifest struct {
+  // When the backup started.
+  Time time.Time `json:"time"`
+  // The number of shards the backup was taken with.
+  Shards int `json:"shards"`
+  // The sequence number of the first journal entry that may be
+  // missing from the snapshot.  Replaying the journal from here
+  // on brings a restored backup up to date.
+  JournalSeq uint64 `json:"journal_seq"`
+  // The id mode of the data, see IDMode.  Archives written before
+  // id modes existed hold numeric ids.
+  IDs string `json:"ids,omitempty"`
+  // How keys map to the shards, see ShardMapping.  Archives
+  // written before mappings existed use the modulo mapping.
+  Mapping string `json:"mapping,omitempty"`
+  // The URL of every member that led the raft group, by id, in
+  // snapshots taken by raft.
+  Members map[string]string `json:"members,omitempty"`
+}
+
+// Write a snapshot of every shard of the storage into the archive.
+// Every shard is copied within a read transaction, so writes can
+// go on while the backup is running.
+func (s *ShardedStorage) backup(tw *tar.Writer) error {
+  return s.forEachShard(func(shard *storageShard) error {
+    return shard.db.View(func(tx *bolt.Tx) error {
+      hdr := &tar.Header{
+        Name: ShardFileName(s.name, shard.shardN),
+        Mode: 0600,
+        Size: tx.Size(),
+        ModTime: time.Now(),
+      }
+      if err := tw.WriteHeader(hdr); err != nil {
+        return err
+      }
+
+      _, err := tx.WriteTo(tw)
+      return err
+    })
+  })
+}
+
+// Backup writes a gzipped tar archive holding a snapshot of every
+// shard of both storages and of the variant registry.  Every shard
+// is consistent on its own, but a write landing between the
+// snapshots of its customer and item shard only makes it into one
+// of them; check -repair fixes that after a restore.
+func (h *Handler) Backup(w io.Writer) error {
+  if !h.begin() {
+    return ErrClosed
+  }
+  defer h.leave()
+
+  return h.backup(w, nil)
+}
+
+// The body of Backup, recording the members of the raft group in
+// the manifest.  The caller must be inside a request, or be raft
+// taking a snapshot.
+func (h *Handler) backup(w io.Writer, members map[string]string) error {
+  gw := gzip.NewWriter(w)
+  tw := tar.NewWriter(gw)
+
+  // Every journal entry written before this point is in the
+  // snapshot, because entries are written after the storage.
+  m := Manifest{
+    Time: time.Now().UTC(),
+    Shards: len(h.cStorage.shards),
+    JournalSeq: 1,
+    IDs: h.ids.String(),
+    Mapping: h.mapping.String(),
+    Members: members,
+  }
+  if h.journal != nil {
+    m.JournalSeq = h.journal.Next()
+  }
+  if err := writeManifest(tw, m); err != nil {
+    return err
+  }
+
+  for _, storage := range [...]*ShardedStorage{&h.cStorage, &h.iStorage} {
+    if err := storage.backup(tw); err != nil {
+      return err
+    }
+  }
+
+  // Last, so that every variant in the shards is in the registry.
+  if err := h.variants.backup(tw); err != nil {
+    return err
+  }
+
+  if err := tw.Close(); err != nil {
+    return err
+  }
+  return gw.Close()
+}
+
+// Replace the contents of a shard with the ones of the shard file
+// at path, or empty it if there is no such file.  The shard is
+// replaced in a single transaction, so readers see either all of
+// the old or all of the new contents.
+func (s *ShardedStorage) replaceShard(id uint32, path string) error {
+  var src *bolt.DB
+  if _, err := os.Stat(path); err == nil {
+    src, err = bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+    if err != nil {
+      return err
+    }
+    defer src.Close()
+  } else if !os.IsNotExist(err) {
+    return err
+  } else if _, err := os.Stat(filepath.Join(s.folder, ShardFileName(s.name, id))); os.IsNotExist(err) {
+    // Empty already, no need to create the file.
+    return nil
+  }
+
+  shard, err := s.getShardAt(id)
+  if err != nil {
+    return err
+  }
+  defer s.releaseShard(shard)
+
+  err = shard.db.Update(func(tx *bolt.Tx) error {
+    var names [][]byte
+    err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+      names = append(names, append([]byte(nil), name...))
+      return nil
+    })
+    if err != nil {
+      return err
+    }
+    for _, name := range names {
+      if err := tx.DeleteBucket(name); err != nil {
+        return err
+      }
+    }
+
+    if src == nil {
+      return nil
+    }
+    return src.View(func(stx *bolt.Tx) error {
+      return stx.ForEach(func(name []byte, b *bolt.Bucket) error {
+        dst, err := tx.CreateBucket(name)
+        if err != nil {
+          return err
+        }
+        return copyBucket(dst, b)
+      })
+    })
+  })
+  if err != nil {
+    return err
+  }
+  return shard.db.Sync()
+}
+
+// Copy every key and nested bucket of src into dst.
+func copyBucket(dst *bolt.Bucket, src *bolt.Bucket) error {
+  if err := dst.SetSequence(src.Sequence()); err != nil {
+    return err
+  }
+  return src.ForEach(func(k, v []byte) error {
+    // The data of src is only valid while its transaction is.
+    k = append([]byte(nil), k...)
+    if v != nil {
+      return dst.Put(k, append([]byte(nil), v...))
+    }
+
+    child, err := dst.CreateBucket(k)
+    if err != nil {
+      return err
+    }
+    return copyBucket(child, src.Bucket(k))
+  })
+}
+
+// Write the manifest as the first entry of the archive.
+func writeManifest(tw *tar.Writer, m Manifest) error {
+  data, err := json.Marshal(m)
+  if err != nil {
+    return err
+  }
+
+  hdr := &tar.Header{
+    Name: ManifestFileName,
+    Mode: 0600,
+    Size: int64(len(data)),
+    ModTime: m.Time,
+  }
+  if err := tw.WriteHeader(hdr); err != nil {
+    return err
+  }
+  _, err = tw.Write(data)
+  return err
+}
+
+// Restore unpacks an archive written by Backup into dir, which must
+// not hold any shard files yet.  shards is the number of shards the
+// archive will be served with.  Every shard is validated before the
+// first one is moved into place, so a bad archive leaves dir as it
+// was.  The layout file of dir records the id mode and the shard
+// mapping of the archive.
+// Return the manifest of the archive; archives written before
+// manifests existed get one starting at the first journal entry.
+func Restore(r io.Reader, dir string, shards int) (Manifest, error) {
+  m := Manifest{Shards: shards, JournalSeq: 1}
+
+  for _, name := range [...]string{CustomerStorage, ItemStorage} {
+    paths, err := ShardFiles(dir, name)
+    if err != nil && !os.IsNotExist(err) {
+      return m, err
+    }
+    if len(paths) > 0 {
+      return m, fmt.Errorf("%v already holds %v shards", dir, name)
+    }
+  }
+  if _, err := os.Stat(filepath.Join(dir, VariantFileName)); err == nil {
+    return m, fmt.Errorf("%v already holds a variant registry", dir)
+  }
+
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return m, err
+  }
+
+  // Unpack next to the destination, so that moving the files
+  // into place is a rename.
+  tmp, err := ioutil.TempDir(dir, ".restore-")
+  if err != nil {
+    return m, err
+  }
+  defer os.RemoveAll(tmp)
+
+  files, err := unpack(r, tmp, shards, &m)
+  if err != nil {
+    return m, err
+  }
+
+  for _, file := range files {
+    if err := checkShardFile(filepath.Join(tmp, file)); err != nil {
+      return m, fmt.Errorf("%v: %v", file, err)
+    }
+  }
+
+  ids, err := ParseIDMode(m.IDs)
+  if err != nil {
+    return m, fmt.Errorf("%v: %v", ManifestFileName, err)
+  }
+  mapping, err := ParseShardMapping(m.Mapping)
+  if err != nil {
+    return m, fmt.Errorf("%v: %v", ManifestFileName, err)
+  }
+  layout := Layout{IDs: ids.String(), Mapping: mapping.String(), Shards: shards}
+
+  for _, file := range files {
+    if err := os.Rename(filepath.Join(tmp, file), filepath.Join(dir, file)); err != nil {
+      return m, err
+    }
+  }
+  return m, writeLayout(filepath.Join(dir, LayoutFileName), layout)
+}
+
+// Unpack the shard files of the archive into dir and read the
+// manifest into m.  Return the names of the shard files and of the
+// variant registry, if there is one.
+func unpack(r io.Reader, dir string, shards int, m *Manifest) ([]string, error) {
+  gr, err := gzip.NewReader(r)
+  if err != nil {
+    return nil, err
+  }
+  defer gr.Close()
+
+  var files []string
+  seen := make(map[string]bool)
+  tr := tar.NewReader(gr)
+  for {
+    hdr, err := tr.Next()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return nil, err
+    }
+
+    if hdr.Name == ManifestFileName && hdr.Typeflag == tar.TypeReg {
+      if err := json.NewDecoder(tr).Decode(m); err != nil {
+        return nil, fmt.Errorf("%v: %v", hdr.Name, err)
+      }
+      if m.Shards != shards {
+        return nil, fmt.Errorf("archive has %v shards, but there are %v shards",
+          m.Shards, shards)
+      }
+      continue
+    }
+
+    // Only accept shard files of the known storages and the
+    // variant registry, nothing that could land outside of dir.
+    if hdr.Typeflag != tar.TypeReg {
+      return nil, fmt.Errorf("unexpected file %q in archive", hdr.Name)
+    }
+    if hdr.Name != VariantFileName {
+      name, id, ok := ParseShardFileName(hdr.Name)
+      if !ok || (name != CustomerStorage && name != ItemStorage) {
+        return nil, fmt.Errorf("unexpected file %q in archive", hdr.Name)
+      }
+      if id >= uint32(shards) {
+        return nil, fmt.Errorf("%v is out of range, there are only %v shards",
+          hdr.Name, shards)
+      }
+    }
+    if seen[hdr.Name] {
+      return nil, fmt.Errorf("%v is in the archive twice", hdr.Name)
+    }
+    seen[hdr.Name] = true
+
+    if err := unpackFile(tr, filepath.Join(dir, hdr.Name)); err != nil {
+      return nil, err
+    }
+    files = append(files, hdr.Name)
+  }
+
+  return files, nil
+}
+
+// Copy the current archive entry into a new file at path.
+func unpackFile(r io.Reader, path string) error {
+  f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+  if err != nil {
+    return err
+  }
+
+  if _, err := io.Copy(f, r); err != nil {
+    f.Close()
+    return err
+  }
+  if err := f.Sync(); err != nil {
+    f.Close()
+    return err
+  }
+  return f.Close()
+}
+
+// Open the shard file read-only and verify its integrity.
+func checkShardFile(path string) error {
+  db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+  if err != nil {
+    return err
+  }
+  defer db.Close()
+
+  var errs []error
+  err = db.View(func(tx *bolt.Tx) error {
+    for err := range tx.Check() {
+      errs = append(errs, err)
+    }
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+  return errors.Join(errs...)
+}
@@ -0,0 +1,390 @@
+// The gRPC API of the cart server.  It offers the operations of the
+// HTTP handler: changing carts, listing a cart or the carts having
+// an item, and applying a batch of changes.
+//
+// Customer ids and SKUs are strings whatever the id mode of the
+// server; they must be ids the server accepts over HTTP too.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.25.3
+// source: cart.proto
+
+package cartpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Cart_Add_FullMethodName          = "/cart.v1.Cart/Add"
+	Cart_Remove_FullMethodName       = "/cart.v1.Cart/Remove"
+	Cart_Clear_FullMethodName        = "/cart.v1.Cart/Clear"
+	Cart_ListCustomer_FullMethodName = "/cart.v1.Cart/ListCustomer"
+	Cart_ListItem_FullMethodName     = "/cart.v1.Cart/ListItem"
+	Cart_Batch_FullMethodName        = "/cart.v1.Cart/Batch"
+	Cart_StreamList_FullMethodName   = "/cart.v1.Cart/StreamList"
+)
+
+// CartClient is the client API for Cart service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type CartClient interface {
+	// Add one of the item to the cart of the customer, setting the
+	// details of the line if given.
+	Add(ctx context.Context, in *ModRequest, opts ...grpc.CallOption) (*ModResponse, error)
+	// Remove one of the item from the cart of the customer.
+	Remove(ctx context.Context, in *ModRequest, opts ...grpc.CallOption) (*ModResponse, error)
+	// Remove every item from the cart of the customer.
+	Clear(ctx context.Context, in *ClearRequest, opts ...grpc.CallOption) (*ClearResponse, error)
+	// Return the lines of the cart of the customer, in item order.
+	ListCustomer(ctx context.Context, in *ListCustomerRequest, opts ...grpc.CallOption) (*ListCustomerResponse, error)
+	// Return the customers having the item in their cart, in customer
+	// order.  Without a variant the quantities of every variant of
+	// the item add up.
+	ListItem(ctx context.Context, in *ListItemRequest, opts ...grpc.CallOption) (*ListItemResponse, error)
+	// Apply the operations in order and report the result of every
+	// one of them.  A failed operation does not stop the batch.
+	Batch(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error)
+	// List a cart or the carts having an item like ListCustomer and
+	// ListItem, one entry per message.
+	StreamList(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (Cart_StreamListClient, error)
+}
+
+type cartClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCartClient(cc grpc.ClientConnInterface) CartClient {
+	return &cartClient{cc}
+}
+
+func (c *cartClient) Add(ctx context.Context, in *ModRequest, opts ...grpc.CallOption) (*ModResponse, error) {
+	out := new(ModResponse)
+	err := c.cc.Invoke(ctx, Cart_Add_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartClient) Remove(ctx context.Context, in *ModRequest, opts ...grpc.CallOption) (*ModResponse, error) {
+	out := new(ModResponse)
+	err := c.cc.Invoke(ctx, Cart_Remove_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartClient) Clear(ctx context.Context, in *ClearRequest, opts ...grpc.CallOption) (*ClearResponse, error) {
+	out := new(ClearResponse)
+	err := c.cc.Invoke(ctx, Cart_Clear_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartClient) ListCustomer(ctx context.Context, in *ListCustomerRequest, opts ...grpc.CallOption) (*ListCustomerResponse, error) {
+	out := new(ListCustomerResponse)
+	err := c.cc.Invoke(ctx, Cart_ListCustomer_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartClient) ListItem(ctx context.Context, in *ListItemRequest, opts ...grpc.CallOption) (*ListItemResponse, error) {
+	out := new(ListItemResponse)
+	err := c.cc.Invoke(ctx, Cart_ListItem_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartClient) Batch(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error) {
+	out := new(BatchResponse)
+	err := c.cc.Invoke(ctx, Cart_Batch_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cartClient) StreamList(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (Cart_StreamListClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Cart_ServiceDesc.Streams[0], Cart_StreamList_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &cartStreamListClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Cart_StreamListClient interface {
+	Recv() (*ListEntry, error)
+	grpc.ClientStream
+}
+
+type cartStreamListClient struct {
+	grpc.ClientStream
+}
+
+func (x *cartStreamListClient) Recv() (*ListEntry, error) {
+	m := new(ListEntry)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CartServer is the server API for Cart service.
+// All implementations must embed UnimplementedCartServer
+// for forward compatibility
+type CartServer interface {
+	// Add one of the item to the cart of the customer, setting the
+	// details of the line if given.
+	Add(context.Context, *ModRequest) (*ModResponse, error)
+	// Remove one of the item from the cart of the customer.
+	Remove(context.Context, *ModRequest) (*ModResponse, error)
+	// Remove every item from the cart of the customer.
+	Clear(context.Context, *ClearRequest) (*ClearResponse, error)
+	// Return the lines of the cart of the customer, in item order.
+	ListCustomer(context.Context, *ListCustomerRequest) (*ListCustomerResponse, error)
+	// Return the customers having the item in their cart, in customer
+	// order.  Without a variant the quantities of every variant of
+	// the item add up.
+	ListItem(context.Context, *ListItemRequest) (*ListItemResponse, error)
+	// Apply the operations in order and report the result of every
+	// one of them.  A failed operation does not stop the batch.
+	Batch(context.Context, *BatchRequest) (*BatchResponse, error)
+	// List a cart or the carts having an item like ListCustomer and
+	// ListItem, one entry per message.
+	StreamList(*ListRequest, Cart_StreamListServer) error
+	mustEmbedUnimplementedCartServer()
+}
+
+// UnimplementedCartServer must be embedded to have forward compatible implementations.
+type UnimplementedCartServer struct {
+}
+
+func (UnimplementedCartServer) Add(context.Context, *ModRequest) (*ModResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Add not implemented")
+}
+func (UnimplementedCartServer) Remove(context.Context, *ModRequest) (*ModResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Remove not implemented")
+}
+func (UnimplementedCartServer) Clear(context.Context, *ClearRequest) (*ClearResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Clear not implemented")
+}
+func (UnimplementedCartServer) ListCustomer(context.Context, *ListCustomerRequest) (*ListCustomerResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListCustomer not implemented")
+}
+func (UnimplementedCartServer) ListItem(context.Context, *ListItemRequest) (*ListItemResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListItem not implemented")
+}
+func (UnimplementedCartServer) Batch(context.Context, *BatchRequest) (*BatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Batch not implemented")
+}
+func (UnimplementedCartServer) StreamList(*ListRequest, Cart_StreamListServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamList not implemented")
+}
+func (UnimplementedCartServer) mustEmbedUnimplementedCartServer() {}
+
+// UnsafeCartServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to CartServer will
+// result in compilation errors.
+type UnsafeCartServer interface {
+	mustEmbedUnimplementedCartServer()
+}
+
+func RegisterCartServer(s grpc.ServiceRegistrar, srv CartServer) {
+	s.RegisterService(&Cart_ServiceDesc, srv)
+}
+
+func _Cart_Add_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ModRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServer).Add(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Cart_Add_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServer).Add(ctx, req.(*ModRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cart_Remove_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ModRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServer).Remove(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Cart_Remove_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServer).Remove(ctx, req.(*ModRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cart_Clear_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClearRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServer).Clear(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Cart_Clear_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServer).Clear(ctx, req.(*ClearRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cart_ListCustomer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListCustomerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServer).ListCustomer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Cart_ListCustomer_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServer).ListCustomer(ctx, req.(*ListCustomerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cart_ListItem_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListItemRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServer).ListItem(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Cart_ListItem_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServer).ListItem(ctx, req.(*ListItemRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cart_Batch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CartServer).Batch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Cart_Batch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CartServer).Batch(ctx, req.(*BatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cart_StreamList_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CartServer).StreamList(m, &cartStreamListServer{stream})
+}
+
+type Cart_StreamListServer interface {
+	Send(*ListEntry) error
+	grpc.ServerStream
+}
+
+type cartStreamListServer struct {
+	grpc.ServerStream
+}
+
+func (x *cartStreamListServer) Send(m *ListEntry) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Cart_ServiceDesc is the grpc.ServiceDesc for Cart service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Cart_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cart.v1.Cart",
+	HandlerType: (*CartServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Add",
+			Handler:    _Cart_Add_Handler,
+		},
+		{
+			MethodName: "Remove",
+			Handler:    _Cart_Remove_Handler,
+		},
+		{
+			MethodName: "Clear",
+			Handler:    _Cart_Clear_Handler,
+		},
+		{
+			MethodName: "ListCustomer",
+			Handler:    _Cart_ListCustomer_Handler,
+		},
+		{
+			MethodName: "ListItem",
+			Handler:    _Cart_ListItem_Handler,
+		},
+		{
+			MethodName: "Batch",
+			Handler:    _Cart_Batch_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamList",
+			Handler:       _Cart_StreamList_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "cart.proto",
+}
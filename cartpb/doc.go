@@ -0,0 +1,6 @@
+// Package cartpb holds the messages and the service of the gRPC API
+// of the cart server, generated from cart.proto.  Package cart
+// implements the service, see cart.GRPCServer.
+package cartpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative cart.proto
@@ -0,0 +1,178 @@
+package cart
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "math"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+// ErrNoJournal is returned when the change feed is asked for while
+// journaling is disabled.
+var ErrNoJournal = errors.New("journal is disabled")
+
+// The most changes a single /changes response carries, unless the
+// client asks for fewer.
+const MaxChanges = 1000
+
+// The longest a /changes query waits for a change.
+const MaxChangesWait = time.Minute
+
+// Asks Changes for the changes to every shard.
+const AllShards = math.MaxUint32
+
+// Errors out of ReadJournal to stop reading early.
+var errEnough = errors.New("enough changes")
+
+// Call f on the changes to the carts of the customers living in the
+// given customer shard, or to every cart with AllShards, in order,
+// starting after the given sequence number and stopping after limit
+// changes.  Return a channel that
+// gets closed once there may be new changes.
+func (h *Handler) Changes(shard uint32, after uint64, limit int,
+f func(JournalEntry) error) (<-chan struct{}, error) {
+  if !h.begin() {
+    return nil, ErrClosed
+  }
+  defer h.leave()
+
+  if h.journal == nil {
+    return nil, ErrNoJournal
+  }
+  if shard != AllShards && shard >= uint32(len(h.cStorage.shards)) {
+    return nil, fmt.Errorf("shard %v is out of range, there are only %v shards",
+      shard, len(h.cStorage.shards))
+  }
+
+  // Ask for the channel first, so that no change slips through
+  // between reading and waiting.
+  changed := h.journal.Changed()
+
+  n := 0
+  err := h.journal.Read(after, func(e JournalEntry) error {
+    if shard != AllShards &&
+      h.mapping.shard(h.ids, e.Customer.Value, len(h.cStorage.shards)) != shard {
+      return nil
+    }
+    if err := f(e); err != nil {
+      return err
+    }
+    if n++; n == limit {
+      return errEnough
+    }
+    return nil
+  })
+  if err != nil && err != errEnough {
+    return nil, err
+  }
+  return changed, nil
+}
+
+// This function is responsible for handling /changes queries.  It
+// streams the changes to the carts of one customer shard as JSON
+// lines, one per change, in journal order.  The parameters are:
+//
+//   shard  the customer shard, default every shard
+//   after  the sequence number of the last change seen, default 0
+//   limit  the most changes to return, default and at most MaxChanges
+//   wait   how long to wait for a change if there is none, e.g. 30s,
+//          at most MaxChangesWait
+//
+// Clients resume by passing the seq of the last change they got as
+// after.  Every change carries the resulting quantity, so applying
+// a change twice does no harm.
+func (h* Handler) Feed(w http.ResponseWriter, r *http.Request) {
+  // The journals of the members of a raft group number the changes
+  // alike, but only the leader's is sure to have every one.
+  if h.toLeader(w, r) {
+    return
+  }
+  q := r.URL.Query()
+
+  var shard uint64 = AllShards
+  var err error
+  if s := q.Get("shard"); s != "" {
+    if shard, err = strconv.ParseUint(s, 10, 32); err != nil || shard == AllShards {
+      fmt.Fprintf(w, "error: invalid shard %q", s)
+      return
+    }
+  }
+
+  // Only the node owning the shard journals its changes.
+  if h.cluster != nil && shard < uint64(len(h.cluster.owners)) {
+    if node := h.shardOwner(uint32(shard)); node != nil {
+      h.forward(w, r, node)
+      return
+    }
+  }
+
+  var after uint64
+  if s := q.Get("after"); s != "" {
+    if after, err = strconv.ParseUint(s, 10, 64); err != nil {
+      fmt.Fprintf(w, "error: invalid after %q", s)
+      return
+    }
+  }
+
+  limit := MaxChanges
+  if s := q.Get("limit"); s != "" {
+    if limit, err = strconv.Atoi(s); err != nil || limit <= 0 || limit > MaxChanges {
+      fmt.Fprintf(w, "error: limit must be between 1 and %v", MaxChanges)
+      return
+    }
+  }
+
+  var wait time.Duration
+  if s := q.Get("wait"); s != "" {
+    if wait, err = time.ParseDuration(s); err != nil || wait < 0 || wait > MaxChangesWait {
+      fmt.Fprintf(w, "error: wait must be between 0 and %v", MaxChangesWait)
+      return
+    }
+  }
+
+  // Waiting must not run into the server's write timeout.
+  deadline := time.Now().Add(wait)
+  if wait > 0 {
+    http.NewResponseController(w).SetWriteDeadline(deadline.Add(10 * time.Second))
+  }
+
+  var changes []JournalEntry
+  for {
+    changed, err := h.Changes(uint32(shard), after, limit, func(e JournalEntry) error {
+      changes = append(changes, e)
+      return nil
+    })
+    if err == ErrClosed {
+      w.WriteHeader(http.StatusServiceUnavailable)
+    }
+    if err != nil {
+      fmt.Fprintf(w, "error: %v", err)
+      return
+    }
+
+    left := time.Until(deadline)
+    if len(changes) > 0 || left <= 0 {
+      break
+    }
+
+    // Nothing yet, wait without keeping the handler busy.
+    timer := time.NewTimer(left)
+    select {
+    case <-changed:
+    case <-timer.C:
+    case <-r.Context().Done():
+      timer.Stop()
+      return
+    }
+    timer.Stop()
+  }
+
+  fmt.Fprintf(w, "OK\n")
+  enc := json.NewEncoder(w)
+  for _, e := range changes {
+    enc.Encode(e)
+  }
+}
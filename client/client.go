@@ -0,0 +1,534 @@
+// Package client talks to the HTTP API of a cart server.
+//
+// Every call takes a context and is retried with exponential
+// backoff while the server answers 503 Service Unavailable, which
+// it does when a shard lock is taken, while it is closed, or while
+// a raft group has no leader.  Requests turned away with a 503 were
+// not applied, so retrying them is safe.  A 504 Gateway Timeout
+// means another node or the raft log did not answer in time and the
+// change may have been applied anyway; it is never retried, see
+// ErrUnknownOutcome.
+package client
+
+import (
+	"bufio"
+	"cart"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The defaults of a client returned by New.
+const (
+	DefaultRetries     = 5
+	DefaultMinBackoff  = 10 * time.Millisecond
+	DefaultMaxBackoff  = time.Second
+	DefaultConcurrency = 8
+)
+
+// ErrUnavailable is returned when the server still answers 503
+// after every retry.
+var ErrUnavailable = errors.New("server unavailable")
+
+// ErrUnknownOutcome is matched by the *Error of a request the server
+// answered with 504 Gateway Timeout.  The change may or may not
+// have been applied, so look at the cart before trying again.
+var ErrUnknownOutcome = errors.New("outcome unknown")
+
+// Error is an error reported by the server.
+type Error struct {
+	Status  int    // The HTTP status code.
+	Message string // The message without the "error: " prefix.
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("server responded with %v: %v", e.Status, e.Message)
+}
+
+// Unwrap returns ErrUnknownOutcome for a 504 Gateway Timeout.
+func (e *Error) Unwrap() error {
+	if e.Status == http.StatusGatewayTimeout {
+		return ErrUnknownOutcome
+	}
+	return nil
+}
+
+// Client is a client of a cart server.  Its fields must not change
+// once it is in use.
+type Client struct {
+	// The base URL of the server, e.g. http://localhost:8097.
+	URL string
+	// The client sending the requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	// How many times a request answered with 503 is retried, waiting
+	// MinBackoff first and twice as long every time, up to
+	// MaxBackoff.
+	Retries    int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// How many requests Batch sends at once.
+	Concurrency int
+}
+
+// New returns a client of the server at the base URL with the
+// default settings.
+func New(baseURL string) *Client {
+	return &Client{
+		URL:         strings.TrimSuffix(baseURL, "/"),
+		Retries:     DefaultRetries,
+		MinBackoff:  DefaultMinBackoff,
+		MaxBackoff:  DefaultMaxBackoff,
+		Concurrency: DefaultConcurrency,
+	}
+}
+
+// An item in a cart.
+type CartItem struct {
+	Item cart.ItemKey
+	Qty  uint32
+}
+
+// A customer having an item in the cart.
+type ItemCustomer struct {
+	Customer string
+	Qty      uint32
+}
+
+// A line of a cart with its details.
+type CartLine struct {
+	Item cart.ItemKey
+	cart.Line
+}
+
+// Ping makes sure the server is up.
+func (c *Client) Ping(ctx context.Context) error {
+	resp, err := c.do(ctx, "GET", "/ping", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "ping\n" {
+		return &Error{resp.StatusCode, strings.TrimSpace(string(body))}
+	}
+	return nil
+}
+
+// Add puts one more of the item into the cart of the customer.  The
+// details, if any, set the price, currency and attributes of the
+// line.
+func (c *Client) Add(ctx context.Context, customer string, item cart.ItemKey, details *cart.LineDetails) error {
+	return c.AddQty(ctx, customer, item, 1, details)
+}
+
+// AddQty puts qty more of the item, at most cart.MaxModQty, into the
+// cart of the customer at once, the way Add does.
+func (c *Client) AddQty(ctx context.Context, customer string, item cart.ItemKey, qty uint32,
+	details *cart.LineDetails) error {
+	q := qtyQuery(customer, item, qty)
+	if details != nil {
+		if details.Price != 0 {
+			q.Set("price", strconv.FormatInt(details.Price, 10))
+		}
+		if details.Currency != "" {
+			q.Set("currency", details.Currency)
+		}
+		q["attr"] = attributes(details.Attributes)
+	}
+	_, err := c.call(ctx, "POST", "/add", q)
+	return err
+}
+
+// Remove takes one of the item out of the cart of the customer.
+func (c *Client) Remove(ctx context.Context, customer string, item cart.ItemKey) error {
+	return c.RemoveQty(ctx, customer, item, 1)
+}
+
+// RemoveQty takes qty of the item, at most cart.MaxModQty, out of the
+// cart of the customer at once.  Nothing is taken out if the cart
+// holds fewer.
+func (c *Client) RemoveQty(ctx context.Context, customer string, item cart.ItemKey, qty uint32) error {
+	_, err := c.call(ctx, "POST", "/remove", qtyQuery(customer, item, qty))
+	return err
+}
+
+// Clear empties the cart of the customer.
+func (c *Client) Clear(ctx context.Context, customer string) error {
+	_, err := c.call(ctx, "POST", "/clear", url.Values{"customer": {customer}})
+	return err
+}
+
+// ListCustomer returns the items in the cart of the customer, in
+// item order.  An empty cart has no items.
+func (c *Client) ListCustomer(ctx context.Context, customer string) ([]CartItem, error) {
+	lines, err := c.call(ctx, "GET", "/list", url.Values{"customer": {customer}})
+	if isNoSuchKey(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]CartItem, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("unexpected line %q", line)
+		}
+		qty, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected line %q", line)
+		}
+		variant, err := cart.ParseAttributes(fields[2:])
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, CartItem{cart.ItemKey{SKU: fields[0], Variant: variant}, uint32(qty)})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Item.SKU != items[j].Item.SKU {
+			return cart.LessID(items[i].Item.SKU, items[j].Item.SKU)
+		}
+		return items[i].Item.String() < items[j].Item.String()
+	})
+	return items, nil
+}
+
+// ListItem returns the customers having the item in their cart, in
+// customer order.  Without variant attributes, the quantities of
+// every variant of the item add up.
+func (c *Client) ListItem(ctx context.Context, item cart.ItemKey) ([]ItemCustomer, error) {
+	q := url.Values{"item": {item.SKU}}
+	if item.IsVariant() {
+		q["variant"] = item.Attributes()
+	}
+	lines, err := c.call(ctx, "GET", "/list", q)
+	if isNoSuchKey(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	customers := make([]ItemCustomer, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("unexpected line %q", line)
+		}
+		qty, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected line %q", line)
+		}
+		customers = append(customers, ItemCustomer{fields[0], uint32(qty)})
+	}
+	sort.Slice(customers, func(i, j int) bool {
+		return cart.LessID(customers[i].Customer, customers[j].Customer)
+	})
+	return customers, nil
+}
+
+// Lines returns the lines of the cart of the customer with their
+// details, in the order the server keeps them: SKUs in item order,
+// then variants in the order they were first seen.
+func (c *Client) Lines(ctx context.Context, customer string) ([]CartLine, error) {
+	lines, err := c.call(ctx, "GET", "/lines", url.Values{"customer": {customer}})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]CartLine, 0, len(lines))
+	for _, line := range lines {
+		var l struct {
+			Item    cart.ID           `json:"item"`
+			Variant map[string]string `json:"variant"`
+			cart.Line
+		}
+		if err := json.Unmarshal([]byte(line), &l); err != nil {
+			return nil, err
+		}
+		result = append(result, CartLine{cart.ItemKey{SKU: l.Item.Value, Variant: l.Variant}, l.Line})
+	}
+	return result, nil
+}
+
+// What Changes asks for.
+type ChangesQuery struct {
+	// The customer shard, or cart.AllShards for every shard.
+	Shard uint32
+	// The sequence number of the last change seen.
+	After uint64
+	// The most changes to return, the server's maximum if zero.
+	Limit int
+	// How long the server waits for a change if there is none, at
+	// most cart.MaxChangesWait.
+	Wait time.Duration
+}
+
+// Changes returns the changes to the carts after q.After, in journal
+// order.  Pass the Seq of the last one as q.After to get the next
+// ones.
+func (c *Client) Changes(ctx context.Context, q ChangesQuery) ([]cart.JournalEntry, error) {
+	v := url.Values{"after": {strconv.FormatUint(q.After, 10)}}
+	if q.Shard != cart.AllShards {
+		v.Set("shard", strconv.FormatUint(uint64(q.Shard), 10))
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.Wait > 0 {
+		v.Set("wait", q.Wait.String())
+	}
+
+	resp, err := c.do(ctx, "GET", "/changes", v)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	br := bufio.NewReader(resp.Body)
+	if err := status(resp, br); err != nil {
+		return nil, err
+	}
+	var entries []cart.JournalEntry
+	err = cart.ReadJournal(br, func(e cart.JournalEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// The kinds of operations of a batch.
+type OpKind int
+
+const (
+	OpAdd OpKind = iota
+	OpRemove
+	OpClear
+)
+
+// An operation of a batch.  Clear ignores the item, the quantity and
+// the details, Remove the details.
+type Op struct {
+	Kind     OpKind
+	Customer string
+	Item     cart.ItemKey
+	// How many units Add and Remove change, 0 meaning 1.
+	Qty     uint32
+	Details *cart.LineDetails
+}
+
+// BatchError reports the operations of a batch that failed, by
+// their index.
+type BatchError struct {
+	Errors map[int]error
+}
+
+func (e *BatchError) Error() string {
+	indexes := make([]int, 0, len(e.Errors))
+	for i := range e.Errors {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return fmt.Sprintf("%v of the operations failed, the first one, %v: %v",
+		len(indexes), indexes[0], e.Errors[indexes[0]])
+}
+
+// Batch applies the operations, up to Concurrency at a time.  The
+// operations on the cart of a customer are applied in order, one
+// after the other, so only the carts of different customers change
+// concurrently.  An operation failing does not stop the others of
+// the same cart.  Return a *BatchError if any of them failed.
+func (c *Client) Batch(ctx context.Context, ops []Op) error {
+	var customers []string
+	byCustomer := make(map[string][]int)
+	for i, op := range ops {
+		if _, ok := byCustomer[op.Customer]; !ok {
+			customers = append(customers, op.Customer)
+		}
+		byCustomer[op.Customer] = append(byCustomer[op.Customer], i)
+	}
+
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(map[int]error)
+	todo := make(chan string)
+	for n := 0; n < concurrency; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for customer := range todo {
+				for _, i := range byCustomer[customer] {
+					if err := c.apply(ctx, ops[i]); err != nil {
+						mu.Lock()
+						errs[i] = err
+						mu.Unlock()
+					}
+				}
+			}
+		}()
+	}
+	for _, customer := range customers {
+		todo <- customer
+	}
+	close(todo)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return &BatchError{errs}
+	}
+	return nil
+}
+
+// Apply a single operation of a batch.
+func (c *Client) apply(ctx context.Context, op Op) error {
+	qty := op.Qty
+	if qty == 0 {
+		qty = 1
+	}
+	switch op.Kind {
+	case OpAdd:
+		return c.AddQty(ctx, op.Customer, op.Item, qty, op.Details)
+	case OpRemove:
+		return c.RemoveQty(ctx, op.Customer, op.Item, qty)
+	case OpClear:
+		return c.Clear(ctx, op.Customer)
+	}
+	return fmt.Errorf("unknown operation %v", op.Kind)
+}
+
+// Send a request and return the lines following the OK status line.
+func (c *Client) call(ctx context.Context, method string, path string, q url.Values) ([]string, error) {
+	resp, err := c.do(ctx, method, path, q)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	br := bufio.NewReader(resp.Body)
+	if err := status(resp, br); err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return nil, nil
+	}
+	return strings.Split(strings.TrimSuffix(string(body), "\n"), "\n"), nil
+}
+
+// Send a request, retrying while the server answers 503, and only
+// then: anything else may have been applied already.  The caller
+// must close the body of the response.
+func (c *Client) do(ctx context.Context, method string, path string, q url.Values) (*http.Response, error) {
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	u := c.URL + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+
+	backoff := c.MinBackoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			return resp, nil
+		}
+
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if attempt >= c.Retries {
+			if msg := strings.TrimPrefix(strings.TrimSpace(string(body)), "error: "); msg != "" {
+				return nil, fmt.Errorf("%w: %v", ErrUnavailable, msg)
+			}
+			return nil, ErrUnavailable
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		if backoff *= 2; backoff > c.MaxBackoff {
+			backoff = c.MaxBackoff
+		}
+	}
+}
+
+// Read the status line of the response.  Return an *Error unless
+// it is OK.
+func status(resp *http.Response, br *bufio.Reader) error {
+	line, err := br.ReadString('\n')
+	if line == "OK\n" {
+		return nil
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	rest, _ := ioutil.ReadAll(io.LimitReader(br, 1024))
+	msg := strings.TrimPrefix(strings.TrimSpace(line+string(rest)), "error: ")
+	return &Error{resp.StatusCode, msg}
+}
+
+// Report whether the server found nothing for the key.
+func isNoSuchKey(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Message == cart.ErrNoSuchKey.Error()
+}
+
+// Return the query of /add and /remove.
+func itemQuery(customer string, item cart.ItemKey) url.Values {
+	q := url.Values{"customer": {customer}, "item": {item.SKU}}
+	if item.IsVariant() {
+		q["variant"] = item.Attributes()
+	}
+	return q
+}
+
+// Return the query for qty units of the item in the cart of the
+// customer.  A single unit is the default.
+func qtyQuery(customer string, item cart.ItemKey, qty uint32) url.Values {
+	q := itemQuery(customer, item)
+	if qty != 1 {
+		q.Set("qty", strconv.FormatUint(uint64(qty), 10))
+	}
+	return q
+}
+
+// Return the attributes as name:value, in name order.
+func attributes(m map[string]string) []string {
+	return cart.ItemKey{Variant: m}.Attributes()
+}
@@ -0,0 +1,239 @@
+package client
+
+import (
+	"cart"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Start a server with a handler on a temporary directory and return
+// a client of it.
+func tempServer(t *testing.T) (*Client, func()) {
+	dir, err := ioutil.TempDir("", "cart")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	o := cart.DefaultOptions()
+	o.Dir = dir
+	o.Shards = 4
+	o.Journal = true
+	h, err := cart.NewHandlerWithOptions(o)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/add", h.Mod(cart.AddToSet))
+	mux.HandleFunc("/remove", h.Mod(cart.RemoveFromSet))
+	mux.HandleFunc("/list", h.List)
+	mux.HandleFunc("/lines", h.Lines)
+	mux.HandleFunc("/clear", h.Clear)
+	mux.HandleFunc("/changes", h.Feed)
+	mux.HandleFunc("/ping", h.Ping)
+	srv := httptest.NewServer(mux)
+
+	return New(srv.URL), func() { srv.Close(); h.Close(); os.RemoveAll(dir) }
+}
+
+// Ensure every call reaches the server and decodes its response.
+func TestClient(t *testing.T) {
+	c, cleanup := tempServer(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	sizeM := cart.ItemKey{SKU: "10", Variant: map[string]string{"size": "M"}}
+	details := &cart.LineDetails{Price: 1999, Currency: "EUR", Attributes: map[string]string{"note": "gift"}}
+	for _, add := range []struct {
+		customer string
+		item     cart.ItemKey
+		details  *cart.LineDetails
+	}{
+		{"1", cart.ItemKey{SKU: "13"}, nil},
+		{"1", cart.ItemKey{SKU: "13"}, nil},
+		{"1", sizeM, details},
+		{"1", cart.ItemKey{SKU: "9"}, nil},
+		{"2", cart.ItemKey{SKU: "10"}, nil},
+	} {
+		if err := c.Add(ctx, add.customer, add.item, add.details); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := c.Remove(ctx, "1", cart.ItemKey{SKU: "9"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	items, err := c.ListCustomer(ctx, "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []CartItem{{sizeM, 1}, {cart.ItemKey{SKU: "13"}, 2}}
+	if !reflect.DeepEqual(items, expected) {
+		t.Fatalf("expected %v, got %v", expected, items)
+	}
+
+	customers, err := c.ListItem(ctx, cart.ItemKey{SKU: "10"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if !reflect.DeepEqual(customers, []ItemCustomer{{"1", 1}, {"2", 1}}) {
+		t.Fatalf("unexpected customers: %v", customers)
+	}
+	customers, err = c.ListItem(ctx, sizeM)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if !reflect.DeepEqual(customers, []ItemCustomer{{"1", 1}}) {
+		t.Fatalf("unexpected customers: %v", customers)
+	}
+
+	lines, err := c.Lines(ctx, "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(lines) != 2 || !reflect.DeepEqual(lines[1].Item, sizeM) || lines[1].Price != 1999 ||
+		lines[1].Attributes["note"] != "gift" || lines[0].Qty != 2 {
+		t.Fatalf("unexpected lines: %+v", lines)
+	}
+
+	if err := c.Clear(ctx, "1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if items, err := c.ListCustomer(ctx, "1"); err != nil || len(items) != 0 {
+		t.Fatalf("expected an empty cart, got %v, %v", items, err)
+	}
+
+	// Every change shows up in the feed, and paging resumes after
+	// the last one seen.
+	changes, err := c.Changes(ctx, ChangesQuery{Shard: cart.AllShards, Limit: 5})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if len(changes) != 5 {
+		t.Fatalf("expected 5 changes, got %v", len(changes))
+	}
+	changes, err = c.Changes(ctx, ChangesQuery{Shard: cart.AllShards, After: changes[4].Seq})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if len(changes) != 3 || changes[2].Op != cart.OpClear {
+		t.Fatalf("expected the removal and the two clears, got %+v", changes)
+	}
+
+	// Errors of the server come back as they are.
+	err = c.Add(ctx, "1", cart.ItemKey{SKU: "x"}, nil)
+	var e *Error
+	if !errors.As(err, &e) || e.Message != "invalid item id x" {
+		t.Fatalf("expected an invalid item error, got %v", err)
+	}
+}
+
+// Ensure requests turned away with 503 are retried until they go
+// through or the retries run out.
+func TestClient_Retry(t *testing.T) {
+	var busy, calls, timeout int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&timeout) != 0 {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			w.Write([]byte("error: node is unavailable"))
+			return
+		}
+		if atomic.AddInt32(&busy, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("error: shard is busy"))
+			return
+		}
+		w.Write([]byte("OK\n"))
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	c.MinBackoff = time.Millisecond
+	ctx := context.Background()
+
+	atomic.StoreInt32(&busy, 3)
+	if err := c.Clear(ctx, "1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if calls != 4 {
+		t.Fatalf("expected 4 calls, got %v", calls)
+	}
+
+	atomic.StoreInt32(&busy, 100)
+	atomic.StoreInt32(&calls, 0)
+	err := c.Clear(ctx, "1")
+	if !errors.Is(err, ErrUnavailable) || err.Error() != "server unavailable: shard is busy" {
+		t.Fatalf("expected ErrUnavailable, got %v", err)
+	} else if calls != DefaultRetries+1 {
+		t.Fatalf("expected %v calls, got %v", DefaultRetries+1, calls)
+	}
+
+	// A change that may have been applied is not tried again.
+	atomic.StoreInt32(&timeout, 1)
+	atomic.StoreInt32(&calls, 0)
+	if err := c.Clear(ctx, "1"); !errors.Is(err, ErrUnknownOutcome) {
+		t.Fatalf("expected ErrUnknownOutcome, got %v", err)
+	} else if calls != 1 {
+		t.Fatalf("expected 1 call, got %v", calls)
+	}
+	atomic.StoreInt32(&timeout, 0)
+
+	// Giving up on the context stops waiting.
+	c.MinBackoff = time.Hour
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := c.Clear(ctx, "1"); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+}
+
+// Ensure a batch applies the operations of every cart in order and
+// reports the ones that failed.
+func TestClient_Batch(t *testing.T) {
+	c, cleanup := tempServer(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	var ops []Op
+	for customer := 1; customer <= 20; customer++ {
+		id := strconv.Itoa(customer)
+		ops = append(ops,
+			Op{Kind: OpAdd, Customer: id, Item: cart.ItemKey{SKU: "1"}},
+			Op{Kind: OpClear, Customer: id},
+			Op{Kind: OpAdd, Customer: id, Item: cart.ItemKey{SKU: "2"}},
+			Op{Kind: OpAdd, Customer: id, Item: cart.ItemKey{SKU: "2"}},
+			Op{Kind: OpRemove, Customer: id, Item: cart.ItemKey{SKU: "2"}},
+		)
+	}
+	ops = append(ops, Op{Kind: OpAdd, Customer: "7", Item: cart.ItemKey{SKU: "x"}})
+
+	err := c.Batch(ctx, ops)
+	var e *BatchError
+	if !errors.As(err, &e) || len(e.Errors) != 1 || e.Errors[len(ops)-1] == nil {
+		t.Fatalf("expected the last operation to fail, got %v", err)
+	}
+
+	customers, err := c.ListItem(ctx, cart.ItemKey{SKU: "2"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if len(customers) != 20 {
+		t.Fatalf("expected 20 customers, got %v", customers)
+	}
+	for _, customer := range customers {
+		if customer.Qty != 1 {
+			t.Fatalf("expected a single item 2, got %v", customer)
+		}
+	}
+	if customers, err := c.ListItem(ctx, cart.ItemKey{SKU: "1"}); err != nil || len(customers) != 0 {
+		t.Fatalf("expected item 1 to be cleared, got %v, %v", customers, err)
+	}
+}
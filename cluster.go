@@ -0,0 +1,429 @@
+package cart
+
+import (
+  "crypto/subtle"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// ErrUnavailable is returned when the node owning a key cannot be
+// reached, or the raft log does not take a change in time.  The
+// change may have been made anyway, so HTTP clients get a 504
+// Gateway Timeout for it rather than a 503, which tells them that
+// trying again is safe.
+var ErrUnavailable = errors.New("node is unavailable")
+
+// ErrNotOwner is returned when a key is changed on a node that
+// does not own it.
+var ErrNotOwner = errors.New("key is owned by another node")
+
+// ErrClustered is returned by what only works when a handler owns
+// every shard, e.g. Verify.
+var ErrClustered = errors.New("not supported in cluster mode")
+
+// The header marking requests forwarded by another node, naming it.
+const NodeHeader = "X-Cart-Node"
+
+// The header carrying the cluster secret on /cluster/item requests,
+// proving that they come from a node.
+const SecretHeader = "X-Cart-Secret"
+
+// How long a node waits for another one by default.
+const DefaultClusterTimeout = 5 * time.Second
+
+// A node of a cluster, and the shards it owns.
+type Node struct {
+  Name string `json:"name"`
+  // Where the node serves HTTP, e.g. http://10.0.0.1:8080.
+  URL string `json:"url"`
+  // Shard numbers and ranges of them, e.g. "0-511" or "7".
+  Shards []string `json:"shards"`
+  // Where else it serves HTTP, if the node is a raft group: the
+  // URLs of the other members, tried in order when URL cannot be
+  // reached.
+  URLs []string `json:"urls,omitempty"`
+}
+
+// A static set of nodes sharing the shards between them.  Every
+// node owns the keys mapping to its shards, customer and item keys
+// alike, except that variants live with their SKU.  Requests for
+// keys owned elsewhere are forwarded to the owner, and a change to
+// a cart whose item is owned elsewhere updates the item index of
+// the owner while holding the customer lock.
+type Cluster struct {
+  Nodes []Node `json:"nodes"`
+  // The name of the node this handler is.
+  Self string `json:"-"`
+  // Shared by every node and by nobody else: only requests carrying
+  // it may change the item index through /cluster/item.
+  Secret string `json:"secret"`
+  // How long to wait for another node, DefaultClusterTimeout if 0.
+  Timeout time.Duration `json:"-"`
+}
+
+// Read the nodes of a cluster from a JSON membership file.
+func LoadCluster(path string) (*Cluster, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+
+  var c Cluster
+  if err := json.Unmarshal(data, &c); err != nil {
+    return nil, fmt.Errorf("%v: %v", path, err)
+  }
+  return &c, nil
+}
+
+// Validate makes sure every one of the shards is owned by exactly
+// one node, that this node is one of them, and that there is a
+// secret.
+func (c *Cluster) Validate(shards int) error {
+  _, err := c.owners(shards)
+  return err
+}
+
+// Return the index of the node owning every shard.
+func (c *Cluster) owners(shards int) ([]int, error) {
+  if c.Timeout < 0 {
+    return nil, fmt.Errorf("cluster timeout must not be negative")
+  }
+  if c.Secret == "" {
+    return nil, fmt.Errorf("cluster secret missing")
+  }
+
+  owners := make([]int, shards)
+  for i := range owners {
+    owners[i] = -1
+  }
+  self := -1
+  names := make(map[string]bool)
+  for i, node := range c.Nodes {
+    if node.Name == "" {
+      return nil, fmt.Errorf("node %v has no name", i)
+    }
+    if names[node.Name] {
+      return nil, fmt.Errorf("node %v is defined twice", node.Name)
+    }
+    names[node.Name] = true
+    if node.Name == c.Self {
+      self = i
+    }
+    for _, s := range node.urls() {
+      if u, err := url.Parse(s); err != nil || u.Scheme == "" || u.Host == "" {
+        return nil, fmt.Errorf("node %v: invalid url %q", node.Name, s)
+      }
+    }
+
+    for _, r := range node.Shards {
+      first, last, err := parseShardRange(r)
+      if err != nil {
+        return nil, fmt.Errorf("node %v: %v", node.Name, err)
+      }
+      if last >= shards {
+        return nil, fmt.Errorf("node %v: shard %v is out of range, there are only %v shards",
+          node.Name, last, shards)
+      }
+      for shard := first; shard <= last; shard++ {
+        if owners[shard] >= 0 {
+          return nil, fmt.Errorf("shard %v is owned by both %v and %v",
+            shard, c.Nodes[owners[shard]].Name, node.Name)
+        }
+        owners[shard] = i
+      }
+    }
+  }
+
+  if self < 0 {
+    return nil, fmt.Errorf("node %q is not a member of the cluster", c.Self)
+  }
+  for shard, owner := range owners {
+    if owner < 0 {
+      return nil, fmt.Errorf("shard %v is not owned by any node", shard)
+    }
+  }
+  return owners, nil
+}
+
+// Return every URL the node serves HTTP at, the main one first.
+func (n Node) urls() []string {
+  return append([]string{n.URL}, n.URLs...)
+}
+
+// Given a shard number or a range like 0-511, return the first and
+// the last shard of it.
+func parseShardRange(s string) (int, int, error) {
+  from, to, isRange := strings.Cut(s, "-")
+  first, err := strconv.Atoi(from)
+  last := first
+  if err == nil && isRange {
+    last, err = strconv.Atoi(to)
+  }
+  if err != nil || first < 0 || last < first {
+    return 0, 0, fmt.Errorf("invalid shard range %q", s)
+  }
+  return first, last, nil
+}
+
+// The cluster as seen by one of its nodes.
+type clusterState struct {
+  nodes  []Node
+  self   int
+  owners []int
+  secret string
+  client *http.Client
+}
+
+func newClusterState(c *Cluster, shards int) (*clusterState, error) {
+  owners, err := c.owners(shards)
+  if err != nil {
+    return nil, err
+  }
+
+  timeout := c.Timeout
+  if timeout == 0 {
+    timeout = DefaultClusterTimeout
+  }
+  s := clusterState{nodes: c.Nodes, owners: owners, secret: c.Secret,
+    client: &http.Client{Timeout: timeout}}
+  for i, node := range c.Nodes {
+    if node.Name == c.Self {
+      s.self = i
+    }
+  }
+  return &s, nil
+}
+
+// Return the node owning the shard, or nil if it is this one.
+func (h *Handler) shardOwner(shard uint32) *Node {
+  if h.cluster == nil {
+    return nil
+  }
+  owner := h.cluster.owners[shard]
+  if owner == h.cluster.self {
+    return nil
+  }
+  return &h.cluster.nodes[owner]
+}
+
+// Return the node owning the key, or nil if it is this one.
+func (h *Handler) keyOwner(key string) *Node {
+  if h.cluster == nil {
+    return nil
+  }
+  return h.shardOwner(h.mapping.shard(h.ids, key, len(h.cluster.owners)))
+}
+
+// Return the node owning the item, or nil if it is this one.  The
+// item is a SKU or a variant id, and variants live with their SKU.
+func (h *Handler) itemOwner(item string) (*Node, error) {
+  if h.cluster == nil {
+    return nil, nil
+  }
+  key, err := h.itemKey(item)
+  if err != nil {
+    return nil, err
+  }
+  return h.keyOwner(key.SKU), nil
+}
+
+// Make sure the customer is owned by this node.
+func (h *Handler) checkOwner(customer string) error {
+  if node := h.keyOwner(customer); node != nil {
+    return fmt.Errorf("%w: customer %v belongs to %v", ErrNotOwner, customer, node.Name)
+  }
+  return nil
+}
+
+// Pass the request on to the node owning its key and copy the
+// response back.  A request that was forwarded already is never
+// forwarded again, the nodes disagree on who owns what.
+func (h *Handler) forward(w http.ResponseWriter, r *http.Request, node *Node) {
+  if from := r.Header.Get(NodeHeader); from != "" {
+    w.WriteHeader(http.StatusServiceUnavailable)
+    fmt.Fprintf(w, "error: %v forwarded a request for a key owned by %v",
+      from, node.Name)
+    return
+  }
+
+  proxy(w, r, h.cluster.client, node.urls(), NodeHeader, h.cluster.nodes[h.cluster.self].Name)
+}
+
+// Pass the request on to the first of the URLs that can be reached,
+// marking it with the header, and copy the response back.  Only
+// the mark of another node survives the trip, so that the node
+// serving the request knows not to forward it again.
+func proxy(w http.ResponseWriter, r *http.Request, client *http.Client,
+urls []string, header string, from string) {
+  var resp *http.Response
+  var err error
+  for _, u := range urls {
+    var req *http.Request
+    req, err = http.NewRequestWithContext(r.Context(), r.Method,
+      strings.TrimSuffix(u, "/") + r.URL.RequestURI(), r.Body)
+    if err != nil {
+      fmt.Fprintf(w, "error: %v", err)
+      return
+    }
+    for _, h := range []string{NodeHeader, SecretHeader} {
+      if v := r.Header.Get(h); v != "" {
+        req.Header.Set(h, v)
+      }
+    }
+    req.Header.Set(header, from)
+
+    if resp, err = client.Do(req); err == nil {
+      break
+    }
+  }
+  if err != nil {
+    w.WriteHeader(http.StatusGatewayTimeout)
+    fmt.Fprintf(w, "error: %v: %v", ErrUnavailable, err)
+    return
+  }
+  defer resp.Body.Close()
+
+  if ct := resp.Header.Get("Content-Type"); ct != "" {
+    w.Header().Set("Content-Type", ct)
+  }
+  w.WriteHeader(resp.StatusCode)
+  io.Copy(w, resp.Body)
+}
+
+// Set the quantity of the item in the cart of the customer in the
+// item index of the node owning the item.
+func (h *Handler) setRemoteItem(node *Node, customer string, item string, qty uint32) error {
+  key, err := h.itemKey(item)
+  if err != nil {
+    return err
+  }
+
+  q := url.Values{}
+  q.Set("customer", customer)
+  q.Set("item", key.SKU)
+  q["variant"] = key.Attributes()
+  q.Set("qty", strconv.FormatUint(uint64(qty), 10))
+
+  var resp *http.Response
+  for _, u := range node.urls() {
+    var req *http.Request
+    req, err = http.NewRequest("POST",
+      strings.TrimSuffix(u, "/") + "/cluster/item?" + q.Encode(), nil)
+    if err != nil {
+      return err
+    }
+    req.Header.Set(NodeHeader, h.cluster.nodes[h.cluster.self].Name)
+    req.Header.Set(SecretHeader, h.cluster.secret)
+
+    if resp, err = h.cluster.client.Do(req); err == nil {
+      break
+    }
+  }
+  if err != nil {
+    return fmt.Errorf("%w: %v", ErrUnavailable, err)
+  }
+  defer resp.Body.Close()
+
+  body, err := io.ReadAll(resp.Body)
+  if err != nil {
+    return fmt.Errorf("%w: %v", ErrUnavailable, err)
+  }
+  switch {
+  case resp.StatusCode == http.StatusServiceUnavailable:
+    return ErrBusy
+  case resp.StatusCode == http.StatusGatewayTimeout:
+    return fmt.Errorf("%w: %v: %s", ErrUnavailable, node.Name, strings.TrimPrefix(string(body), "error: "))
+  case string(body) != "OK\n":
+    return fmt.Errorf("%v: %s", node.Name, strings.TrimPrefix(string(body), "error: "))
+  }
+  return nil
+}
+
+// This function is responsible for handling /cluster/item queries,
+// sent by the node owning a customer to the node owning an item.
+// It sets the quantity of the item, possibly a variant, in the
+// cart of the customer in the item index.  Only POST requests
+// carrying the cluster secret are accepted.
+func (h* Handler) ClusterItem(w http.ResponseWriter, r *http.Request) {
+  if !h.enter(w) {
+    return
+  }
+  defer h.leave()
+
+  if h.cluster == nil {
+    fmt.Fprintf(w, "error: not in cluster mode")
+    return
+  }
+  if r.Method != "POST" {
+    w.Header().Set("Allow", "POST")
+    w.WriteHeader(http.StatusMethodNotAllowed)
+    fmt.Fprintf(w, "error: changing the item index requires POST")
+    return
+  }
+  secret := r.Header.Get(SecretHeader)
+  if subtle.ConstantTimeCompare([]byte(secret), []byte(h.cluster.secret)) != 1 {
+    w.WriteHeader(http.StatusForbidden)
+    fmt.Fprintf(w, "error: only nodes of the cluster may change the item index")
+    return
+  }
+  if h.toLeader(w, r) {
+    return
+  }
+
+  customer, err := h.checkCustomerArg(w, r)
+  if err != nil {
+    fmt.Fprintf(w, "error: %v", err)
+    return
+  }
+  sku, err := h.checkItemArg(w, r)
+  if err != nil {
+    fmt.Fprintf(w, "error: %v", err)
+    return
+  }
+  variant, err := h.checkVariantArg(w, r)
+  if err != nil {
+    fmt.Fprintf(w, "error: %v", err)
+    return
+  }
+  qty, err := strconv.ParseUint(r.URL.Query().Get("qty"), 10, 32)
+  if err != nil {
+    fmt.Fprintf(w, "error: invalid qty %q", r.URL.Query().Get("qty"))
+    return
+  }
+  if node := h.keyOwner(string(sku)); node != nil {
+    fmt.Fprintf(w, "error: item %v belongs to %v", sku, node.Name)
+    return
+  }
+
+  item, err := h.variants.intern(ItemKey{string(sku), variant})
+  if err != nil {
+    fmt.Fprintf(w, "error: %v", err)
+    return
+  }
+
+  if !h.lock(&h.iLock, item) {
+    w.WriteHeader(http.StatusServiceUnavailable)
+    return
+  }
+  defer h.iLock.MustUnlock(item)
+
+  if h.raft != nil {
+    err = h.proposeItemIndex(string(customer), item, uint32(qty))
+  } else {
+    err = h.iStorage.ChangeValue(item, string(customer), setQtyInSet(uint32(qty)))
+  }
+  writeStatus(w, err)
+  if err != nil {
+    fmt.Fprintf(w, "error: %v", err)
+    return
+  }
+  fmt.Fprintf(w, "OK\n")
+}
@@ -0,0 +1,261 @@
+package cart
+
+import (
+  "errors"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "sort"
+  "strings"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+// Start a cluster of two nodes on localhost with four shards, a
+// owning shards 0 and 1 and b shards 2 and 3.  Customer 1 and item
+// 13 live on a, customer 2 and item 10 on b.
+func tempCluster(t *testing.T) (map[string]*Handler, map[string]*httptest.Server, func()) {
+  handlers := make(map[string]*Handler)
+  servers := make(map[string]*httptest.Server)
+  var dirs []string
+  cleanup := func() {
+    for _, srv := range servers {
+      srv.Close()
+    }
+    for _, h := range handlers {
+      h.Close()
+    }
+    for _, dir := range dirs {
+      os.RemoveAll(dir)
+    }
+  }
+
+  cluster := Cluster{}
+  for _, name := range []string{"a", "b"} {
+    mux := http.NewServeMux()
+    srv := httptest.NewServer(mux)
+    servers[name] = srv
+    shards := map[string]string{"a": "0-1", "b": "2-3"}[name]
+    cluster.Nodes = append(cluster.Nodes, Node{name, srv.URL, []string{shards}, nil})
+  }
+
+  for _, name := range []string{"a", "b"} {
+    dir, err := ioutil.TempDir("", "cart")
+    if err != nil {
+      cleanup()
+      t.Fatalf("unexpected error: %s", err)
+    }
+    dirs = append(dirs, dir)
+
+    o := DefaultOptions()
+    o.Dir = dir
+    o.Shards = 4
+    o.Cluster = &Cluster{Nodes: cluster.Nodes, Self: name, Secret: "s3cret"}
+    h, err := NewHandlerWithOptions(o)
+    if err != nil {
+      cleanup()
+      t.Fatalf("unexpected error: %s", err)
+    }
+    handlers[name] = h
+
+    mux := servers[name].Config.Handler.(*http.ServeMux)
+    mux.HandleFunc("/add", h.Mod(AddToSet))
+    mux.HandleFunc("/remove", h.Mod(RemoveFromSet))
+    mux.HandleFunc("/list", h.List)
+    mux.HandleFunc("/lines", h.Lines)
+    mux.HandleFunc("/clear", h.Clear)
+    mux.HandleFunc("/cluster/item", h.ClusterItem)
+  }
+  return handlers, servers, cleanup
+}
+
+// Ensure every node serves every key, and that both indexes are
+// kept on the nodes owning their keys.
+func TestCluster(t *testing.T) {
+  handlers, servers, cleanup := tempCluster(t)
+  defer cleanup()
+
+  // Return the status and the response lines, sorted after the
+  // status line.
+  do := func(node string, path string) (int, []string) {
+    resp, err := http.Get(servers[node].URL + path)
+    if err != nil {
+      t.Fatalf("unexpected error: %s", err)
+    }
+    defer resp.Body.Close()
+    body, _ := ioutil.ReadAll(resp.Body)
+    lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+    sort.Strings(lines[1:])
+    return resp.StatusCode, lines
+  }
+
+  for _, path := range []string{
+    "/add?customer=1&item=13",
+    "/add?customer=1&item=10&variant=size:M",
+    "/add?customer=2&item=13",
+    "/add?customer=2&item=10",
+    "/add?customer=2&item=10",
+  } {
+    if _, got := do("a", path); got[0] != "OK" {
+      t.Fatalf("%v: expected `OK`, got %v", path, got)
+    }
+  }
+
+  expected := map[string]string{
+    "/list?customer=1": "OK 10 1 size:M|13 1",
+    "/list?customer=2": "OK 10 2|13 1",
+    "/list?item=13": "OK 1 1|2 1",
+    "/list?item=10": "OK 1 1|2 2",
+    "/list?item=10&variant=size:M": "OK 1 1",
+  }
+  for _, node := range []string{"a", "b"} {
+    for path, lines := range expected {
+      _, got := do(node, path)
+      if joined := got[0] + " " + strings.Join(got[1:], "|"); joined != lines {
+        t.Fatalf("%v%v: expected %v, got %v", node, path, lines, joined)
+      }
+    }
+  }
+
+  // Every node holds its own keys only.
+  for name, keys := range map[string][2]string{"a": {"1", "13"}, "b": {"2", "10"}} {
+    h := handlers[name]
+    if _, err := h.cStorage.qty(keys[0], "13"); err != nil {
+      t.Fatalf("%v: unexpected error: %s", name, err)
+    }
+    if err := h.cStorage.ObserveValue(map[string]string{"a": "2", "b": "1"}[name],
+      func(*setT) error { return nil }); err != ErrNoSuchKey {
+      t.Fatalf("%v: expected the other node's customer to be missing, got %v", name, err)
+    }
+    if err := h.iStorage.ObserveValue(keys[1], func(*setT) error { return nil }); err != nil {
+      t.Fatalf("%v: unexpected error: %s", name, err)
+    }
+  }
+
+  // Clearing a cart through the other node empties both indexes.
+  if _, got := do("b", "/clear?customer=1"); got[0] != "OK" {
+    t.Fatalf("expected `OK`, got %v", got)
+  }
+  if _, got := do("a", "/list?item=13"); strings.Join(got, "|") != "OK|2 1" {
+    t.Fatalf("expected only customer 2 left, got %v", got)
+  }
+
+  // The Go API only changes carts owned by the node, and checking
+  // the indexes takes every node.
+  if err := handlers["a"].Apply("2", "10", AddToSet); !errors.Is(err, ErrNotOwner) {
+    t.Fatalf("expected ErrNotOwner, got %v", err)
+  }
+  if err := handlers["a"].Verify(func(Mismatch) error { return nil }); err != ErrClustered {
+    t.Fatalf("expected ErrClustered, got %v", err)
+  }
+
+  // Without the node owning the item, the cart is left alone.  The
+  // client cannot know whether the node took the change before it
+  // went away.
+  servers["b"].Close()
+  if status, got := do("a", "/add?customer=1&item=10"); status != http.StatusGatewayTimeout {
+    t.Fatalf("expected a 504, got %v %v", status, got)
+  }
+  if qty, _ := handlers["a"].cStorage.qty("1", "10"); qty != 0 {
+    t.Fatalf("expected the change to be undone, got %v", qty)
+  }
+}
+
+// Ensure a change the node owning the item took without answering
+// in time is taken back from its item index too.
+func TestCluster_UndoRemote(t *testing.T) {
+  handlers, servers, cleanup := tempCluster(t)
+  defer cleanup()
+  handlers["a"].cluster.client.Timeout = 100 * time.Millisecond
+
+  // The first item index change is made, but answered too late.
+  mux := servers["b"].Config.Handler
+  var slow int32 = 1
+  servers["b"].Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path == "/cluster/item" && atomic.CompareAndSwapInt32(&slow, 1, 0) {
+      mux.ServeHTTP(httptest.NewRecorder(), r)
+      time.Sleep(300 * time.Millisecond)
+      return
+    }
+    mux.ServeHTTP(w, r)
+  })
+
+  resp, err := http.Get(servers["a"].URL + "/add?customer=1&item=10")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  resp.Body.Close()
+  if resp.StatusCode != http.StatusGatewayTimeout {
+    t.Fatalf("expected a 504, got %v", resp.StatusCode)
+  }
+
+  if qty, _ := handlers["a"].cStorage.qty("1", "10"); qty != 0 {
+    t.Fatalf("expected the cart to be put back, got %v", qty)
+  }
+  if qty, _ := handlers["b"].iStorage.qty("10", "1"); qty != 0 {
+    t.Fatalf("expected the item index to be put back, got %v", qty)
+  }
+}
+
+// Ensure only nodes of the cluster change the item index.
+func TestCluster_ItemSecret(t *testing.T) {
+  handlers, servers, cleanup := tempCluster(t)
+  defer cleanup()
+
+  u := servers["b"].URL + "/cluster/item?customer=1&item=10&qty=3"
+  for _, tt := range []struct {
+    method, secret string
+    status         int
+  }{
+    {"GET", "s3cret", http.StatusMethodNotAllowed},
+    {"POST", "", http.StatusForbidden},
+    {"POST", "guess", http.StatusForbidden},
+  } {
+    req, _ := http.NewRequest(tt.method, u, nil)
+    req.Header.Set(NodeHeader, "a")
+    if tt.secret != "" {
+      req.Header.Set(SecretHeader, tt.secret)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+      t.Fatalf("unexpected error: %s", err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != tt.status {
+      t.Fatalf("%s with %q: expected %v, got %v", tt.method, tt.secret, tt.status, resp.StatusCode)
+    }
+  }
+  if qty, _ := handlers["b"].iStorage.qty("10", "1"); qty != 0 {
+    t.Fatalf("expected the item index to be left alone, got %v", qty)
+  }
+}
+
+// Ensure membership files leaving shards without a single owner
+// are refused.
+func TestCluster_Validate(t *testing.T) {
+  node := func(name string, shards ...string) Node {
+    return Node{name, "http://localhost:8097", shards, nil}
+  }
+
+  for _, c := range []Cluster{
+    {Nodes: []Node{node("a", "0-1"), node("b", "2")}, Self: "a", Secret: "s"},
+    {Nodes: []Node{node("a", "0-2"), node("b", "2-3")}, Self: "a", Secret: "s"},
+    {Nodes: []Node{node("a", "0-1"), node("b", "2-4")}, Self: "a", Secret: "s"},
+    {Nodes: []Node{node("a", "0-1"), node("b", "3-2")}, Self: "a", Secret: "s"},
+    {Nodes: []Node{node("a", "0-1"), node("a", "2-3")}, Self: "a", Secret: "s"},
+    {Nodes: []Node{node("a", "0-1"), node("b", "2-3")}, Self: "c", Secret: "s"},
+    {Nodes: []Node{node("a", "0-1"), {"b", "localhost", []string{"2-3"}, nil}}, Self: "a", Secret: "s"},
+    {Nodes: []Node{node("a", "0-1"), node("b", "2-3")}, Self: "a"},
+  } {
+    if err := c.Validate(4); err == nil {
+      t.Fatalf("expected an error for %+v", c)
+    }
+  }
+
+  c := Cluster{Nodes: []Node{node("a", "0", "3"), node("b", "1-2")}, Self: "b", Secret: "s"}
+  if err := c.Validate(4); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+}
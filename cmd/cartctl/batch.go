@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"cart/client"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// A failed operation of a batch, as printed by batch.
+type failureJSON struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// Batch parses the batch subcommand's arguments and applies the
+// operations read from a file or from stdin, one per line:
+//
+//	add <customer> <sku> [name:value ...]
+//	remove <customer> <sku> [name:value ...]
+//	clear <customer>
+//
+// Empty lines and lines starting with # are skipped.  The whole
+// file is read before anything is applied, so a syntax error
+// applies nothing.  Carts of different customers change
+// concurrently, the operations on one cart in file order.
+func Batch(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs, server := newFlagSet("batch")
+	asJSON := jsonFlag(fs)
+	input := fs.String("i", "-", "File to read from, - for stdin.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	r := stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	ops, lineNumbers, err := readOps(r)
+	if err != nil {
+		return err
+	}
+
+	err = client.New(*server).Batch(context.Background(), ops)
+	var batchErr *client.BatchError
+	if err != nil && !errors.As(err, &batchErr) {
+		return err
+	}
+
+	var failures []failureJSON
+	if batchErr != nil {
+		for i, err := range batchErr.Errors {
+			failures = append(failures, failureJSON{lineNumbers[i], err.Error()})
+		}
+		sort.Slice(failures, func(i, j int) bool { return failures[i].Line < failures[j].Line })
+	}
+
+	if *asJSON {
+		err = writeJSON(stdout, struct {
+			Applied int           `json:"applied"`
+			Failed  []failureJSON `json:"failed"`
+		}{len(ops) - len(failures), append([]failureJSON{}, failures...)})
+	} else {
+		tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+		if len(failures) > 0 {
+			fmt.Fprintln(tw, "line\terror")
+			for _, f := range failures {
+				fmt.Fprintf(tw, "%v\t%v\n", f.Line, f.Error)
+			}
+		}
+		fmt.Fprintf(tw, "Applied %v of %v operations\n", len(ops)-len(failures), len(ops))
+		err = tw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%v of %v operations failed", len(failures), len(ops))
+	}
+	return nil
+}
+
+// Read the operations of a batch.  Return them with the line every
+// one of them is on.
+func readOps(r io.Reader) ([]client.Op, []int, error) {
+	var ops []client.Op
+	var lineNumbers []int
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		op, err := parseOp(fields)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %v: %v", n, err)
+		}
+		ops = append(ops, op)
+		lineNumbers = append(lineNumbers, n)
+	}
+	return ops, lineNumbers, s.Err()
+}
+
+// Parse a line of a batch split into fields.
+func parseOp(fields []string) (client.Op, error) {
+	var op client.Op
+	switch fields[0] {
+	case "add":
+		op.Kind = client.OpAdd
+	case "remove":
+		op.Kind = client.OpRemove
+	case "clear":
+		op.Kind = client.OpClear
+	default:
+		return op, fmt.Errorf("unknown operation %q, expected add, remove or clear", fields[0])
+	}
+
+	if len(fields) < 2 {
+		return op, fmt.Errorf("customer missing")
+	}
+	op.Customer = fields[1]
+
+	if op.Kind == client.OpClear {
+		if len(fields) > 2 {
+			return op, fmt.Errorf("clear takes the customer only")
+		}
+		return op, nil
+	}
+	item, err := parseItem(fields[2:])
+	op.Item = item
+	return op, err
+}
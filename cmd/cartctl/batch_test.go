@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Ensure the operations of a batch file are applied in order per
+// cart, and that the failed ones are reported by line.
+func TestBatch(t *testing.T) {
+	server, cleanup := tempServer(t)
+	defer cleanup()
+
+	input := `# restock
+add 1 13
+add 1 13
+add 1 10 size:M
+clear 1
+add 1 10 size:L
+add 1 10 size:L
+
+add 2 x
+remove 1 10 size:L
+add 3 13
+`
+	var out bytes.Buffer
+	err := Batch([]string{"-server", server, "-json"}, strings.NewReader(input), &out)
+	if err == nil || err.Error() != "1 of 9 operations failed" {
+		t.Fatalf("expected one operation to fail, got %v", err)
+	}
+	var result struct {
+		Applied int
+		Failed  []failureJSON
+	}
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if result.Applied != 8 || len(result.Failed) != 1 || result.Failed[0].Line != 9 ||
+		!strings.Contains(result.Failed[0].Error, "invalid item id x") {
+		t.Fatalf("unexpected result:\n%s", out.String())
+	}
+
+	if out := run(t, List, server, "-item", "13"); table(out) != "customer qty|3 1" {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+	if out := run(t, List, server, "-item", "10"); table(out) != "customer qty|1 1" {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	// A syntax error applies nothing.
+	out.Reset()
+	err = Batch([]string{"-server", server}, strings.NewReader("add 4 13\nempty 4\n"), &out)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2: unknown operation") {
+		t.Fatalf("expected a syntax error, got %v", err)
+	}
+	if out := run(t, List, server, "-item", "13"); table(out) != "customer qty|3 1" {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	if out := run(t, Batch, server, "-i", "/dev/null"); out != "Applied 0 of 0 operations\n" {
+		t.Fatalf("unexpected output: %s", out)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"cart"
+	"cart/client"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A cart line as printed by list and merge.  Ids are strings
+// whatever the id mode of the server.
+type lineJSON struct {
+	Item       string            `json:"item"`
+	Variant    map[string]string `json:"variant,omitempty"`
+	Qty        uint32            `json:"qty"`
+	Price      int64             `json:"price,omitempty"`
+	Currency   string            `json:"currency,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+// A customer having an item, as printed by list -item.
+type customerJSON struct {
+	Customer string `json:"customer"`
+	Qty      uint32 `json:"qty"`
+}
+
+// Add parses the add subcommand's arguments and adds -n of the
+// item to the cart of the customer.
+func Add(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs, server := newFlagSet("add")
+	n := fs.Int("n", 1, "How many to add.")
+	price := fs.Int64("price", 0, "Unit price in minor units of the currency, e.g. cents.")
+	currency := fs.String("currency", "", "ISO 4217 code of the currency, e.g. EUR.")
+	attrs := make(attrFlag)
+	fs.Var(attrs, "attr", "Line attribute as name:value, any number of times.")
+	fs.Usage = usage(fs, "add [flags] <customer> <sku> [name:value ...]")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return fmt.Errorf("customer and item required")
+	}
+	if *n <= 0 {
+		return fmt.Errorf("-n must be positive")
+	}
+	item, err := parseItem(fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	var details *cart.LineDetails
+	if *price != 0 || *currency != "" || len(attrs) > 0 {
+		details = &cart.LineDetails{Price: *price, Currency: *currency, Attributes: attrs}
+	}
+
+	c := client.New(*server)
+	for i := 0; i < *n; i++ {
+		if err := c.Add(context.Background(), fs.Arg(0), item, details); err != nil {
+			return fmt.Errorf("after adding %v: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Remove parses the remove subcommand's arguments and removes -n of
+// the item from the cart of the customer.
+func Remove(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs, server := newFlagSet("remove")
+	n := fs.Int("n", 1, "How many to remove.")
+	fs.Usage = usage(fs, "remove [flags] <customer> <sku> [name:value ...]")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return fmt.Errorf("customer and item required")
+	}
+	if *n <= 0 {
+		return fmt.Errorf("-n must be positive")
+	}
+	item, err := parseItem(fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	c := client.New(*server)
+	for i := 0; i < *n; i++ {
+		if err := c.Remove(context.Background(), fs.Arg(0), item); err != nil {
+			return fmt.Errorf("after removing %v: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Clear parses the clear subcommand's arguments and empties the
+// cart of the customer.
+func Clear(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs, server := newFlagSet("clear")
+	fs.Usage = usage(fs, "clear [flags] <customer>")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("customer required")
+	}
+	return client.New(*server).Clear(context.Background(), fs.Arg(0))
+}
+
+// List parses the list subcommand's arguments and prints the lines
+// of the cart of the customer, or with -item the customers having
+// the item in their cart.
+func List(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs, server := newFlagSet("list")
+	asJSON := jsonFlag(fs)
+	byItem := fs.Bool("item", false, "List the carts having the item instead.")
+	fs.Usage = usage(fs, "list [flags] <customer>\n       cartctl list -item [flags] <sku> [name:value ...]")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c := client.New(*server)
+	ctx := context.Background()
+
+	if *byItem {
+		item, err := parseItem(fs.Args())
+		if err != nil {
+			return err
+		}
+		customers, err := c.ListItem(ctx, item)
+		if err != nil {
+			return err
+		}
+		return writeCustomers(stdout, customers, *asJSON)
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("customer required")
+	}
+	lines, err := c.Lines(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return writeLines(stdout, lines, *asJSON)
+}
+
+// Merge parses the merge subcommand's arguments and moves every line
+// of the cart of one customer into the cart of another, e.g. when a
+// guest logs in.  Quantities add up; the details of the moved lines
+// go with them.  Every line moves at once, in chunks of
+// cart.MaxModQty units, and is only removed from the first cart once
+// it made it into the second one; units added to the first cart
+// meanwhile stay there.  If anything fails, the error tells which
+// units moved and which did not.
+func Merge(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs, server := newFlagSet("merge")
+	asJSON := jsonFlag(fs)
+	fs.Usage = usage(fs, "merge [flags] <from customer> <to customer>")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("both customers required")
+	}
+	from, to := fs.Arg(0), fs.Arg(1)
+	if from == to {
+		return fmt.Errorf("cannot merge a cart into itself")
+	}
+	c := client.New(*server)
+	ctx := context.Background()
+
+	lines, err := c.Lines(ctx, from)
+	if err != nil {
+		return err
+	}
+	var adds []client.Op
+	for _, l := range lines {
+		details := &cart.LineDetails{Price: l.Price, Currency: l.Currency, Attributes: l.Attributes}
+		if details.Price == 0 && details.Currency == "" && len(details.Attributes) == 0 {
+			details = nil
+		}
+		for left := l.Qty; left > 0; {
+			qty := left
+			if qty > cart.MaxModQty {
+				qty = cart.MaxModQty
+			}
+			adds = append(adds, client.Op{Kind: client.OpAdd, Customer: to, Item: l.Item, Qty: qty,
+				Details: details})
+			left -= qty
+		}
+	}
+
+	// Only what made it into the second cart leaves the first one.
+	addErr := c.Batch(ctx, adds)
+	added, notAdded, err := splitBatch(adds, addErr)
+	if err != nil {
+		return err
+	}
+	removes := make([]client.Op, len(added))
+	for i, op := range added {
+		removes[i] = client.Op{Kind: client.OpRemove, Customer: from, Item: op.Item, Qty: op.Qty}
+	}
+	removeErr := c.Batch(ctx, removes)
+	removed, notRemoved, err := splitBatch(removes, removeErr)
+	if err != nil {
+		return err
+	}
+
+	if addErr != nil || removeErr != nil {
+		return fmt.Errorf("moved %v; kept in %v, and possibly in %v too: %v; in %v, and possibly still in %v: %v: %v",
+			describeOps(removed), from, to, describeOps(notAdded), to, from, describeOps(notRemoved),
+			errors.Join(addErr, removeErr))
+	}
+	return writeLines(stdout, lines, *asJSON)
+}
+
+// Given the operations of a batch and the error of the batch, return
+// the operations that succeeded and the ones that failed.
+func splitBatch(ops []client.Op, err error) ([]client.Op, []client.Op, error) {
+	if err == nil {
+		return ops, nil, nil
+	}
+	var batchErr *client.BatchError
+	if !errors.As(err, &batchErr) {
+		return nil, nil, err
+	}
+
+	var ok, failed []client.Op
+	for i, op := range ops {
+		if _, found := batchErr.Errors[i]; found {
+			failed = append(failed, op)
+		} else {
+			ok = append(ok, op)
+		}
+	}
+	return ok, failed, nil
+}
+
+// Describe the units the operations change, e.g. "2 of 7, 1 of 8
+// size:M".
+func describeOps(ops []client.Op) string {
+	if len(ops) == 0 {
+		return "nothing"
+	}
+	units := make([]string, len(ops))
+	for i, op := range ops {
+		units[i] = fmt.Sprintf("%v of %v", op.Qty, op.Item)
+	}
+	return strings.Join(units, ", ")
+}
+
+// Write the lines of a cart as a table or as JSON.
+func writeLines(w io.Writer, lines []client.CartLine, asJSON bool) error {
+	if asJSON {
+		out := make([]lineJSON, 0, len(lines))
+		for _, l := range lines {
+			out = append(out, lineJSON{l.Item.SKU, l.Item.Variant, l.Qty,
+				l.Price, l.Currency, l.Attributes, l.UpdatedAt})
+		}
+		return writeJSON(w, out)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "item\tvariant\tqty\tprice\tupdated")
+	for _, l := range lines {
+		price := ""
+		if l.Currency != "" {
+			price = fmt.Sprintf("%v %v", l.Price, l.Currency)
+		}
+		updated := ""
+		if !l.UpdatedAt.IsZero() {
+			updated = l.UpdatedAt.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", l.Item.SKU, strings.Join(l.Item.Attributes(), " "),
+			l.Qty, price, updated)
+	}
+	return tw.Flush()
+}
+
+// Write the customers having an item as a table or as JSON.
+func writeCustomers(w io.Writer, customers []client.ItemCustomer, asJSON bool) error {
+	if asJSON {
+		out := make([]customerJSON, 0, len(customers))
+		for _, c := range customers {
+			out = append(out, customerJSON{c.Customer, c.Qty})
+		}
+		return writeJSON(w, out)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "customer\tqty")
+	for _, c := range customers {
+		fmt.Fprintf(tw, "%v\t%v\n", c.Customer, c.Qty)
+	}
+	return tw.Flush()
+}
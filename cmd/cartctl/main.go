@@ -0,0 +1,133 @@
+// Command cartctl talks to a running cart server over HTTP.
+package main
+
+import (
+	"cart"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// DefaultServer is the server talked to without -server or
+// CARTCTL_SERVER.
+const DefaultServer = "http://localhost:8097"
+
+// Usage is printed for "cartctl help".
+const Usage = `usage: cartctl <command> [arguments]
+
+The commands are:
+
+    add       add items to a cart
+    remove    remove items from a cart
+    list      print a cart, or the carts having an item
+    clear     empty a cart
+    merge     move every line of a cart into another one
+    batch     apply the operations listed in a file
+
+Items are given as the SKU followed by the attributes of the
+variant, if any, e.g. "10 size:M color:red".  Every command talks
+to the server given by -server, CARTCTL_SERVER or
+` + DefaultServer + `.  List, merge and batch print a table, or
+JSON with -json.  Use "cartctl <command> -h" for the arguments of
+a command.
+`
+
+// A subcommand.  It reads its input from stdin and writes its
+// output to stdout.
+type command func(args []string, stdin io.Reader, stdout io.Writer) error
+
+var commands = map[string]command{
+	"add":    Add,
+	"remove": Remove,
+	"list":   List,
+	"clear":  Clear,
+	"merge":  Merge,
+	"batch":  Batch,
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "help" || os.Args[1] == "-h" {
+		fmt.Print(Usage)
+		return
+	}
+
+	name, args := os.Args[1], os.Args[2:]
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "cartctl: unknown command %q\n\n%s", name, Usage)
+		os.Exit(2)
+	}
+
+	if err := cmd(args, os.Stdin, os.Stdout); err == flag.ErrHelp {
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "cartctl %v: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// Return a flag set for the command with the -server flag every
+// command has.
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	server := os.Getenv("CARTCTL_SERVER")
+	if server == "" {
+		server = DefaultServer
+	}
+	return fs, fs.String("server", server, "URL of the cart server.")
+}
+
+// Return the usage function of a command taking arguments besides
+// the flags, printing its synopsis before the flags.
+func usage(fs *flag.FlagSet, synopsis string) func() {
+	return func() {
+		fmt.Fprintf(fs.Output(), "usage: cartctl %v\n\n", synopsis)
+		fs.PrintDefaults()
+	}
+}
+
+// Add the -json flag of the commands printing something.
+func jsonFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("json", false, "Print JSON instead of a table.")
+}
+
+// Write v as indented JSON.
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// Parse an item given as the SKU followed by the variant attributes
+// as name:value.
+func parseItem(args []string) (cart.ItemKey, error) {
+	if len(args) == 0 {
+		return cart.ItemKey{}, fmt.Errorf("item missing")
+	}
+	variant, err := cart.ParseAttributes(args[1:])
+	if err != nil {
+		return cart.ItemKey{}, err
+	}
+	return cart.ItemKey{SKU: args[0], Variant: variant}, nil
+}
+
+// Attributes given as name:value any number of times.
+type attrFlag map[string]string
+
+func (a attrFlag) String() string {
+	return strings.Join(cart.ItemKey{Variant: a}.Attributes(), " ")
+}
+
+func (a attrFlag) Set(s string) error {
+	m, err := cart.ParseAttributes([]string{s})
+	if err != nil {
+		return err
+	}
+	for name, value := range m {
+		a[name] = value
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"cart"
+	"cart/client"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Start a cart server on a temporary directory and return its URL.
+func tempServer(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "cartctl")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	o := cart.DefaultOptions()
+	o.Dir = dir
+	o.Shards = 4
+	h, err := cart.NewHandlerWithOptions(o)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/add", h.Mod(cart.AddToSet))
+	mux.HandleFunc("/remove", h.Mod(cart.RemoveFromSet))
+	mux.HandleFunc("/list", h.List)
+	mux.HandleFunc("/lines", h.Lines)
+	mux.HandleFunc("/clear", h.Clear)
+	srv := httptest.NewServer(mux)
+	return srv.URL, func() { srv.Close(); h.Close(); os.RemoveAll(dir) }
+}
+
+// Run the command against the server and return its output.
+func run(t *testing.T, cmd command, server string, args ...string) string {
+	var out bytes.Buffer
+	if err := cmd(append([]string{"-server", server}, args...), nil, &out); err != nil {
+		t.Fatalf("%v: unexpected error: %s", args, err)
+	}
+	return out.String()
+}
+
+// Return the lines of the output with their fields separated by a
+// single space.
+func table(s string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		lines = append(lines, strings.Join(strings.Fields(line), " "))
+	}
+	return strings.Join(lines, "|")
+}
+
+// Ensure carts are changed and listed through the server.
+func TestCommands(t *testing.T) {
+	server, cleanup := tempServer(t)
+	defer cleanup()
+
+	run(t, Add, server, "-n", "2", "1", "13")
+	run(t, Add, server, "-price", "1999", "-currency", "EUR", "-attr", "note:gift", "1", "10", "size:M")
+	run(t, Add, server, "-n", "3", "2", "10")
+	run(t, Remove, server, "2", "10")
+
+	out := run(t, List, server, "1")
+	if !strings.HasPrefix(table(out), "item variant qty price updated|13 2 20") ||
+		!strings.Contains(table(out), "|10 size:M 1 1999 EUR 20") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+	if out := run(t, List, server, "-item", "10"); table(out) != "customer qty|1 1|2 2" {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+
+	var customers []customerJSON
+	if err := json.Unmarshal([]byte(run(t, List, server, "-json", "-item", "10", "size:M")), &customers); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if len(customers) != 1 || customers[0] != (customerJSON{"1", 1}) {
+		t.Fatalf("unexpected customers: %v", customers)
+	}
+
+	// Merging moves every line with its details.
+	out = run(t, Merge, server, "-json", "1", "2")
+	var moved []lineJSON
+	if err := json.Unmarshal([]byte(out), &moved); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if len(moved) != 2 {
+		t.Fatalf("expected 2 lines, got:\n%s", out)
+	}
+	lines := run(t, List, server, "-json", "2")
+	var after []lineJSON
+	if err := json.Unmarshal([]byte(lines), &after); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(after) != 3 || after[0].Item != "10" || after[0].Qty != 2 || after[1].Item != "13" ||
+		after[1].Qty != 2 || after[2].Currency != "EUR" || after[2].Attributes["note"] != "gift" {
+		t.Fatalf("unexpected lines:\n%s", lines)
+	}
+	if out := run(t, List, server, "1"); table(out) != "item variant qty price updated" {
+		t.Fatalf("expected an empty cart, got:\n%s", out)
+	}
+
+	run(t, Clear, server, "2")
+	if out := run(t, List, server, "-json", "2"); out != "[]\n" {
+		t.Fatalf("expected an empty cart, got:\n%s", out)
+	}
+
+	// Errors of the server come back.
+	var out2 bytes.Buffer
+	err := Add([]string{"-server", server, "1", "x"}, nil, &out2)
+	if err == nil || !strings.Contains(err.Error(), "invalid item id x") {
+		t.Fatalf("expected an invalid item error, got %v", err)
+	}
+	if err := Merge([]string{"-server", server, "1", "1"}, nil, &out2); err == nil {
+		t.Fatalf("expected an error merging a cart into itself")
+	}
+}
+
+// Ensure merging leaves the units added to the first cart meanwhile.
+func TestMerge_Concurrent(t *testing.T) {
+	server, cleanup := tempServer(t)
+	defer cleanup()
+	run(t, Add, server, "-n", "2", "1", "13")
+
+	// A unit gets added to the first cart while the lines move.
+	u, err := url.Parse(server)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	var once sync.Once
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/add" && r.URL.Query().Get("customer") == "2" {
+			once.Do(func() { run(t, Add, server, "1", "13") })
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	run(t, Merge, srv.URL, "1", "2")
+	if out := run(t, List, server, "-item", "13"); table(out) != "customer qty|1 1|2 2" {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+}
+
+// Ensure merging moves a line in a few requests, and reports the
+// lines that did not move.
+func TestMerge_Failure(t *testing.T) {
+	server, cleanup := tempServer(t)
+	defer cleanup()
+	c := client.New(server)
+	ctx := context.Background()
+	for _, qty := range []uint32{cart.MaxModQty, 1} {
+		if err := c.AddQty(ctx, "1", cart.ItemKey{SKU: "13"}, qty, nil); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	run(t, Add, server, "-n", "2", "1", "10")
+
+	// Item 10 does not make it into the second cart.
+	u, err := url.Parse(server)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		if r.URL.Path == "/add" && r.URL.Query().Get("item") == "10" {
+			fmt.Fprintf(w, "error: refused")
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	err = Merge([]string{"-server", srv.URL, "1", "2"}, nil, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "moved 1000 of 13, 1 of 13; kept in 1, and possibly in 2 too: 2 of 10;") {
+		t.Fatalf("expected item 10 reported as not moved, got %v", err)
+	}
+	if requests > 6 {
+		t.Fatalf("expected at most 6 requests, got %v", requests)
+	}
+	for _, tt := range []struct{ item, expected string }{
+		{"13", "customer qty|2 1001"},
+		{"10", "customer qty|1 2"},
+	} {
+		if out := run(t, List, server, "-item", tt.item); table(out) != tt.expected {
+			t.Fatalf("unexpected output:\n%s", out)
+		}
+	}
+}
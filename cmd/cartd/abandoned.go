@@ -0,0 +1,41 @@
+package main
+
+import (
+	"cart"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// Abandoned parses the abandoned subcommand's arguments and prints
+// every cart that expires within the given duration, the ones
+// expiring first first.
+func Abandoned(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("abandoned", flag.ContinueOnError)
+	config := fs.String("config", "", "Path to the configuration file.")
+	within := fs.Duration("within", time.Hour, "Report carts expiring within this long.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	h, err := openHandler(*config)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "customer\titems\tlast change\texpires\t")
+
+	err = h.Abandoned(time.Now(), *within, func(c cart.AbandonedCart) error {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t\n", c.Customer, c.Items,
+			c.LastChange.UTC().Format(time.RFC3339), c.Expires.UTC().Format(time.RFC3339))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"cart"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Backup parses the backup subcommand's arguments and writes a
+// snapshot of every shard into a gzipped tar archive.  With -server
+// the snapshot is taken by a running cartd, otherwise the shard
+// files are read directly.
+func Backup(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	config := fs.String("config", "", "Path to the configuration file.")
+	output := fs.String("o", "-", "File to write to, - for stdout.")
+	server := fs.String("server", "", "URL of a running cartd, e.g. http://localhost:8097.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	w := stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if *server != "" {
+		return fetchBackup(strings.TrimSuffix(*server, "/"), w)
+	}
+
+	h, err := openHandler(*config)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	return h.Backup(w)
+}
+
+// Stream the backup of a running server into w.
+func fetchBackup(server string, w io.Writer) error {
+	resp, err := http.Get(server + "/admin/backup")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server responded with %v", resp.Status)
+	}
+
+	// A server failing halfway through aborts the response, which
+	// shows up as an error here.
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Restore parses the restore subcommand's arguments, validates the
+// archive and unpacks it into the shards directory, which must not
+// hold any shards yet.  With -journal, the journal entries made
+// after the backup, up to -until, are replayed on top of it.
+func Restore(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	config := fs.String("config", "", "Path to the configuration file.")
+	input := fs.String("i", "-", "Archive to read from, - for stdin.")
+	journal := fs.String("journal", "", "Journal to replay on top of the archive.")
+	until := fs.String("until", "", "Replay journal entries up to this RFC 3339 time, default all.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var t time.Time
+	if *until != "" {
+		if *journal == "" {
+			return fmt.Errorf("-until requires -journal")
+		}
+		var err error
+		if t, err = time.Parse(time.RFC3339Nano, *until); err != nil {
+			return fmt.Errorf("-until: %v", err)
+		}
+	}
+
+	c, err := ParseConfigFile(*config)
+	if err != nil {
+		return err
+	}
+	if err := refuseRaft(c); err != nil {
+		return err
+	}
+
+	// Open the journal first, it may well live in the directory
+	// we are restoring into.
+	var j io.Reader
+	if *journal != "" {
+		f, err := os.Open(*journal)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		j = f
+	}
+
+	r := stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	m, err := cart.Restore(r, c.Storage.DataDir, c.Storage.ShardCount)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "Restored into", c.Storage.DataDir)
+
+	if j == nil {
+		return nil
+	}
+	n, err := replay(c, j, m.JournalSeq, t)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Replayed %v journal entries from entry %v\n", n, m.JournalSeq)
+	return nil
+}
+
+// Replay the journal on top of the shards without journaling the
+// replayed entries again.
+func replay(c *Config, j io.Reader, from uint64, until time.Time) (int, error) {
+	o, err := c.Options()
+	if err != nil {
+		return 0, err
+	}
+	o.OpenTimeout = OpenTimeout
+	o.Journal = false
+
+	h, err := cart.NewHandlerWithOptions(o)
+	if err != nil {
+		return 0, err
+	}
+	defer h.Close()
+
+	return h.Replay(j, from, until)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Ensure a backup restores into a fresh directory with all carts.
+func TestBackupRestore(t *testing.T) {
+	config, cleanup := tempConfig(t)
+	defer cleanup()
+
+	input := "customer,item,qty\n1,7,2\n2,8,1\n"
+	var out bytes.Buffer
+	args := []string{"-config", config, "-format", "csv"}
+	if err := Import(args, strings.NewReader(input), &out); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var archive bytes.Buffer
+	if err := Backup([]string{"-config", config}, nil, &archive); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// A running server hands out the same snapshot.
+	h, err := openHandler(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(h.AdminBackup))
+	var online bytes.Buffer
+	err = Backup([]string{"-server", srv.URL}, nil, &online)
+	srv.Close()
+	h.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if online.Len() == 0 {
+		t.Fatalf("expected a backup from the server")
+	}
+
+	// Restore into a second data directory.
+	restored, cleanupRestored := tempConfig(t)
+	defer cleanupRestored()
+
+	err = Restore([]string{"-config", restored}, bytes.NewReader(online.Bytes()), &out)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	out.Reset()
+	if err := Export([]string{"-config", restored, "-format", "csv"}, nil, &out); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if out.String() != input {
+		t.Fatalf("expected `%s`, got `%s`", input, out.String())
+	}
+
+	// Restoring over existing shards is refused.
+	err = Restore([]string{"-config", restored}, bytes.NewReader(archive.Bytes()), &out)
+	if err == nil {
+		t.Fatalf("expected an error restoring over existing shards")
+	}
+}
+
+// Ensure a backup taking longer than the server's write timeout
+// still arrives whole.
+func TestBackup_WriteTimeout(t *testing.T) {
+	config, cleanup := tempConfig(t)
+	defer cleanup()
+
+	input := "customer,item,qty\n1,7,2\n"
+	var out bytes.Buffer
+	args := []string{"-config", config, "-format", "csv"}
+	if err := Import(args, strings.NewReader(input), &out); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	h, err := openHandler(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer h.Close()
+
+	// The backup starts writing after the timeout has passed.
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		h.AdminBackup(w, r)
+	}))
+	srv.Config.WriteTimeout = 20 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	var online bytes.Buffer
+	if err := Backup([]string{"-server", srv.URL}, nil, &online); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	gr, err := gzip.NewReader(&online)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tr := tar.NewReader(gr)
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("expected a whole archive, got %s", err)
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			t.Fatalf("expected a whole archive, got %s", err)
+		}
+	}
+}
+
+// Ensure archives with anything but valid shards are refused
+// without touching the shards directory.
+func TestRestore_Invalid(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		data string
+	}{
+		{"../customer-1.db", "x"},
+		{"notes.txt", "x"},
+		{"customer-5000.db", "x"},
+		{"customer-1.db", "not a bolt file"},
+		{"manifest.json", `{"shards":7}`},
+	} {
+		config, cleanup := tempConfig(t)
+
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		tw.WriteHeader(&tar.Header{Name: tt.name, Mode: 0600, Size: int64(len(tt.data))})
+		tw.Write([]byte(tt.data))
+		tw.Close()
+		gw.Close()
+
+		var out bytes.Buffer
+		if err := Restore([]string{"-config", config}, &buf, &out); err == nil {
+			t.Fatalf("%s: expected an error", tt.name)
+		}
+
+		// Not even the temporary directory is left behind.
+		dir := filepath.Join(filepath.Dir(config), "shards")
+		names, _ := ioutil.ReadDir(dir)
+		if len(names) != 0 {
+			t.Fatalf("%s: expected an empty shards directory, got %v", tt.name, names)
+		}
+		cleanup()
+	}
+}
+
+// Ensure the journal brings a restored backup up to the given time,
+// but no further.
+func TestRestore_Journal(t *testing.T) {
+	config, cleanup := tempConfig(t)
+	defer cleanup()
+	f, err := os.OpenFile(config, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f.WriteString("journal = true\n")
+	f.Close()
+
+	var out bytes.Buffer
+	load := func(input string) {
+		args := []string{"-config", config, "-format", "csv"}
+		if err := Import(args, strings.NewReader(input), &out); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	load("customer,item,qty\n1,7,2\n")
+	var archive bytes.Buffer
+	if err := Backup([]string{"-config", config}, nil, &archive); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	load("customer,item,qty\n1,7,1\n2,8,1\n")
+	until := time.Now().UTC()
+	time.Sleep(10 * time.Millisecond)
+	load("customer,item,qty\n3,9,1\n")
+
+	restored, cleanupRestored := tempConfig(t)
+	defer cleanupRestored()
+
+	journal := filepath.Join(filepath.Dir(config), "shards", "journal.log")
+	args := []string{"-config", restored, "-journal", journal, "-until", until.Format(time.RFC3339Nano)}
+	if err := Restore(args, bytes.NewReader(archive.Bytes()), &out); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	out.Reset()
+	if err := Export([]string{"-config", restored, "-format", "csv"}, nil, &out); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := "customer,item,qty\n1,7,3\n2,8,1\n"
+	if out.String() != expected {
+		t.Fatalf("expected `%s`, got `%s`", expected, out.String())
+	}
+
+	out.Reset()
+	if err := Check([]string{"-config", restored}, nil, &out); err != nil {
+		t.Fatalf("unexpected error: %s: %s", err, out.String())
+	}
+}
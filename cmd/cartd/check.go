@@ -0,0 +1,72 @@
+package main
+
+import (
+	"cart"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// Check parses the check subcommand's arguments, verifies the
+// integrity of every shard and the consistency between the
+// customer and the item index, and reports every problem found.
+// It can also repair the item index from the customer index.
+func Check(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	config := fs.String("config", "", "Path to the configuration file.")
+	repair := fs.Bool("repair", false, "Fix every mismatch in the item index.")
+	rebuild := fs.Bool("rebuild", false, "Rebuild the item index from scratch.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *repair && *rebuild {
+		return fmt.Errorf("-repair and -rebuild are mutually exclusive")
+	}
+
+	h, err := openHandler(*config)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	// The customer index is the source of truth, it doesn't
+	// matter what shape the item index is in.
+	if *rebuild {
+		if err := h.RebuildItemIndex(); err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, "Rebuilt the item index")
+	}
+
+	// A corrupt shard makes the consistency check meaningless.
+	if err := h.Check(); err != nil {
+		fmt.Fprintln(stdout, err)
+		return fmt.Errorf("shard integrity check failed")
+	}
+	fmt.Fprintln(stdout, "Shard integrity OK")
+
+	n := 0
+	report := func(m cart.Mismatch) error {
+		n++
+		fmt.Fprintln(stdout, m)
+		return nil
+	}
+	if *repair {
+		err = h.Repair(report)
+	} else {
+		err = h.Verify(report)
+	}
+	if err != nil {
+		return err
+	}
+
+	if n > 0 && *repair {
+		fmt.Fprintf(stdout, "Repaired %d mismatches in the item index\n", n)
+		return nil
+	}
+	if n > 0 {
+		return fmt.Errorf("found %d mismatches between the indexes", n)
+	}
+	fmt.Fprintln(stdout, "Index consistency OK")
+	return nil
+}
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"cart"
+	"cart/cartpb"
+	"encoding"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"google.golang.org/grpc"
+)
+
+const (
+	// DefaultPort represents the default port the server runs on
+	DefaultPort = 8097
+
+	// DefaultBindAddress represents the ip address the server binds to
+	DefaultBindAddress = "0.0.0.0"
+
+	// DefaultBackend is the only storage backend available
+	DefaultBackend = "bolt"
+
+	// DefaultReadTimeout, DefaultWriteTimeout and DefaultIdleTimeout
+	// bound how long a single connection may take
+	DefaultReadTimeout  = 10 * time.Second
+	DefaultWriteTimeout = 10 * time.Second
+	DefaultIdleTimeout  = 2 * time.Minute
+
+	// DefaultShutdownTimeout is how long in-flight requests get to
+	// finish once the server is asked to stop.
+	DefaultShutdownTimeout = 30 * time.Second
+
+	// DefaultMaxBodyBytes limits the size of request bodies
+	DefaultMaxBodyBytes = 1 << 20
+
+	// DefaultGRPCMaxMessageBytes limits the size of gRPC requests
+	DefaultGRPCMaxMessageBytes = 4 << 20
+
+	// DefaultWebhookTimeout, DefaultWebhookMinBackoff and
+	// DefaultWebhookMaxBackoff apply to webhooks that leave them out
+	DefaultWebhookTimeout    = 10 * time.Second
+	DefaultWebhookMinBackoff = time.Second
+	DefaultWebhookMaxBackoff = 5 * time.Minute
+
+	// DefaultSweepInterval is how often expired items are looked for
+	DefaultSweepInterval = time.Minute
+
+	// DefaultFollowWait, DefaultFollowMinBackoff and
+	// DefaultFollowMaxBackoff apply to followers that leave them out
+	DefaultFollowWait       = 30 * time.Second
+	DefaultFollowMinBackoff = time.Second
+	DefaultFollowMaxBackoff = time.Minute
+
+	// DefaultRaftHeartbeatTimeout, DefaultRaftElectionTimeout and
+	// DefaultRaftApplyTimeout bound how long raft members wait
+	DefaultRaftHeartbeatTimeout = time.Second
+	DefaultRaftElectionTimeout  = time.Second
+	DefaultRaftApplyTimeout     = 5 * time.Second
+
+	// DefaultRaftSnapshotInterval and DefaultRaftSnapshotThreshold
+	// decide when raft members take snapshots
+	DefaultRaftSnapshotInterval  = 2 * time.Minute
+	DefaultRaftSnapshotThreshold = 8192
+
+	// EnvPrefix is the prefix of the environment variables that
+	// override configuration fields.
+	EnvPrefix = "CARTD"
+)
+
+// Config represents the configuration format.
+type Config struct {
+	BindAddress string `toml:"bind-address"`
+	Port        int    `toml:"port"`
+
+	Storage StorageConfig `toml:"storage"`
+	Locking LockingConfig `toml:"locking"`
+	HTTP    HTTPConfig    `toml:"http"`
+	GRPC    GRPCConfig    `toml:"grpc"`
+	Expiry  ExpiryConfig  `toml:"expiry"`
+	Cluster ClusterConfig `toml:"cluster"`
+	Follow  FollowConfig  `toml:"follow"`
+	Raft    RaftConfig    `toml:"raft"`
+
+	Webhooks []WebhookConfig `toml:"webhook"`
+}
+
+// StorageConfig represents where and how the shards are stored.
+type StorageConfig struct {
+	DataDir          string   `toml:"data-dir"`
+	ShardCount       int      `toml:"shard-count"`
+	ShardMapping     string   `toml:"shard-mapping"`
+	IDs              string   `toml:"ids"`
+	Backend          string   `toml:"backend"`
+	MaxOpenShards    int      `toml:"max-open-shards"`
+	ShardIdleTimeout Duration `toml:"shard-idle-timeout"`
+	Journal          bool     `toml:"journal"`
+
+	Customer DurabilityConfig `toml:"customer"`
+	Item     DurabilityConfig `toml:"item"`
+}
+
+// DurabilityConfig represents the durability settings of one storage.
+type DurabilityConfig struct {
+	Fsync         string   `toml:"fsync"`
+	FsyncInterval Duration `toml:"fsync-interval"`
+	NoGrowSync    bool     `toml:"no-grow-sync"`
+}
+
+// LockingConfig represents how requests wait for shard locks.
+type LockingConfig struct {
+	Mode    string   `toml:"mode"`
+	Timeout Duration `toml:"timeout"`
+}
+
+// ClusterConfig represents the cluster the server is a node of.
+// Without a membership file, the server owns every shard itself.
+type ClusterConfig struct {
+	Membership string   `toml:"membership"`
+	Node       string   `toml:"node"`
+	Timeout    Duration `toml:"timeout"`
+}
+
+// Cluster loads the membership file, if any.
+func (c ClusterConfig) Cluster() (*cart.Cluster, error) {
+	if c.Membership == "" {
+		if c.Node != "" {
+			return nil, fmt.Errorf("node requires a membership file")
+		}
+		return nil, nil
+	}
+
+	cluster, err := cart.LoadCluster(c.Membership)
+	if err != nil {
+		return nil, err
+	}
+	cluster.Self = c.Node
+	cluster.Timeout = time.Duration(c.Timeout)
+	return cluster, nil
+}
+
+// FollowConfig represents the leader a read-only follower
+// replicates.  Without a leader, the server is a leader itself.
+type FollowConfig struct {
+	Leader     string   `toml:"leader"`
+	Wait       Duration `toml:"wait"`
+	MinBackoff Duration `toml:"min-backoff"`
+	MaxBackoff Duration `toml:"max-backoff"`
+}
+
+// Follow converts the configuration into follower settings, nil
+// without a leader.
+func (c FollowConfig) Follow() *cart.Follow {
+	if c.Leader == "" {
+		return nil
+	}
+	return &cart.Follow{
+		Leader:     c.Leader,
+		Wait:       time.Duration(c.Wait),
+		MinBackoff: time.Duration(c.MinBackoff),
+		MaxBackoff: time.Duration(c.MaxBackoff),
+	}
+}
+
+// RaftConfig represents the raft group the server is a member of.
+// Without an id, the server is not a member of any.
+type RaftConfig struct {
+	ID        string `toml:"id"`
+	Bind      string `toml:"bind"`
+	Advertise string `toml:"advertise"`
+	URL       string `toml:"url"`
+	// Every member as id=address, this one included.
+	Peers []string `toml:"peers"`
+
+	HeartbeatTimeout  Duration `toml:"heartbeat-timeout"`
+	ElectionTimeout   Duration `toml:"election-timeout"`
+	ApplyTimeout      Duration `toml:"apply-timeout"`
+	SnapshotInterval  Duration `toml:"snapshot-interval"`
+	SnapshotThreshold int      `toml:"snapshot-threshold"`
+	TrailingLogs      int      `toml:"trailing-logs"`
+}
+
+// Raft converts the configuration into raft settings, nil without
+// an id.
+func (c RaftConfig) Raft() (*cart.Raft, error) {
+	if c.ID == "" {
+		return nil, nil
+	}
+	if c.SnapshotThreshold < 0 || c.TrailingLogs < 0 {
+		return nil, fmt.Errorf("snapshot-threshold and trailing-logs must not be negative")
+	}
+
+	r := &cart.Raft{
+		ID:                c.ID,
+		Bind:              c.Bind,
+		Advertise:         c.Advertise,
+		URL:               c.URL,
+		HeartbeatTimeout:  time.Duration(c.HeartbeatTimeout),
+		ElectionTimeout:   time.Duration(c.ElectionTimeout),
+		ApplyTimeout:      time.Duration(c.ApplyTimeout),
+		SnapshotInterval:  time.Duration(c.SnapshotInterval),
+		SnapshotThreshold: uint64(c.SnapshotThreshold),
+		TrailingLogs:      uint64(c.TrailingLogs),
+	}
+	for _, peer := range c.Peers {
+		i := strings.Index(peer, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("peer %q is not id=address", peer)
+		}
+		r.Peers = append(r.Peers, cart.RaftPeer{ID: peer[:i], Address: peer[i+1:]})
+	}
+	return r, nil
+}
+
+// ExpiryConfig represents when items and carts expire.
+type ExpiryConfig struct {
+	ItemTTL       Duration `toml:"item-ttl"`
+	CartTTL       Duration `toml:"cart-ttl"`
+	SweepInterval Duration `toml:"sweep-interval"`
+}
+
+// HTTPConfig represents the HTTP server limits.
+type HTTPConfig struct {
+	ReadTimeout     Duration `toml:"read-timeout"`
+	WriteTimeout    Duration `toml:"write-timeout"`
+	IdleTimeout     Duration `toml:"idle-timeout"`
+	ShutdownTimeout Duration `toml:"shutdown-timeout"`
+	MaxHeaderBytes  int      `toml:"max-header-bytes"`
+	MaxBodyBytes    int64    `toml:"max-body-bytes"`
+}
+
+// GRPCConfig represents the gRPC server, running next to the HTTP
+// server on the same bind address.  Without a port it is off.
+type GRPCConfig struct {
+	Port            int `toml:"port"`
+	MaxMessageBytes int `toml:"max-message-bytes"`
+}
+
+// WebhookConfig represents a URL notified of cart changes.
+type WebhookConfig struct {
+	Name        string   `toml:"name"`
+	URL         string   `toml:"url"`
+	Secret      string   `toml:"secret"`
+	Events      []string `toml:"events"`
+	Timeout     Duration `toml:"timeout"`
+	MinBackoff  Duration `toml:"min-backoff"`
+	MaxBackoff  Duration `toml:"max-backoff"`
+	MaxAttempts int      `toml:"max-attempts"`
+}
+
+// Webhook converts the configuration into a webhook, filling in
+// the defaults.
+func (c WebhookConfig) Webhook() cart.Webhook {
+	w := cart.Webhook{
+		Name:        c.Name,
+		URL:         c.URL,
+		Secret:      c.Secret,
+		Events:      c.Events,
+		Timeout:     time.Duration(c.Timeout),
+		MinBackoff:  time.Duration(c.MinBackoff),
+		MaxBackoff:  time.Duration(c.MaxBackoff),
+		MaxAttempts: c.MaxAttempts,
+	}
+	if w.Timeout == 0 {
+		w.Timeout = DefaultWebhookTimeout
+	}
+	if w.MinBackoff == 0 {
+		w.MinBackoff = DefaultWebhookMinBackoff
+	}
+	if w.MaxBackoff == 0 {
+		w.MaxBackoff = DefaultWebhookMaxBackoff
+	}
+	return w
+}
+
+// Duration is a time.Duration that can be decoded from a TOML string.
+type Duration time.Duration
+
+// UnmarshalText parses a duration such as "1s" or "500ms".
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// NewConfig returns an instance of Config with default values
+func NewConfig() (*Config, error) {
+	c := &Config{}
+	c.BindAddress = DefaultBindAddress
+	c.Port = DefaultPort
+
+	c.Storage.DataDir = cart.ShardDirPath
+	c.Storage.ShardCount = cart.NShards
+	c.Storage.ShardMapping = cart.ModuloMapping.String()
+	c.Storage.IDs = cart.NumericIDs.String()
+	c.Storage.Backend = DefaultBackend
+	c.Storage.Customer.Fsync = "always"
+	c.Storage.Item.Fsync = "always"
+
+	c.Locking.Mode = "try"
+
+	c.Expiry.SweepInterval = Duration(DefaultSweepInterval)
+
+	c.Cluster.Timeout = Duration(cart.DefaultClusterTimeout)
+
+	c.Follow.Wait = Duration(DefaultFollowWait)
+	c.Follow.MinBackoff = Duration(DefaultFollowMinBackoff)
+	c.Follow.MaxBackoff = Duration(DefaultFollowMaxBackoff)
+
+	c.Raft.HeartbeatTimeout = Duration(DefaultRaftHeartbeatTimeout)
+	c.Raft.ElectionTimeout = Duration(DefaultRaftElectionTimeout)
+	c.Raft.ApplyTimeout = Duration(DefaultRaftApplyTimeout)
+	c.Raft.SnapshotInterval = Duration(DefaultRaftSnapshotInterval)
+	c.Raft.SnapshotThreshold = DefaultRaftSnapshotThreshold
+
+	c.HTTP.ReadTimeout = Duration(DefaultReadTimeout)
+	c.HTTP.WriteTimeout = Duration(DefaultWriteTimeout)
+	c.HTTP.IdleTimeout = Duration(DefaultIdleTimeout)
+	c.HTTP.ShutdownTimeout = Duration(DefaultShutdownTimeout)
+	c.HTTP.MaxHeaderBytes = http.DefaultMaxHeaderBytes
+	c.HTTP.MaxBodyBytes = DefaultMaxBodyBytes
+
+	c.GRPC.MaxMessageBytes = DefaultGRPCMaxMessageBytes
+
+	return c, nil
+}
+
+// Validate returns an error if the configuration is invalid.
+func (c *Config) Validate() error {
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("port: %d is out of range", c.Port)
+	}
+	if c.Storage.Backend != DefaultBackend {
+		return fmt.Errorf("storage.backend: unsupported backend %q, only %q is available",
+			c.Storage.Backend, DefaultBackend)
+	}
+	if c.Storage.MaxOpenShards > c.Storage.ShardCount {
+		return fmt.Errorf("storage.max-open-shards: %d exceeds storage.shard-count %d",
+			c.Storage.MaxOpenShards, c.Storage.ShardCount)
+	}
+	if err := c.Storage.Customer.Validate(); err != nil {
+		return fmt.Errorf("storage.customer: %v", err)
+	}
+	if err := c.Storage.Item.Validate(); err != nil {
+		return fmt.Errorf("storage.item: %v", err)
+	}
+	if err := c.HTTP.Validate(); err != nil {
+		return fmt.Errorf("http: %v", err)
+	}
+	if err := c.GRPC.Validate(); err != nil {
+		return fmt.Errorf("grpc: %v", err)
+	}
+	if c.GRPC.Port == c.Port {
+		return fmt.Errorf("grpc.port: %d is the HTTP port", c.Port)
+	}
+
+	// The remaining combinations are checked by the handler itself.
+	if _, err := c.Options(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Validate returns an error if the durability settings are invalid.
+func (c DurabilityConfig) Validate() error {
+	if c.FsyncInterval != 0 && c.Fsync != "interval" {
+		return fmt.Errorf("fsync-interval requires fsync = \"interval\"")
+	}
+	return nil
+}
+
+// Validate returns an error if the HTTP settings are invalid.
+func (c HTTPConfig) Validate() error {
+	for _, d := range []struct {
+		name  string
+		value Duration
+	}{
+		{"read-timeout", c.ReadTimeout},
+		{"write-timeout", c.WriteTimeout},
+		{"idle-timeout", c.IdleTimeout},
+		{"shutdown-timeout", c.ShutdownTimeout},
+	} {
+		if d.value < 0 {
+			return fmt.Errorf("%v must not be negative", d.name)
+		}
+	}
+	if c.MaxHeaderBytes <= 0 {
+		return fmt.Errorf("max-header-bytes must be positive")
+	}
+	if c.MaxBodyBytes <= 0 {
+		return fmt.Errorf("max-body-bytes must be positive")
+	}
+	return nil
+}
+
+// Validate returns an error if the gRPC settings are invalid.
+func (c GRPCConfig) Validate() error {
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("port: %d is out of range", c.Port)
+	}
+	if c.MaxMessageBytes <= 0 {
+		return fmt.Errorf("max-message-bytes must be positive")
+	}
+	return nil
+}
+
+// Durability converts the configuration into storage settings.
+func (c DurabilityConfig) Durability() (cart.Durability, error) {
+	mode, err := cart.ParseFsyncMode(c.Fsync)
+	if err != nil {
+		return cart.Durability{}, err
+	}
+	return cart.Durability{
+		Fsync:        mode,
+		SyncInterval: time.Duration(c.FsyncInterval),
+		NoGrowSync:   c.NoGrowSync,
+	}, nil
+}
+
+// Options converts the configuration into validated handler options.
+func (c *Config) Options() (cart.Options, error) {
+	o := cart.DefaultOptions()
+	o.Dir = c.Storage.DataDir
+	o.Shards = c.Storage.ShardCount
+	o.MaxOpenShards = c.Storage.MaxOpenShards
+	o.ShardIdleTimeout = time.Duration(c.Storage.ShardIdleTimeout)
+	o.Journal = c.Storage.Journal
+
+	var err error
+	if o.Mapping, err = cart.ParseShardMapping(c.Storage.ShardMapping); err != nil {
+		return o, fmt.Errorf("storage.shard-mapping: %v", err)
+	}
+	if o.IDs, err = cart.ParseIDMode(c.Storage.IDs); err != nil {
+		return o, fmt.Errorf("storage.ids: %v", err)
+	}
+	if o.CustomerDurability, err = c.Storage.Customer.Durability(); err != nil {
+		return o, fmt.Errorf("storage.customer: %v", err)
+	}
+	if o.ItemDurability, err = c.Storage.Item.Durability(); err != nil {
+		return o, fmt.Errorf("storage.item: %v", err)
+	}
+	if o.LockMode, err = cart.ParseLockMode(c.Locking.Mode); err != nil {
+		return o, fmt.Errorf("locking.mode: %v", err)
+	}
+	o.LockTimeout = time.Duration(c.Locking.Timeout)
+
+	o.Expiry = cart.Expiry{
+		ItemTTL:       time.Duration(c.Expiry.ItemTTL),
+		CartTTL:       time.Duration(c.Expiry.CartTTL),
+		SweepInterval: time.Duration(c.Expiry.SweepInterval),
+	}
+
+	for _, w := range c.Webhooks {
+		o.Webhooks = append(o.Webhooks, w.Webhook())
+	}
+
+	if o.Cluster, err = c.Cluster.Cluster(); err != nil {
+		return o, fmt.Errorf("cluster: %v", err)
+	}
+	o.Follow = c.Follow.Follow()
+	if o.Raft, err = c.Raft.Raft(); err != nil {
+		return o, fmt.Errorf("raft: %v", err)
+	}
+
+	if err := o.Validate(); err != nil {
+		return o, err
+	}
+	return o, nil
+}
+
+// Server returns an HTTP server configured with the HTTP settings.
+func (c *Config) Server(h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:           c.Address(),
+		Handler:        maxBody(h, c.HTTP.MaxBodyBytes),
+		ReadTimeout:    time.Duration(c.HTTP.ReadTimeout),
+		WriteTimeout:   time.Duration(c.HTTP.WriteTimeout),
+		IdleTimeout:    time.Duration(c.HTTP.IdleTimeout),
+		MaxHeaderBytes: c.HTTP.MaxHeaderBytes,
+	}
+}
+
+// GRPCServer returns a gRPC server serving the cart API of the
+// handler, configured with the gRPC settings.  Return nil if the
+// gRPC server is off.
+func (c *Config) GRPCServer(h *cart.Handler) *grpc.Server {
+	if c.GRPC.Port == 0 {
+		return nil
+	}
+	s := grpc.NewServer(grpc.MaxRecvMsgSize(c.GRPC.MaxMessageBytes))
+	cartpb.RegisterCartServer(s, cart.NewGRPCServer(h))
+	return s
+}
+
+// Limit the size of every request body to n bytes.
+func maxBody(h http.Handler, n int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ParseConfigFile parses a configuration file at a given path.
+// An empty path or a missing file leaves the default values in
+// place.  Environment variables override the file either way.
+func ParseConfigFile(path string) (*Config, error) {
+	c, err := NewConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "No configuration file given, using defaults")
+	} else if _, err := os.Stat(path); os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "Configuration file", path, "not found, using defaults")
+	} else if _, err := toml.DecodeFile(path, c); err != nil {
+		return nil, err
+	}
+
+	if err := c.ApplyEnvOverrides(os.Getenv); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ApplyEnvOverrides overrides every configuration field that has a
+// matching environment variable.  The variable name is EnvPrefix
+// followed by the field's TOML path, upper-cased, with dashes and
+// dots replaced by underscores, e.g. CARTD_STORAGE_CUSTOMER_FSYNC.
+// Lists are comma-separated, e.g. CARTD_RAFT_PEERS.  Tables of
+// arrays are indexed from 0, e.g. CARTD_WEBHOOK_0_URL; an index past
+// the configured ones adds a table.
+func (c *Config) ApplyEnvOverrides(getenv func(string) string) error {
+	return applyEnvOverrides(getenv, EnvPrefix, reflect.ValueOf(c).Elem())
+}
+
+// Walk the struct fields recursively, setting the leaves from
+// the environment.
+func applyEnvOverrides(getenv func(string) string, prefix string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		tag := t.Field(i).Tag.Get("toml")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		key := prefix + "_" + strings.ToUpper(strings.Replace(tag, "-", "_", -1))
+
+		// Nested sections, unless the type knows how to parse itself.
+		_, isText := f.Addr().Interface().(encoding.TextUnmarshaler)
+		if f.Kind() == reflect.Struct && !isText {
+			if err := applyEnvOverrides(getenv, key, f); err != nil {
+				return err
+			}
+			continue
+		}
+		if f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Struct {
+			if err := applyEnvOverridesList(getenv, key, f); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value := getenv(key)
+		if value == "" {
+			continue
+		}
+		if err := setField(f, value); err != nil {
+			return fmt.Errorf("%v: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// Walk the sections of a table array one index after the other,
+// adding a section for the index past the last one as long as any
+// of its variables is set.
+func applyEnvOverridesList(getenv func(string) string, prefix string, f reflect.Value) error {
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("%v_%v", prefix, i)
+		if i < f.Len() {
+			if err := applyEnvOverrides(getenv, key, f.Index(i)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		elem := reflect.New(f.Type().Elem()).Elem()
+		if err := applyEnvOverrides(getenv, key, elem); err != nil {
+			return err
+		}
+		if elem.IsZero() {
+			return nil
+		}
+		f.Set(reflect.Append(f, elem))
+	}
+}
+
+// Parse the string value into the field according to its type.
+func setField(f reflect.Value, value string) error {
+	if u, ok := f.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 0, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Slice:
+		// Lists of strings are comma-separated.
+		if f.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %v", f.Type())
+		}
+		f.Set(reflect.ValueOf(strings.Split(value, ",")).Convert(f.Type()))
+	default:
+		return fmt.Errorf("unsupported type %v", f.Type())
+	}
+	return nil
+}
+
+// Address returns the concatenated IP address and port
+func (c *Config) Address() string {
+	return c.BindAddress + ":" + strconv.Itoa(c.Port)
+}
+
+// GRPCAddress returns the address the gRPC server listens on.
+func (c *Config) GRPCAddress() string {
+	return c.BindAddress + ":" + strconv.Itoa(c.GRPC.Port)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"cart"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Ensure the sample configuration file parses.
+func TestParseConfigFile_Sample(t *testing.T) {
+	c, err := ParseConfigFile("cart.sample.toml")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if c.Address() != "0.0.0.0:8097" {
+		t.Fatalf("unexpected address: %s", c.Address())
+	} else if c.Storage.Item.Fsync != "interval" {
+		t.Fatalf("unexpected item fsync: %s", c.Storage.Item.Fsync)
+	} else if time.Duration(c.Storage.ShardIdleTimeout) != 10*time.Minute {
+		t.Fatalf("unexpected idle timeout: %v", c.Storage.ShardIdleTimeout)
+	}
+}
+
+// Ensure a missing configuration file falls back to the defaults.
+func TestParseConfigFile_Missing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cartd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := ParseConfigFile(filepath.Join(dir, "missing.toml"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if c.Port != DefaultPort {
+		t.Fatalf("expected port %d, got %d", DefaultPort, c.Port)
+	}
+}
+
+// Ensure environment variables override every kind of field.
+func TestConfig_ApplyEnvOverrides(t *testing.T) {
+	env := map[string]string{
+		"CARTD_PORT":                       "9000",
+		"CARTD_BIND_ADDRESS":               "127.0.0.1",
+		"CARTD_STORAGE_SHARD_IDLE_TIMEOUT": "30s",
+		"CARTD_STORAGE_CUSTOMER_FSYNC":     "never",
+		"CARTD_STORAGE_ITEM_NO_GROW_SYNC":  "true",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	c, _ := NewConfig()
+	if err := c.ApplyEnvOverrides(getenv); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if c.Address() != "127.0.0.1:9000" {
+		t.Fatalf("unexpected address: %s", c.Address())
+	} else if time.Duration(c.Storage.ShardIdleTimeout) != 30*time.Second {
+		t.Fatalf("unexpected idle timeout: %v", c.Storage.ShardIdleTimeout)
+	} else if c.Storage.Customer.Fsync != "never" {
+		t.Fatalf("unexpected customer fsync: %s", c.Storage.Customer.Fsync)
+	} else if !c.Storage.Item.NoGrowSync {
+		t.Fatalf("expected item no-grow-sync to be set")
+	}
+
+	env["CARTD_PORT"] = "nope"
+	if err := c.ApplyEnvOverrides(getenv); err == nil {
+		t.Fatalf("expected an error for an invalid port")
+	}
+}
+
+// Ensure webhooks are overridden and added by index.
+func TestConfig_ApplyEnvOverridesWebhooks(t *testing.T) {
+	env := map[string]string{
+		"CARTD_WEBHOOK_0_SECRET": "s3cret",
+		"CARTD_WEBHOOK_1_NAME":   "crm",
+		"CARTD_WEBHOOK_1_URL":    "http://localhost:9001/cart",
+		"CARTD_WEBHOOK_1_EVENTS": "item.added,cart.emptied",
+		"CARTD_WEBHOOK_3_NAME":   "skipped",
+	}
+	c, _ := NewConfig()
+	c.Webhooks = []WebhookConfig{{Name: "shop", URL: "http://localhost:9000/cart"}}
+	if err := c.ApplyEnvOverrides(func(key string) string { return env[key] }); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []WebhookConfig{
+		{Name: "shop", URL: "http://localhost:9000/cart", Secret: "s3cret"},
+		{Name: "crm", URL: "http://localhost:9001/cart", Events: []string{"item.added", "cart.emptied"}},
+	}
+	if !reflect.DeepEqual(c.Webhooks, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, c.Webhooks)
+	}
+}
+
+// Ensure invalid combinations of settings are refused.
+func TestConfig_Validate(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		modify func(c *Config)
+	}{
+		{"port", func(c *Config) { c.Port = 70000 }},
+		{"backend", func(c *Config) { c.Storage.Backend = "leveldb" }},
+		{"shard count", func(c *Config) { c.Storage.ShardCount = 0 }},
+		{"data dir", func(c *Config) { c.Storage.DataDir = "" }},
+		{"max open shards", func(c *Config) { c.Storage.MaxOpenShards = 2048 }},
+		{"fsync mode", func(c *Config) { c.Storage.Item.Fsync = "sometimes" }},
+		{"fsync interval without interval mode", func(c *Config) {
+			c.Storage.Customer.FsyncInterval = Duration(time.Second)
+		}},
+		{"interval mode without interval", func(c *Config) {
+			c.Storage.Customer.Fsync = "interval"
+		}},
+		{"lock mode", func(c *Config) { c.Locking.Mode = "block" }},
+		{"lock timeout without wait mode", func(c *Config) {
+			c.Locking.Timeout = Duration(time.Second)
+		}},
+		{"wait mode without timeout", func(c *Config) { c.Locking.Mode = "wait" }},
+		{"negative read timeout", func(c *Config) {
+			c.HTTP.ReadTimeout = Duration(-time.Second)
+		}},
+		{"max body bytes", func(c *Config) { c.HTTP.MaxBodyBytes = 0 }},
+		{"grpc port", func(c *Config) { c.GRPC.Port = 70000 }},
+		{"grpc on the http port", func(c *Config) { c.GRPC.Port = c.Port }},
+		{"grpc max message bytes", func(c *Config) { c.GRPC.MaxMessageBytes = 0 }},
+		{"webhook url", func(c *Config) {
+			c.Webhooks = []WebhookConfig{{Name: "shop", URL: "ftp://localhost"}}
+		}},
+		{"webhook event", func(c *Config) {
+			c.Webhooks = []WebhookConfig{{Name: "shop", URL: "http://localhost", Events: []string{"cart.paid"}}}
+		}},
+		{"webhooks without journal", func(c *Config) {
+			c.Storage.Journal = false
+			c.Webhooks = []WebhookConfig{{Name: "shop", URL: "http://localhost"}}
+		}},
+		{"id mode", func(c *Config) { c.Storage.IDs = "uuid" }},
+		{"shard mapping", func(c *Config) { c.Storage.ShardMapping = "ring" }},
+		{"cluster node without membership", func(c *Config) { c.Cluster.Node = "a" }},
+		{"cluster node not a member", func(c *Config) {
+			c.Cluster.Membership = "cluster.sample.json"
+			c.Cluster.Node = "c"
+		}},
+		{"cluster membership with other shards", func(c *Config) {
+			c.Cluster.Membership = "cluster.sample.json"
+			c.Cluster.Node = "a"
+			c.Storage.ShardCount = 512
+			c.Storage.MaxOpenShards = 0
+		}},
+		{"raft peer", func(c *Config) {
+			c.Raft = RaftConfig{ID: "a", Bind: "127.0.0.1:7097", URL: "http://127.0.0.1:8097",
+				Peers: []string{"a"}}
+		}},
+		{"raft without url", func(c *Config) { c.Raft.ID = "a"; c.Raft.Bind = "127.0.0.1:7097" }},
+		{"raft with follow", func(c *Config) {
+			c.Raft = RaftConfig{ID: "a", Bind: "127.0.0.1:7097", URL: "http://127.0.0.1:8097"}
+			c.Follow.Leader = "http://10.0.0.1:8097"
+		}},
+	} {
+		c, _ := NewConfig()
+		if err := c.Validate(); err != nil {
+			t.Fatalf("%s: unexpected error for the defaults: %s", tt.name, err)
+		}
+
+		tt.modify(c)
+		if err := c.Validate(); err == nil {
+			t.Fatalf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+// Ensure the sample membership file makes a valid cluster.
+func TestConfig_Cluster(t *testing.T) {
+	c, _ := NewConfig()
+	c.Cluster.Membership = "cluster.sample.json"
+	c.Cluster.Node = "b"
+
+	o, err := c.Options()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(o.Cluster.Nodes) != 2 || o.Cluster.Self != "b" || o.Cluster.Timeout != cart.DefaultClusterTimeout {
+		t.Fatalf("unexpected cluster: %+v", o.Cluster)
+	}
+}
+
+// Ensure raft members are configured from the environment, peers
+// included.
+func TestConfig_Raft(t *testing.T) {
+	env := map[string]string{
+		"CARTD_RAFT_ID":    "b",
+		"CARTD_RAFT_BIND":  "127.0.0.1:7098",
+		"CARTD_RAFT_URL":   "http://127.0.0.1:8098",
+		"CARTD_RAFT_PEERS": "a=127.0.0.1:7097,b=127.0.0.1:7098",
+	}
+	c, _ := NewConfig()
+	if err := c.ApplyEnvOverrides(func(key string) string { return env[key] }); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	o, err := c.Options()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []cart.RaftPeer{{ID: "a", Address: "127.0.0.1:7097"}, {ID: "b", Address: "127.0.0.1:7098"}}
+	if o.Raft.ID != "b" || !reflect.DeepEqual(o.Raft.Peers, expected) ||
+		o.Raft.ApplyTimeout != DefaultRaftApplyTimeout {
+		t.Fatalf("unexpected raft settings: %+v", o.Raft)
+	}
+}
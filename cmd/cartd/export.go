@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"cart"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// A single cart line as written by export and read by import.
+type line struct {
+	Customer cart.ID `json:"customer"`
+	Item     cart.ID `json:"item"`
+	// The attributes of the variant of the item, if it is one.
+	Variant map[string]string `json:"variant,omitempty"`
+	Qty     uint32            `json:"qty"`
+}
+
+// The header of the CSV format.
+var csvHeader = []string{"customer", "item", "qty"}
+
+// Writes cart lines in one of the export formats.
+type lineWriter interface {
+	Write(l line) error
+	Flush() error
+}
+
+// Reads cart lines in one of the export formats.  Read returns
+// io.EOF once there are no more lines.
+type lineReader interface {
+	Read() (line, error)
+}
+
+// Given the -format flag and the file name, return the format
+// to use.  Without a flag, the file extension decides.
+func format(flag string, path string) (string, error) {
+	if flag == "" {
+		flag = "jsonl"
+		if filepath.Ext(path) == ".csv" {
+			flag = "csv"
+		}
+	}
+
+	switch flag {
+	case "jsonl", "csv":
+		return flag, nil
+	}
+	return "", fmt.Errorf("unknown format %q, expected jsonl or csv", flag)
+}
+
+// Return a writer of the given format.
+func newLineWriter(format string, w io.Writer) lineWriter {
+	bw := bufio.NewWriter(w)
+	if format == "csv" {
+		return &csvLineWriter{w: csv.NewWriter(bw)}
+	}
+	return &jsonLineWriter{w: bw, enc: json.NewEncoder(bw)}
+}
+
+// Return a reader of the given format.
+func newLineReader(format string, r io.Reader) lineReader {
+	br := bufio.NewReader(r)
+	if format == "csv" {
+		cr := csv.NewReader(br)
+		cr.FieldsPerRecord = len(csvHeader)
+		return &csvLineReader{r: cr}
+	}
+	return &jsonLineReader{dec: json.NewDecoder(br)}
+}
+
+// Writes a JSON object per line.
+type jsonLineWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (w *jsonLineWriter) Write(l line) error { return w.enc.Encode(l) }
+func (w *jsonLineWriter) Flush() error       { return w.w.Flush() }
+
+// Reads a JSON object per line.
+type jsonLineReader struct {
+	dec *json.Decoder
+}
+
+func (r *jsonLineReader) Read() (line, error) {
+	var l line
+	err := r.dec.Decode(&l)
+	return l, err
+}
+
+// Writes a header followed by a record per line.
+type csvLineWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func (w *csvLineWriter) Write(l line) error {
+	if len(l.Variant) > 0 {
+		return fmt.Errorf("customer %v item %v: variants can only be exported as jsonl",
+			l.Customer, l.Item)
+	}
+	if !w.header {
+		w.header = true
+		if err := w.w.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	return w.w.Write([]string{
+		l.Customer.Value,
+		l.Item.Value,
+		strconv.FormatUint(uint64(l.Qty), 10),
+	})
+}
+
+func (w *csvLineWriter) Flush() error {
+	// An empty export still gets its header.
+	if !w.header {
+		w.header = true
+		if err := w.w.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// Reads the records following the header.
+type csvLineReader struct {
+	r      *csv.Reader
+	header bool
+}
+
+func (r *csvLineReader) Read() (line, error) {
+	if !r.header {
+		r.header = true
+		record, err := r.r.Read()
+		if err != nil {
+			return line{}, err
+		}
+		for i := range csvHeader {
+			if record[i] != csvHeader[i] {
+				return line{}, fmt.Errorf("expected the header %v, got %v", csvHeader, record)
+			}
+		}
+	}
+
+	record, err := r.r.Read()
+	if err != nil {
+		return line{}, err
+	}
+
+	// The ids are checked on import.
+	qty, err := strconv.ParseUint(record[2], 10, 32)
+	if err != nil {
+		return line{}, fmt.Errorf("invalid %v %q", csvHeader[2], record[2])
+	}
+	return line{
+		Customer: cart.ID{Value: record[0]},
+		Item:     cart.ID{Value: record[1]},
+		Qty:      uint32(qty),
+	}, nil
+}
+
+// Export parses the export subcommand's arguments and streams every
+// cart line of the customer index as JSON Lines or CSV, to a file
+// or to stdout.
+func Export(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	config := fs.String("config", "", "Path to the configuration file.")
+	output := fs.String("o", "-", "File to write to, - for stdout.")
+	formatFlag := fs.String("format", "", "jsonl or csv, by default guessed from the file name.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	f, err := format(*formatFlag, *output)
+	if err != nil {
+		return err
+	}
+
+	h, err := openHandler(*config)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	w := stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	lw := newLineWriter(f, w)
+	ids := h.IDs()
+	err = h.ForEachLine(func(customer string, item cart.ItemKey, qty uint32) error {
+		return lw.Write(line{
+			Customer: ids.ID(customer),
+			Item:     ids.ID(item.SKU),
+			Variant:  item.Variant,
+			Qty:      qty,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return lw.Flush()
+}
+
+// Import parses the import subcommand's arguments and adds every
+// cart line read from a file or from stdin to both indexes, the
+// same way /add does.  Quantities add up with what is already
+// stored.
+func Import(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	config := fs.String("config", "", "Path to the configuration file.")
+	input := fs.String("i", "-", "File to read from, - for stdin.")
+	formatFlag := fs.String("format", "", "jsonl or csv, by default guessed from the file name.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	f, err := format(*formatFlag, *input)
+	if err != nil {
+		return err
+	}
+
+	c, err := ParseConfigFile(*config)
+	if err != nil {
+		return err
+	}
+	if err := refuseRaft(c); err != nil {
+		return err
+	}
+	h, err := openConfigHandler(c)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	r := stdin
+	if *input != "-" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	n := 0
+	lr := newLineReader(f, r)
+	for {
+		l, err := lr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("line %d: %v", n+1, err)
+		}
+
+		if err := importLine(h, l); err != nil {
+			return fmt.Errorf("line %d: %v", n+1, err)
+		}
+		n++
+	}
+
+	fmt.Fprintln(stdout, "Imported", n, "cart lines")
+	return nil
+}
+
+// Add the line to both indexes.
+func importLine(h *cart.Handler, l line) error {
+	ids := h.IDs()
+	customer, err := ids.Parse(l.Customer.Value)
+	if err != nil {
+		return fmt.Errorf("customer: %v", err)
+	}
+	sku, err := ids.Parse(l.Item.Value)
+	if err != nil {
+		return fmt.Errorf("item: %v", err)
+	}
+
+	item, err := h.ItemID(cart.ItemKey{SKU: sku, Variant: l.Variant})
+	if err != nil {
+		return err
+	}
+	return h.Apply(customer, item, cart.AddQtyToSet(l.Qty))
+}
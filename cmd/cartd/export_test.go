@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"cart"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write a configuration file keeping the shards in a fresh
+// temporary directory.  Return the path of the file and a
+// function removing everything.
+func tempConfig(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "cartd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	config := filepath.Join(dir, "cart.toml")
+	data := "[storage]\ndata-dir = \"" + filepath.Join(dir, "shards") + "\"\n"
+	if err := ioutil.WriteFile(config, []byte(data), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return config, func() { os.RemoveAll(dir) }
+}
+
+// Ensure exported lines can be imported, checked and counted.
+func TestExportImport(t *testing.T) {
+	config, cleanup := tempConfig(t)
+	defer cleanup()
+
+	input := `{"customer":1,"item":7,"qty":2}
+{"customer":1,"item":1031,"qty":1}
+{"customer":2,"item":7,"qty":3}
+`
+	var out bytes.Buffer
+	err := Import([]string{"-config", config}, strings.NewReader(input), &out)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	out.Reset()
+	if err := Export([]string{"-config", config}, nil, &out); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if out.String() != input {
+		t.Fatalf("expected `%s`, got `%s`", input, out.String())
+	}
+
+	out.Reset()
+	if err := Check([]string{"-config", config}, nil, &out); err != nil {
+		t.Fatalf("unexpected error: %s\n%s", err, out.String())
+	}
+
+	// Items 7 and 1031 share a shard.
+	out.Reset()
+	if err := Stats([]string{"-config", config, "-total"}, nil, &out); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `     index     shard  keys  entries  bytes
+  customer  2 shards     2        3  65536
+      item  1 shards     2        3  32768
+`
+	if out.String() != expected {
+		t.Fatalf("expected `%s`, got `%s`", expected, out.String())
+	}
+}
+
+// Ensure carts survive a round trip through CSV.
+func TestExportImport_CSV(t *testing.T) {
+	config, cleanup := tempConfig(t)
+	defer cleanup()
+
+	input := "customer,item,qty\n1,7,2\n1,1031,1\n2,7,3\n"
+	var out bytes.Buffer
+	args := []string{"-config", config, "-format", "csv"}
+	if err := Import(args, strings.NewReader(input), &out); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Importing again adds up the quantities.
+	if err := Import(args, strings.NewReader(input), &out); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	dir := filepath.Dir(config)
+	path := filepath.Join(dir, "carts.csv")
+	if err := Export([]string{"-config", config, "-o", path}, nil, &out); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := "customer,item,qty\n1,7,4\n1,1031,2\n2,7,6\n"
+	if string(data) != expected {
+		t.Fatalf("expected `%s`, got `%s`", expected, string(data))
+	}
+
+	// Malformed input is refused with its line number.
+	bad := "customer,item,qty\n1,7,x\n"
+	err = Import(args, strings.NewReader(bad), &out)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 1:") {
+		t.Fatalf("expected an error for line 1, got %v", err)
+	}
+}
+
+// Ensure the commands give up on shards a server holds on to instead
+// of dying.
+func TestExport_Locked(t *testing.T) {
+	config, cleanup := tempConfig(t)
+	defer cleanup()
+
+	input := `{"customer":1,"item":7,"qty":2}` + "\n"
+	var out bytes.Buffer
+	if err := Import([]string{"-config", config}, strings.NewReader(input), &out); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The server has every shard open.
+	h, err := openHandler(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer h.Close()
+	if _, err := h.Stats(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, cmd := range []command{Stats, Export} {
+		if err := cmd([]string{"-config", config}, nil, &out); !errors.Is(err, cart.ErrShardOpen) {
+			t.Fatalf("expected ErrShardOpen, got %v", err)
+		}
+	}
+}
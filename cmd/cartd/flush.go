@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"cart"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// FlushUsage is printed for "cartd flush -h".
+const FlushUsage = `usage: cartd flush [-config path] [-index customer|item|all] [-yes]
+
+Remove the shard files of one or both indexes.  Only files following
+the shard naming pattern are removed, anything else in the data
+directory is left alone.  The server must not be running.
+`
+
+// Flush parses the flush subcommand's arguments and removes the
+// shard files it selects.
+func Flush(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("flush", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, FlushUsage); fs.PrintDefaults() }
+	config := fs.String("config", "", "Path to the configuration file.")
+	index := fs.String("index", "all", "Index to flush: customer, item or all.")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	c, err := ParseConfigFile(*config)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	switch *index {
+	case "all":
+		names = []string{cart.CustomerStorage, cart.ItemStorage}
+	case cart.CustomerStorage, cart.ItemStorage:
+		names = []string{*index}
+	default:
+		return fmt.Errorf("unknown index %q", *index)
+	}
+
+	// Collect the files first, so we can tell the user what
+	// is about to go away.
+	var paths []string
+	for _, name := range names {
+		p, err := cart.ShardFiles(c.Storage.DataDir, name)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, p...)
+	}
+
+	if len(paths) == 0 {
+		fmt.Fprintln(stdout, "Nothing to flush in", c.Storage.DataDir)
+		return nil
+	}
+
+	if !*yes {
+		fmt.Fprintf(stdout, "Remove %d shard files of the %v index from %v? [y/N] ",
+			len(paths), *index, c.Storage.DataDir)
+		if !confirm(stdin) {
+			return fmt.Errorf("aborted")
+		}
+	}
+
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(stdout, "Removed", len(paths), "shard files")
+	return nil
+}
+
+// Read a line from r and report whether it is a yes.
+func confirm(r io.Reader) bool {
+	line, _ := bufio.NewReader(r).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Ensure flush only removes the shard files of the selected index.
+func TestFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cartd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		"customer-1.db", "customer-22.db", "item-1.db",
+		"customer-backup.db", "customer-01.db", "notes.txt",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	config := filepath.Join(dir, "cart.toml")
+	data := "[storage]\ndata-dir = \"" + dir + "\"\n"
+	if err := ioutil.WriteFile(config, []byte(data), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Refusing the confirmation keeps everything.
+	var out bytes.Buffer
+	args := []string{"-config", config, "-index", "customer"}
+	if err := Flush(args, strings.NewReader("n\n"), &out); err == nil {
+		t.Fatalf("expected the flush to be aborted")
+	}
+	if names := list(t, dir); len(names) != 7 {
+		t.Fatalf("expected nothing to be removed, got %v", names)
+	}
+
+	out.Reset()
+	if err := Flush(append(args, "-yes"), nil, &out); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := "cart.toml customer-01.db customer-backup.db item-1.db notes.txt"
+	if names := strings.Join(list(t, dir), " "); names != expected {
+		t.Fatalf("expected `%s`, got `%s`", expected, names)
+	}
+}
+
+// Return the sorted names of the files in dir.
+func list(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
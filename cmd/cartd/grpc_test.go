@@ -0,0 +1,55 @@
+package main
+
+import (
+	"cart/cartpb"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Ensure the server runs the gRPC API next to the HTTP API, on the
+// same storage.
+func TestServe_GRPC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cartd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	grpcPort := freePort(t)
+	url, stop := startServer(t, dir, "server", freePort(t), fmt.Sprintf("[grpc]\nport = %v", grpcPort))
+	defer stop()
+
+	conn, err := grpc.Dial(fmt.Sprintf("127.0.0.1:%v", grpcPort),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	c := cartpb.NewCartClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = c.Add(ctx, &cartpb.ModRequest{Customer: "1", Item: &cartpb.Item{Sku: "13"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if out := get(t, url+"/list?item=13"); out != "OK|1 1" {
+		t.Fatalf("unexpected response: %v", out)
+	}
+
+	get(t, url+"/add?customer=2&item=13")
+	resp, err := c.ListItem(ctx, &cartpb.ListItemRequest{Item: &cartpb.Item{Sku: "13"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := len(resp.GetCustomers()); n != 2 {
+		t.Fatalf("expected 2 customers, got %v", n)
+	}
+}
@@ -1,91 +1,127 @@
 package main
 
 import (
-	"fmt"
-  "flag"
-	"log"
 	"cart"
-	"net/http"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"os"
-	"strconv"
-
-	"github.com/BurntSushi/toml"
-)
-
-const (
-	// DefaultPort represents the default port the server runs on
-  DefaultPort = 8097
-
-	// DefaultBindAddress represents the ip address the server binds to
-	DefaultBindAddress = "0.0.0.0"
-
-  // Number of shards to user for locking and storage.
-  NShards = 1024
-
-  // Where to store the storage shards.
-  ShardDirPath = "shards/"
+	"strings"
+	"time"
 )
 
+// OpenTimeout is how long the commands working on the shard files
+// wait for a shard locked by another process, e.g. a running server.
+const OpenTimeout = time.Second
+
+// Usage is printed for "cartd help".
+const Usage = `usage: cartd <command> [arguments]
+
+The commands are:
+
+    serve     run the cart server (the default)
+    check     verify shard integrity and cross-index consistency
+    stats     print key counts and sizes per shard
+    export    write every cart line as JSON Lines or CSV
+    import    load cart lines written by export
+    backup    write a snapshot of every shard into an archive
+    restore   unpack an archive written by backup, optionally replaying the journal
+    flush     remove shard files
+    abandoned list the carts about to expire
+    migrate   rewrite carts stored in an older encoding
+    promote   turn a follower into a leader
+    members   list, add or remove the members of a raft group
+
+Every command but serve works directly on the shards directory,
+so the server must be stopped first.  The only exceptions are
+backup -server, which asks a running server for the snapshot,
+promote -server, which promotes a running follower, and members,
+which always asks a running server.  On a member of a raft group
+they work on its own copy of the carts, and import and restore
+are refused.  Use "cartd <command> -h" for the arguments of a
+command.
+`
+
+// A subcommand.  It reads its input from stdin and writes its
+// output to stdout.
+type command func(args []string, stdin io.Reader, stdout io.Writer) error
+
+var commands = map[string]command{
+	"serve":     Serve,
+	"check":     Check,
+	"stats":     Stats,
+	"export":    Export,
+	"import":    Import,
+	"backup":    Backup,
+	"restore":   Restore,
+	"flush":     Flush,
+	"abandoned": Abandoned,
+	"migrate":   Migrate,
+	"promote":   Promote,
+	"members":   Members,
+}
 
 func main() {
-
-  var flush = flag.Bool("flush", false, "Flush the persistent storage.")
-  flag.Parse()
-
-  if *flush {
-    cart.RemoveContents("shards/")
-  }
-	// Parse configuration.
-	c, err := ParseConfigFile("cmd/cartd/cart.sample.toml")
-	if err != nil {
-		fmt.Println("Failed to load configuration:", err.Error())
-		os.Exit(1)
+	// Without a subcommand, run the server.
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
 
-	// Create handler.
-	h := cart.NewHandler()
-
-	// Start HTTP server.
-	fmt.Println("Starting cart server on", c.Address())
-
-  // Associate a function with each query type.
-  http.HandleFunc("/add", h.Mod(cart.AddToSet))
-  http.HandleFunc("/remove", h.Mod(cart.RemoveFromSet))
-  http.HandleFunc("/list", h.List)
-  http.HandleFunc("/ping", h.Ping)
-
-  // Creates a new service goroutine for each requst.
-  log.Fatal(http.ListenAndServe(c.Address(), nil))
-}
-
-// Config represents the configuration format.
-type Config struct {
-	BindAddress string `toml:"bind-address"`
-	Port        int    `toml:"port"`
-}
+	if name == "help" {
+		fmt.Print(Usage)
+		return
+	}
 
-// NewConfig returns an instance of Config with default values
-func NewConfig() (*Config, error) {
-	c := &Config{}
-	c.BindAddress = DefaultBindAddress
-	c.Port = DefaultPort
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "cartd: unknown command %q\n\n%s", name, Usage)
+		os.Exit(2)
+	}
 
-	return c, nil
+	if err := cmd(args, os.Stdin, os.Stdout); err == flag.ErrHelp {
+		os.Exit(2)
+	} else if err != nil {
+		if errors.Is(err, cart.ErrShardOpen) && name != "serve" {
+			err = fmt.Errorf("%v, is a server still running on the shards?", err)
+		}
+		fmt.Fprintf(os.Stderr, "cartd %v: %v\n", name, err)
+		os.Exit(1)
+	}
 }
 
-// ParseConfigFile parses a configuration file at a given path
-func ParseConfigFile(path string) (*Config, error) {
-	c, err := NewConfig()
+// Parse the configuration file and open a handler on the shards
+// directory it names, for the commands working on the shard files.
+func openHandler(config string) (*cart.Handler, error) {
+	c, err := ParseConfigFile(config)
 	if err != nil {
 		return nil, err
 	}
-	if _, err := toml.DecodeFile(path, &c); err != nil {
+	return openConfigHandler(c)
+}
+
+// Open a handler on the shards directory of the configuration.  A
+// member of a raft group opens its own copy without joining the
+// group.
+func openConfigHandler(c *Config) (*cart.Handler, error) {
+	o, err := c.Options()
+	if err != nil {
 		return nil, err
 	}
-	return c, nil
+
+	// Don't wait forever on a server holding on to the shards.
+	o.OpenTimeout = OpenTimeout
+	o.Raft = nil
+	return cart.NewHandlerWithOptions(o)
 }
 
-// Address returns the concatenated IP address and port
-func (c *Config) Address() string {
-	return c.BindAddress + ":" + strconv.Itoa(c.Port)
+// Return an error for the commands adding carts of their own if the
+// configuration makes the server a member of a raft group, whose
+// changes must go through the log.
+func refuseRaft(c *Config) error {
+	if c.Raft.ID != "" {
+		return fmt.Errorf("raft member %v only takes changes from its leader", c.Raft.ID)
+	}
+	return nil
 }
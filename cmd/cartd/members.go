@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+)
+
+// Members parses the members subcommand's arguments and prints the
+// members of the raft group of a running server.  With -join or
+// -leave a member is added or removed first; the server passes the
+// change on to the leader.
+func Members(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("members", flag.ContinueOnError)
+	server := fs.String("server", "", "URL of a running member, e.g. http://localhost:8097.")
+	join := fs.String("join", "", "Member to add as id=address, e.g. d=10.0.0.4:7097.")
+	leave := fs.String("leave", "", "Id of the member to remove.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if *server == "" {
+		return fmt.Errorf("-server is required")
+	}
+	if *join != "" && *leave != "" {
+		return fmt.Errorf("-join and -leave are exclusive")
+	}
+	base := strings.TrimSuffix(*server, "/")
+
+	if *join != "" {
+		i := strings.Index(*join, "=")
+		if i < 0 {
+			return fmt.Errorf("-join: %q is not id=address", *join)
+		}
+		q := url.Values{"id": {(*join)[:i]}, "address": {(*join)[i+1:]}}
+		if _, err := membersRequest("POST", base+"/raft/join?"+q.Encode()); err != nil {
+			return err
+		}
+	}
+	if *leave != "" {
+		q := url.Values{"id": {*leave}}
+		if _, err := membersRequest("POST", base+"/raft/leave?"+q.Encode()); err != nil {
+			return err
+		}
+	}
+
+	lines, err := membersRequest("GET", base+"/raft/members")
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "id\taddress\trole")
+	for _, line := range lines {
+		fmt.Fprintln(w, strings.Replace(line, " ", "\t", -1))
+	}
+	return w.Flush()
+}
+
+// Send a request to the raft endpoints of a server.  Return the
+// lines following the status line.
+func membersRequest(method string, u string) ([]string, error) {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	if lines[0] != "OK" {
+		return nil, fmt.Errorf("server responded with %v: %v", resp.Status, strings.TrimPrefix(lines[0], "error: "))
+	}
+	return lines[1:], nil
+}
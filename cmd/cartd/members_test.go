@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Return the configuration of a raft member listening on port and
+// its raft traffic on raftPort.
+func raftConfig(id string, port int, raftPort int, peers []string) string {
+	quoted := make([]string, len(peers))
+	for i, peer := range peers {
+		quoted[i] = fmt.Sprintf("%q", peer)
+	}
+	return fmt.Sprintf("[raft]\nid = %q\nbind = \"127.0.0.1:%v\"\nurl = \"http://127.0.0.1:%v\"\n"+
+		"peers = [%v]\nheartbeat-timeout = \"300ms\"\nelection-timeout = \"300ms\"\napply-timeout = \"2s\"",
+		id, raftPort, port, strings.Join(quoted, ", "))
+}
+
+// Wait for the servers to agree on a leader and to serve queries
+// through it, and return its id.
+func waitRaftLeader(t *testing.T, urls map[string]string) string {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		leaders := make(map[string]bool)
+		for _, u := range urls {
+			for _, line := range strings.Split(get(t, u+"/raft/members"), "|") {
+				if fields := strings.Fields(line); len(fields) == 3 && fields[2] == "leader" {
+					leaders[fields[0]] = true
+				}
+			}
+		}
+		// The leader serves queries once it announced itself.
+		serving := true
+		for _, u := range urls {
+			got := get(t, u+"/list?customer=1")
+			serving = serving && (strings.HasPrefix(got, "OK") || got == "error: no such key")
+		}
+		if len(leaders) == 1 && serving {
+			for id := range leaders {
+				return id
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no leader elected, got %v", leaders)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Ensure the servers of a raft group take changes through any of
+// them, survive losing the leader, and let members join and leave.
+func TestMembers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cartd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ports := make(map[string][2]int)
+	var peers []string
+	for _, id := range []string{"a", "b", "c", "d"} {
+		ports[id] = [2]int{freePort(t), freePort(t)}
+		if id != "d" {
+			peers = append(peers, fmt.Sprintf("%v=127.0.0.1:%v", id, ports[id][1]))
+		}
+	}
+
+	urls := make(map[string]string)
+	stops := make(map[string]func())
+	defer func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}()
+	for _, id := range []string{"a", "b", "c"} {
+		urls[id], stops[id] = startServer(t, dir, id, ports[id][0],
+			raftConfig(id, ports[id][0], ports[id][1], peers))
+	}
+
+	leader := waitRaftLeader(t, urls)
+	var others []string
+	for _, id := range []string{"a", "b", "c"} {
+		if id != leader {
+			others = append(others, id)
+		}
+	}
+
+	if got := get(t, urls[others[0]]+"/add?customer=1&item=2"); got != "OK" {
+		t.Fatalf("expected `OK`, got `%s`", got)
+	}
+	if got := get(t, urls[others[1]]+"/list?customer=1"); got != "OK|2 1" {
+		t.Fatalf("expected `OK|2 1`, got `%s`", got)
+	}
+
+	// The others elect a new leader, which has every change.
+	stops[leader]()
+	delete(stops, leader)
+	delete(urls, leader)
+	old := leader
+	leader = waitRaftLeader(t, urls)
+	if got := get(t, urls[leader]+"/list?customer=1"); got != "OK|2 1" {
+		t.Fatalf("expected `OK|2 1`, got `%s`", got)
+	}
+
+	// A new member replaces the old leader.
+	urls["d"], stops["d"] = startServer(t, dir, "d", ports["d"][0],
+		raftConfig("d", ports["d"][0], ports["d"][1], nil))
+	var out bytes.Buffer
+	err = Members([]string{"-server", urls[others[0]], "-join", fmt.Sprintf("d=127.0.0.1:%v", ports["d"][1])},
+		nil, &out)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	out.Reset()
+	if err := Members([]string{"-server", urls[leader], "-leave", old}, nil, &out); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var members []string
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")[1:] {
+		members = append(members, strings.Fields(line)[0])
+	}
+	if len(members) != 3 || strings.Contains(strings.Join(members, " "), old) {
+		t.Fatalf("expected three members without %v, got:\n%s", old, out.String())
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		// Served by the leader, but d forwards only once it caught up
+		// with the leader's announcement.
+		got := get(t, urls["d"]+"/list?customer=1")
+		if got == "OK|2 1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected `OK|2 1` through d, got `%s`", got)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := Members([]string{"-server", urls["d"], "-join", "e"}, nil, &out); err == nil {
+		t.Fatalf("expected an error for a member without address")
+	}
+}
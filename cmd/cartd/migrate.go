@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+)
+
+// Migrate parses the migrate subcommand's arguments and rewrites
+// every cart stored in an older encoding in the current one.
+func Migrate(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	config := fs.String("config", "", "Path to the configuration file.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := ParseConfigFile(*config)
+	if err != nil {
+		return err
+	}
+	if err := refuseRaft(c); err != nil {
+		return err
+	}
+	h, err := openConfigHandler(c)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	n, err := h.Migrate()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Migrated %v carts\n", n)
+	return nil
+}
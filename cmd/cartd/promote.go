@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Promote parses the promote subcommand's arguments and turns a
+// follower into a leader, after applying whatever changes the
+// leader still has.  With -server the running follower is asked to
+// promote itself, otherwise the shard files are promoted directly.
+func Promote(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("promote", flag.ContinueOnError)
+	config := fs.String("config", "", "Path to the configuration file.")
+	server := fs.String("server", "", "URL of a running follower, e.g. http://localhost:8097.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	if *server != "" {
+		seq, err := promoteServer(strings.TrimSuffix(*server, "/"))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, "Promoted after leader entry", seq)
+		return nil
+	}
+
+	h, err := openHandler(*config)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	state, err := h.Promote()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "Promoted after leader entry", state.Seq)
+	return nil
+}
+
+// Ask a running follower to promote itself.  Return the last leader
+// entry it applied.
+func promoteServer(server string) (string, error) {
+	resp, err := http.Post(server+"/admin/promote", "", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	if lines[0] != "OK" || len(lines) != 2 {
+		return "", fmt.Errorf("server responded with %v: %v", resp.Status, strings.TrimPrefix(lines[0], "error: "))
+	}
+	return lines[1], nil
+}
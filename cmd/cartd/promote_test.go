@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Not a test: runs the server for the configuration in
+// CARTD_TEST_SERVE, when the test binary is started by startServer.
+func TestHelperServe(t *testing.T) {
+	config := os.Getenv("CARTD_TEST_SERVE")
+	if config == "" {
+		return
+	}
+	if err := Serve([]string{"-config", config}, nil, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Return a free port on localhost.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// Start a server in its own process, with the configuration data
+// plus the port, the journal and a data directory under dir.  Wait
+// for it to answer /ping and return its URL and a function stopping
+// it.
+func startServer(t *testing.T, dir string, name string, port int, data string) (string, func()) {
+	config := filepath.Join(dir, name+".toml")
+	data = fmt.Sprintf("bind-address = \"127.0.0.1\"\nport = %v\n%v\n[storage]\ndata-dir = %q\njournal = true\n",
+		port, data, filepath.Join(dir, name))
+	if err := ioutil.WriteFile(config, []byte(data), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperServe$")
+	cmd.Env = append(os.Environ(), "CARTD_TEST_SERVE="+config)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stop := func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Wait()
+	}
+
+	url := fmt.Sprintf("http://127.0.0.1:%v", port)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(url + "/ping")
+		if err == nil {
+			resp.Body.Close()
+			return url, stop
+		}
+		if time.Now().After(deadline) {
+			stop()
+			t.Fatalf("%v did not start: %s", name, out.String())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Return the response of a running server as one line.
+func get(t *testing.T, url string) string {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return strings.Replace(strings.TrimSuffix(string(body), "\n"), "\n", "|", -1)
+}
+
+// Ensure a follower server replicates its leader, refuses changes
+// of its own, and takes them once promoted.
+func TestPromote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cartd")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	leader, stopLeader := startServer(t, dir, "leader", freePort(t), "")
+	defer stopLeader()
+	follower, stopFollower := startServer(t, dir, "follower", freePort(t),
+		fmt.Sprintf("[follow]\nleader = %q\nwait = \"1s\"\nmin-backoff = \"10ms\"\nmax-backoff = \"100ms\"", leader))
+	defer stopFollower()
+
+	if got := get(t, leader+"/add?customer=1&item=2"); got != "OK" {
+		t.Fatalf("expected `OK`, got `%s`", got)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		got := get(t, follower+"/list?customer=1")
+		if got == "OK|2 1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the follower to have item 2, got `%s`", got)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if got := get(t, follower+"/add?customer=1&item=3"); !strings.Contains(got, "read-only") {
+		t.Fatalf("expected a read-only error, got `%s`", got)
+	}
+
+	var out bytes.Buffer
+	if err := Promote([]string{"-server", follower}, nil, &out); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if out.String() != "Promoted after leader entry 1\n" {
+		t.Fatalf("unexpected output: %s", out.String())
+	}
+	if got := get(t, follower+"/add?customer=1&item=3"); got != "OK" {
+		t.Fatalf("expected `OK`, got `%s`", got)
+	}
+	if got := get(t, follower+"/list?customer=1"); got != "OK|2 1|3 1" && got != "OK|3 1|2 1" {
+		t.Fatalf("expected items 2 and 3, got `%s`", got)
+	}
+}
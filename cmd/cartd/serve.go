@@ -0,0 +1,156 @@
+package main
+
+import (
+	"cart"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Serve parses the serve subcommand's arguments and runs the cart
+// server until it gets a SIGINT or a SIGTERM.
+func Serve(args []string, stdin io.Reader, stdout io.Writer) error {
+  fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+  config := fs.String("config", "", "Path to the configuration file.")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+
+	// Parse configuration.
+	c, err := ParseConfigFile(*config)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
+	}
+
+	// Create handler.
+	o, err := c.Options()
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	h, err := cart.NewHandlerWithOptions(o)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+
+	// Start HTTP server.
+	fmt.Fprintln(stdout, "Starting cart server on", c.Address())
+
+  // Associate a function with each query type.
+  mux := http.NewServeMux()
+  mux.HandleFunc("/add", h.Mod(cart.AddToSet))
+  mux.HandleFunc("/remove", h.Mod(cart.RemoveFromSet))
+  mux.HandleFunc("/list", h.List)
+  mux.HandleFunc("/lines", h.Lines)
+  mux.HandleFunc("/clear", h.Clear)
+  mux.HandleFunc("/changes", h.Feed)
+  mux.HandleFunc("/ping", h.Ping)
+  mux.HandleFunc("/cluster/item", h.ClusterItem)
+  mux.HandleFunc("/admin/storage", h.AdminStorage)
+  mux.HandleFunc("/admin/shards", h.AdminShards)
+  mux.HandleFunc("/admin/verify", h.AdminVerify)
+  mux.HandleFunc("/admin/backup", h.AdminBackup)
+  mux.HandleFunc("/admin/abandoned", h.AdminAbandoned)
+  mux.HandleFunc("/admin/promote", h.AdminPromote)
+  mux.HandleFunc("/raft/members", h.RaftMembers)
+  mux.HandleFunc("/raft/join", h.RaftJoin)
+  mux.HandleFunc("/raft/leave", h.RaftLeave)
+
+  // The gRPC server, if any, listens first so that a taken port
+  // fails before the HTTP server starts.
+  gs := c.GRPCServer(h)
+  var lis net.Listener
+  if gs != nil {
+    if lis, err = net.Listen("tcp", c.GRPCAddress()); err != nil {
+      if cerr := h.Close(); cerr != nil {
+        fmt.Fprintln(stdout, "Failed to close storage:", cerr.Error())
+      }
+      return err
+    }
+  }
+
+  // Creates a new service goroutine for each requst.
+  srv := c.Server(mux)
+  errc := make(chan error, 2)
+  go func() {
+    errc <- srv.ListenAndServe()
+  }()
+  if gs != nil {
+    fmt.Fprintln(stdout, "Starting gRPC server on", c.GRPCAddress())
+    go func() {
+      errc <- gs.Serve(lis)
+    }()
+  }
+
+  // Wait until we either get asked to stop or the listener fails.
+  sigc := make(chan os.Signal, 1)
+  signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+  select {
+  case err := <-errc:
+    srv.Close()
+    if gs != nil {
+      gs.Stop()
+    }
+    if cerr := h.Close(); cerr != nil {
+      fmt.Fprintln(stdout, "Failed to close storage:", cerr.Error())
+    }
+    return err
+  case sig := <-sigc:
+    fmt.Fprintln(stdout, "Received", sig, "shutting down")
+  }
+
+  // Stop accepting connections and drain the in-flight requests.
+  // A second signal skips the wait.
+  if err := shutdown(srv, gs, sigc, time.Duration(c.HTTP.ShutdownTimeout)); err != nil {
+    fmt.Fprintln(stdout, "Failed to drain requests:", err.Error())
+  }
+
+  // No request can touch the storage anymore, close every shard.
+  if err := h.Close(); err != nil {
+    return fmt.Errorf("failed to close storage: %v", err)
+  }
+  fmt.Fprintln(stdout, "Stopped cart server")
+  return nil
+}
+
+// Gracefully stop the server and the gRPC server, if any, giving
+// in-flight requests until the timeout to finish.  Another signal
+// on sigc cuts the wait short.
+func shutdown(srv *http.Server, gs *grpc.Server, sigc chan os.Signal, timeout time.Duration) error {
+  ctx, cancel := context.WithTimeout(context.Background(), timeout)
+  defer cancel()
+
+  go func() {
+    select {
+    case <-sigc:
+      cancel()
+    case <-ctx.Done():
+    }
+  }()
+
+  if gs != nil {
+    stopped := make(chan struct{})
+    go func() {
+      gs.GracefulStop()
+      close(stopped)
+    }()
+    defer func() {
+      select {
+      case <-stopped:
+      case <-ctx.Done():
+        gs.Stop()
+        <-stopped
+      }
+    }()
+  }
+
+  return srv.Shutdown(ctx)
+}
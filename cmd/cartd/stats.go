@@ -0,0 +1,60 @@
+package main
+
+import (
+	"cart"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// Stats parses the stats subcommand's arguments and prints the
+// number of keys, entries and bytes of every shard, followed by
+// the totals of every index.
+func Stats(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	config := fs.String("config", "", "Path to the configuration file.")
+	total := fs.Bool("total", false, "Only print the totals of every index.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	h, err := openHandler(*config)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	stats, err := h.Stats()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "index\tshard\tkeys\tentries\tbytes\t")
+
+	totals := map[string]*cart.ShardStats{
+		cart.CustomerStorage: {Storage: cart.CustomerStorage},
+		cart.ItemStorage:     {Storage: cart.ItemStorage},
+	}
+	for _, st := range stats {
+		if !*total {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t\n",
+				st.Storage, st.Shard, st.Keys, st.Entries, st.Size)
+		}
+
+		t := totals[st.Storage]
+		t.Shard++
+		t.Keys += st.Keys
+		t.Entries += st.Entries
+		t.Size += st.Size
+	}
+
+	// The shard column holds the number of shards for the totals.
+	for _, name := range []string{cart.CustomerStorage, cart.ItemStorage} {
+		t := totals[name]
+		fmt.Fprintf(w, "%v\t%v shards\t%v\t%v\t%v\t\n",
+			t.Storage, t.Shard, t.Keys, t.Entries, t.Size)
+	}
+	return w.Flush()
+}
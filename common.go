@@ -6,9 +6,16 @@ const (
 
   // Where to store the storage shards.
   ShardDirPath = "shards/"
+
+  // The names of the two storages.  Shard files are
+  // named after them.
+  CustomerStorage = "customer"
+  ItemStorage = "item"
 )
 
-type customerID uint32
-type itemID uint32
+type customerID string
+type itemID string
 
-type setT map[uint32]uint32
+// A set of ids with their quantities, e.g. the items of a cart
+// or the customers having an item in their cart.
+type setT map[string]uint32
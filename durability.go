@@ -0,0 +1,92 @@
+package cart
+
+import (
+  "fmt"
+  "time"
+)
+
+// How often a storage shard flushes its writes to stable storage.
+type FsyncMode int
+
+const (
+  // Fsync on every committed transaction.  This is bolt's default.
+  FsyncAlways FsyncMode = iota
+
+  // Skip the per-commit fsync and flush a shard on the first commit
+  // that happens after the sync interval has elapsed, or in the
+  // background if no commit follows.
+  FsyncInterval
+
+  // Never fsync on commit; shards are only flushed when closed.
+  // Suitable for ephemeral carts only, a crash may lose recent
+  // writes.
+  FsyncNever
+)
+
+// Return the configuration name of the fsync mode.
+func (m FsyncMode) String() string {
+  switch m {
+  case FsyncAlways:
+    return "always"
+  case FsyncInterval:
+    return "interval"
+  case FsyncNever:
+    return "never"
+  }
+  return fmt.Sprintf("FsyncMode(%d)", int(m))
+}
+
+// Given a configuration name, return the matching fsync mode.
+func ParseFsyncMode(s string) (FsyncMode, error) {
+  switch s {
+  case "", "always":
+    return FsyncAlways, nil
+  case "interval":
+    return FsyncInterval, nil
+  case "never":
+    return FsyncNever, nil
+  }
+  return FsyncAlways, fmt.Errorf("unknown fsync mode %q", s)
+}
+
+// The durability settings of a single ShardedStorage.  Every shard
+// of the storage is opened with the same settings.
+type Durability struct {
+  // When to fsync committed transactions.
+  Fsync FsyncMode
+
+  // How often to flush a shard when Fsync is FsyncInterval.
+  SyncInterval time.Duration
+
+  // Maps to bolt's NoGrowSync: skip the truncate call when
+  // growing the database file.
+  NoGrowSync bool
+}
+
+// The default, strict durability settings.
+func StrictDurability() Durability {
+  return Durability{Fsync: FsyncAlways}
+}
+
+// Make sure the settings make sense together.
+func (d Durability) Validate() error {
+  switch d.Fsync {
+  case FsyncAlways, FsyncNever:
+  case FsyncInterval:
+    if d.SyncInterval <= 0 {
+      return fmt.Errorf("fsync interval must be positive")
+    }
+  default:
+    return fmt.Errorf("unknown fsync mode %v", d.Fsync)
+  }
+  return nil
+}
+
+// Return a one line, human readable description of the settings.
+func (d Durability) String() string {
+  if d.Fsync == FsyncInterval {
+    return fmt.Sprintf("fsync=%v sync-interval=%v no-grow-sync=%v",
+      d.Fsync, d.SyncInterval, d.NoGrowSync)
+  }
+  return fmt.Sprintf("fsync=%v no-grow-sync=%v", d.Fsync, d.NoGrowSync)
+}
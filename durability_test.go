@@ -0,0 +1,60 @@
+package cart
+
+import (
+  "testing"
+  "time"
+)
+
+// Ensure the interval fsync strategy flushes a shard no commit
+// flushed once the interval elapsed.
+func TestHandler_IntervalSync(t *testing.T) {
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+
+  if err := h.Close(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  h.cStorage.durability = Durability{Fsync: FsyncInterval, SyncInterval: 50 * time.Millisecond}
+  if err := h.Open(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  // Right after the shard was opened, the commit skips the fsync.
+  if err := h.Apply("1", "10", AddToSet); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  dirty := func() bool {
+    h.cStorage.mu.Lock()
+    defer h.cStorage.mu.Unlock()
+    return h.cStorage.lru.Front().Value.(*storageShard).dirty
+  }
+  if !dirty() {
+    t.Fatalf("expected the shard to wait for a flush")
+  }
+
+  for deadline := time.Now().Add(5 * time.Second); dirty(); {
+    if time.Now().After(deadline) {
+      t.Fatalf("expected the janitor to flush the shard")
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+}
+
+// Ensure closing a shard reports a flush that failed.
+func TestStorageShard_CloseSyncFailure(t *testing.T) {
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+
+  shard, err := h.cStorage.getShard("1")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  h.cStorage.releaseShard(shard)
+  shard.db.NoSync = true
+
+  // The file is gone by the time the shard flushes it.
+  shard.db.Close()
+  if err := shard.close(); err == nil {
+    t.Fatalf("expected the failed flush reported")
+  }
+}
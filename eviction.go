@@ -0,0 +1,172 @@
+package cart
+
+import (
+  "fmt"
+  "log"
+  "time"
+)
+
+// Counters describing how a ShardedStorage opens and closes its
+// shards.
+type ShardMetrics struct {
+  Open        int    // Shards currently open.
+  Opens       uint64 // Shards opened so far.
+  Evictions   uint64 // Shards closed to stay under the open limit.
+  Expirations uint64 // Shards closed after being idle for too long.
+}
+
+// Return a snapshot of the shard metrics.
+func (s *ShardedStorage) Metrics() ShardMetrics {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  m := s.metrics
+  m.Open = s.lru.Len()
+  return m
+}
+
+// Close least recently used shards until we are back under the
+// open limit.  Shards that are in use are skipped, so the limit
+// can be exceeded while every open shard is busy.
+// The caller must hold s.mu.
+func (s *ShardedStorage) evictLocked() {
+  if s.maxOpen <= 0 {
+    return
+  }
+
+  e := s.lru.Back()
+  for s.lru.Len() > s.maxOpen && e != nil {
+    shard := e.Value.(*storageShard)
+    e = e.Prev()
+    if shard.refs > 0 {
+      continue
+    }
+
+    if err := s.closeShardLocked(shard); err != nil {
+      log.Print(err)
+    }
+    s.metrics.Evictions++
+  }
+}
+
+// Close all the unused shards that have been idle for longer than
+// the idle timeout.  The caller must hold s.mu.
+func (s *ShardedStorage) expireLocked(now time.Time) {
+  e := s.lru.Back()
+  for e != nil {
+    shard := e.Value.(*storageShard)
+    e = e.Prev()
+    if shard.refs > 0 {
+      continue
+    }
+
+    // The list is ordered by use, so everything
+    // in front of this shard is fresh as well.
+    if now.Sub(shard.lastUsed) < s.idleTimeout {
+      break
+    }
+
+    if err := s.closeShardLocked(shard); err != nil {
+      log.Print(err)
+    }
+    s.metrics.Expirations++
+  }
+}
+
+// Pin and return the open shards holding commits that have not been
+// flushed for longer than the sync interval, for the janitor to
+// flush and release.  The caller must hold s.mu.
+func (s *ShardedStorage) syncLocked(now time.Time) []*storageShard {
+  var due []*storageShard
+  for e := s.lru.Front(); e != nil; e = e.Next() {
+    shard := e.Value.(*storageShard)
+    if !shard.dirty || now.Sub(shard.lastSync) < s.durability.SyncInterval {
+      continue
+    }
+    shard.dirty, shard.lastSync = false, now
+    shard.refs++
+    due = append(due, shard)
+  }
+  return due
+}
+
+// Close a shard and forget about it, so that the next access
+// reopens it.  The caller must hold s.mu.
+func (s *ShardedStorage) closeShardLocked(shard *storageShard) error {
+  s.lru.Remove(shard.elem)
+  s.shards[shard.shardN] = nil
+
+  if err := shard.close(); err != nil {
+    return fmt.Errorf("%v shard %v: %v", s.name, shard.shardN, err)
+  }
+  return nil
+}
+
+// Start the background goroutine closing idle shards and flushing
+// the shards of the interval fsync strategy no commit flushed.  It
+// is a no-op when there is nothing to do or the janitor is running.
+func (s *ShardedStorage) startJanitor() {
+  interval := s.durability.Fsync == FsyncInterval
+  if (s.idleTimeout <= 0 && !interval) || s.stop != nil {
+    return
+  }
+
+  tick := s.idleTimeout / 2
+  if interval && (tick <= 0 || s.durability.SyncInterval / 2 < tick) {
+    tick = s.durability.SyncInterval / 2
+  }
+  if tick <= 0 {
+    tick = 1
+  }
+  stop, done := make(chan struct{}), make(chan struct{})
+  s.stop, s.done = stop, done
+
+  go func() {
+    defer close(done)
+    ticker := time.NewTicker(tick)
+    defer ticker.Stop()
+
+    for {
+      select {
+      case <-stop:
+        return
+      case now := <-ticker.C:
+        var due []*storageShard
+        s.mu.Lock()
+        if s.idleTimeout > 0 {
+          s.expireLocked(now)
+        }
+        if interval {
+          due = s.syncLocked(now)
+        }
+        s.mu.Unlock()
+
+        // Not holding s.mu, the shards are pinned.
+        for _, shard := range due {
+          if err := shard.db.Sync(); err != nil {
+            log.Printf("%v shard %v: %v", s.name, shard.shardN, err)
+          }
+          s.releaseShard(shard)
+        }
+      }
+    }
+  }()
+}
+
+// Stop the shard janitor, if it is running, and wait for it to
+// finish.  The caller must not hold s.mu.
+func (s *ShardedStorage) stopJanitor() {
+  if s.stop == nil {
+    return
+  }
+
+  close(s.stop)
+  <-s.done
+  s.stop, s.done = nil, nil
+}
+
+// Return a one line, human readable description of the metrics.
+func (m ShardMetrics) String() string {
+  return fmt.Sprintf("open=%v opens=%v evictions=%v expirations=%v",
+    m.Open, m.Opens, m.Evictions, m.Expirations)
+}
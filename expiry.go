@@ -0,0 +1,316 @@
+package cart
+
+import (
+  "errors"
+  "fmt"
+  "log"
+  "net/http"
+  "sort"
+  "time"
+)
+
+// ErrNoCartTTL is returned when asking for abandoned carts while
+// carts never expire.
+var ErrNoCartTTL = errors.New("carts never expire, there is no cart TTL")
+
+// When and how carts expire.
+type Expiry struct {
+  // Items unchanged for this long are removed.  0 means never.
+  ItemTTL time.Duration
+  // Carts unchanged for this long are removed as a whole.
+  // 0 means never.
+  CartTTL time.Duration
+  // How often to look for expired items.
+  SweepInterval time.Duration
+}
+
+// A cart that is about to expire.
+type AbandonedCart struct {
+  Customer   string
+  Items      int       // Number of distinct items.
+  LastChange time.Time // When any item was last changed.
+  Expires    time.Time // When the cart expires.
+}
+
+func (c AbandonedCart) String() string {
+  return fmt.Sprintf("customer %v items %v last-change %v expires %v",
+    c.Customer, c.Items, c.LastChange.UTC().Format(time.RFC3339), c.Expires.UTC().Format(time.RFC3339))
+}
+
+// Report whether anything ever expires.
+func (e Expiry) Enabled() bool {
+  return e.ItemTTL > 0 || e.CartTTL > 0
+}
+
+// Validate makes sure the expiry settings make sense together.
+func (e Expiry) Validate() error {
+  if e.ItemTTL < 0 || e.CartTTL < 0 {
+    return fmt.Errorf("TTLs must not be negative")
+  }
+  if e.Enabled() && e.SweepInterval <= 0 {
+    return fmt.Errorf("expiring items requires a positive sweep interval")
+  }
+  return nil
+}
+
+// Return the items of the cart that have expired by now, the whole
+// cart if the cart itself has expired.  Lines that do not know
+// when they were changed do not expire until the sweep stamps them.
+func (e Expiry) expired(c cartT, now time.Time) []string {
+  last := c.lastChange()
+  if e.CartTTL > 0 && !last.IsZero() && !now.Before(last.Add(e.CartTTL)) {
+    return c.sortedKeys()
+  }
+  if e.ItemTTL <= 0 {
+    return nil
+  }
+
+  var items []string
+  for _, item := range c.sortedKeys() {
+    l := c[item]
+    if !l.UpdatedAt.IsZero() && !now.Before(l.UpdatedAt.Add(e.ItemTTL)) {
+      items = append(items, item)
+    }
+  }
+  return items
+}
+
+// Sweep removes every item that has expired by now from both
+// indexes, and every cart that has expired as a whole.  Carts
+// that are busy are left for the next sweep.  Return the number of
+// items removed.
+func (h *Handler) Sweep(now time.Time) (int, error) {
+  if !h.begin() {
+    return 0, ErrClosed
+  }
+  defer h.leave()
+
+  if h.readOnly {
+    return 0, ErrReadOnly
+  }
+  if h.following() {
+    return 0, ErrNotLeader
+  }
+
+  return h.sweep(now)
+}
+
+// The body of Sweep.  The caller must be inside a request.
+func (h *Handler) sweep(now time.Time) (int, error) {
+  // Find the carts with expired items without holding any lock,
+  // then check again under the lock of every cart.
+  var customers, unstamped []string
+  err := h.cStorage.forEachShard(func(shard *storageShard) error {
+    return shard.forEachCart(func(customer string, c cartT) error {
+      if len(h.expiry.expired(c, now)) > 0 {
+        customers = append(customers, customer)
+      }
+      for _, l := range c {
+        if l.UpdatedAt.IsZero() {
+          unstamped = append(unstamped, customer)
+          break
+        }
+      }
+      return nil
+    })
+  })
+  if err != nil {
+    return 0, err
+  }
+
+  // Lines that do not know when they were changed, e.g. of carts
+  // from before version 2, expire counting from the first sweep
+  // that sees them.
+  for _, customer := range unstamped {
+    if !h.lock(&h.cLock, customer) {
+      continue
+    }
+    err := h.stampCart(customer, now)
+    h.cLock.MustUnlock(customer)
+    if err != nil {
+      return 0, err
+    }
+  }
+
+  n := 0
+  for _, customer := range customers {
+    removed, err := h.expireCart(customer, now)
+    n += removed
+    if err != nil && err != ErrBusy {
+      return n, err
+    }
+  }
+  return n, nil
+}
+
+// Stamp the lines of the cart that do not know when they were
+// changed with now.  Members of a raft group stamp them through the
+// raft log, so that they all expire the same items.  The stamps are
+// not journaled: followers stamp the lines themselves once promoted.
+// The caller must hold the customer lock.
+func (h *Handler) stampCart(customer string, now time.Time) error {
+  if h.raft != nil {
+    return h.propose(raftCommand{Stamp: true, Time: now.UTC(), Customer: h.ids.ID(customer)})
+  }
+  return h.cStorage.stampCart(customer, now)
+}
+
+// Remove the expired items of the cart.  Return how many of them.
+func (h *Handler) expireCart(customer string, now time.Time) (int, error) {
+  if !h.lock(&h.cLock, customer) {
+    return 0, ErrBusy
+  }
+  defer h.cLock.MustUnlock(customer)
+
+  var items []string
+  err := h.cStorage.observeCart(customer, func(c cartT) {
+    items = h.expiry.expired(c, now)
+  })
+  if err == ErrNoSuchKey {
+    return 0, nil
+  }
+  if err != nil {
+    return 0, err
+  }
+
+  for i, item := range items {
+    if err := h.applyItem(customer, item, setQtyInSet(0), nil, OpExpire); err != nil {
+      return i, err
+    }
+  }
+  return len(items), nil
+}
+
+// Start removing expired items in the background, if anything
+// ever expires.  The caller must hold the write lock.
+func (h *Handler) startSweeper() {
+  if !h.expiry.Enabled() {
+    return
+  }
+
+  stop, done := make(chan struct{}), make(chan struct{})
+  h.sweepStop, h.sweepDone = stop, done
+
+  go func() {
+    defer close(done)
+
+    ticker := time.NewTicker(h.expiry.SweepInterval)
+    defer ticker.Stop()
+
+    for {
+      select {
+      case <-stop:
+        return
+      case now := <-ticker.C:
+        // Close stops us while holding the write lock, so we must
+        // never wait for the read lock.
+        if !h.mu.TryRLock() {
+          continue
+        }
+        // Only the leader of a raft group expires items, the
+        // others get the changes from it.
+        if !h.closed && !h.following() {
+          if _, err := h.sweep(now); err != nil {
+            log.Printf("sweep: %v", err)
+          }
+        }
+        h.mu.RUnlock()
+      }
+    }
+  }()
+}
+
+// Report whether the handler is a member of a raft group that is
+// not ready to take changes.
+func (h *Handler) following() bool {
+  if h.raft == nil {
+    return false
+  }
+  _, ready := h.raft.state()
+  return !ready
+}
+
+// Stop the sweeper, if it is running, and wait for it to finish.
+func (h *Handler) stopSweeper() {
+  if h.sweepStop == nil {
+    return
+  }
+
+  close(h.sweepStop)
+  <-h.sweepDone
+  h.sweepStop, h.sweepDone = nil, nil
+}
+
+// Call f on every cart expiring within the given duration from
+// now, the ones expiring first first.
+func (h *Handler) Abandoned(now time.Time, within time.Duration,
+f func(AbandonedCart) error) error {
+  if !h.begin() {
+    return ErrClosed
+  }
+  defer h.leave()
+
+  if h.expiry.CartTTL <= 0 {
+    return ErrNoCartTTL
+  }
+
+  var carts []AbandonedCart
+  err := h.cStorage.forEachShard(func(shard *storageShard) error {
+    return shard.forEachCart(func(customer string, c cartT) error {
+      last := c.lastChange()
+      if last.IsZero() {
+        return nil
+      }
+      expires := last.Add(h.expiry.CartTTL)
+      if expires.Before(now.Add(within)) {
+        carts = append(carts, AbandonedCart{customer, len(c), last, expires})
+      }
+      return nil
+    })
+  })
+  if err != nil {
+    return err
+  }
+
+  sort.Slice(carts, func(i, j int) bool {
+    if !carts[i].Expires.Equal(carts[j].Expires) {
+      return carts[i].Expires.Before(carts[j].Expires)
+    }
+    return LessID(carts[i].Customer, carts[j].Customer)
+  })
+  for _, c := range carts {
+    if err := f(c); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// This function is responsible for handling /admin/abandoned
+// queries.  It reports the carts expiring within the duration
+// passed as within, e.g. 1h, one per line.
+func (h* Handler) AdminAbandoned(w http.ResponseWriter, r *http.Request) {
+  within, err := time.ParseDuration(r.URL.Query().Get("within"))
+  if err != nil || within < 0 {
+    fmt.Fprintf(w, "error: invalid within %q", r.URL.Query().Get("within"))
+    return
+  }
+
+  var lines []string
+  err = h.Abandoned(time.Now(), within, func(c AbandonedCart) error {
+    lines = append(lines, c.String())
+    return nil
+  })
+  if err == ErrClosed {
+    w.WriteHeader(http.StatusServiceUnavailable)
+  }
+  if err != nil {
+    fmt.Fprintf(w, "error: %v", err)
+    return
+  }
+
+  fmt.Fprintf(w, "OK\n")
+  for _, line := range lines {
+    fmt.Fprintf(w, "%v\n", line)
+  }
+}
@@ -0,0 +1,122 @@
+package cart
+
+import (
+  "fmt"
+  "reflect"
+  "testing"
+  "time"
+
+  "github.com/boltdb/bolt"
+)
+
+// Ensure expired items and carts disappear from both indexes, and
+// that abandoned carts are reported before they expire.
+func TestHandler_Sweep(t *testing.T) {
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+  h.expiry = Expiry{ItemTTL: 3 * time.Hour, CartTTL: 2 * time.Hour}
+
+  // Customer 1 keeps adding items, customer 2 stops after the
+  // first one.
+  start := time.Now()
+  for _, l := range []struct {
+    customer, item string
+    at time.Duration
+  }{
+    {"1", "10", 0},
+    {"1", "11", 90 * time.Minute},
+    {"1", "12", 165 * time.Minute},
+    {"2", "10", 30 * time.Minute},
+  } {
+    if err := h.set(l.customer, l.item, 1, nil, start.Add(l.at)); err != nil {
+      t.Fatalf("unexpected error: %s", err)
+    }
+  }
+
+  // The cart of customer 2 expires after two and a half hours.
+  var report []AbandonedCart
+  err := h.Abandoned(start.Add(time.Hour), 105*time.Minute, func(c AbandonedCart) error {
+    report = append(report, c)
+    return nil
+  })
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  expected := []AbandonedCart{{"2", 1, start.Add(30 * time.Minute), start.Add(150 * time.Minute)}}
+  if len(report) != 1 || report[0].Customer != "2" || !report[0].Expires.Equal(expected[0].Expires) {
+    t.Fatalf("expected %v, got %v", expected, report)
+  }
+
+  // After three hours, that cart is gone, and so is the first
+  // item of customer 1.
+  n, err := h.Sweep(start.Add(3 * time.Hour))
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  } else if n != 2 {
+    t.Fatalf("expected 2 items to expire, got %v", n)
+  }
+
+  var lines [][3]string
+  h.ForEachLine(func(customer string, item ItemKey, qty uint32) error {
+    if qty > 0 {
+      lines = append(lines, [3]string{customer, item.SKU, fmt.Sprint(qty)})
+    }
+    return nil
+  })
+  if expected := [][3]string{{"1", "11", "1"}, {"1", "12", "1"}}; !reflect.DeepEqual(lines, expected) {
+    t.Fatalf("expected %v, got %v", expected, lines)
+  }
+  if found := verify(t, h); len(found) != 0 {
+    t.Fatalf("expected consistent indexes, got %v", found)
+  }
+}
+
+// Give customer 1 a version 1 cart holding item 10, without stamps.
+func writeUnstampedCart(t *testing.T, h *Handler) {
+  keyBuf, _ := getBytes(uint32(1))
+  setBuf, _ := getBytes(map[uint32]uint32{10: 1})
+  shard, err := h.cStorage.getShard("1")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  err = shard.db.Update(func(tx *bolt.Tx) error {
+    carts, _ := tx.CreateBucketIfNotExists([]byte("Cart"))
+    return carts.Put(keyBuf, setBuf)
+  })
+  h.cStorage.releaseShard(shard)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  h.iStorage.ChangeValue("10", "1", setQtyInSet(1))
+}
+
+// Ensure lines without a stamp expire counting from the first sweep
+// that sees them.
+func TestHandler_SweepUnstamped(t *testing.T) {
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+  h.expiry = Expiry{ItemTTL: time.Hour}
+  writeUnstampedCart(t, h)
+
+  start := time.Now().Round(0)
+  for _, s := range []struct {
+    at time.Duration
+    expected int
+  }{{0, 0}, {30 * time.Minute, 0}, {time.Hour, 1}} {
+    n, err := h.Sweep(start.Add(s.at))
+    if err != nil {
+      t.Fatalf("unexpected error: %s", err)
+    } else if n != s.expected {
+      t.Fatalf("expected %v items to expire after %v, got %v", s.expected, s.at, n)
+    }
+    if s.at == 0 {
+      lines, _ := h.CartLines("1")
+      if !lines["10"].UpdatedAt.Equal(start) {
+        t.Fatalf("expected the line stamped with %v, got %v", start, lines)
+      }
+    }
+  }
+  if found := verify(t, h); len(found) != 0 {
+    t.Fatalf("expected consistent indexes, got %v", found)
+  }
+}
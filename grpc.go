@@ -0,0 +1,333 @@
+package cart
+
+import (
+  "context"
+  "errors"
+  "sort"
+  "time"
+
+  "cart/cartpb"
+
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/status"
+)
+
+// GRPCServer serves the gRPC API of package cartpb on top of a
+// handler.  Carts change and get listed the same way as over HTTP,
+// under the same locks.  Unlike the HTTP handlers it never passes a
+// request on: members of a raft group other than the leader, and
+// nodes of a cluster asked for a key another node owns, refuse it
+// with codes.Unavailable and codes.FailedPrecondition respectively,
+// naming who to ask instead.
+type GRPCServer struct {
+  cartpb.UnimplementedCartServer
+  h *Handler
+}
+
+// NewGRPCServer returns a gRPC server for the handler, to be
+// registered with cartpb.RegisterCartServer.
+func NewGRPCServer(h *Handler) *GRPCServer {
+  return &GRPCServer{h: h}
+}
+
+// Add adds one of the item to the cart of the customer, the way
+// /add does.
+func (s *GRPCServer) Add(ctx context.Context, req *cartpb.ModRequest) (*cartpb.ModResponse, error) {
+  err := s.apply(cartpb.Operation_ADD, req.GetCustomer(), req.GetItem(), req.GetDetails())
+  if err != nil {
+    return nil, err
+  }
+  return &cartpb.ModResponse{}, nil
+}
+
+// Remove removes one of the item from the cart of the customer, the
+// way /remove does.
+func (s *GRPCServer) Remove(ctx context.Context, req *cartpb.ModRequest) (*cartpb.ModResponse, error) {
+  err := s.apply(cartpb.Operation_REMOVE, req.GetCustomer(), req.GetItem(), req.GetDetails())
+  if err != nil {
+    return nil, err
+  }
+  return &cartpb.ModResponse{}, nil
+}
+
+// Clear empties the cart of the customer, the way /clear does.
+func (s *GRPCServer) Clear(ctx context.Context, req *cartpb.ClearRequest) (*cartpb.ClearResponse, error) {
+  if err := s.apply(cartpb.Operation_CLEAR, req.GetCustomer(), nil, nil); err != nil {
+    return nil, err
+  }
+  return &cartpb.ClearResponse{}, nil
+}
+
+// Batch applies the operations one after the other and reports how
+// every one of them went.  A failed operation does not stop the
+// batch, and the ones applied stay applied.
+func (s *GRPCServer) Batch(ctx context.Context, req *cartpb.BatchRequest) (*cartpb.BatchResponse, error) {
+  results := make([]*cartpb.OperationResult, 0, len(req.GetOperations()))
+  for _, op := range req.GetOperations() {
+    if err := ctx.Err(); err != nil {
+      return nil, status.FromContextError(err).Err()
+    }
+    st := status.Convert(s.apply(op.GetKind(), op.GetCustomer(), op.GetItem(), op.GetDetails()))
+    results = append(results, &cartpb.OperationResult{
+      Code: int32(st.Code()),
+      Message: st.Message(),
+    })
+  }
+  return &cartpb.BatchResponse{Results: results}, nil
+}
+
+// ListCustomer returns the lines of the cart of the customer in item
+// order.  An empty cart has no lines.
+func (s *GRPCServer) ListCustomer(ctx context.Context, req *cartpb.ListCustomerRequest) (*cartpb.ListCustomerResponse, error) {
+  lines, err := s.lines(req.GetCustomer())
+  if err != nil {
+    return nil, err
+  }
+  return &cartpb.ListCustomerResponse{Lines: lines}, nil
+}
+
+// ListItem returns the customers having the item in their cart in
+// customer order, the way /list does.  Return codes.NotFound if
+// nobody has it.
+func (s *GRPCServer) ListItem(ctx context.Context, req *cartpb.ListItemRequest) (*cartpb.ListItemResponse, error) {
+  customers, err := s.customers(req.GetItem())
+  if err != nil {
+    return nil, err
+  }
+  return &cartpb.ListItemResponse{Customers: customers}, nil
+}
+
+// StreamList lists a cart or the customers having an item like
+// ListCustomer and ListItem, one entry per message.  The list is
+// taken at once, no lock is held while it is sent.
+func (s *GRPCServer) StreamList(req *cartpb.ListRequest, stream cartpb.Cart_StreamListServer) error {
+  var entries []*cartpb.ListEntry
+  switch key := req.GetKey().(type) {
+  case *cartpb.ListRequest_Customer:
+    lines, err := s.lines(key.Customer)
+    if err != nil {
+      return err
+    }
+    for _, l := range lines {
+      entries = append(entries, &cartpb.ListEntry{Entry: &cartpb.ListEntry_Line{Line: l}})
+    }
+  case *cartpb.ListRequest_Item:
+    customers, err := s.customers(key.Item)
+    if err != nil {
+      return err
+    }
+    for _, c := range customers {
+      entries = append(entries, &cartpb.ListEntry{Entry: &cartpb.ListEntry_Customer{Customer: c}})
+    }
+  default:
+    return status.Error(codes.InvalidArgument, "customer or item required")
+  }
+
+  for _, e := range entries {
+    if err := stream.Send(e); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Apply an operation the way /add, /remove and /clear do.
+func (s *GRPCServer) apply(kind cartpb.Operation_Kind, customer string,
+item *cartpb.Item, details *cartpb.LineDetails) error {
+  h := s.h
+  if !h.begin() {
+    return grpcError(ErrClosed)
+  }
+  defer h.leave()
+
+  // Before a variant gets registered: only the leader of a raft
+  // group registers them.
+  if err := h.checkLeader(); err != nil {
+    return grpcError(err)
+  }
+  c, err := s.customer(customer)
+  if err != nil {
+    return err
+  }
+
+  var f func(*setT, string) error
+  switch kind {
+  case cartpb.Operation_ADD:
+    f = AddToSet
+  case cartpb.Operation_REMOVE:
+    f = RemoveFromSet
+  case cartpb.Operation_CLEAR:
+    if item != nil || details != nil {
+      return status.Error(codes.InvalidArgument, "clear takes the customer only")
+    }
+    return grpcError(h.clear(c))
+  default:
+    return status.Errorf(codes.InvalidArgument, "unknown operation %v", kind)
+  }
+
+  key, err := s.itemKey(item)
+  if err != nil {
+    return err
+  }
+  var d *LineDetails
+  if details != nil {
+    d = &LineDetails{details.GetPrice(), details.GetCurrency(), details.GetAttributes()}
+    if err := d.Validate(); err != nil {
+      return status.Error(codes.InvalidArgument, err.Error())
+    }
+  }
+  if h.readOnly {
+    return grpcError(ErrReadOnly)
+  }
+  id, err := h.modItem(key, f)
+  if err != nil {
+    return grpcError(err)
+  }
+  return grpcError(h.apply(c, id, f, d))
+}
+
+// Return the lines of the cart of the customer in item order.
+func (s *GRPCServer) lines(customer string) ([]*cartpb.CartLine, error) {
+  h := s.h
+  if !h.begin() {
+    return nil, grpcError(ErrClosed)
+  }
+  defer h.leave()
+
+  if err := h.checkLeader(); err != nil {
+    return nil, grpcError(err)
+  }
+  c, err := s.customer(customer)
+  if err != nil {
+    return nil, err
+  }
+  lines, err := h.cartLines(c)
+  if err != nil {
+    return nil, grpcError(err)
+  }
+
+  items := make([]string, 0, len(lines))
+  for item := range lines {
+    items = append(items, item)
+  }
+  sort.Slice(items, func(i, j int) bool { return LessID(items[i], items[j]) })
+
+  out := make([]*cartpb.CartLine, 0, len(items))
+  for _, item := range items {
+    key, err := h.itemKey(item)
+    if err != nil {
+      key = ItemKey{SKU: item}
+    }
+    l := lines[item]
+    line := &cartpb.CartLine{
+      Item: &cartpb.Item{Sku: key.SKU, Variant: key.Variant},
+      Qty: l.Qty,
+      AddedAt: unixNano(l.AddedAt),
+      UpdatedAt: unixNano(l.UpdatedAt),
+    }
+    if l.Price != 0 || l.Currency != "" || len(l.Attributes) > 0 {
+      line.Details = &cartpb.LineDetails{
+        Price: l.Price,
+        Currency: l.Currency,
+        Attributes: l.Attributes,
+      }
+    }
+    out = append(out, line)
+  }
+  return out, nil
+}
+
+// Return the customers having the item in their cart in customer
+// order.
+func (s *GRPCServer) customers(item *cartpb.Item) ([]*cartpb.ItemCustomer, error) {
+  h := s.h
+  if !h.begin() {
+    return nil, grpcError(ErrClosed)
+  }
+  defer h.leave()
+
+  if err := h.checkLeader(); err != nil {
+    return nil, grpcError(err)
+  }
+  key, err := s.itemKey(item)
+  if err != nil {
+    return nil, err
+  }
+  // Every variant of the item lives with it.
+  if err := h.checkOwner(key.SKU); err != nil {
+    return nil, grpcError(err)
+  }
+  customers, err := h.itemCustomers(key.SKU, key.Variant)
+  if err != nil {
+    return nil, grpcError(err)
+  }
+
+  out := make([]*cartpb.ItemCustomer, 0, len(customers))
+  for _, c := range customers.sortedKeys() {
+    out = append(out, &cartpb.ItemCustomer{Customer: c, Qty: customers[c]})
+  }
+  return out, nil
+}
+
+// Parse the customer id of a request and make sure this node owns
+// it.  The caller must be inside a request.
+func (s *GRPCServer) customer(customer string) (string, error) {
+  c, err := s.h.ids.Parse(customer)
+  if err != nil {
+    return "", status.Errorf(codes.InvalidArgument, "invalid customer id %q", customer)
+  }
+  if err := s.h.checkOwner(c); err != nil {
+    return "", grpcError(err)
+  }
+  return c, nil
+}
+
+// Parse the item of a request.  The caller must be inside a request.
+func (s *GRPCServer) itemKey(item *cartpb.Item) (ItemKey, error) {
+  if item == nil {
+    return ItemKey{}, status.Error(codes.InvalidArgument, "item missing")
+  }
+  sku, err := s.h.ids.Parse(item.GetSku())
+  if err != nil || s.h.ids.isVariant(sku) {
+    return ItemKey{}, status.Errorf(codes.InvalidArgument, "invalid item id %q", item.GetSku())
+  }
+
+  key := ItemKey{SKU: sku}
+  if len(item.GetVariant()) > 0 {
+    key.Variant = item.GetVariant()
+  }
+  if err := s.h.variants.validate(key); err != nil {
+    return ItemKey{}, status.Error(codes.InvalidArgument, err.Error())
+  }
+  return key, nil
+}
+
+// Turn an error of the handler into a gRPC status error.  What
+// makes /add and friends answer 503 is codes.Unavailable, worth
+// trying again.  What makes them answer 504 is
+// codes.DeadlineExceeded: the change may have been made.
+func grpcError(err error) error {
+  switch {
+  case err == nil:
+    return nil
+  case errors.Is(err, ErrUnavailable):
+    return status.Error(codes.DeadlineExceeded, err.Error())
+  case errors.Is(err, ErrBusy) || errors.Is(err, ErrClosed) ||
+    errors.Is(err, ErrNotLeader) || errors.Is(err, ErrShardOpen):
+    return status.Error(codes.Unavailable, err.Error())
+  case errors.Is(err, ErrNoSuchKey):
+    return status.Error(codes.NotFound, err.Error())
+  case errors.Is(err, ErrNotInCart) || errors.Is(err, ErrReadOnly) ||
+    errors.Is(err, ErrNotOwner):
+    return status.Error(codes.FailedPrecondition, err.Error())
+  }
+  return status.Error(codes.Unknown, err.Error())
+}
+
+// Return the time in Unix nanoseconds, zero for the zero time.
+func unixNano(t time.Time) int64 {
+  if t.IsZero() {
+    return 0
+  }
+  return t.UnixNano()
+}
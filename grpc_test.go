@@ -0,0 +1,170 @@
+package cart
+
+import (
+  "context"
+  "io"
+  "net"
+  "net/http/httptest"
+  "testing"
+
+  "cart/cartpb"
+
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/credentials/insecure"
+  "google.golang.org/grpc/status"
+  "google.golang.org/grpc/test/bufconn"
+)
+
+// Serve the gRPC API of the handler in memory and return a client
+// for it.
+func tempGRPC(t *testing.T, h *Handler) (cartpb.CartClient, func()) {
+  lis := bufconn.Listen(1 << 20)
+  s := grpc.NewServer()
+  cartpb.RegisterCartServer(s, NewGRPCServer(h))
+  go s.Serve(lis)
+
+  conn, err := grpc.Dial("bufnet",
+    grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+      return lis.DialContext(ctx)
+    }),
+    grpc.WithTransportCredentials(insecure.NewCredentials()))
+  if err != nil {
+    s.Stop()
+    t.Fatalf("unexpected error: %s", err)
+  }
+  return cartpb.NewCartClient(conn), func() { conn.Close(); s.Stop() }
+}
+
+// Ensure carts change and get listed over gRPC the same way as over
+// HTTP.
+func TestGRPCServer(t *testing.T) {
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+  c, stop := tempGRPC(t, h)
+  defer stop()
+  ctx := context.Background()
+
+  m := &cartpb.Item{Sku: "10", Variant: map[string]string{"size": "M"}}
+  for _, req := range []*cartpb.ModRequest{
+    {Customer: "1", Item: &cartpb.Item{Sku: "13"}},
+    {Customer: "1", Item: &cartpb.Item{Sku: "13"}},
+    {Customer: "01", Item: m, Details: &cartpb.LineDetails{Price: 1999, Currency: "EUR"}},
+    {Customer: "2", Item: m},
+  } {
+    if _, err := c.Add(ctx, req); err != nil {
+      t.Fatalf("%v: unexpected error: %s", req, err)
+    }
+  }
+  if _, err := c.Remove(ctx, &cartpb.ModRequest{Customer: "1", Item: &cartpb.Item{Sku: "13"}}); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  // What changed over gRPC shows over HTTP.
+  w := httptest.NewRecorder()
+  h.List(w, httptest.NewRequest("GET", "http://localhost/list?item=10", nil))
+  if body := w.Body.String(); body != "OK\n1 1\n2 1\n" && body != "OK\n2 1\n1 1\n" {
+    t.Fatalf("unexpected response: %q", body)
+  }
+
+  lines, err := c.ListCustomer(ctx, &cartpb.ListCustomerRequest{Customer: "1"})
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if l := lines.GetLines(); len(l) != 2 || l[0].GetItem().GetSku() != "13" || l[0].GetQty() != 1 ||
+    l[0].GetDetails() != nil || l[1].GetItem().GetVariant()["size"] != "M" ||
+    l[1].GetDetails().GetCurrency() != "EUR" || l[1].GetUpdatedAt() == 0 {
+    t.Fatalf("unexpected lines: %v", l)
+  }
+
+  customers, err := c.ListItem(ctx, &cartpb.ListItemRequest{Item: &cartpb.Item{Sku: "10"}})
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if cs := customers.GetCustomers(); len(cs) != 2 || cs[0].GetCustomer() != "1" || cs[1].GetCustomer() != "2" {
+    t.Fatalf("unexpected customers: %v", cs)
+  }
+
+  // Streaming lists the same.
+  stream, err := c.StreamList(ctx, &cartpb.ListRequest{Key: &cartpb.ListRequest_Item{Item: m}})
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  var streamed []string
+  for {
+    e, err := stream.Recv()
+    if err == io.EOF {
+      break
+    } else if err != nil {
+      t.Fatalf("unexpected error: %s", err)
+    }
+    streamed = append(streamed, e.GetCustomer().GetCustomer())
+  }
+  if len(streamed) != 2 || streamed[0] != "1" || streamed[1] != "2" {
+    t.Fatalf("unexpected customers: %v", streamed)
+  }
+
+  // Errors come back with codes.
+  for _, tt := range []struct {
+    err  error
+    code codes.Code
+  }{
+    {func() error {
+      _, err := c.Add(ctx, &cartpb.ModRequest{Customer: "x", Item: &cartpb.Item{Sku: "13"}})
+      return err
+    }(), codes.InvalidArgument},
+    {func() error {
+      _, err := c.Remove(ctx, &cartpb.ModRequest{Customer: "3", Item: &cartpb.Item{Sku: "13"}})
+      return err
+    }(), codes.FailedPrecondition},
+    {func() error {
+      _, err := c.ListItem(ctx, &cartpb.ListItemRequest{Item: &cartpb.Item{Sku: "99"}})
+      return err
+    }(), codes.NotFound},
+  } {
+    if status.Code(tt.err) != tt.code {
+      t.Fatalf("expected %v, got %v", tt.code, tt.err)
+    }
+  }
+}
+
+// Ensure a batch applies its operations in order and reports every
+// one of them.
+func TestGRPCServer_Batch(t *testing.T) {
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+  c, stop := tempGRPC(t, h)
+  defer stop()
+
+  item := &cartpb.Item{Sku: "13"}
+  resp, err := c.Batch(context.Background(), &cartpb.BatchRequest{Operations: []*cartpb.Operation{
+    {Kind: cartpb.Operation_ADD, Customer: "1", Item: item},
+    {Kind: cartpb.Operation_ADD, Customer: "1", Item: item},
+    {Kind: cartpb.Operation_CLEAR, Customer: "1"},
+    {Kind: cartpb.Operation_REMOVE, Customer: "1", Item: item},
+    {Kind: cartpb.Operation_ADD, Customer: "1", Item: item},
+  }})
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  var got []codes.Code
+  for _, r := range resp.GetResults() {
+    got = append(got, codes.Code(r.GetCode()))
+  }
+  expected := []codes.Code{codes.OK, codes.OK, codes.OK, codes.FailedPrecondition, codes.OK}
+  if len(got) != len(expected) {
+    t.Fatalf("expected %v, got %v", expected, got)
+  }
+  for i := range expected {
+    if got[i] != expected[i] {
+      t.Fatalf("expected %v, got %v", expected, got)
+    }
+  }
+
+  lines, err := h.CartLines("1")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  } else if len(lines) != 1 || lines["13"].Qty != 1 {
+    t.Fatalf("unexpected lines: %v", lines)
+  }
+}
@@ -1,10 +1,23 @@
 package cart
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"os"
+  "path/filepath"
   "strconv"
+  "sync"
+  "time"
 	"net/http"
 )
+
+// ErrClosed is reported to clients of a closed Handler.
+var ErrClosed = errors.New("handler is closed")
+
+// ErrBusy is returned when a shard lock is taken.
+var ErrBusy = errors.New("shard is busy")
+
 // Handler represents the HTTP handler for the customer API.
 type Handler struct {
 	http.Handler
@@ -12,40 +25,548 @@ type Handler struct {
   iLock ShardedLock
   cStorage ShardedStorage
   iStorage ShardedStorage
+
+  // Where the shard files live.
+  dir string
+  // How customers and items are identified, and how they map to
+  // shards.
+  ids IDMode
+  mapping ShardMapping
+  // The other nodes and the shards they own, nil unless the
+  // handler is a node of a cluster.
+  cluster *clusterState
+  // The leader to follow and the replicator following it while
+  // open, nil unless the handler is a follower.  A follower is
+  // read-only until promoted.
+  follow *Follow
+  replicator *replicator
+  readOnly bool
+  // The raft group the handler is a member of, nil unless it is.
+  raft *raftMember
+  // What to do when a shard lock is taken.
+  lockMode LockMode
+  lockTimeout time.Duration
+
+  // The item ids standing for variants of items.
+  variants variantRegistry
+
+  // The mutation journal, nil unless journaling is enabled.
+  journal *Journal
+  journaling bool
+  journalSync bool
+
+  // Webhooks and the dispatchers delivering to them while open.
+  webhooks []Webhook
+  dispatchers []*dispatcher
+
+  // When items expire, and the sweeper removing them while open.
+  expiry Expiry
+  sweepStop chan struct{}
+  sweepDone chan struct{}
+
+  // Requests hold the read side for their whole duration, Open
+  // and Close take the write side.
+  mu sync.RWMutex
+  closed bool
+}
+
+// Options holds the settings a Handler passes down to its storage.
+type Options struct {
+  // The directory holding the shard files.
+  Dir string
+  // The number of shards of every lock and storage, and how keys
+  // map to them.  The data directory remembers both and refuses
+  // any others, since they would look for keys in the wrong shard.
+  Shards int
+  Mapping ShardMapping
+
+  // How customers and items are identified.  The data directory
+  // remembers the mode it was created with and refuses any other.
+  IDs IDMode
+
+  // The cluster the handler is a node of, nil if it owns every
+  // shard itself.
+  Cluster *Cluster
+
+  // The leader to follow, nil unless the handler is a read-only
+  // follower of another one.
+  Follow *Follow
+
+  // The raft group replicating the shards of the handler, nil
+  // unless the handler is a member of one.
+  Raft *Raft
+
+  // What requests do when a shard lock is taken, and for how
+  // long they wait with LockWait.
+  LockMode LockMode
+  LockTimeout time.Duration
+
+  // Durability of the customer -> items index.
+  CustomerDurability Durability
+  // Durability of the item -> customers index.
+  ItemDurability Durability
+
+  // How many shards each storage keeps open at once.  The least
+  // recently used shard gets closed to make room.  0 means no limit.
+  MaxOpenShards int
+  // How long an unused shard stays open.  0 means forever.
+  ShardIdleTimeout time.Duration
+
+  // How long to wait for another process, e.g. a running server,
+  // to release a shard file.  0 means forever.
+  OpenTimeout time.Duration
+
+  // Whether to record every mutation in the journal file next to
+  // the shards, see JournalFileName.  The journal is synced after
+  // every entry when the customer storage fsyncs always.
+  Journal bool
+
+  // URLs notified of every change, see Webhook.  Requires Journal.
+  Webhooks []Webhook
+
+  // When items and carts expire.  The zero value never expires
+  // anything.
+  Expiry Expiry
+}
+
+// DefaultOptions returns the options used by NewHandler.
+func DefaultOptions() Options {
+  return Options{
+    Dir: ShardDirPath,
+    Shards: NShards,
+    LockMode: LockTry,
+    CustomerDurability: StrictDurability(),
+    ItemDurability: StrictDurability(),
+  }
 }
 
 // NewHandler returns a new instance of Handler.
 func NewHandler() *Handler {
+  h, err := NewHandlerWithOptions(DefaultOptions())
+  if err != nil {
+    log.Fatal(err)
+  }
+	return h
+}
+
+// NewHandlerWithOptions returns a new instance of Handler
+// configured with the given options.
+func NewHandlerWithOptions(o Options) (*Handler, error) {
+  if err := o.Validate(); err != nil {
+    return nil, err
+  }
+
   h := Handler{
-    cStorage: ShardedStorage{name: "customer"},
-    iStorage: ShardedStorage{name: "item"},
+    cLock: NewShardedLock(o.Shards),
+    iLock: NewShardedLock(o.Shards),
+    cStorage: newShardedStorage(CustomerStorage, o.Dir, o.Shards),
+    iStorage: newShardedStorage(ItemStorage, o.Dir, o.Shards),
+    dir: o.Dir,
+    ids: o.IDs,
+    mapping: o.Mapping,
+    follow: o.Follow,
+    variants: variantRegistry{
+      path: filepath.Join(o.Dir, VariantFileName),
+      timeout: o.OpenTimeout,
+      ids: o.IDs,
+    },
+    lockMode: o.LockMode,
+    lockTimeout: o.LockTimeout,
+    journaling: o.Journal,
+    journalSync: o.CustomerDurability.Fsync == FsyncAlways,
+    webhooks: o.Webhooks,
+    expiry: o.Expiry,
+    closed: true,
+  }
+  if o.Cluster != nil {
+    cluster, err := newClusterState(o.Cluster, o.Shards)
+    if err != nil {
+      return nil, err
+    }
+    h.cluster = cluster
+  }
+  if o.Raft != nil {
+    h.raft = newRaftMember(o.Raft)
+  }
+  h.cStorage.durability = o.CustomerDurability
+  h.cStorage.lines = true
+  h.iStorage.durability = o.ItemDurability
+  for _, lock := range [...]*ShardedLock{&h.cLock, &h.iLock} {
+    lock.ids = o.IDs
+    lock.mapping = o.Mapping
+  }
+  for _, storage := range [...]*ShardedStorage{&h.cStorage, &h.iStorage} {
+    storage.maxOpen = o.MaxOpenShards
+    storage.idleTimeout = o.ShardIdleTimeout
+    storage.openTimeout = o.OpenTimeout
+    storage.ids = o.IDs
+    storage.mapping = o.Mapping
+  }
+
+  if err := h.Open(); err != nil {
+    return nil, err
+  }
+	return &h, nil
+}
+
+// Validate makes sure the options make sense together.
+func (o Options) Validate() error {
+  if o.Dir == "" {
+    return fmt.Errorf("shard directory must be set")
+  }
+  if o.Shards <= 0 {
+    return fmt.Errorf("number of shards must be positive")
+  }
+  if o.IDs != NumericIDs && o.IDs != StringIDs {
+    return fmt.Errorf("unknown id mode %v", o.IDs)
+  }
+  if o.Mapping != ModuloMapping && o.Mapping != JumpMapping {
+    return fmt.Errorf("unknown shard mapping %v", o.Mapping)
+  }
+  if o.Cluster != nil {
+    if err := o.Cluster.Validate(o.Shards); err != nil {
+      return fmt.Errorf("cluster: %v", err)
+    }
+  }
+  if o.Follow != nil {
+    if err := o.Follow.Validate(); err != nil {
+      return fmt.Errorf("follow: %v", err)
+    }
+    if o.Cluster != nil {
+      return fmt.Errorf("a follower cannot be a node of a cluster")
+    }
+    if len(o.Webhooks) > 0 {
+      return fmt.Errorf("webhooks require a leader, the follower would deliver every change again")
+    }
+  }
+  if o.Raft != nil {
+    if err := o.Raft.Validate(); err != nil {
+      return fmt.Errorf("raft: %v", err)
+    }
+    if o.Follow != nil {
+      return fmt.Errorf("a member of a raft group cannot follow a leader")
+    }
+    if len(o.Webhooks) > 0 {
+      return fmt.Errorf("webhooks cannot be used with raft, every member would deliver every change")
+    }
+  }
+
+  switch o.LockMode {
+  case LockTry:
+    if o.LockTimeout != 0 {
+      return fmt.Errorf("lock timeout requires the wait lock mode")
+    }
+  case LockWait:
+    if o.LockTimeout <= 0 {
+      return fmt.Errorf("wait lock mode requires a positive lock timeout")
+    }
+  default:
+    return fmt.Errorf("unknown lock mode %v", o.LockMode)
+  }
+
+  if err := o.CustomerDurability.Validate(); err != nil {
+    return fmt.Errorf("customer storage: %v", err)
+  }
+  if err := o.ItemDurability.Validate(); err != nil {
+    return fmt.Errorf("item storage: %v", err)
+  }
+  if o.MaxOpenShards < 0 {
+    return fmt.Errorf("max open shards must not be negative")
+  }
+  if o.ShardIdleTimeout < 0 {
+    return fmt.Errorf("shard idle timeout must not be negative")
+  }
+  if o.OpenTimeout < 0 {
+    return fmt.Errorf("open timeout must not be negative")
+  }
+
+  if err := o.Expiry.Validate(); err != nil {
+    return fmt.Errorf("expiry: %v", err)
+  }
+
+  if len(o.Webhooks) > 0 && !o.Journal {
+    return fmt.Errorf("webhooks require the journal")
+  }
+  names := make(map[string]bool)
+  for _, hook := range o.Webhooks {
+    if err := hook.Validate(); err != nil {
+      return err
+    }
+    if names[hook.Name] {
+      return fmt.Errorf("webhook %v is defined twice", hook.Name)
+    }
+    names[hook.Name] = true
+  }
+  return nil
+}
+
+// Open prepares the handler for serving requests.  Shards are
+// opened lazily.  Opening an open handler is a no-op, opening a
+// closed one makes it usable again.
+func (h *Handler) Open() error {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  if !h.closed {
+    return nil
+  }
+
+  if err := os.MkdirAll(h.dir, 0700); err != nil {
+    return err
+  }
+  if err := checkLayout(h.dir, h.layout()); err != nil {
+    return err
+  }
+
+  if err := h.variants.open(); err != nil {
+    return err
+  }
+  if err := h.checkVariantIDs(); err != nil {
+    h.iStorage.Close()
+    h.variants.close()
+    return err
+  }
+
+  if h.journaling {
+    j, err := OpenJournal(filepath.Join(h.dir, JournalFileName), h.journalSync)
+    if err != nil {
+      h.variants.close()
+      return err
+    }
+    h.journal = j
+  }
+  for _, hook := range h.webhooks {
+    d, err := startDispatcher(hook, h.journal, h.dir)
+    if err != nil {
+      h.stopDispatchers()
+      h.journal.Close()
+      h.journal = nil
+      h.variants.close()
+      return err
+    }
+    h.dispatchers = append(h.dispatchers, d)
+  }
+
+  if h.follow != nil {
+    readOnly, err := h.startReplicator()
+    if err != nil {
+      h.stopDispatchers()
+      if h.journal != nil {
+        h.journal.Close()
+        h.journal = nil
+      }
+      h.variants.close()
+      return err
+    }
+    h.readOnly = readOnly
+  }
+  if h.raft != nil {
+    if err := h.startRaft(); err != nil {
+      if h.journal != nil {
+        h.journal.Close()
+        h.journal = nil
+      }
+      h.variants.close()
+      return err
+    }
+  }
+
+  h.cStorage.startJanitor()
+  h.iStorage.startJanitor()
+  // Followers get their items expired by the leader.
+  if !h.readOnly {
+    h.startSweeper()
+  }
+  h.closed = false
+  return nil
+}
+
+// Stop delivering to the webhooks.
+func (h *Handler) stopDispatchers() {
+  for _, d := range h.dispatchers {
+    d.stop()
+  }
+  h.dispatchers = nil
+}
+
+// IDs returns how customers and items are identified.
+func (h *Handler) IDs() IDMode {
+  return h.ids
+}
+
+// Return how the data of the handler is laid out.
+func (h *Handler) layout() Layout {
+  return Layout{
+    IDs: h.ids.String(),
+    Mapping: h.mapping.String(),
+    Shards: len(h.cStorage.shards),
+    Variants: true,
+  }
+}
+
+// IsClosed reports whether the handler has been closed.
+func (h *Handler) IsClosed() bool {
+  h.mu.RLock()
+  defer h.mu.RUnlock()
+  return h.closed
+}
+
+// Mark the start of a request.  Return false if the handler is
+// closed.  Otherwise the caller must call h.leave() once it is
+// done with the storage.
+func (h *Handler) begin() bool {
+  h.mu.RLock()
+  if h.closed {
+    h.mu.RUnlock()
+    return false
+  }
+  return true
+}
+
+// Like h.begin(), but also let an HTTP client know that the
+// handler is closed.
+func (h *Handler) enter(w http.ResponseWriter) bool {
+  if !h.begin() {
+    w.WriteHeader(http.StatusServiceUnavailable)
+    fmt.Fprintf(w, "error: %v", ErrClosed)
+    return false
+  }
+  return true
+}
+
+// Mark the end of a request started with h.begin() or h.enter().
+func (h *Handler) leave() {
+  h.mu.RUnlock()
+}
+
+// Given a key, acquire the lock according to the lock mode.
+// Return success or failure.
+func (h *Handler) lock(l *ShardedLock, key string) bool {
+  if h.lockMode == LockWait {
+    return l.LockTimeout(key, h.lockTimeout)
+  }
+  return l.TryLock(key)
+}
+
+// Write the status of a request that failed, if the error calls for
+// one other than 200: 503 Service Unavailable if the request was
+// turned away before anything happened, so that trying again is
+// safe, and 504 Gateway Timeout if it is not known whether a change
+// was made, see ErrUnavailable.
+func writeStatus(w http.ResponseWriter, err error) {
+  switch {
+  case errors.Is(err, ErrUnavailable):
+    w.WriteHeader(http.StatusGatewayTimeout)
+  case errors.Is(err, ErrBusy) || errors.Is(err, ErrClosed) ||
+    errors.Is(err, ErrNotLeader) || errors.Is(err, ErrShardOpen):
+    w.WriteHeader(http.StatusServiceUnavailable)
   }
-	return &h
 }
 
 func (h* Handler) Ping(w http.ResponseWriter, r *http.Request) {
   fmt.Fprintf(w, "ping\n")
 }
 
+// This function is responsible for handling /admin/storage queries.
+// It reports the durability settings of every storage, one per line.
+func (h* Handler) AdminStorage(w http.ResponseWriter, r *http.Request) {
+  fmt.Fprintf(w, "OK\n")
+  for _, storage := range [...]*ShardedStorage{&h.cStorage, &h.iStorage} {
+    fmt.Fprintf(w, "%v %v\n", storage.name, storage.Durability())
+  }
+}
+
+// This function is responsible for handling /admin/shards queries.
+// It reports how many shards every storage keeps open, and how
+// often it had to open and close them.
+func (h* Handler) AdminShards(w http.ResponseWriter, r *http.Request) {
+  fmt.Fprintf(w, "OK\n")
+  for _, storage := range [...]*ShardedStorage{&h.cStorage, &h.iStorage} {
+    fmt.Fprintf(w, "%v %v\n", storage.name, storage.Metrics())
+  }
+}
+
+// This function is responsible for handling /admin/verify queries.
+// It reports every mismatch between the customer and the item
+// index.  With repair=true, which requires POST, it also fixes the
+// item index.
+func (h* Handler) AdminVerify(w http.ResponseWriter, r *http.Request) {
+  repair, _ := strconv.ParseBool(r.URL.Query().Get("repair"))
+  if repair && r.Method != "POST" {
+    w.Header().Set("Allow", "POST")
+    w.WriteHeader(http.StatusMethodNotAllowed)
+    fmt.Fprintf(w, "error: repairing requires POST")
+    return
+  }
+
+  var lines []string
+  var collect = func(m Mismatch) error {
+    lines = append(lines, m.String())
+    return nil
+  }
+
+  var err error
+  if repair {
+    err = h.Repair(collect)
+  } else {
+    err = h.Verify(collect)
+  }
+
+  writeStatus(w, err)
+  if err != nil {
+    fmt.Fprintf(w, "error: %v", err)
+    return
+  }
+
+  fmt.Fprintf(w, "OK\n")
+  for _, line := range lines {
+    fmt.Fprintf(w, "%v\n", line)
+  }
+}
+
+// This function is responsible for handling /admin/backup queries.
+// It streams a gzipped tar archive holding a snapshot of every shard.
+func (h* Handler) AdminBackup(w http.ResponseWriter, r *http.Request) {
+  if !h.enter(w) {
+    return
+  }
+  defer h.leave()
+
+  w.Header().Set("Content-Type", "application/gzip")
+  w.Header().Set("Content-Disposition", `attachment; filename="cart-backup.tar.gz"`)
+
+  // A large archive takes longer than the server's write timeout.
+  http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+  // The status is out by the time anything can go wrong, all we
+  // can do is cut the archive short.
+  if err := h.backup(w, nil); err != nil {
+    log.Printf("backup failed: %v", err)
+    panic(http.ErrAbortHandler)
+  }
+}
+
 // This function is responsible for handling /list queries.
 // A valid parameter for the list query is either an item or a
-// customer id, but not both.
+// customer id, but not both.  An item can be narrowed down to
+// one of its variants with the variant parameter, otherwise the
+// customers of every variant of it are listed.
 func (h* Handler) List(w http.ResponseWriter, r *http.Request) {
+  if !h.enter(w) {
+    return
+  }
+  defer h.leave()
 
-  // A helper function for communication with the client.
-  var printcustomer = func (w http.ResponseWriter) (func(*setT) error) {
-    return func(s *setT) error {
-      fmt.Fprintf(w, "OK\n",)
-      for k, v := range *s {
-        fmt.Fprintf(w, "%v %v\n", k, v)
-      }
-      return nil
-    }
+  // Only the leader of a raft group has every change.
+  if h.toLeader(w, r) {
+    return
   }
 
-  // Make sure that only one parameter is being passed to this
-  // handler.  Otherwise, report an error to the client.
-  if len(r.URL.Query()) != 1 {
+  // Make sure that only one parameter, besides the variant, is
+  // being passed to this handler.  Otherwise, report an error to
+  // the client.
+  _, hasVariant := r.URL.Query()["variant"]
+  if n := len(r.URL.Query()); n != 1 && (n != 2 || !hasVariant) {
     err := fmt.Errorf("you can specify only one arg")
     fmt.Fprintf(w, "error: %v", err)
     return
@@ -61,109 +582,486 @@ func (h* Handler) List(w http.ResponseWriter, r *http.Request) {
     return
   }
 
-  // Depending on the parameter type, use the proper
-  // storage and locking instances.
-  var key uint32
-  var storage *ShardedStorage
-  var lock *ShardedLock
+  // List items associated with a customer id.
+  if customerErr == nil {
+    if hasVariant {
+      fmt.Fprintf(w, "error: a variant requires an item")
+      return
+    }
+    if node := h.keyOwner(string(customer)); node != nil {
+      h.forward(w, r, node)
+      return
+    }
+    h.listCustomer(w, string(customer))
+    return
+  }
 
-  // List customer ids associated with an item?
-  if itemErr == nil {
-    key = uint32(item)
-    storage = &h.iStorage
-    lock = &h.iLock
+  // Every variant of the item lives with it.
+  if node := h.keyOwner(string(item)); node != nil {
+    h.forward(w, r, node)
+    return
   }
 
-  // List items associated with a customer id.
-  if customerErr == nil {
-    key = uint32(customer)
-    storage = &h.cStorage
-    lock = &h.cLock
+  // List customer ids associated with an item.
+  variant, err := h.checkVariantArg(w, r)
+  if err != nil {
+    fmt.Fprintf(w, "error: %v", err)
+    return
   }
+  h.listItem(w, string(item), variant)
+}
 
+// Write the cart of the customer, one item per line followed by
+// the attributes of its variant, if any.
+func (h* Handler) listCustomer(w http.ResponseWriter, customer string) {
   // Try to acquire the lock.
-  if !lock.TryLock(key) {
+  if !h.lock(&h.cLock, customer) {
     // We failed. Let the client know.
     w.WriteHeader(http.StatusServiceUnavailable)
     return
   }
   // in case we succeeded, make sure to release the lock
   // when we're done.
-  defer lock.MustUnlock(key)
+  defer h.cLock.MustUnlock(customer)
 
   // Ask the underlying storage for the corresponding
-  // value.  The result is going to be handled by
-  // printcustomer(w) function.
-  err := storage.ObserveValue(key, printcustomer(w))
+  // value.
+  err := h.cStorage.ObserveValue(customer, func(s *setT) error {
+    fmt.Fprintf(w, "OK\n",)
+    for k, v := range *s {
+      key, err := h.itemKey(k)
+      if err != nil {
+        key = ItemKey{SKU: k}
+      }
+      fmt.Fprintf(w, "%v %v", key.SKU, v)
+      for _, attr := range key.Attributes() {
+        fmt.Fprintf(w, " %v", attr)
+      }
+      fmt.Fprintf(w, "\n")
+    }
+    return nil
+  })
   if (err != nil) {
+    writeStatus(w, err)
+    fmt.Fprintf(w, "error: %v", err)
+    return
+  }
+}
+
+// Write the customers having the item in their cart, one per line
+// with the quantity.  Without a variant, the quantities of every
+// variant of the item add up.
+func (h* Handler) listItem(w http.ResponseWriter, sku string, variant map[string]string) {
+  customers, err := h.itemCustomers(sku, variant)
+  if err == ErrBusy {
+    w.WriteHeader(http.StatusServiceUnavailable)
+    return
+  }
+  writeStatus(w, err)
+  if err != nil {
     fmt.Fprintf(w, "error: %v", err)
     return
   }
 
+  fmt.Fprintf(w, "OK\n",)
+  for k, v := range customers {
+    fmt.Fprintf(w, "%v %v\n", k, v)
+  }
+}
+
+// Return the customers having the item in their cart with the
+// quantity, the way listItem lists them.  Return ErrNoSuchKey if
+// nobody has it.  The caller must be inside a request.
+func (h* Handler) itemCustomers(sku string, variant map[string]string) (setT, error) {
+  var items []string
+  if variant != nil {
+    id, ok, err := h.variants.lookup(ItemKey{sku, variant})
+    if err != nil {
+      return nil, err
+    }
+    if !ok {
+      return nil, ErrNoSuchKey
+    }
+    items = []string{id}
+  } else {
+    items = h.variants.items(sku)
+  }
+
+  // One item at a time, so that we never hold more than one lock.
+  customers := make(setT)
+  found := false
+  for _, item := range items {
+    if !h.lock(&h.iLock, item) {
+      return nil, ErrBusy
+    }
+    err := h.iStorage.ObserveValue(item, func(s *setT) error {
+      for k, v := range *s {
+        customers[k] += v
+      }
+      return nil
+    })
+    h.iLock.MustUnlock(item)
+
+    if err == ErrNoSuchKey {
+      continue
+    }
+    if err != nil {
+      return nil, err
+    }
+    found = true
+  }
+  if !found {
+    return nil, ErrNoSuchKey
+  }
+  return customers, nil
 }
 
 // This function is responsible for handling /add and /remove
 // queries.  Two necessary parameters are the customer id and 
-// the item.
-func (h* Handler) Mod(f (func (*setT, uint32) error)) func(w http.ResponseWriter, r *http.Request) {
+// the item.  The optional qty, at most MaxModQty, changes that many
+// units at once.
+func (h* Handler) Mod(f (func (*setT, string) error)) func(w http.ResponseWriter, r *http.Request) {
   return func(w http.ResponseWriter, r *http.Request) {
 
-    // Make sure that only two parameters are being passed to 
-    // this handler.  Otherwise, report an error to the client.
-    if len(r.URL.Query()) != 2 {
-      err := fmt.Errorf("you need to specity two args")
-      fmt.Fprintf(w, "error: %v", err)
+    if !h.enter(w) {
       return
     }
+    defer h.leave()
+
+    if h.toLeader(w, r) {
+      return
+    }
+
+    // Make sure that only the customer, the item, the quantity and
+    // the line details are being passed to this handler.  Otherwise,
+    // report an error to the client.
+    for k := range r.URL.Query() {
+      switch k {
+      case "customer", "item", "variant", "qty", "price", "currency", "attr":
+      default:
+        fmt.Fprintf(w, "error: unknown parameter %q", k)
+        return
+      }
+    }
 
     // Make sure we have the customer id parameter.
     customer, err := h.checkCustomerArg(w, r)
     if err != nil {
       fmt.Fprintf(w, "error: %v", err)
+      return
+    }
+
+    // The node owning the customer changes both indexes.
+    if node := h.keyOwner(string(customer)); node != nil {
+      h.forward(w, r, node)
+      return
     }
 
     // Make sure we have the item parameter.
     item, err := h.checkItemArg(w, r)
     if err != nil {
       fmt.Fprintf(w, "error: %v", err)
+      return
+    }
+
+    // The variant is optional, without one the item is the SKU.
+    variant, err := h.checkVariantArg(w, r)
+    if err != nil {
+      fmt.Fprintf(w, "error: %v", err)
+      return
+    }
+    if h.readOnly {
+      fmt.Fprintf(w, "error: %v", ErrReadOnly)
+      return
     }
 
-    // We need to acquire both locks.  One for the item shard
-    // and the other one for the customer id shard
-    if !h.cLock.TryLock(uint32(customer)) {
-      w.WriteHeader(http.StatusServiceUnavailable)
+    // The price, currency and attributes are optional.
+    details, err := h.checkDetailsArg(w, r)
+    if err != nil {
+      fmt.Fprintf(w, "error: %v", err)
       return
     }
-    defer h.cLock.MustUnlock(uint32(customer))
 
-    if !h.iLock.TryLock(uint32(item)) {
-      w.WriteHeader(http.StatusServiceUnavailable)
+    // So is the quantity, one unit by default.
+    qty, err := h.checkQtyArg(w, r)
+    if err != nil {
+      fmt.Fprintf(w, "error: %v", err)
       return
     }
-    defer h.iLock.MustUnlock(uint32(item))
+    mod := f
+    if qty > 1 {
+      mod = repeatInSet(f, qty)
+    }
 
-    // Update the customer's customer by making appropriate changes.
-    err = h.cStorage.ChangeValue(uint32(customer), uint32(item), f)
-    if (err != nil) {
+    // Only once the request is known to be valid, so that a new
+    // variant is not registered for nothing.
+    id, err := h.modItem(ItemKey{string(item), variant}, mod)
+    if err != nil {
       fmt.Fprintf(w, "error: %v", err)
       return
     }
 
-    // Update the mapping between an item and customers that have it
-    // in their customers.
-    err = h.iStorage.ChangeValue(uint32(item), uint32(customer), f)
+    err = h.apply(string(customer), id, mod, details)
+    writeStatus(w, err)
     if (err != nil) {
       fmt.Fprintf(w, "error: %v", err)
       return
     }
 
-    // TODO: In case the later action fails, we need to revert
-    // the first change.
-
     fmt.Fprintf(w, "OK\n")
   }
 }
 
+// Apply lets the function f modify the cart of the customer and
+// the item's customer list, the same way /add and /remove do.
+// The item is a SKU or a variant id from ItemID.  Return ErrBusy
+// if one of the shards is locked.
+func (h* Handler) Apply(customer string, item string,
+f (func (*setT, string) error)) error {
+  if !h.begin() {
+    return ErrClosed
+  }
+  defer h.leave()
+
+  if err := h.checkIDs(customer, item); err != nil {
+    return err
+  }
+  if err := h.checkOwner(customer); err != nil {
+    return err
+  }
+
+  return h.apply(customer, item, f, nil)
+}
+
+// ApplyLine is Apply, but it also sets the details of the line if
+// the item is still in the cart afterwards.
+func (h* Handler) ApplyLine(customer string, item string,
+f (func (*setT, string) error), details LineDetails) error {
+  if err := details.Validate(); err != nil {
+    return err
+  }
+  if !h.begin() {
+    return ErrClosed
+  }
+  defer h.leave()
+
+  if err := h.checkIDs(customer, item); err != nil {
+    return err
+  }
+  if err := h.checkOwner(customer); err != nil {
+    return err
+  }
+
+  return h.apply(customer, item, f, &details)
+}
+
+// The body of Apply.  The caller must be inside a request.
+func (h* Handler) apply(customer string, item string,
+f (func (*setT, string) error), details *LineDetails) error {
+  if h.readOnly {
+    return ErrReadOnly
+  }
+
+  // We need to acquire both locks.  One for the item shard
+  // and the other one for the customer id shard
+  if !h.lock(&h.cLock, customer) {
+    return ErrBusy
+  }
+  defer h.cLock.MustUnlock(customer)
+
+  return h.applyItem(customer, item, f, details, "")
+}
+
+// Let f modify both indexes, set the details of the line if given,
+// and journal the change as op, or as add or remove depending on
+// the quantity when op is empty.  The caller must hold the customer
+// lock.  An item owned by another node has its index changed there.
+// Members of a raft group make the change through the raft log.
+func (h* Handler) applyItem(customer string, item string,
+f (func (*setT, string) error), details *LineDetails, op Op) error {
+  if h.raft != nil {
+    return h.proposeItem(customer, item, f, details, op)
+  }
+
+  owner, err := h.itemOwner(item)
+  if err != nil {
+    return err
+  }
+  if owner == nil {
+    if !h.lock(&h.iLock, item) {
+      return ErrBusy
+    }
+    defer h.iLock.MustUnlock(item)
+  }
+
+  // Update the customer's customer by making appropriate changes.
+  // Keep track of the quantity before and after for the journal.
+  var before, after uint32
+  var items int
+  track := func(s *setT, v string) error {
+    before = (*s)[v]
+    err := f(s, v)
+    after = (*s)[v]
+    items = len(*s)
+    return err
+  }
+  now := time.Now()
+  line, err := h.cStorage.changeLineAt(customer, item, track, details, false, now)
+  if (err != nil) {
+    return err
+  }
+
+  // Update the mapping between an item and customers that have it
+  // in their customers.
+  if owner != nil {
+    // Put the cart back if the other node did not take the
+    // change, so that both indexes still agree.  It may have taken
+    // it before failing to answer, so put its index back too; the
+    // quantity is absolute, setting it twice does no harm.
+    if err = h.setRemoteItem(owner, customer, item, after); err != nil {
+      _, undoErr := h.cStorage.changeLineAt(customer, item, setQtyInSet(before), nil, false, time.Now())
+      return errors.Join(err, undoErr, h.setRemoteItem(owner, customer, item, before))
+    }
+  } else if err = h.iStorage.ChangeValue(item, customer, f); err != nil {
+    // Put the quantity in the cart back, so that both indexes
+    // still agree.  The details of the line stay as set.
+    _, undoErr := h.cStorage.changeLineAt(customer, item, setQtyInSet(before), nil, false, time.Now())
+    return errors.Join(err, undoErr)
+  }
+
+  // Record the change while we still hold the locks, so that the
+  // journal order matches the storage order of every pair.  Both
+  // indexes changed already, so a failure is only logged: reporting
+  // it would make the client try again and apply the change twice.
+  if h.journal != nil {
+    if op == "" {
+      op = OpAdd
+      if after < before {
+        op = OpRemove
+      }
+    }
+    key, err := h.itemKey(item)
+    if err == nil {
+      // The time of the line, so that replaying the entry stamps
+      // the line the same way.
+      e := JournalEntry{Op: op, Time: now.UTC(), Customer: h.ids.ID(customer),
+        Item: h.ids.ID(key.SKU), Variant: key.Variant, Qty: after, Items: items}
+      e.setDetails(line.Details())
+      err = h.journal.Append(&e)
+    }
+    if err != nil {
+      log.Printf("journal: customer %v item %v: %v", customer, item, err)
+    }
+  }
+
+  return nil
+}
+
+// This function is responsible for handling /clear queries.  It
+// empties the cart of the customer passed as the only parameter.
+func (h* Handler) Clear(w http.ResponseWriter, r *http.Request) {
+  if !h.enter(w) {
+    return
+  }
+  defer h.leave()
+
+  if h.toLeader(w, r) {
+    return
+  }
+
+  if len(r.URL.Query()) != 1 {
+    err := fmt.Errorf("you can specify only one arg")
+    fmt.Fprintf(w, "error: %v", err)
+    return
+  }
+
+  customer, err := h.checkCustomerArg(w, r)
+  if err != nil {
+    fmt.Fprintf(w, "error: %v", err)
+    return
+  }
+
+  if node := h.keyOwner(string(customer)); node != nil {
+    h.forward(w, r, node)
+    return
+  }
+
+  err = h.clear(string(customer))
+  writeStatus(w, err)
+  if err != nil {
+    fmt.Fprintf(w, "error: %v", err)
+    return
+  }
+
+  fmt.Fprintf(w, "OK\n")
+}
+
+// ClearCart removes every item from the cart of the customer, the
+// same way /clear does.  Return ErrBusy if one of the shards is
+// locked; the items removed so far stay removed.
+func (h* Handler) ClearCart(customer string) error {
+  if !h.begin() {
+    return ErrClosed
+  }
+  defer h.leave()
+
+  if c, err := h.ids.Parse(customer); err != nil || c != customer {
+    return fmt.Errorf("invalid customer id %q", customer)
+  }
+  if err := h.checkOwner(customer); err != nil {
+    return err
+  }
+
+  return h.clear(customer)
+}
+
+// The body of ClearCart.  The caller must be inside a request.
+func (h* Handler) clear(customer string) error {
+  if h.readOnly {
+    return ErrReadOnly
+  }
+  if !h.lock(&h.cLock, customer) {
+    return ErrBusy
+  }
+  defer h.cLock.MustUnlock(customer)
+
+  var items []string
+  err := h.cStorage.ObserveValue(customer, func(s *setT) error {
+    items = s.sortedKeys()
+    return nil
+  })
+  if err == ErrNoSuchKey {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+
+  // Item by item, so that both indexes agree even if we have to
+  // give up halfway through.
+  for _, item := range items {
+    if err := h.applyItem(customer, item, setQtyInSet(0), nil, OpClear); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Verify the quantity parameter, if passed, and return it.  Without
+// one, the quantity is 1.
+func (h* Handler) checkQtyArg(
+    w http.ResponseWriter, r *http.Request) (uint32, error) {
+
+  s := r.URL.Query().Get("qty")
+  if s == "" {
+    return 1, nil
+  }
+  qty, err := strconv.ParseUint(s, 10, 32)
+  if err != nil || qty == 0 || qty > MaxModQty {
+    return 0, fmt.Errorf("qty must be between 1 and %v", MaxModQty)
+  }
+  return uint32(qty), nil
+}
 
 // Verify that the item parameter is passed properly.
 func (h* Handler) checkItemArg(
@@ -173,42 +1071,97 @@ func (h* Handler) checkItemArg(
   itemStr, ok := r.URL.Query()["item"]
   if (!ok) {
     err := fmt.Errorf("item missing")
-    return 0, err
+    return "", err
   }
 
   // There is only one value?
   if len(itemStr) > 1 {
     err := fmt.Errorf("only one item allowed")
-    return 0, err
+    return "", err
   }
 
-  // is it a proper int?
-  // TODO: Check boundaries.
-  item, err := strconv.Atoi(itemStr[0])
-  if (err != nil) {
-    err := fmt.Errorf("invalid item id %v", item)
-    return 0, err
+  // is it a proper id?  Some of them are taken by variants.
+  item, err := h.ids.Parse(itemStr[0])
+  if (err != nil || h.ids.isVariant(item)) {
+    err := fmt.Errorf("invalid item id %v", itemStr[0])
+    return "", err
   }
 
   return itemID(item), nil
 }
 
+// Read the optional variant of the item, variant as name:value
+// any number of times.
+func (h* Handler) checkVariantArg(
+    w http.ResponseWriter, r *http.Request) (map[string]string, error) {
 
-// An optional cleanup function.
-func (h* Handler) Close() {
-  for _, storage := range [...]ShardedStorage{h.cStorage, h.iStorage} {
-    for _, s := range storage.shards {
-      if s == nil {
-        continue
-      }
+  variant, err := ParseAttributes(r.URL.Query()["variant"])
+  if err != nil {
+    return nil, fmt.Errorf("invalid variant: %v", err)
+  }
+  return variant, nil
+}
 
-      if s.db == nil {
-        continue
-      }
 
-      s.db.Close()
+// Close closes every open shard of both storages.  Requests
+// arriving afterwards get a 503 until the handler is opened again.
+// Closing a closed handler is a no-op.  The returned error
+// aggregates the failures of every shard.
+func (h* Handler) Close() error {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  if h.closed {
+    return nil
+  }
+  h.closed = true
+
+  h.stopSweeper()
+  h.stopDispatchers()
+  h.stopReplicator()
+
+  var errs []error
+  if h.raft != nil {
+    errs = append(errs, h.stopRaft())
+  }
+  errs = append(errs, h.cStorage.Close(), h.iStorage.Close(), h.variants.close())
+  if h.journal != nil {
+    errs = append(errs, h.journal.Close())
+    h.journal = nil
+  }
+  return errors.Join(errs...)
+}
+
+// Read the optional line details, price and currency together
+// and attr as name:value any number of times.
+func (h* Handler) checkDetailsArg(
+    w http.ResponseWriter, r *http.Request) (*LineDetails, error) {
+
+  q := r.URL.Query()
+  if q.Get("price") == "" && q.Get("currency") == "" && len(q["attr"]) == 0 {
+    return nil, nil
+  }
+
+  var details LineDetails
+  if s := q.Get("price"); s != "" {
+    price, err := strconv.ParseInt(s, 10, 64)
+    if err != nil {
+      return nil, fmt.Errorf("invalid price %v, expected minor units", s)
     }
+    details.Price = price
+  }
+  details.Currency = q.Get("currency")
+
+  attrs, err := ParseAttributes(q["attr"])
+  if err != nil {
+    return nil, err
+  }
+  details.Attributes = attrs
+
+  if err := details.Validate(); err != nil {
+    return nil, err
   }
+  return &details, nil
 }
 
 // Verify that the customer id parameter is passed properly.
@@ -219,26 +1172,41 @@ func (h* Handler) checkCustomerArg(
   customerStr, ok := r.URL.Query()["customer"]
   if (!ok) {
     err := fmt.Errorf("customer missing")
-    return 0, err
+    return "", err
   }
 
   // There is only one value?
   if len(customerStr) > 1 {
     err := fmt.Errorf("only one customer allowed")
-    return 0, err
+    return "", err
   }
 
-  // is it a proper int?
-  // TODO: Check boundaries.
-  customer, err := strconv.Atoi(customerStr[0])
+  // is it a proper id?
+  customer, err := h.ids.Parse(customerStr[0])
   if (err != nil) {
     err := fmt.Errorf("invalid customer id %v", customerStr)
-    return 0, err
+    return "", err
   }
 
   return customerID(customer), nil
 }
 
+// Make sure the ids passed to Apply and friends are canonical, and
+// that the item is a SKU or a registered variant.
+func (h* Handler) checkIDs(customer string, item string) error {
+  if c, err := h.ids.Parse(customer); err != nil || c != customer {
+    return fmt.Errorf("invalid customer id %q", customer)
+  }
+  if h.ids.isVariant(item) {
+    _, err := h.itemKey(item)
+    return err
+  }
+  if i, err := h.ids.Parse(item); err != nil || i != item {
+    return fmt.Errorf("invalid item id %q", item)
+  }
+  return nil
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.URL.Path {
 	case "/ping":
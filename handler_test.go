@@ -1,6 +1,7 @@
 package cart_test
 
 import (
+  "encoding/json"
   "fmt"
 	"net/http"
 	"net/http/httptest"
@@ -10,7 +11,10 @@ import (
 	"sync"
   "cart"
 	"strconv"
-//	"time"
+	"reflect"
+	"time"
+
+	"github.com/boltdb/bolt"
 )
 
 const (
@@ -74,6 +78,280 @@ func TestHandler_Remove(t *testing.T) {
   }
 }
 
+// Ensure qty changes that many units at once, or none at all.
+func TestHandler_ModQty(t *testing.T) {
+  h := cart.NewHandler()
+  defer cart.RemoveContents("shards/")
+  defer h.Close()
+
+  for _, tt := range []struct {
+    op, qty, expected string
+  }{
+    {"add", "3", "OK\n"},
+    {"remove", "4", "error: item not in the cart"},
+    {"remove", "2", "OK\n"},
+    {"add", "0", "error: qty must be between 1 and 1000"},
+    {"add", "1001", "error: qty must be between 1 and 1000"},
+  } {
+    r := modRequest(t, tt.op, 1, 10)
+    r.URL.RawQuery += "&qty=" + tt.qty
+    w := httptest.NewRecorder()
+    if tt.op == "add" {
+      h.Mod(cart.AddToSet)(w, r)
+    } else {
+      h.Mod(cart.RemoveFromSet)(w, r)
+    }
+    if w.Body.String() != tt.expected {
+      t.Fatalf("%v %v: expected `%s`, got `%s`", tt.op, tt.qty, tt.expected, w.Body.String())
+    }
+  }
+
+  w := httptest.NewRecorder()
+  h.List(w, listRequest(t, "customer", 1))
+  if w.Body.String() != "OK\n10 1\n" {
+    t.Fatalf("expected `OK\n10 1`, got `%s`", w.Body.String())
+  }
+}
+
+// Ensure the Handler reports the durability of every storage.
+func TestHandler_AdminStorage(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://localhost/admin/storage", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+  o := cart.DefaultOptions()
+  o.ItemDurability = cart.Durability{
+    Fsync: cart.FsyncInterval, SyncInterval: time.Second}
+  h, err := cart.NewHandlerWithOptions(o)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+  h.AdminStorage(w, r)
+
+  expected := "OK\n" +
+    "customer fsync=always no-grow-sync=false\n" +
+    "item fsync=interval sync-interval=1s no-grow-sync=false\n"
+	if w.Body.String() != expected {
+		t.Fatalf("expected `%s`, got `%s`", expected, w.Body.String())
+	}
+
+  o.ItemDurability = cart.Durability{Fsync: cart.FsyncInterval}
+  if _, err := cart.NewHandlerWithOptions(o); err == nil {
+		t.Fatalf("expected an error for a zero sync interval")
+  }
+}
+
+// Ensure a closed Handler turns requests away and can be reopened.
+func TestHandler_Lifecycle(t *testing.T) {
+  h := cart.NewHandler()
+  defer cart.RemoveContents("shards/")
+
+  w := httptest.NewRecorder()
+  h.Mod(cart.AddToSet)(w, modRequest(t, "add", 4321, 1234))
+	if w.Body.String() != "OK\n" {
+		t.Fatalf("expected `OK`, got `%s`", w.Body.String())
+	}
+
+  if err := h.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+  }
+  if !h.IsClosed() {
+		t.Fatalf("expected the handler to be closed")
+  }
+  if err := h.Close(); err != nil {
+		t.Fatalf("unexpected error on second close: %s", err)
+  }
+
+  w = httptest.NewRecorder()
+  h.List(w, listRequest(t, "customer", 4321))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status code 503, got %d", w.Code)
+	}
+
+  if err := h.Open(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+  }
+  defer h.Close()
+
+  w = httptest.NewRecorder()
+  h.List(w, listRequest(t, "customer", 4321))
+	if w.Body.String() != "OK\n1234 1\n" {
+		t.Fatalf("expected `OK\n1234 1`, got `%s`", w.Body.String())
+	}
+}
+
+// Ensure shards over the open limit get evicted and transparently
+// reopened.
+func TestHandler_ShardEviction(t *testing.T) {
+  o := cart.DefaultOptions()
+  o.MaxOpenShards = 1
+  h, err := cart.NewHandlerWithOptions(o)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+  defer cart.RemoveContents("shards/")
+  defer h.Close()
+
+  // Every customer and every item lands in a different shard.
+  for i := uint32(1); i <= 3; i++ {
+    w := httptest.NewRecorder()
+    h.Mod(cart.AddToSet)(w, modRequest(t, "add", i, 100 + i))
+    if w.Body.String() != "OK\n" {
+      t.Fatalf("expected `OK`, got `%s`", w.Body.String())
+    }
+  }
+
+  w := httptest.NewRecorder()
+  h.List(w, listRequest(t, "customer", 1))
+	if w.Body.String() != "OK\n101 1\n" {
+		t.Fatalf("expected `OK\n101 1`, got `%s`", w.Body.String())
+	}
+
+  w = httptest.NewRecorder()
+  h.AdminShards(w, nil)
+  expected := "OK\n" +
+    "customer open=1 opens=4 evictions=3 expirations=0\n" +
+    "item open=1 opens=3 evictions=2 expirations=0\n"
+	if w.Body.String() != expected {
+		t.Fatalf("expected `%s`, got `%s`", expected, w.Body.String())
+	}
+}
+
+// Ensure a shard that cannot be reopened makes requests answer 503
+// instead of bringing the server down.
+func TestHandler_ShardOpenFailure(t *testing.T) {
+  o := cart.DefaultOptions()
+  o.MaxOpenShards = 1
+  o.OpenTimeout = 50 * time.Millisecond
+  h, err := cart.NewHandlerWithOptions(o)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+  defer cart.RemoveContents("shards/")
+  defer h.Close()
+
+  for i := uint32(1); i <= 2; i++ {
+    h.Mod(cart.AddToSet)(httptest.NewRecorder(), modRequest(t, "add", i, 100 + i))
+  }
+
+  // Another process holds on to the evicted shard of customer 1.
+  paths, err := cart.ShardFiles("shards/", cart.CustomerStorage)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  var held []*bolt.DB
+  for _, path := range paths {
+    if db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Millisecond}); err == nil {
+      held = append(held, db)
+    }
+  }
+  if len(held) != 1 {
+    t.Fatalf("expected to hold 1 shard, got %v", len(held))
+  }
+
+  for _, r := range []*http.Request{modRequest(t, "add", 1, 101), listRequest(t, "customer", 1)} {
+    w := httptest.NewRecorder()
+    if r.URL.Path == "/add" {
+      h.Mod(cart.AddToSet)(w, r)
+    } else {
+      h.List(w, r)
+    }
+    if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "cannot open shard") {
+      t.Fatalf("%v: expected a 503, got %v `%s`", r.URL, w.Code, w.Body.String())
+    }
+  }
+
+  // Once it is released, the shard opens again.
+  held[0].Close()
+  w := httptest.NewRecorder()
+  h.List(w, listRequest(t, "customer", 1))
+	if w.Body.String() != "OK\n101 1\n" {
+		t.Fatalf("expected `OK\n101 1`, got `%s`", w.Body.String())
+	}
+}
+
+// Ensure the change feed lists the changes of one shard in order,
+// resumes after an offset and waits for new changes.
+func TestHandler_Changes(t *testing.T) {
+  o := cart.DefaultOptions()
+  o.Journal = true
+  h, err := cart.NewHandlerWithOptions(o)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+  defer cart.RemoveContents("shards/")
+  defer h.Close()
+
+  // Customers 1 and 1025 share a shard, customer 2 does not.
+  for _, l := range [][2]uint32{{1, 10}, {1, 10}, {2, 10}, {1025, 11}} {
+    w := httptest.NewRecorder()
+    h.Mod(cart.AddToSet)(w, modRequest(t, "add", l[0], l[1]))
+  }
+  w := httptest.NewRecorder()
+  h.Clear(w, httptest.NewRequest("GET", "http://localhost/clear?customer=1", nil))
+	if w.Body.String() != "OK\n" {
+		t.Fatalf("expected `OK`, got `%s`", w.Body.String())
+	}
+
+  feed := func(query string) string {
+    w := httptest.NewRecorder()
+    h.Feed(w, httptest.NewRequest("GET", "http://localhost/changes?" + query, nil))
+    return w.Body.String()
+  }
+
+  // Only keep what does not depend on the clock.
+  summary := func(body string) []string {
+    lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+    if lines[0] != "OK" {
+      t.Fatalf("expected `OK`, got `%s`", body)
+    }
+    var changes []string
+    for _, line := range lines[1:] {
+      var e cart.JournalEntry
+      if err := json.Unmarshal([]byte(line), &e); err != nil {
+        t.Fatalf("unexpected error: %s", err)
+      }
+      changes = append(changes, fmt.Sprintf("%v %v %v %v %v", e.Seq, e.Op, e.Customer, e.Item, e.Qty))
+    }
+    return changes
+  }
+
+  expected := []string{"1 add 1 10 1", "2 add 1 10 2", "4 add 1025 11 1", "5 clear 1 10 0"}
+  if got := summary(feed("shard=1")); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+  }
+
+  // Resume after the second change, one change at a time.
+  expected = []string{"4 add 1025 11 1"}
+  if got := summary(feed("shard=1&after=2&limit=1")); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+  }
+
+  // Nothing new, so the wait runs out.
+  if got := feed("shard=1&after=5&wait=10ms"); got != "OK\n" {
+		t.Fatalf("expected `OK`, got `%s`", got)
+  }
+
+  // A change arriving while waiting ends the wait.
+  go func() {
+    time.Sleep(20 * time.Millisecond)
+    h.Mod(cart.AddToSet)(httptest.NewRecorder(), modRequest(t, "add", 1, 12))
+  }()
+  expected = []string{"6 add 1 12 1"}
+  if got := summary(feed("shard=1&after=5&wait=10s")); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+  }
+
+  for _, query := range []string{"shard=1024", "after=6&wait=1000h"} {
+    if got := feed(query); !strings.HasPrefix(got, "error:") {
+      t.Fatalf("%v: expected an error, got `%s`", query, got)
+    }
+  }
+}
+
 func listRequest(
   t *testing.T, op string, key uint32) *http.Request {
 
@@ -115,7 +393,6 @@ wg* sync.WaitGroup,
 data chan map[uint32]map[uint32]uint32) {
 
 	basket := make(map[uint32]map[uint32]uint32)
-  w := httptest.NewRecorder()
 	var slice []tuple
 
   for i := 0; i <= NumberOfThreadIterations; i++ {
@@ -129,6 +406,9 @@ data chan map[uint32]map[uint32]uint32) {
 	for _, pair  := range slice {
     r := modRequest(t, "add", pair.customer, pair.item)
 retry:
+    // A recorder keeps the first status code it sees, so
+    // every attempt needs a fresh one.
+    w := httptest.NewRecorder()
     h.Mod(cart.AddToSet)(w, r)
 
 		if w.Code == 503 {
@@ -141,7 +421,7 @@ retry:
 
 		basket[pair.customer][pair.item]++
     if !strings.HasPrefix(w.Body.String(), "OK") {
-			t.Fatalf("expected `OK`, got `%s`", w.Body.String())
+			t.Errorf("expected `OK`, got `%s`", w.Body.String())
     }
   }
 
@@ -198,7 +478,7 @@ t *testing.T, data map[uint32]map[uint32]uint32,h *cart.Handler) {
 
 			if (data[customer][uint32(i)] != uint32(n)) {
 				t.Fatalf("customer %v has %v of %v instead of %v",
-					customer, n)
+					customer, n, i, data[customer][uint32(i)])
 			}
 		}
 	}
@@ -219,7 +499,6 @@ func TestHandler_ParallelAdd(t *testing.T) {
 	}
 
 	total := <-done
-  h.Close()
 	checkCorrectness(t, total, h)
   h.Close()
   cart.RemoveContents("shards/")
@@ -0,0 +1,270 @@
+package cart
+
+import (
+  "bytes"
+  "encoding/gob"
+  "encoding/json"
+  "fmt"
+  "io"
+  "math"
+  "regexp"
+  "strconv"
+  "strings"
+)
+
+// How customers and items are identified.
+type IDMode int
+
+const (
+  // Decimal numbers that fit in 32 bits.  Keys are stored the way
+  // they always were.
+  NumericIDs IDMode = iota
+
+  // Opaque strings of letters, digits and _.:@- such as UUIDs or
+  // alphanumeric SKUs, at most MaxIDLength bytes long.
+  StringIDs
+)
+
+// The longest string id.
+const MaxIDLength = 128
+
+var stringID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:@-]*$`)
+
+// Starts the ids the variant registry hands out in string mode.
+// Client ids never start with it.
+const variantPrefix = "~"
+
+// Return the configuration name of the id mode.
+func (m IDMode) String() string {
+  switch m {
+  case NumericIDs:
+    return "numeric"
+  case StringIDs:
+    return "string"
+  }
+  return fmt.Sprintf("IDMode(%d)", int(m))
+}
+
+// Given a configuration name, return the matching id mode.
+func ParseIDMode(s string) (IDMode, error) {
+  switch s {
+  case "", "numeric":
+    return NumericIDs, nil
+  case "string":
+    return StringIDs, nil
+  }
+  return NumericIDs, fmt.Errorf("unknown id mode %q", s)
+}
+
+// Given an id as sent by a client, return it in its canonical
+// form, e.g. without leading zeros.
+func (m IDMode) Parse(s string) (string, error) {
+  if m == StringIDs {
+    if len(s) > MaxIDLength || !stringID.MatchString(s) {
+      return "", fmt.Errorf("invalid id %q", s)
+    }
+    return s, nil
+  }
+
+  n, err := strconv.ParseUint(s, 10, 32)
+  if err != nil {
+    return "", fmt.Errorf("invalid id %q", s)
+  }
+  return strconv.FormatUint(n, 10), nil
+}
+
+// Given a canonical id, return the key it is stored under.
+func (m IDMode) keyBytes(id string) ([]byte, error) {
+  if m == StringIDs {
+    return []byte(id), nil
+  }
+
+  n, err := strconv.ParseUint(id, 10, 32)
+  if err != nil {
+    return nil, fmt.Errorf("invalid id %q", id)
+  }
+  return getBytes(uint32(n))
+}
+
+// Given the key an id is stored under, return the id.
+func (m IDMode) extractKey(data []byte) (string, error) {
+  if m == StringIDs {
+    return string(data), nil
+  }
+
+  n, err := extractKey(data)
+  if err != nil {
+    return "", err
+  }
+  return strconv.FormatUint(uint64(n), 10), nil
+}
+
+// Return the binary representation of the set.  Numeric sets are
+// stored with numeric keys, the way they always were.
+func (m IDMode) encodeSet(s setT) ([]byte, error) {
+  if m == StringIDs {
+    return getBytes(s)
+  }
+
+  numeric := make(map[uint32]uint32, len(s))
+  for k, v := range s {
+    n, err := strconv.ParseUint(k, 10, 32)
+    if err != nil {
+      return nil, fmt.Errorf("invalid id %q", k)
+    }
+    numeric[uint32(n)] = v
+  }
+  return getBytes(numeric)
+}
+
+// Given the binary representation of a set, return the set.  No
+// data at all is an empty set.
+func (m IDMode) extractSet(data []byte) (*setT, error) {
+  set := make(setT)
+  if data == nil {
+    return &set, nil
+  }
+
+  dec := gob.NewDecoder(bytes.NewReader(data))
+  if m == StringIDs {
+    if err := dec.Decode(&set); err != nil {
+      return nil, err
+    }
+    return &set, nil
+  }
+
+  var numeric map[uint32]uint32
+  if err := dec.Decode(&numeric); err != nil {
+    return nil, err
+  }
+  for k, v := range numeric {
+    set[strconv.FormatUint(uint64(k), 10)] = v
+  }
+  return &set, nil
+}
+
+// Write the gob encoded lines of the cart.
+func (m IDMode) encodeLines(w io.Writer, c cartT) error {
+  enc := gob.NewEncoder(w)
+  if m == StringIDs {
+    return enc.Encode(c)
+  }
+
+  numeric := make(map[uint32]*Line, len(c))
+  for k, l := range c {
+    n, err := strconv.ParseUint(k, 10, 32)
+    if err != nil {
+      return fmt.Errorf("invalid id %q", k)
+    }
+    numeric[uint32(n)] = l
+  }
+  return enc.Encode(numeric)
+}
+
+// Read the gob encoded lines of a cart.
+func (m IDMode) extractLines(r io.Reader) (cartT, error) {
+  c := make(cartT)
+  dec := gob.NewDecoder(r)
+  if m == StringIDs {
+    if err := dec.Decode(&c); err != nil {
+      return nil, err
+    }
+    return c, nil
+  }
+
+  var numeric map[uint32]*Line
+  if err := dec.Decode(&numeric); err != nil {
+    return nil, err
+  }
+  for k, l := range numeric {
+    c[strconv.FormatUint(uint64(k), 10)] = l
+  }
+  return c, nil
+}
+
+// Return the id of the variant with the given sequence number.
+// Numeric variant ids come after MaxItem.
+func (m IDMode) variantID(seq uint64) (string, error) {
+  if m == StringIDs {
+    return variantPrefix + strconv.FormatUint(seq, 10), nil
+  }
+  if seq > math.MaxUint32 - MaxItem {
+    return "", fmt.Errorf("out of variant ids")
+  }
+  return strconv.FormatUint(MaxItem + seq, 10), nil
+}
+
+// Report whether the item id was handed out to a variant.
+func (m IDMode) isVariant(item string) bool {
+  if m == StringIDs {
+    return strings.HasPrefix(item, variantPrefix)
+  }
+  n, err := strconv.ParseUint(item, 10, 32)
+  return err == nil && n > MaxItem
+}
+
+// Return the id as it appears in JSON.
+func (m IDMode) ID(s string) ID {
+  return ID{Value: s, Numeric: m == NumericIDs}
+}
+
+// A customer or item id as it appears in JSON, e.g. in the journal
+// and in webhook events.  Numeric ids are written as numbers, so
+// that numeric deployments keep their formats, and string ids as
+// strings.
+type ID struct {
+  Value   string
+  Numeric bool
+}
+
+func (id ID) String() string {
+  return id.Value
+}
+
+func (id ID) MarshalJSON() ([]byte, error) {
+  if id.Numeric {
+    return []byte(id.Value), nil
+  }
+  return json.Marshal(id.Value)
+}
+
+func (id *ID) UnmarshalJSON(data []byte) error {
+  if len(data) > 0 && data[0] == '"' {
+    id.Numeric = false
+    return json.Unmarshal(data, &id.Value)
+  }
+
+  var n uint32
+  if err := json.Unmarshal(data, &n); err != nil {
+    return err
+  }
+  id.Value, id.Numeric = strconv.FormatUint(uint64(n), 10), true
+  return nil
+}
+
+// LessID orders ids the way people expect, and the way they are
+// listed: numbers by value first, then everything else
+// alphabetically.
+func LessID(a, b string) bool {
+  na, nb := isNumber(a), isNumber(b)
+  switch {
+  case na && nb:
+    return len(a) < len(b) || (len(a) == len(b) && a < b)
+  case na != nb:
+    return na
+  }
+  return a < b
+}
+
+// Report whether s is a decimal number without leading zeros.
+func isNumber(s string) bool {
+  if s == "" || (len(s) > 1 && s[0] == '0') {
+    return false
+  }
+  for i := 0; i < len(s); i++ {
+    if s[i] < '0' || s[i] > '9' {
+      return false
+    }
+  }
+  return true
+}
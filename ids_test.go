@@ -0,0 +1,148 @@
+package cart
+
+import (
+  "bytes"
+  "io/ioutil"
+  "net/http/httptest"
+  "os"
+  "sort"
+  "strings"
+  "testing"
+)
+
+// Ensure string ids work end to end, and that data is never opened
+// with the wrong id mode.
+func TestHandler_StringIDs(t *testing.T) {
+  dir, err := ioutil.TempDir("", "cart")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  defer os.RemoveAll(dir)
+
+  o := DefaultOptions()
+  o.Dir = dir
+  o.IDs = StringIDs
+  h, err := NewHandlerWithOptions(o)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  defer func() { h.Close() }()
+
+  // Return the response lines, sorted after the status line.
+  do := func(path string) []string {
+    w := httptest.NewRecorder()
+    r := httptest.NewRequest("GET", "http://localhost" + path, nil)
+    if strings.HasPrefix(path, "/list") {
+      h.List(w, r)
+    } else {
+      h.Mod(AddToSet)(w, r)
+    }
+    lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+    sort.Strings(lines[1:])
+    return lines
+  }
+
+  const customer = "3f2b8c1e-7a4d-4e5f-9b6a-0c1d2e3f4a5b"
+  for _, path := range []string{
+    "/add?customer=" + customer + "&item=SKU-42",
+    "/add?customer=" + customer + "&item=SKU-42",
+    "/add?customer=" + customer + "&item=SKU-42&variant=size:M",
+    "/add?customer=7&item=SKU-42",
+  } {
+    if got := do(path); got[0] != "OK" {
+      t.Fatalf("%v: expected `OK`, got %v", path, got)
+    }
+  }
+
+  expected := map[string]string{
+    "/list?customer=" + customer: "OK SKU-42 1 size:M|SKU-42 2",
+    "/list?item=SKU-42": "OK " + customer + " 3|7 1",
+    "/list?item=SKU-42&variant=size:M": "OK " + customer + " 1",
+  }
+  check := func() {
+    for path, lines := range expected {
+      got := do(path)
+      if joined := got[0] + " " + strings.Join(got[1:], "|"); joined != lines {
+        t.Fatalf("%v: expected %v, got %v", path, lines, joined)
+      }
+    }
+  }
+  check()
+
+  for _, path := range []string{
+    "/add?customer=a+b&item=SKU-42",
+    "/add?customer=1&item=~1",
+    "/add?customer=1&item=" + strings.Repeat("x", MaxIDLength + 1),
+    "/list?customer=",
+  } {
+    if got := do(path); !strings.HasPrefix(got[0], "error:") {
+      t.Fatalf("%v: expected an error, got %v", path, got)
+    }
+  }
+
+  var backup bytes.Buffer
+  if err := h.Backup(&backup); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if err := h.Close(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  // The data refuses to open with numeric ids, before and after a
+  // restore.
+  restored, err := ioutil.TempDir("", "cart")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  defer os.RemoveAll(restored)
+  if _, err := Restore(&backup, restored, NShards); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  for _, dir := range []string{dir, restored} {
+    o.Dir = dir
+    o.IDs = NumericIDs
+    if h, err := NewHandlerWithOptions(o); err == nil {
+      h.Close()
+      t.Fatalf("%v: expected an error opening string ids as numeric", dir)
+    }
+
+    o.IDs = StringIDs
+    if h, err = NewHandlerWithOptions(o); err != nil {
+      t.Fatalf("unexpected error: %s", err)
+    }
+    check()
+    if found := verify(t, h); len(found) != 0 {
+      t.Fatalf("expected consistent indexes, got %v", found)
+    }
+    h.Close()
+  }
+}
+
+// Ensure ids parse to their canonical form and sort numbers first.
+func TestIDMode_Parse(t *testing.T) {
+  for _, c := range []struct {
+    ids IDMode
+    in, out string
+  }{
+    {NumericIDs, "007", "7"},
+    {NumericIDs, "4294967295", "4294967295"},
+    {NumericIDs, "4294967296", ""},
+    {NumericIDs, "abc", ""},
+    {StringIDs, "007", "007"},
+    {StringIDs, "user@example.com", "user@example.com"},
+    {StringIDs, "-1", ""},
+    {StringIDs, "", ""},
+  } {
+    got, err := c.ids.Parse(c.in)
+    if got != c.out || (err == nil) != (c.out != "") {
+      t.Fatalf("%v %q: expected %q, got %q, %v", c.ids, c.in, c.out, got, err)
+    }
+  }
+
+  ids := []string{"b", "10", "a", "9", "010"}
+  sort.Slice(ids, func(i, j int) bool { return LessID(ids[i], ids[j]) })
+  if joined := strings.Join(ids, " "); joined != "9 10 010 a b" {
+    t.Fatalf("expected `9 10 010 a b`, got `%v`", joined)
+  }
+}
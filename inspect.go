@@ -0,0 +1,289 @@
+package cart
+
+import (
+  "errors"
+  "fmt"
+  "os"
+  "path/filepath"
+  "sort"
+
+	"github.com/boltdb/bolt"
+)
+
+// Statistics about a single storage shard.
+type ShardStats struct {
+  Storage string // The storage type-name.
+  Shard   uint32 // Shard number/id.
+  Keys    int    // Number of keys, i.e. customers or items.
+  Entries int    // Number of (key, value) pairs over all keys.
+  Size    int64  // Size of the shard file in bytes.
+}
+
+// A (customer, item) pair whose quantity differs between the
+// customer and the item index.  A zero quantity means the
+// pair is missing from that index.
+type Mismatch struct {
+  Customer    string
+  Item        string
+  CustomerQty uint32 // Quantity according to the customer index.
+  ItemQty     uint32 // Quantity according to the item index.
+}
+
+func (m Mismatch) String() string {
+  return fmt.Sprintf("customer %v item %v: customer index has %v, item index has %v",
+    m.Customer, m.Item, m.CustomerQty, m.ItemQty)
+}
+
+// Return the ids of the shards that exist on disk.  Unlike
+// getShard, this never creates a new shard file.
+func (s *ShardedStorage) existingShards() ([]uint32, error) {
+  paths, err := ShardFiles(s.folder, s.name)
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  var ids []uint32
+  for _, path := range paths {
+    _, id, _ := ParseShardFileName(filepath.Base(path))
+    if id >= uint32(len(s.shards)) {
+      return nil, fmt.Errorf("%v shard %v is out of range, there are only %v shards",
+        s.name, id, len(s.shards))
+    }
+    ids = append(ids, id)
+  }
+  sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+  return ids, nil
+}
+
+// Call f on every shard that exists on disk, in shard order.
+func (s *ShardedStorage) forEachShard(f func(*storageShard) error) error {
+  ids, err := s.existingShards()
+  if err != nil {
+    return err
+  }
+
+  for _, id := range ids {
+    shard, err := s.getShardAt(id)
+    if err != nil {
+      return err
+    }
+    err = f(shard)
+    s.releaseShard(shard)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Call f on every key of the shard with its decoded value.
+// The shard is read in a single transaction.
+func (shard *storageShard) forEach(f func(string, *setT) error) error {
+  return shard.db.View(func(tx *bolt.Tx) error {
+    bucket := tx.Bucket([]byte("Cart"))
+    if bucket == nil {
+      return nil
+    }
+
+    return bucket.ForEach(func(k, v []byte) error {
+      key, err := shard.ids.extractKey(k)
+      if err != nil {
+        return err
+      }
+
+      set, _, err := shard.decode(tx, k, v)
+      if err != nil {
+        return err
+      }
+
+      return f(key, set)
+    })
+  })
+}
+
+// Call f on every key stored in the storage with its decoded
+// value.  Every shard is read in its own transaction, so the
+// result is only consistent per shard.
+func (s *ShardedStorage) ForEach(f func(string, *setT) error) error {
+  return s.forEachShard(func(shard *storageShard) error {
+    return shard.forEach(f)
+  })
+}
+
+// Return the statistics of every shard that exists on disk.
+func (s *ShardedStorage) Stats() ([]ShardStats, error) {
+  var stats []ShardStats
+  err := s.forEachShard(func(shard *storageShard) error {
+    st := ShardStats{Storage: s.name, Shard: shard.shardN}
+
+    err := shard.forEach(func(key string, set *setT) error {
+      st.Keys++
+      st.Entries += len(*set)
+      return nil
+    })
+    if err != nil {
+      return err
+    }
+
+    info, err := os.Stat(shard.db.Path())
+    if err != nil {
+      return err
+    }
+    st.Size = info.Size()
+
+    stats = append(stats, st)
+    return nil
+  })
+  return stats, err
+}
+
+// Verify the integrity of every shard that exists on disk.
+// The returned error aggregates the problems of every shard.
+func (s *ShardedStorage) Check() error {
+  var errs []error
+  err := s.forEachShard(func(shard *storageShard) error {
+    err := shard.db.View(func(tx *bolt.Tx) error {
+      for err := range tx.Check() {
+        errs = append(errs, fmt.Errorf("%v shard %v: %v", s.name, shard.shardN, err))
+      }
+      return nil
+    })
+    if err != nil {
+      return err
+    }
+
+    // Make sure every key and value decodes.
+    err = shard.forEach(func(string, *setT) error { return nil })
+    if err != nil {
+      errs = append(errs, fmt.Errorf("%v shard %v: %v", s.name, shard.shardN, err))
+    }
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+  return errors.Join(errs...)
+}
+
+// Return the statistics of every shard of both storages.
+func (h *Handler) Stats() ([]ShardStats, error) {
+  if !h.begin() {
+    return nil, ErrClosed
+  }
+  defer h.leave()
+
+  cStats, err := h.cStorage.Stats()
+  if err != nil {
+    return nil, err
+  }
+  iStats, err := h.iStorage.Stats()
+  if err != nil {
+    return nil, err
+  }
+  return append(cStats, iStats...), nil
+}
+
+// Verify the integrity of every shard of both storages.
+func (h *Handler) Check() error {
+  if !h.begin() {
+    return ErrClosed
+  }
+  defer h.leave()
+
+  return errors.Join(h.cStorage.Check(), h.iStorage.Check())
+}
+
+// Call f on every (customer, item, quantity) line of every cart,
+// in customer shard order and item order within a cart.
+func (h *Handler) ForEachLine(f func(customer string, item ItemKey, qty uint32) error) error {
+  if !h.begin() {
+    return ErrClosed
+  }
+  defer h.leave()
+
+  return h.cStorage.ForEach(func(customer string, set *setT) error {
+    for _, item := range set.sortedKeys() {
+      key, err := h.itemKey(item)
+      if err != nil {
+        return fmt.Errorf("customer %v: %v", customer, err)
+      }
+      if err := f(customer, key, (*set)[item]); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+}
+
+// Compare the customer and the item index and call f on every
+// (customer, item) pair they disagree on.  Writes that happen
+// while the indexes are scanned may show up as mismatches.  The
+// item index of a cluster is spread over its nodes, so nodes of a
+// cluster return ErrClustered.
+func (h *Handler) Verify(f func(Mismatch) error) error {
+  if !h.begin() {
+    return ErrClosed
+  }
+  defer h.leave()
+
+  if h.cluster != nil {
+    return ErrClustered
+  }
+
+  // Load the whole item index, then walk the customer index.
+  items := make(map[string]setT)
+  err := h.iStorage.ForEach(func(item string, set *setT) error {
+    items[item] = *set
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+
+  // Every line of every cart has to be in the item index.  Tick
+  // off what we have seen, so that the leftovers can be reported.
+  err = h.cStorage.ForEach(func(customer string, set *setT) error {
+    for _, item := range set.sortedKeys() {
+      qty := (*set)[item]
+      iqty := items[item][customer]
+      delete(items[item], customer)
+      if iqty == qty {
+        continue
+      }
+
+      err := f(Mismatch{Customer: customer, Item: item, CustomerQty: qty, ItemQty: iqty})
+      if err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+
+  // Whatever is left is missing from the customer index.
+  for _, item := range sortedKeys(items) {
+    set := items[item]
+    for _, customer := range set.sortedKeys() {
+      err := f(Mismatch{Customer: customer, Item: item, ItemQty: set[customer]})
+      if err != nil {
+        return err
+      }
+    }
+  }
+  return nil
+}
+
+// Return the keys of the map in increasing order, see LessID.
+func sortedKeys(m map[string]setT) []string {
+  keys := make([]string, 0, len(m))
+  for k := range m {
+    keys = append(keys, k)
+  }
+  sort.Slice(keys, func(i, j int) bool { return LessID(keys[i], keys[j]) })
+  return keys
+}
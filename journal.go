@@ -0,0 +1,359 @@
+package cart
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "os"
+  "sort"
+  "sync"
+  "time"
+)
+
+// The name of the journal file in the shard directory.
+const JournalFileName = "journal.log"
+
+// Every how many entries the journal remembers the file offset, so
+// that reading from a sequence number does not scan the whole file.
+const journalMarkEvery = 1024
+
+// The kind of change a journal entry records.
+type Op string
+
+const (
+  OpAdd    Op = "add"    // The quantity went up.
+  OpRemove Op = "remove" // The quantity went down, possibly to zero.
+  OpClear  Op = "clear"  // The item went away with the rest of the cart.
+  OpExpire Op = "expire" // The item or its cart expired.
+)
+
+// A single cart mutation.  Qty is the quantity after the mutation
+// rather than the difference, so replaying an entry twice does no
+// harm.
+type JournalEntry struct {
+  Seq      uint64    `json:"seq"`
+  Time     time.Time `json:"time"`
+  Op       Op        `json:"op"`
+  Customer ID        `json:"customer"`
+  Item     ID        `json:"item"`
+  // The attributes of the variant of the item, if it is one.
+  Variant  map[string]string `json:"variant,omitempty"`
+  Qty      uint32    `json:"qty"`
+  // The number of distinct items left in the cart.
+  Items    int       `json:"items"`
+  // The details of the line after the mutation.
+  Price      int64             `json:"price,omitempty"`
+  Currency   string            `json:"currency,omitempty"`
+  Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Copy the line details into the entry.
+func (e *JournalEntry) setDetails(d LineDetails) {
+  e.Price, e.Currency, e.Attributes = d.Price, d.Currency, d.Attributes
+}
+
+// Return the line details of the entry, the whole details of the
+// line after the mutation.
+func (e JournalEntry) details() *LineDetails {
+  return &LineDetails{Price: e.Price, Currency: e.Currency, Attributes: e.Attributes}
+}
+
+// An append-only log of every cart mutation, one JSON object per
+// line.  It is safe for concurrent use.
+type Journal struct {
+  mu   sync.Mutex
+  f    *os.File
+  path string
+  // The sequence number of the next entry.
+  next uint64
+  // The size of the complete entries.
+  size int64
+  // Whether to fsync after every entry.
+  sync bool
+  // Offsets of every journalMarkEvery-th entry, by sequence number.
+  marks []journalMark
+  // Closed and replaced whenever an entry is appended.
+  changed chan struct{}
+}
+
+// The offset of an entry in the journal file.
+type journalMark struct {
+  seq uint64
+  off int64
+}
+
+// Open the journal at path for appending, creating it if needed.
+// A torn entry at the end, left behind by a crash, is cut off.
+func OpenJournal(path string, sync bool) (*Journal, error) {
+  f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+  if err != nil {
+    return nil, err
+  }
+
+  // Find the end of the last complete entry and the next
+  // sequence number.
+  var next uint64 = 1
+  var good int64
+  var marks []journalMark
+  r := bufio.NewReader(f)
+  for {
+    line, err := r.ReadBytes('\n')
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      f.Close()
+      return nil, err
+    }
+
+    var e JournalEntry
+    if err := json.Unmarshal(line, &e); err != nil {
+      f.Close()
+      return nil, fmt.Errorf("%v: corrupt entry at offset %v: %v", path, good, err)
+    }
+    if e.Seq%journalMarkEvery == 1 {
+      marks = append(marks, journalMark{e.Seq, good})
+    }
+    good += int64(len(line))
+    next = e.Seq + 1
+  }
+
+  if err := f.Truncate(good); err != nil {
+    f.Close()
+    return nil, err
+  }
+  if _, err := f.Seek(good, io.SeekStart); err != nil {
+    f.Close()
+    return nil, err
+  }
+
+  return &Journal{
+    f: f,
+    path: path,
+    next: next,
+    size: good,
+    sync: sync,
+    marks: marks,
+    changed: make(chan struct{}),
+  }, nil
+}
+
+// Append the entry, filling in its sequence number, and its time
+// unless set.
+func (j *Journal) Append(e *JournalEntry) error {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  e.Seq = j.next
+  if e.Time.IsZero() {
+    e.Time = time.Now().UTC()
+  }
+  return j.writeLocked(e)
+}
+
+// Append the entry under the sequence number it carries, which
+// must be above the one of every entry so far.  Entries at or
+// below the last one were appended before and are skipped, so that
+// replaying a raft log does not journal its entries twice.
+func (j *Journal) appendAt(e *JournalEntry) error {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  if e.Seq < j.next {
+    return nil
+  }
+  return j.writeLocked(e)
+}
+
+// Write the entry and move past its sequence number.  An entry
+// that fails to be written is cut off again, so that the next one
+// does not land after a torn line.  The caller must hold j.mu.
+func (j *Journal) writeLocked(e *JournalEntry) error {
+  line, err := json.Marshal(e)
+  if err != nil {
+    return err
+  }
+  _, err = j.f.Write(append(line, '\n'))
+  if err == nil && j.sync {
+    err = j.f.Sync()
+  }
+  if err != nil {
+    return j.cutLocked(err)
+  }
+
+  if e.Seq%journalMarkEvery == 1 {
+    j.marks = append(j.marks, journalMark{e.Seq, j.size})
+  }
+  j.size += int64(len(line)) + 1
+  j.next = e.Seq + 1
+
+  close(j.changed)
+  j.changed = make(chan struct{})
+  return nil
+}
+
+// Cut the file back to the complete entries after err, and return
+// err along with anything that went wrong doing so.  The caller must
+// hold j.mu.
+func (j *Journal) cutLocked(err error) error {
+  if terr := j.f.Truncate(j.size); terr != nil {
+    return errors.Join(err, terr)
+  }
+  if _, serr := j.f.Seek(j.size, io.SeekStart); serr != nil {
+    return errors.Join(err, serr)
+  }
+  return err
+}
+
+// Return a channel that gets closed by the next Append, or when
+// the journal is closed.
+func (j *Journal) Changed() <-chan struct{} {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+  return j.changed
+}
+
+// Call f on every entry numbered above after, in order, up to the
+// last entry appended before Read was called.
+func (j *Journal) Read(after uint64, f func(JournalEntry) error) error {
+  j.mu.Lock()
+  size := j.size
+  // Start at the last mark at or before the first wanted entry.
+  var off int64
+  i := sort.Search(len(j.marks), func(i int) bool { return j.marks[i].seq > after+1 })
+  if i > 0 {
+    off = j.marks[i-1].off
+  }
+  j.mu.Unlock()
+
+  file, err := os.Open(j.path)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+
+  return ReadJournal(io.NewSectionReader(file, off, size-off), func(e JournalEntry) error {
+    if e.Seq <= after {
+      return nil
+    }
+    return f(e)
+  })
+}
+
+// Return the sequence number the next entry will get.
+func (j *Journal) Next() uint64 {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+  return j.next
+}
+
+// Flush and close the journal file.
+func (j *Journal) Close() error {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  // Wake up whoever waits for changes, they will find the
+  // handler closed.
+  close(j.changed)
+  j.changed = make(chan struct{})
+
+  if err := j.f.Sync(); err != nil {
+    j.f.Close()
+    return err
+  }
+  return j.f.Close()
+}
+
+// Call f on every entry of the journal read from r, in order.
+// A torn entry at the end is ignored.
+func ReadJournal(r io.Reader, f func(JournalEntry) error) error {
+  br := bufio.NewReader(r)
+  for n := 1; ; n++ {
+    line, err := br.ReadBytes('\n')
+    if err == io.EOF {
+      return nil
+    }
+    if err != nil {
+      return err
+    }
+
+    var e JournalEntry
+    dec := json.NewDecoder(bytes.NewReader(line))
+    if err := dec.Decode(&e); err != nil {
+      return fmt.Errorf("journal entry %v: %v", n, err)
+    }
+    if err := f(e); err != nil {
+      return err
+    }
+  }
+}
+
+// Replay the journal read from r on top of the storage.  Only the
+// entries numbered from and above, and made no later than until,
+// are applied.  A zero until means no limit.  Replayed entries are
+// not journaled again.  Return the number of entries applied.
+// Members of a raft group return ErrRaft.
+func (h *Handler) Replay(r io.Reader, from uint64, until time.Time) (int, error) {
+  if !h.begin() {
+    return 0, ErrClosed
+  }
+  defer h.leave()
+
+  if h.raft != nil {
+    return 0, ErrRaft
+  }
+
+  n := 0
+  err := ReadJournal(r, func(e JournalEntry) error {
+    if e.Seq < from || (!until.IsZero() && e.Time.After(until)) {
+      return nil
+    }
+
+    item, err := h.variants.intern(ItemKey{e.Item.Value, e.Variant})
+    if err == nil {
+      err = h.set(e.Customer.Value, item, e.Qty, e.details(), e.Time)
+    }
+    if err != nil {
+      return fmt.Errorf("journal entry %v: %v", e.Seq, err)
+    }
+    n++
+    return nil
+  })
+  return n, err
+}
+
+// Set the quantity and the details of an item in a cart in both
+// indexes as of the given time, without journaling it.  The details
+// replace those of the line, nil leaves them as they are.  The
+// caller must be inside a request.  An item owned by another node has its
+// index changed there.
+func (h *Handler) set(customer string, item string, qty uint32,
+details *LineDetails, at time.Time) error {
+  if !h.lock(&h.cLock, customer) {
+    return ErrBusy
+  }
+  defer h.cLock.MustUnlock(customer)
+
+  owner, err := h.itemOwner(item)
+  if err != nil {
+    return err
+  }
+  if owner == nil {
+    if !h.lock(&h.iLock, item) {
+      return ErrBusy
+    }
+    defer h.iLock.MustUnlock(item)
+  }
+
+  f := setQtyInSet(qty)
+  if _, err := h.cStorage.changeLineAt(customer, item, f, details, true, at); err != nil {
+    return err
+  }
+  if owner != nil {
+    return h.setRemoteItem(owner, customer, item, qty)
+  }
+  return h.iStorage.ChangeValue(item, customer, f)
+}
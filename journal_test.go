@@ -0,0 +1,202 @@
+package cart
+
+import (
+  "errors"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "reflect"
+  "testing"
+  "time"
+)
+
+// Ensure a change that made it into both indexes is reported as
+// made even if the journal fails to record it.
+func TestHandler_JournalFailure(t *testing.T) {
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+
+  if err := h.Close(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  h.journaling = true
+  if err := h.Open(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  h.journal.f.Close()
+  if err := h.Apply("1", "10", AddToSet); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if qty, _ := h.cStorage.qty("1", "10"); qty != 1 {
+    t.Fatalf("expected 1, got %v", qty)
+  }
+  if found := verify(t, h); len(found) != 0 {
+    t.Fatalf("expected consistent indexes, got %v", found)
+  }
+}
+
+// Ensure every change ends up in the journal with its resulting
+// quantity, and that a torn entry is cut off on reopening.
+func TestHandler_Journal(t *testing.T) {
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+
+  if err := h.Close(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  h.journaling = true
+  if err := h.Open(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  for _, f := range []func(*setT, string) error{AddQtyToSet(3), AddToSet, RemoveFromSet} {
+    if err := h.Apply("1", "10", f); err != nil {
+      t.Fatalf("unexpected error: %s", err)
+    }
+  }
+  if err := h.Close(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  // Simulate a crash in the middle of an entry.
+  path := filepath.Join(h.dir, JournalFileName)
+  f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  f.WriteString(`{"seq":4,"ti`)
+  f.Close()
+
+  j, err := OpenJournal(path, false)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if j.Next() != 4 {
+    t.Fatalf("expected next entry 4, got %v", j.Next())
+  }
+  if err := j.Append(&JournalEntry{Op: OpRemove, Customer: ID{"1", true}, Item: ID{"10", true}}); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  j.Close()
+
+  f, err = os.Open(path)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  defer f.Close()
+
+  var got [][2]interface{}
+  err = ReadJournal(f, func(e JournalEntry) error {
+    got = append(got, [2]interface{}{e.Op, e.Qty})
+    return nil
+  })
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  expected := [][2]interface{}{{OpAdd, uint32(3)}, {OpAdd, uint32(4)}, {OpRemove, uint32(3)}, {OpRemove, uint32(0)}}
+  if !reflect.DeepEqual(got, expected) {
+    t.Fatalf("expected %v, got %v", expected, got)
+  }
+}
+
+// Ensure an entry that fails to be written is cut off, so that the
+// journal still opens after more entries were appended.
+func TestJournal_FailedWrite(t *testing.T) {
+  dir, err := ioutil.TempDir("", "cart")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  defer os.RemoveAll(dir)
+
+  path := filepath.Join(dir, JournalFileName)
+  j, err := OpenJournal(path, false)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  e := JournalEntry{Op: OpAdd, Customer: ID{"1", true}, Item: ID{"10", true}, Qty: 1}
+  if err := j.Append(&e); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  // Simulate a short write.
+  full := errors.New("no space left on device")
+  j.mu.Lock()
+  j.f.WriteString(`{"seq":2,"ti`)
+  err = j.cutLocked(full)
+  j.mu.Unlock()
+  if err != full {
+    t.Fatalf("expected %v, got %v", full, err)
+  }
+
+  e.Qty = 2
+  if err := j.Append(&e); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  j.Close()
+
+  j, err = OpenJournal(path, false)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  defer j.Close()
+  var got []uint32
+  j.Read(0, func(e JournalEntry) error {
+    got = append(got, e.Qty)
+    return nil
+  })
+  if expected := []uint32{1, 2}; j.Next() != 3 || !reflect.DeepEqual(got, expected) {
+    t.Fatalf("expected %v up to 2, got %v up to %v", expected, got, j.Next() - 1)
+  }
+}
+
+// Ensure replaying the journal leaves lines with the same details
+// as the live ones, removed attributes included.
+func TestHandler_ReplayDetails(t *testing.T) {
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+
+  if err := h.Close(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  h.journaling = true
+  if err := h.Open(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  for _, d := range []LineDetails{
+    {1999, "EUR", map[string]string{"gift": "yes", "note": "hi"}},
+    {Attributes: map[string]string{"note": ""}},
+  } {
+    if err := h.ApplyLine("1", "10", AddToSet, d); err != nil {
+      t.Fatalf("unexpected error: %s", err)
+    }
+  }
+  live, err := h.CartLines("1")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  replayed, cleanupReplayed := tempHandler(t)
+  defer cleanupReplayed()
+  f, err := os.Open(filepath.Join(h.dir, JournalFileName))
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  defer f.Close()
+  if n, err := replayed.Replay(f, 0, time.Time{}); err != nil || n != 2 {
+    t.Fatalf("expected 2 entries replayed, got %v, %v", n, err)
+  }
+
+  lines, err := replayed.CartLines("1")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  expected := LineDetails{1999, "EUR", map[string]string{"gift": "yes"}}
+  if !reflect.DeepEqual(live["10"].Details(), expected) {
+    t.Fatalf("expected %v live, got %v", expected, live["10"].Details())
+  } else if lines["10"].Qty != 2 || !reflect.DeepEqual(lines["10"].Details(), expected) {
+    t.Fatalf("expected %v replayed, got %v", expected, lines["10"])
+  }
+}
@@ -0,0 +1,227 @@
+package cart
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "time"
+
+	"github.com/boltdb/bolt"
+)
+
+// The file next to the shards recording how they are laid out.
+const LayoutFileName = "layout.json"
+
+// How the data next to the layout file is laid out.  A handler
+// configured differently would misread it, so it refuses to open.
+type Layout struct {
+  // The id mode, see IDMode.
+  IDs string `json:"ids"`
+  // The shard mapping, see ShardMapping, and the number of shards.
+  Mapping string `json:"mapping,omitempty"`
+  Shards int `json:"shards,omitempty"`
+  // Whether the numeric item ids above MaxItem are known to be free
+  // for variants, see checkVariantIDs.
+  Variants bool `json:"variants,omitempty"`
+}
+
+// Make sure the data in dir is laid out as wanted.  A directory
+// without a layout file gets one: a fresh directory the wanted
+// layout, data written before layout files existed the layout it
+// was always written with.  Older layout files are completed the
+// same way.
+func checkLayout(dir string, want Layout) error {
+  path := filepath.Join(dir, LayoutFileName)
+
+  var have Layout
+  data, err := ioutil.ReadFile(path)
+  missing := os.IsNotExist(err)
+  switch {
+  case err == nil:
+    if err := json.Unmarshal(data, &have); err != nil {
+      return fmt.Errorf("%v: %v", path, err)
+    }
+  case missing:
+    fresh, err := isFresh(dir)
+    if err != nil {
+      return err
+    }
+    if fresh {
+      have = want
+    }
+  default:
+    return err
+  }
+
+  if have.Shards == 0 {
+    if err := checkShardCount(dir, have.complete(want), want.Shards); err != nil {
+      return err
+    }
+  }
+  if complete := have.complete(want); complete != have || missing {
+    have = complete
+    if err := writeLayout(path, have); err != nil {
+      return err
+    }
+  }
+
+  switch {
+  case have.IDs != want.IDs:
+    return fmt.Errorf("%v holds %v ids, but %v ids are configured",
+      dir, have.IDs, want.IDs)
+  case have.Mapping != want.Mapping:
+    return fmt.Errorf("%v is sharded by %v mapping, but %v mapping is configured",
+      dir, have.Mapping, want.Mapping)
+  case have.Shards != want.Shards:
+    return fmt.Errorf("%v holds %v shards, but %v shards are configured",
+      dir, have.Shards, want.Shards)
+  }
+  return nil
+}
+
+// Fill in what the layout leaves out with what data written
+// before it was recorded used.  The number of shards was never
+// recorded, so it is the wanted one, once checkShardCount agrees.
+func (l Layout) complete(want Layout) Layout {
+  if l.IDs == "" {
+    l.IDs = NumericIDs.String()
+  }
+  if l.Mapping == "" {
+    l.Mapping = ModuloMapping.String()
+  }
+  if l.Shards == 0 {
+    l.Shards = want.Shards
+  }
+  return l
+}
+
+// Make sure the shard files in dir, laid out as l but for the
+// number of shards, were written with n shards: none of them has
+// an id of n or above, and every key sits in the shard it maps to.
+func checkShardCount(dir string, l Layout, n int) error {
+  ids, err := ParseIDMode(l.IDs)
+  if err != nil {
+    return err
+  }
+  mapping, err := ParseShardMapping(l.Mapping)
+  if err != nil {
+    return err
+  }
+
+  for _, name := range [...]string{CustomerStorage, ItemStorage} {
+    paths, err := ShardFiles(dir, name)
+    if err != nil {
+      return err
+    }
+    for _, path := range paths {
+      _, id, _ := ParseShardFileName(filepath.Base(path))
+      if int(id) >= n {
+        return fmt.Errorf("%v holds shard %v, but %v shards are configured", dir, id, n)
+      }
+      if err := checkShardKeys(path, ids, func(key string) error {
+        if mapping.shard(ids, key, n) != id {
+          return fmt.Errorf("%v holds %v in shard %v, so it was not written with %v shards",
+            dir, key, id, n)
+        }
+        return nil
+      }); err != nil {
+        return err
+      }
+    }
+  }
+  return nil
+}
+
+// Call f on every key of the shard file at path.
+func checkShardKeys(path string, ids IDMode, f func(string) error) error {
+  db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+  if err != nil {
+    return fmt.Errorf("%w %v: %v", ErrShardOpen, path, err)
+  }
+  defer db.Close()
+
+  return db.View(func(tx *bolt.Tx) error {
+    bucket := tx.Bucket([]byte("Cart"))
+    if bucket == nil {
+      return nil
+    }
+    return bucket.ForEach(func(k, v []byte) error {
+      key, err := ids.extractKey(k)
+      if err != nil {
+        return err
+      }
+      return f(key)
+    })
+  })
+}
+
+// Make sure no item stored under a numeric id above MaxItem was
+// put there by a client, as data written before variants existed
+// may hold some: those ids stand for variants now.  The check is
+// made once, and recorded in the layout file.  The caller must
+// hold the write lock, with the variant registry loaded.
+func (h *Handler) checkVariantIDs() error {
+  if h.ids != NumericIDs {
+    return nil
+  }
+  path := filepath.Join(h.dir, LayoutFileName)
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return err
+  }
+  var l Layout
+  if err := json.Unmarshal(data, &l); err != nil {
+    return fmt.Errorf("%v: %v", path, err)
+  }
+  if l.Variants {
+    return nil
+  }
+
+  err = h.iStorage.ForEach(func(item string, set *setT) error {
+    if _, ok := h.variants.key(item); !ok && len(*set) > 0 {
+      return fmt.Errorf("%v holds item %v, but item ids above %v stand for variants",
+        h.dir, item, MaxItem)
+    }
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+
+  l.Variants = true
+  return writeLayout(path, l)
+}
+
+// Report whether dir holds no data yet.
+func isFresh(dir string) (bool, error) {
+  for _, name := range [...]string{CustomerStorage, ItemStorage} {
+    paths, err := ShardFiles(dir, name)
+    if err != nil {
+      return false, err
+    }
+    if len(paths) > 0 {
+      return false, nil
+    }
+  }
+  _, err := os.Stat(filepath.Join(dir, VariantFileName))
+  if os.IsNotExist(err) {
+    return true, nil
+  }
+  return false, err
+}
+
+// Write the layout file atomically.
+func writeLayout(path string, l Layout) error {
+  data, err := json.Marshal(l)
+  if err != nil {
+    return err
+  }
+
+  tmp := path + ".tmp"
+  if err := ioutil.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+    return err
+  }
+  return os.Rename(tmp, path)
+}
@@ -0,0 +1,549 @@
+package cart
+
+import (
+  "bytes"
+  "encoding/gob"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+	"github.com/boltdb/bolt"
+)
+
+// The version of the customer index values written by this code.
+// Version 1 is the plain gob encoded setT of quantities.
+const cartVersion = 2
+
+// Starts every versioned value, followed by the version number.
+// Gob streams never start with it, which tells version 1 apart.
+const versionMark = 0x80
+
+// The bucket of the customer shards in which version 1 remembered
+// when every item of a cart was last changed, in Unix nanoseconds.
+// Version 2 keeps that in the lines, so the stamps are moved over
+// whenever a cart is rewritten.
+const stampBucket = "Touched"
+
+// The most attributes a line can have.
+const MaxAttributes = 32
+
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// A line of a cart.
+type Line struct {
+  Qty uint32 `json:"qty"`
+  // When the item was added to the cart and when the line was
+  // last changed.  Zero for lines from before version 2 that were
+  // never changed since; those get an UpdatedAt once migrated or
+  // seen by the sweep, see cartT.stamp.
+  AddedAt   time.Time `json:"added_at"`
+  UpdatedAt time.Time `json:"updated_at"`
+  // The unit price when the item was added, in minor units of the
+  // currency, e.g. cents.
+  Price    int64  `json:"price,omitempty"`
+  // The ISO 4217 code of the currency, e.g. EUR.
+  Currency string `json:"currency,omitempty"`
+  // Free-form attributes, e.g. a gift note.
+  Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// The price, currency and attributes of a line.
+type LineDetails struct {
+  Price      int64
+  Currency   string
+  Attributes map[string]string
+}
+
+// A cart, the value of the customer index.
+type cartT map[string]*Line
+
+// Validate makes sure the details make sense.
+func (d LineDetails) Validate() error {
+  if d.Price < 0 {
+    return fmt.Errorf("price must not be negative")
+  }
+  if d.Currency != "" && !currencyCode.MatchString(d.Currency) {
+    return fmt.Errorf("invalid currency %q, expected an ISO 4217 code", d.Currency)
+  }
+  if d.Price != 0 && d.Currency == "" {
+    return fmt.Errorf("a price requires a currency")
+  }
+  if len(d.Attributes) > MaxAttributes {
+    return fmt.Errorf("too many attributes, at most %v allowed", MaxAttributes)
+  }
+  for k := range d.Attributes {
+    if k == "" {
+      return fmt.Errorf("attribute names must not be empty")
+    }
+  }
+  return nil
+}
+
+// Return whether there are no details at all.
+func (d LineDetails) IsZero() bool {
+  return d.Price == 0 && d.Currency == "" && len(d.Attributes) == 0
+}
+
+// Overwrite the price and the currency of the line if given, and
+// merge in the attributes.  An attribute with an empty value is
+// removed.
+func (d LineDetails) apply(l *Line) {
+  if d.Currency != "" {
+    l.Price = d.Price
+    l.Currency = d.Currency
+  }
+  for k, v := range d.Attributes {
+    if v == "" {
+      delete(l.Attributes, k)
+      continue
+    }
+    if l.Attributes == nil {
+      l.Attributes = make(map[string]string)
+    }
+    l.Attributes[k] = v
+  }
+}
+
+// Overwrite the price, the currency and the attributes of the
+// line, clearing those not given.
+func (d LineDetails) replace(l *Line) {
+  l.Price = d.Price
+  l.Currency = d.Currency
+  l.Attributes = nil
+  for k, v := range d.Attributes {
+    if l.Attributes == nil {
+      l.Attributes = make(map[string]string, len(d.Attributes))
+    }
+    l.Attributes[k] = v
+  }
+}
+
+// Return the details of the line.
+func (l Line) Details() LineDetails {
+  return LineDetails{Price: l.Price, Currency: l.Currency, Attributes: l.Attributes}
+}
+
+// Parse attributes given as name:value.
+func ParseAttributes(attrs []string) (map[string]string, error) {
+  if len(attrs) == 0 {
+    return nil, nil
+  }
+
+  m := make(map[string]string, len(attrs))
+  for _, attr := range attrs {
+    i := strings.Index(attr, ":")
+    if i <= 0 {
+      return nil, fmt.Errorf("invalid attribute %q, expected name:value", attr)
+    }
+    m[attr[:i]] = attr[i+1:]
+  }
+  return m, nil
+}
+
+// Return the quantities of the cart.
+func (c cartT) quantities() *setT {
+  set := make(setT, len(c))
+  for item, l := range c {
+    set[item] = l.Qty
+  }
+  return &set
+}
+
+// Bring the cart in line with the quantities, stamping every line
+// that changes with now.
+func (c cartT) update(set setT, now time.Time) {
+  for item, qty := range set {
+    l := c[item]
+    if l == nil {
+      c[item] = &Line{Qty: qty, AddedAt: now, UpdatedAt: now}
+    } else if l.Qty != qty {
+      l.Qty = qty
+      l.UpdatedAt = now
+    }
+  }
+  for item := range c {
+    if _, ok := set[item]; !ok {
+      delete(c, item)
+    }
+  }
+}
+
+// Stamp the lines that do not know when they were changed with now,
+// so that they expire counting from now.  Return whether there were
+// any.
+func (c cartT) stamp(now time.Time) bool {
+  stamped := false
+  for _, l := range c {
+    if l.UpdatedAt.IsZero() {
+      l.UpdatedAt = now
+      stamped = true
+    }
+  }
+  return stamped
+}
+
+// Return the items of the cart in increasing order, see LessID.
+func (c cartT) sortedKeys() []string {
+  keys := make([]string, 0, len(c))
+  for k := range c {
+    keys = append(keys, k)
+  }
+  sort.Slice(keys, func(i, j int) bool { return LessID(keys[i], keys[j]) })
+  return keys
+}
+
+// Return when any line of the cart was last changed, zero if no
+// line knows.
+func (c cartT) lastChange() time.Time {
+  var last time.Time
+  for _, l := range c {
+    if l.UpdatedAt.After(last) {
+      last = l.UpdatedAt
+    }
+  }
+  return last
+}
+
+// Return the binary representation of the cart, the version mark
+// and number followed by the gob encoded lines.
+func encodeCart(m IDMode, c cartT) ([]byte, error) {
+  buf := bytes.NewBuffer([]byte{versionMark, cartVersion})
+  if err := m.encodeLines(buf, c); err != nil {
+    return nil, err
+  }
+  return buf.Bytes(), nil
+}
+
+// Given the binary representation of a cart of any version, return
+// the cart and whether it was written by version 1.
+func extractCart(m IDMode, data []byte) (cartT, bool, error) {
+  if len(data) == 0 {
+    return make(cartT), false, nil
+  }
+
+  if data[0] != versionMark {
+    set, err := m.extractSet(data)
+    if err != nil {
+      return nil, false, err
+    }
+
+    c := make(cartT, len(*set))
+    for item, qty := range *set {
+      c[item] = &Line{Qty: qty}
+    }
+    return c, true, nil
+  }
+
+  if len(data) < 2 || data[1] != cartVersion {
+    return nil, false, fmt.Errorf("unknown cart version %v", data[1:2])
+  }
+  c, err := m.extractLines(bytes.NewReader(data[2:]))
+  if err != nil {
+    return nil, false, err
+  }
+  return c, false, nil
+}
+
+// Return the cart stored as data under keyBuf.  Version 1 carts
+// pick up their stamps.  Also return whether the cart was written
+// by version 1.
+func readCart(m IDMode, tx *bolt.Tx, keyBuf []byte, data []byte) (cartT, bool, error) {
+  c, legacy, err := extractCart(m, data)
+  if err != nil || !legacy {
+    return c, legacy, err
+  }
+
+  bucket := tx.Bucket([]byte(stampBucket))
+  if bucket == nil {
+    return c, legacy, nil
+  }
+  stampData := bucket.Get(keyBuf)
+  if stampData == nil {
+    return c, legacy, nil
+  }
+
+  var stamps map[uint32]int64
+  if err := gob.NewDecoder(bytes.NewReader(stampData)).Decode(&stamps); err != nil {
+    return nil, legacy, err
+  }
+  for item, stamp := range stamps {
+    if l := c[strconv.FormatUint(uint64(item), 10)]; l != nil {
+      l.UpdatedAt = time.Unix(0, stamp)
+    }
+  }
+  return c, legacy, nil
+}
+
+// Forget the version 1 stamps of the cart under keyBuf.
+func dropStamps(tx *bolt.Tx, keyBuf []byte) error {
+  bucket := tx.Bucket([]byte(stampBucket))
+  if bucket == nil {
+    return nil
+  }
+  return bucket.Delete(keyBuf)
+}
+
+// Decode the value stored as data under keyBuf.  For storages of
+// carts, also return the cart the quantities come from.
+func (shard *storageShard) decode(tx *bolt.Tx, keyBuf []byte, data []byte) (*setT, cartT, error) {
+  if !shard.lines {
+    set, err := shard.ids.extractSet(data)
+    return set, nil, err
+  }
+
+  c, _, err := readCart(shard.ids, tx, keyBuf, data)
+  if err != nil {
+    return nil, nil, err
+  }
+  return c.quantities(), c, nil
+}
+
+// Call f on every cart of the shard.  The shard is read in a
+// single transaction.
+func (shard *storageShard) forEachCart(f func(string, cartT) error) error {
+  return shard.db.View(func(tx *bolt.Tx) error {
+    bucket := tx.Bucket([]byte("Cart"))
+    if bucket == nil {
+      return nil
+    }
+
+    return bucket.ForEach(func(k, v []byte) error {
+      key, err := shard.ids.extractKey(k)
+      if err != nil {
+        return err
+      }
+
+      c, _, err := readCart(shard.ids, tx, k, v)
+      if err != nil {
+        return err
+      }
+      return f(key, c)
+    })
+  })
+}
+
+// Stamp the lines of the cart associated with the key that do not
+// know when they were changed, see cartT.stamp.
+func (s *ShardedStorage) stampCart(key string, now time.Time) error {
+  shard, err := s.getShard(key)
+  if err != nil {
+    return err
+  }
+  defer s.releaseShard(shard)
+
+  stamped := false
+  err = shard.db.Update(func(tx *bolt.Tx) error {
+    bucket := tx.Bucket([]byte("Cart"))
+    if bucket == nil {
+      return nil
+    }
+    keyBuf, err := s.ids.keyBytes(key)
+    if err != nil {
+      return err
+    }
+    data := bucket.Get(keyBuf)
+    if data == nil {
+      return nil
+    }
+
+    c, _, err := readCart(s.ids, tx, keyBuf, data)
+    if err != nil || !c.stamp(now) {
+      return err
+    }
+    stamped = true
+    cartBuf, err := encodeCart(s.ids, c)
+    if err != nil {
+      return err
+    }
+    if err := bucket.Put(keyBuf, cartBuf); err != nil {
+      return err
+    }
+    return dropStamps(tx, keyBuf)
+  })
+  if err != nil || !stamped {
+    return err
+  }
+  return s.maybeSync(shard)
+}
+
+// Let f observe the cart associated with the key.
+func (s *ShardedStorage) observeCart(key string, f func(cartT)) error {
+  shard, err := s.getShard(key)
+  if err != nil {
+    return err
+  }
+  defer s.releaseShard(shard)
+
+  return shard.db.View(func(tx *bolt.Tx) error {
+    bucket := tx.Bucket([]byte("Cart"))
+    if bucket == nil {
+      return ErrNoSuchKey
+    }
+
+    keyBuf, err := s.ids.keyBytes(key)
+    if err != nil {
+      return err
+    }
+    data := bucket.Get(keyBuf)
+    if data == nil {
+      return ErrNoSuchKey
+    }
+
+    c, _, err := readCart(s.ids, tx, keyBuf, data)
+    if err != nil {
+      return err
+    }
+    f(c)
+    return nil
+  })
+}
+
+// Return the lines of the customer's cart.
+func (h *Handler) CartLines(customer string) (map[string]Line, error) {
+  if !h.begin() {
+    return nil, ErrClosed
+  }
+  defer h.leave()
+
+  return h.cartLines(customer)
+}
+
+// The body of CartLines.  The caller must be inside a request.
+func (h *Handler) cartLines(customer string) (map[string]Line, error) {
+  if !h.lock(&h.cLock, customer) {
+    return nil, ErrBusy
+  }
+  defer h.cLock.MustUnlock(customer)
+
+  lines := make(map[string]Line)
+  err := h.cStorage.observeCart(customer, func(c cartT) {
+    for item, l := range c {
+      lines[item] = *l
+    }
+  })
+  if err != nil && err != ErrNoSuchKey {
+    return nil, err
+  }
+  return lines, nil
+}
+
+// This function is responsible for handling /lines queries.  It
+// reports every line of the cart of the customer passed as the only
+// parameter as a JSON object, one per line, in item order.  Lines
+// of variants carry the variant attributes.
+func (h* Handler) Lines(w http.ResponseWriter, r *http.Request) {
+  if h.toLeader(w, r) {
+    return
+  }
+  if len(r.URL.Query()) != 1 {
+    err := fmt.Errorf("you can specify only one arg")
+    fmt.Fprintf(w, "error: %v", err)
+    return
+  }
+
+  customer, err := h.checkCustomerArg(w, r)
+  if err != nil {
+    fmt.Fprintf(w, "error: %v", err)
+    return
+  }
+  if node := h.keyOwner(string(customer)); node != nil {
+    h.forward(w, r, node)
+    return
+  }
+
+  lines, err := h.CartLines(string(customer))
+  writeStatus(w, err)
+  if err != nil {
+    fmt.Fprintf(w, "error: %v", err)
+    return
+  }
+
+  items := make([]string, 0, len(lines))
+  for item := range lines {
+    items = append(items, item)
+  }
+  sort.Slice(items, func(i, j int) bool { return LessID(items[i], items[j]) })
+
+  fmt.Fprintf(w, "OK\n")
+  enc := json.NewEncoder(w)
+  for _, item := range items {
+    key, _ := h.LookupItem(item)
+    enc.Encode(struct {
+      Item    ID                `json:"item"`
+      Variant map[string]string `json:"variant,omitempty"`
+      Line
+    }{h.ids.ID(key.SKU), key.Variant, lines[item]})
+  }
+}
+
+// Migrate rewrites every cart written by version 1 in the current
+// version.  Carts are migrated whenever they change anyway, this
+// gets rid of the old encoding altogether.  Return the number of
+// carts rewritten.  The lines without a stamp get one, which would
+// set a copy apart from the others: read-only followers return
+// ErrReadOnly, and members of a raft group ErrRaft.
+func (h *Handler) Migrate() (int, error) {
+  if !h.begin() {
+    return 0, ErrClosed
+  }
+  defer h.leave()
+
+  if h.readOnly {
+    return 0, ErrReadOnly
+  }
+  if h.raft != nil {
+    return 0, ErrRaft
+  }
+
+  n := 0
+  now := time.Now()
+  err := h.cStorage.forEachShard(func(shard *storageShard) error {
+    err := shard.db.Update(func(tx *bolt.Tx) error {
+      bucket := tx.Bucket([]byte("Cart"))
+      if bucket == nil {
+        return nil
+      }
+
+      // Bolt does not allow changing a bucket while iterating it.
+      migrated := make(map[string][]byte)
+      err := bucket.ForEach(func(k, v []byte) error {
+        c, legacy, err := readCart(h.ids, tx, k, v)
+        if err != nil || !legacy {
+          return err
+        }
+        c.stamp(now)
+        buf, err := encodeCart(h.ids, c)
+        if err != nil {
+          return err
+        }
+        migrated[string(k)] = buf
+        return nil
+      })
+      if err != nil {
+        return err
+      }
+
+      for k, buf := range migrated {
+        if err := bucket.Put([]byte(k), buf); err != nil {
+          return err
+        }
+      }
+      n += len(migrated)
+
+      if tx.Bucket([]byte(stampBucket)) != nil {
+        return tx.DeleteBucket([]byte(stampBucket))
+      }
+      return nil
+    })
+    if err != nil {
+      return fmt.Errorf("%v shard %v: %v", h.cStorage.name, shard.shardN, err)
+    }
+    return h.cStorage.maybeSync(shard)
+  })
+  return n, err
+}
@@ -0,0 +1,132 @@
+package cart
+
+import (
+  "net/http/httptest"
+  "reflect"
+  "testing"
+  "time"
+
+  "github.com/boltdb/bolt"
+)
+
+// Ensure lines keep their details and times across changes.
+func TestHandler_Lines(t *testing.T) {
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+
+  w := httptest.NewRecorder()
+  h.Mod(AddToSet)(w, httptest.NewRequest("GET",
+    "http://localhost/add?customer=1&item=10&price=1999&currency=EUR&attr=gift:yes&attr=note:hi", nil))
+  if w.Body.String() != "OK\n" {
+    t.Fatalf("expected `OK`, got `%s`", w.Body.String())
+  }
+
+  lines, err := h.CartLines("1")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  added := lines["10"]
+  expected := LineDetails{1999, "EUR", map[string]string{"gift": "yes", "note": "hi"}}
+  if added.Qty != 1 || !reflect.DeepEqual(added.Details(), expected) {
+    t.Fatalf("expected a line with %v, got %v", expected, added)
+  } else if added.AddedAt.IsZero() || !added.AddedAt.Equal(added.UpdatedAt) {
+    t.Fatalf("expected the line to be stamped, got %v", added)
+  }
+
+  // Changing the quantity keeps the details, removing an attribute
+  // keeps the others.
+  time.Sleep(time.Millisecond)
+  err = h.ApplyLine("1", "10", AddToSet, LineDetails{Attributes: map[string]string{"note": ""}})
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  lines, _ = h.CartLines("1")
+  changed := lines["10"]
+  expected.Attributes = map[string]string{"gift": "yes"}
+  if changed.Qty != 2 || !reflect.DeepEqual(changed.Details(), expected) {
+    t.Fatalf("expected a line with %v, got %v", expected, changed)
+  } else if !changed.AddedAt.Equal(added.AddedAt) || !changed.UpdatedAt.After(added.UpdatedAt) {
+    t.Fatalf("expected only the update time to move, got %v", changed)
+  }
+
+  for _, query := range []string{"price=5", "currency=euro", "attr=nocolon", "price=-1&currency=EUR", "color=red"} {
+    w := httptest.NewRecorder()
+    h.Mod(AddToSet)(w, httptest.NewRequest("GET", "http://localhost/add?customer=1&item=10&" + query, nil))
+    if w.Body.String()[:6] != "error:" {
+      t.Fatalf("%s: expected an error, got `%s`", query, w.Body.String())
+    }
+  }
+}
+
+// Ensure carts written by version 1 read, change and migrate.
+func TestHandler_Migrate(t *testing.T) {
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+
+  // A version 1 cart with a stamp for one of its lines.
+  stamp := time.Now().Add(-time.Hour).Round(0)
+  keyBuf, _ := getBytes(uint32(1))
+  setBuf, _ := getBytes(map[uint32]uint32{10: 2, 11: 1})
+  stampBuf, _ := getBytes(map[uint32]int64{10: stamp.UnixNano()})
+  shard, err := h.cStorage.getShard("1")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  err = shard.db.Update(func(tx *bolt.Tx) error {
+    carts, _ := tx.CreateBucketIfNotExists([]byte("Cart"))
+    stamps, _ := tx.CreateBucketIfNotExists([]byte(stampBucket))
+    carts.Put(keyBuf, setBuf)
+    return stamps.Put(keyBuf, stampBuf)
+  })
+  h.cStorage.releaseShard(shard)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  for _, item := range []string{"10", "11"} {
+    h.iStorage.ChangeValue(item, "1", setQtyInSet(setT{"10": 2, "11": 1}[item]))
+  }
+
+  lines, err := h.CartLines("1")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if lines["10"].Qty != 2 || !lines["10"].UpdatedAt.Equal(stamp) || lines["11"].Qty != 1 {
+    t.Fatalf("unexpected lines %v", lines)
+  }
+  if found := verify(t, h); len(found) != 0 {
+    t.Fatalf("expected consistent indexes, got %v", found)
+  }
+
+  for _, expected := range []int{1, 0} {
+    n, err := h.Migrate()
+    if err != nil {
+      t.Fatalf("unexpected error: %s", err)
+    } else if n != expected {
+      t.Fatalf("expected %v carts to migrate, got %v", expected, n)
+    }
+  }
+
+  shard, _ = h.cStorage.getShard("1")
+  shard.db.View(func(tx *bolt.Tx) error {
+    if data := tx.Bucket([]byte("Cart")).Get(keyBuf); data[0] != versionMark {
+      t.Fatalf("expected a versioned cart, got %v", data)
+    }
+    if tx.Bucket([]byte(stampBucket)) != nil {
+      t.Fatalf("expected the stamps to be gone")
+    }
+    return nil
+  })
+  h.cStorage.releaseShard(shard)
+
+  // The line without a stamp expires counting from the migration.
+  migrated, _ := h.CartLines("1")
+  if !reflect.DeepEqual(migrated["10"], lines["10"]) || migrated["11"].Qty != 1 ||
+    migrated["11"].UpdatedAt.IsZero() {
+    t.Fatalf("expected %v with 11 stamped, got %v", lines, migrated)
+  }
+
+  h.readOnly = true
+  if _, err := h.Migrate(); err != ErrReadOnly {
+    t.Fatalf("expected %v, got %v", ErrReadOnly, err)
+  }
+}
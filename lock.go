@@ -1,30 +1,94 @@
 package cart
 
 import (
+  "fmt"
   "log"
   "sync/atomic"
+  "time"
 )
 
+// How a request behaves when the lock it needs is taken.
+type LockMode int
+
+const (
+  // Give up right away.  The client gets a 503 and may retry.
+  LockTry LockMode = iota
+
+  // Keep retrying until the lock timeout expires.
+  LockWait
+)
+
+// Return the configuration name of the lock mode.
+func (m LockMode) String() string {
+  switch m {
+  case LockTry:
+    return "try"
+  case LockWait:
+    return "wait"
+  }
+  return fmt.Sprintf("LockMode(%d)", int(m))
+}
+
+// Given a configuration name, return the matching lock mode.
+func ParseLockMode(s string) (LockMode, error) {
+  switch s {
+  case "", "try":
+    return LockTry, nil
+  case "wait":
+    return LockWait, nil
+  }
+  return LockTry, fmt.Errorf("unknown lock mode %q", s)
+}
+
 // A non-recursive, non-blocking lock implementation.
 // Multiple keys might share the same lock depending
 // on what the number of shards is.
 type ShardedLock struct {
-  shards [NShards]uint32
+  shards []uint32
+  // How keys map to shards.
+  ids IDMode
+  mapping ShardMapping
+}
+
+// Return a new lock with n shards.
+func NewShardedLock(n int) ShardedLock {
+  return ShardedLock{shards: make([]uint32, n)}
 }
 
 // Given a key, try to acquire the lock.
 // Return success or failure.
-func (l* ShardedLock) TryLock(key uint32) bool {
-  idx := key % NShards
+func (l* ShardedLock) TryLock(key string) bool {
+  idx := l.mapping.shard(l.ids, key, len(l.shards))
   loc := &l.shards[idx]
   swapped := atomic.CompareAndSwapUint32(loc, 0, 1)
   return swapped
 }
 
+// Given a key, keep trying to acquire the lock until
+// the timeout expires.  Return success or failure.
+func (l* ShardedLock) LockTimeout(key string, timeout time.Duration) bool {
+  deadline := time.Now().Add(timeout)
+  backoff := time.Microsecond
+
+  for !l.TryLock(key) {
+    if time.Now().After(deadline) {
+      return false
+    }
+
+    // Back off exponentially, but never sleep for
+    // more than a millisecond at a time.
+    time.Sleep(backoff)
+    if backoff < time.Millisecond {
+      backoff *= 2
+    }
+  }
+  return true
+}
+
 // Given a key, release the lock.
 // The invocation must/should never fail.
-func (l* ShardedLock) MustUnlock(key uint32) bool {
-  idx := key % NShards
+func (l* ShardedLock) MustUnlock(key string) bool {
+  idx := l.mapping.shard(l.ids, key, len(l.shards))
   loc := &l.shards[idx]
   swapped := atomic.CompareAndSwapUint32(loc, 1, 0)
   if !swapped {
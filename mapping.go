@@ -0,0 +1,77 @@
+package cart
+
+import (
+  "fmt"
+  "hash/fnv"
+  "io"
+  "strconv"
+)
+
+// How keys are spread over the shards.  Locks and storages use the
+// same mapping, so a key is locked and stored by the same shard.
+type ShardMapping int
+
+const (
+  // The numeric value of the key, or the hash of a string key,
+  // modulo the number of shards.  This is how keys were always
+  // mapped; changing the number of shards moves almost every key.
+  ModuloMapping ShardMapping = iota
+
+  // The jump consistent hash of the key.  Keys spread evenly
+  // whatever they look like, and growing from n to n+1 shards
+  // only moves 1/(n+1) of them, all onto the new shard.
+  JumpMapping
+)
+
+// Return the configuration name of the shard mapping.
+func (m ShardMapping) String() string {
+  switch m {
+  case ModuloMapping:
+    return "modulo"
+  case JumpMapping:
+    return "jump"
+  }
+  return fmt.Sprintf("ShardMapping(%d)", int(m))
+}
+
+// Given a configuration name, return the matching shard mapping.
+func ParseShardMapping(s string) (ShardMapping, error) {
+  switch s {
+  case "", "modulo":
+    return ModuloMapping, nil
+  case "jump":
+    return JumpMapping, nil
+  }
+  return ModuloMapping, fmt.Errorf("unknown shard mapping %q", s)
+}
+
+// Given a canonical key in the id mode, return the shard out of n
+// it belongs to.
+func (m ShardMapping) shard(ids IDMode, key string, n int) uint32 {
+  if m == JumpMapping {
+    h := fnv.New64a()
+    io.WriteString(h, key)
+    return jumpHash(h.Sum64(), n)
+  }
+
+  if ids == NumericIDs {
+    if v, err := strconv.ParseUint(key, 10, 32); err == nil {
+      return uint32(v) % uint32(n)
+    }
+  }
+  h := fnv.New32a()
+  io.WriteString(h, key)
+  return h.Sum32() % uint32(n)
+}
+
+// Return the bucket out of n of the key, as described in "A Fast,
+// Minimal Memory, Consistent Hash Algorithm" by Lamping and Veach.
+func jumpHash(key uint64, n int) uint32 {
+  var b, j int64 = -1, 0
+  for j < int64(n) {
+    b = j
+    key = key * 2862933555777941757 + 1
+    j = int64(float64(b + 1) * (float64(int64(1) << 31) / float64((key >> 33) + 1)))
+  }
+  return uint32(b)
+}
@@ -0,0 +1,110 @@
+package cart
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strconv"
+  "testing"
+)
+
+// Ensure the jump mapping spreads sequential ids evenly, and that
+// adding a shard only moves keys onto it.
+func TestShardMapping_Jump(t *testing.T) {
+  const keys, n = 10000, 16
+
+  counts := make([]int, n + 1)
+  moved := 0
+  for i := 0; i < keys; i++ {
+    key := strconv.Itoa(i)
+    before := JumpMapping.shard(NumericIDs, key, n)
+    after := JumpMapping.shard(NumericIDs, key, n + 1)
+    if after != before {
+      if after != n {
+        t.Fatalf("%v moved from shard %v to %v", key, before, after)
+      }
+      moved++
+    }
+    counts[before]++
+  }
+
+  for shard, count := range counts[:n] {
+    if count < keys / n * 8 / 10 || count > keys / n * 12 / 10 {
+      t.Fatalf("expected about %v keys in shard %v, got %v", keys / n, shard, count)
+    }
+  }
+  if moved > keys / (n + 1) * 12 / 10 {
+    t.Fatalf("expected about %v keys to move, got %v", keys / (n + 1), moved)
+  }
+}
+
+// Ensure the data directory refuses a shard mapping or count other
+// than the one it was written with.
+func TestHandler_Layout(t *testing.T) {
+  dir, err := ioutil.TempDir("", "cart")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  defer os.RemoveAll(dir)
+
+  o := DefaultOptions()
+  o.Dir = dir
+  o.Shards = 8
+  o.Mapping = JumpMapping
+  h, err := NewHandlerWithOptions(o)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if err := h.Apply("1", "10", AddToSet); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  h.Close()
+
+  for _, change := range []func(*Options){
+    func(o *Options) { o.Mapping = ModuloMapping },
+    func(o *Options) { o.Shards = 16 },
+  } {
+    o := o
+    change(&o)
+    if h, err := NewHandlerWithOptions(o); err == nil {
+      h.Close()
+      t.Fatalf("expected an error opening with %v shards by %v", o.Shards, o.Mapping)
+    }
+  }
+
+  // Data written before layout files existed keeps the modulo
+  // mapping, and the number of shards its keys are spread over.
+  if err := RemoveContents(dir); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  o.Mapping = ModuloMapping
+  if h, err = NewHandlerWithOptions(o); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  for _, customer := range []string{"1", "2", "3", "12"} {
+    if err := h.Apply(customer, "10", AddToSet); err != nil {
+      t.Fatalf("unexpected error: %s", err)
+    }
+  }
+  h.Close()
+  if err := os.Remove(filepath.Join(dir, LayoutFileName)); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  for _, change := range []func(*Options){
+    func(o *Options) { o.Mapping = JumpMapping },
+    func(o *Options) { o.Shards = 4 },
+    func(o *Options) { o.Shards = 16 },
+  } {
+    o := o
+    change(&o)
+    if h, err := NewHandlerWithOptions(o); err == nil {
+      h.Close()
+      t.Fatalf("expected an error opening legacy data with %v shards by %v", o.Shards, o.Mapping)
+    }
+  }
+  if h, err = NewHandlerWithOptions(o); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  h.Close()
+}
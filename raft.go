@@ -0,0 +1,874 @@
+package cart
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log"
+  "net"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "sort"
+  "sync"
+  "time"
+
+  "github.com/hashicorp/raft"
+  raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+// The directory next to the shards holding the raft log and the
+// snapshots of a member of a raft group.
+const RaftDirName = "raft"
+
+// The header marking requests forwarded to the leader by another
+// member of its raft group, naming the member.
+const RaftHeader = "X-Cart-Raft"
+
+// ErrNotLeader is returned for changes sent to a member of a raft
+// group that does not lead it, or that just started leading and has
+// not caught up yet.
+var ErrNotLeader = errors.New("not the leader of the raft group")
+
+// ErrRaft is returned by what cannot go through the raft log, e.g.
+// RebuildItemIndex.
+var ErrRaft = errors.New("not supported by members of a raft group")
+
+// A member of a raft group.
+type RaftPeer struct {
+  ID string
+  // Where the member listens for raft traffic, e.g. 10.0.0.1:7097.
+  Address string
+}
+
+// Makes the handler a member of a raft group replicating the data
+// of every shard it owns: all of them, or the ones of its node if
+// the handler is a node of a cluster, every node then being a group
+// of its own.  A change is only made once a quorum of the members
+// has it in its log, and every member applies the changes in log
+// order to both of its indexes and to its journal, whose entries
+// are numbered by their log index.
+//
+// Only the leader takes changes and serves HTTP queries; the other
+// members forward them to it.  Reads through the Go API, e.g.
+// CartLines, are served by every member from its own copy, which
+// may lag behind.  Snapshots are archives written the same way as
+// Backup, and members lagging too far behind get the leader's to
+// replace their shards with.  A member failing to apply a committed
+// change restarts, restoring its last snapshot and replaying the log
+// after it.
+type Raft struct {
+  // The name of the member, unique within the group.
+  ID string
+  // Where the member listens for raft traffic, e.g. 0.0.0.0:7097,
+  // and where the other members reach it, Bind if empty.
+  Bind string
+  Advertise string
+  // Where clients reach the HTTP API of the member, e.g.
+  // http://10.0.0.1:8097.  Requests are forwarded to the leader's.
+  URL string
+
+  // The members to start the group with, this one included.  Only
+  // used the first time a member starts.  Members added later start
+  // without peers and wait to be added by the leader, see Join.
+  Peers []RaftPeer
+
+  // How long the members go without hearing from the leader before
+  // electing another one.
+  HeartbeatTimeout time.Duration
+  ElectionTimeout time.Duration
+  // How long a change waits for a quorum.
+  ApplyTimeout time.Duration
+
+  // How often to check whether to take a snapshot, how many new log
+  // entries make it worth it, and how many entries to keep after
+  // it for members lagging behind.
+  SnapshotInterval time.Duration
+  SnapshotThreshold uint64
+  TrailingLogs uint64
+}
+
+// Validate makes sure the raft settings make sense.
+func (c Raft) Validate() error {
+  if c.ID == "" {
+    return fmt.Errorf("id must be set")
+  }
+  if _, _, err := net.SplitHostPort(c.Bind); err != nil {
+    return fmt.Errorf("bind: %v", err)
+  }
+  if c.Advertise != "" {
+    if _, _, err := net.SplitHostPort(c.Advertise); err != nil {
+      return fmt.Errorf("advertise: %v", err)
+    }
+  }
+  if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+    return fmt.Errorf("url must be http or https")
+  }
+
+  ids := make(map[string]bool)
+  for _, peer := range c.Peers {
+    if peer.ID == "" || peer.Address == "" {
+      return fmt.Errorf("peers must have an id and an address")
+    }
+    if ids[peer.ID] {
+      return fmt.Errorf("peer %v is defined twice", peer.ID)
+    }
+    ids[peer.ID] = true
+  }
+  if len(c.Peers) > 0 && !ids[c.ID] {
+    return fmt.Errorf("peers must include %v itself", c.ID)
+  }
+
+  if c.HeartbeatTimeout <= 0 || c.ElectionTimeout < c.HeartbeatTimeout {
+    return fmt.Errorf("heartbeat timeout must be positive, the election timeout at least as long")
+  }
+  if c.ApplyTimeout <= 0 {
+    return fmt.Errorf("apply timeout must be positive")
+  }
+  if c.SnapshotInterval <= 0 || c.SnapshotThreshold == 0 {
+    return fmt.Errorf("snapshot interval and threshold must be positive")
+  }
+  return nil
+}
+
+// The payload of every raft log entry: a new leader announcing
+// itself, or the quantity of an item in a cart after a change, with
+// the line details the change passed, if any.
+type raftCommand struct {
+  Leader *raftLeader `json:"leader,omitempty"`
+
+  Op       Op                `json:"op,omitempty"`
+  Time     time.Time         `json:"time"`
+  Customer ID                `json:"customer"`
+  Item     ID                `json:"item"`
+  Variant  map[string]string `json:"variant,omitempty"`
+  Qty      uint32            `json:"qty"`
+  Details  *LineDetails      `json:"details,omitempty"`
+  // Only the item index changes, see ClusterItem and Repair.
+  ItemOnly bool `json:"item_only,omitempty"`
+  // Only the lines of the cart without a stamp change, see
+  // Handler.stampCart.
+  Stamp bool `json:"stamp,omitempty"`
+}
+
+// A member that became the leader, and where it serves HTTP.
+type raftLeader struct {
+  ID  string `json:"id"`
+  URL string `json:"url"`
+}
+
+// The member of a raft group a handler is.
+type raftMember struct {
+  conf   Raft
+  client *http.Client
+
+  mu sync.Mutex
+  // The raft instance while the handler is open.
+  node  *raft.Raft
+  store *raftboltdb.BoltStore
+  // Whether this member leads the group and has applied every
+  // change of the earlier leaders.
+  ready bool
+  // Whether the member failed to apply a committed command, see
+  // failRaft.
+  failed bool
+  // The URL of every member that led the group, by id.
+  urls  map[string]string
+
+  // Closed to stop the leadership watcher, which closes done.
+  stop chan struct{}
+  done chan struct{}
+}
+
+func newRaftMember(c *Raft) *raftMember {
+  return &raftMember{
+    conf: *c,
+    // Forwarded requests end with the client's.
+    client: &http.Client{},
+    urls: make(map[string]string),
+  }
+}
+
+// Return the raft instance, nil while the handler is closed, and
+// whether the member is ready to take changes.
+func (n *raftMember) state() (*raft.Raft, bool) {
+  n.mu.Lock()
+  defer n.mu.Unlock()
+  return n.node, n.ready
+}
+
+func (n *raftMember) setReady(ready bool) {
+  n.mu.Lock()
+  defer n.mu.Unlock()
+  n.ready = ready
+}
+
+// Return a copy of the URLs of the members that led the group.
+func (n *raftMember) members() map[string]string {
+  n.mu.Lock()
+  defer n.mu.Unlock()
+
+  urls := make(map[string]string, len(n.urls))
+  for id, u := range n.urls {
+    urls[id] = u
+  }
+  return urls
+}
+
+// Return the id of the leader and its URL, empty if unknown.
+func (n *raftMember) leader() (string, string) {
+  node, _ := n.state()
+  if node == nil {
+    return "", ""
+  }
+  _, id := node.LeaderWithID()
+
+  n.mu.Lock()
+  defer n.mu.Unlock()
+  return string(id), n.urls[string(id)]
+}
+
+// Start the raft instance, bootstrapping the group on the first
+// start if there are peers.  Snapshots are restored and the log is
+// replayed in the background.  The caller must hold the write lock.
+func (h *Handler) startRaft() error {
+  n := h.raft
+  dir := filepath.Join(h.dir, RaftDirName)
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return err
+  }
+
+  store, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+  if err != nil {
+    return err
+  }
+  snaps, err := raft.NewFileSnapshotStore(dir, 2, log.Writer())
+  if err != nil {
+    store.Close()
+    return err
+  }
+
+  advertise := n.conf.Advertise
+  if advertise == "" {
+    advertise = n.conf.Bind
+  }
+  addr, err := net.ResolveTCPAddr("tcp", advertise)
+  if err != nil {
+    store.Close()
+    return err
+  }
+  trans, err := raft.NewTCPTransport(n.conf.Bind, addr, 3, 10 * time.Second, log.Writer())
+  if err != nil {
+    store.Close()
+    return err
+  }
+
+  c := raft.DefaultConfig()
+  c.LocalID = raft.ServerID(n.conf.ID)
+  c.HeartbeatTimeout = n.conf.HeartbeatTimeout
+  c.ElectionTimeout = n.conf.ElectionTimeout
+  c.LeaderLeaseTimeout = n.conf.HeartbeatTimeout / 2
+  c.SnapshotInterval = n.conf.SnapshotInterval
+  c.SnapshotThreshold = n.conf.SnapshotThreshold
+  if n.conf.TrailingLogs > 0 {
+    c.TrailingLogs = n.conf.TrailingLogs
+  }
+  c.LogOutput = log.Writer()
+  c.LogLevel = "WARN"
+
+  if len(n.conf.Peers) > 0 {
+    existing, err := raft.HasExistingState(store, store, snaps)
+    if err == nil && !existing {
+      var servers []raft.Server
+      for _, peer := range n.conf.Peers {
+        servers = append(servers, raft.Server{
+          ID: raft.ServerID(peer.ID),
+          Address: raft.ServerAddress(peer.Address),
+        })
+      }
+      err = raft.BootstrapCluster(c, store, store, snaps, trans,
+        raft.Configuration{Servers: servers})
+    }
+    if err != nil {
+      trans.Close()
+      store.Close()
+      return err
+    }
+  }
+
+  node, err := raft.NewRaft(c, raftFSM{h}, store, store, snaps, trans)
+  if err != nil {
+    trans.Close()
+    store.Close()
+    return err
+  }
+
+  n.mu.Lock()
+  n.node, n.store, n.failed = node, store, false
+  n.mu.Unlock()
+  n.stop, n.done = make(chan struct{}), make(chan struct{})
+  go h.watchLeadership(n, node)
+  return nil
+}
+
+// Report whether the member failed to apply a committed command.
+func (n *raftMember) hasFailed() bool {
+  n.mu.Lock()
+  defer n.mu.Unlock()
+  return n.failed
+}
+
+// Stop the member after it failed to apply a committed command,
+// which left its indexes behind the log, and start it again after
+// an election timeout: raft restores the last snapshot and replays
+// the log after it, redoing whatever the command left half done.
+// Until then the member applies nothing and takes no changes.
+func (h *Handler) failRaft() {
+  n := h.raft
+  n.mu.Lock()
+  node := n.node
+  if node == nil || n.failed {
+    n.mu.Unlock()
+    return
+  }
+  n.failed, n.ready = true, false
+  n.mu.Unlock()
+
+  // Stopping waits for the command being applied to return.
+  go func() {
+    time.Sleep(n.conf.ElectionTimeout)
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if current, _ := n.state(); h.closed || current != node {
+      return
+    }
+    if err := h.stopRaft(); err != nil {
+      log.Printf("raft: stopping the member: %v", err)
+    }
+    for {
+      err := h.startRaft()
+      if err == nil {
+        return
+      }
+      log.Printf("raft: restarting the member: %v", err)
+
+      h.mu.Unlock()
+      time.Sleep(n.conf.ElectionTimeout)
+      h.mu.Lock()
+      if current, _ := n.state(); h.closed || current != nil {
+        return
+      }
+    }
+  }()
+}
+
+// Leave the group until opened again, and close the raft log.  The
+// caller must hold the write lock.
+func (h *Handler) stopRaft() error {
+  n := h.raft
+  node, _ := n.state()
+  if node == nil {
+    return nil
+  }
+
+  // Shutting down first fails whatever the watcher waits for.
+  err := node.Shutdown().Error()
+  close(n.stop)
+  <-n.done
+
+  n.mu.Lock()
+  defer n.mu.Unlock()
+  err = errors.Join(err, n.store.Close())
+  n.node, n.store, n.ready = nil, nil, false
+  return err
+}
+
+// Follow the leadership of the member until stopped.  A new leader
+// catches up with every change of the earlier leaders and announces
+// where it serves HTTP before it takes changes.
+func (h *Handler) watchLeadership(n *raftMember, node *raft.Raft) {
+  defer close(n.done)
+
+  for {
+    select {
+    case <-n.stop:
+      return
+    case leader := <-node.LeaderCh():
+      n.setReady(false)
+      for leader {
+        err := node.Barrier(n.conf.ApplyTimeout).Error()
+        if err == nil {
+          err = n.apply(node, raftCommand{Leader: &raftLeader{n.conf.ID, n.conf.URL}})
+        }
+        if err == nil {
+          n.setReady(true)
+          break
+        }
+        log.Printf("raft: taking over as the leader: %v", err)
+
+        // Try again while we still lead.
+        select {
+        case <-n.stop:
+          return
+        case leader = <-node.LeaderCh():
+        case <-time.After(n.conf.HeartbeatTimeout):
+        }
+      }
+    }
+  }
+}
+
+// Append the command to the log and wait for this member to apply
+// it.  Return what applying it returned.
+func (n *raftMember) apply(node *raft.Raft, c raftCommand) error {
+  data, err := json.Marshal(c)
+  if err != nil {
+    return err
+  }
+
+  f := node.Apply(data, n.conf.ApplyTimeout)
+  if err := f.Error(); err != nil {
+    // Only these turn the command away before it is in the log.
+    // Anything else, e.g. losing the leadership while waiting, may
+    // still see it committed.
+    switch err {
+    case raft.ErrNotLeader, raft.ErrLeadershipTransferInProgress:
+      return fmt.Errorf("%w: %v", ErrNotLeader, err)
+    case raft.ErrEnqueueTimeout:
+      return ErrBusy
+    }
+    return fmt.Errorf("%w: raft: %v", ErrUnavailable, err)
+  }
+  if err, ok := f.Response().(error); ok {
+    return err
+  }
+  return nil
+}
+
+// Append the command to the log if this member is ready to take
+// changes, see apply.
+func (h *Handler) propose(c raftCommand) error {
+  node, ready := h.raft.state()
+  if !ready {
+    return ErrNotLeader
+  }
+  return h.raft.apply(node, c)
+}
+
+// Let f modify both indexes through the raft log, the way
+// applyItem does otherwise: work out the quantity after the change
+// and have every member apply that once it is committed.  The
+// caller must hold the customer lock, which keeps the quantity from
+// changing in the meantime.  An item owned by another node has its
+// index changed there first, and put back if the change does not
+// make it into the log.
+func (h *Handler) proposeItem(customer string, item string,
+f (func (*setT, string) error), details *LineDetails, op Op) error {
+  if _, ready := h.raft.state(); !ready {
+    return ErrNotLeader
+  }
+  key, err := h.itemKey(item)
+  if err != nil {
+    return err
+  }
+  owner, err := h.itemOwner(item)
+  if err != nil {
+    return err
+  }
+
+  set := make(setT)
+  err = h.cStorage.ObserveValue(customer, func(s *setT) error {
+    set = *s
+    return nil
+  })
+  if err != nil && err != ErrNoSuchKey {
+    return err
+  }
+  before := set[item]
+  if err := f(&set, item); err != nil {
+    return err
+  }
+  after := set[item]
+  if op == "" {
+    op = OpAdd
+    if after < before {
+      op = OpRemove
+    }
+  }
+
+  if owner != nil {
+    if err := h.setRemoteItem(owner, customer, item, after); err != nil {
+      return err
+    }
+  }
+
+  err = h.propose(raftCommand{Op: op, Time: time.Now().UTC(),
+    Customer: h.ids.ID(customer), Item: h.ids.ID(key.SKU), Variant: key.Variant,
+    Qty: after, Details: details})
+  if err != nil && owner != nil {
+    err = errors.Join(err, h.setRemoteItem(owner, customer, item, before))
+  }
+  return err
+}
+
+// Set the quantity of the item in the cart of the customer in the
+// item index only, through the raft log.
+func (h *Handler) proposeItemIndex(customer string, item string, qty uint32) error {
+  key, err := h.itemKey(item)
+  if err != nil {
+    return err
+  }
+  return h.propose(raftCommand{Time: time.Now().UTC(), Customer: h.ids.ID(customer),
+    Item: h.ids.ID(key.SKU), Variant: key.Variant, Qty: qty, ItemOnly: true})
+}
+
+// Apply a committed command to both indexes and journal it under
+// its log index.  Commands carry the quantities after the change,
+// so applying one twice does no harm.  Commands are applied one at
+// a time, and the leader proposes them holding the customer lock,
+// so there is no need for the shard locks.
+func (h *Handler) applyCommand(index uint64, c raftCommand) error {
+  if c.Leader != nil {
+    h.raft.mu.Lock()
+    h.raft.urls[c.Leader.ID] = c.Leader.URL
+    h.raft.mu.Unlock()
+    return nil
+  }
+
+  customer := c.Customer.Value
+  if c.Stamp {
+    return h.cStorage.stampCart(customer, c.Time)
+  }
+  item, err := h.variants.intern(ItemKey{c.Item.Value, c.Variant})
+  if err != nil {
+    return err
+  }
+  f := setQtyInSet(c.Qty)
+  if c.ItemOnly {
+    return h.iStorage.ChangeValue(item, customer, f)
+  }
+
+  var items int
+  track := func(s *setT, v string) error {
+    err := f(s, v)
+    items = len(*s)
+    return err
+  }
+  line, err := h.cStorage.changeLineAt(customer, item, track, c.Details, false, c.Time)
+  if err != nil {
+    return err
+  }
+  owner, err := h.itemOwner(item)
+  if err != nil {
+    return err
+  }
+  if owner == nil {
+    if err := h.iStorage.ChangeValue(item, customer, f); err != nil {
+      return err
+    }
+  }
+
+  if h.journal != nil {
+    e := JournalEntry{Seq: index, Op: c.Op, Time: c.Time, Customer: c.Customer,
+      Item: c.Item, Variant: c.Variant, Qty: c.Qty, Items: items}
+    e.setDetails(line.Details())
+    if err := h.journal.appendAt(&e); err != nil {
+      return fmt.Errorf("journal: %v", err)
+    }
+  }
+  return nil
+}
+
+// Replace the data of the handler with a snapshot written by
+// backup.  Every shard is replaced on its own while the handler
+// keeps serving; the members do not serve HTTP queries while they
+// catch up with the leader, as they forward them.
+func (h *Handler) restoreSnapshot(r io.Reader) error {
+  tmp, err := ioutil.TempDir(h.dir, ".restore-")
+  if err != nil {
+    return err
+  }
+  defer os.RemoveAll(tmp)
+
+  shards := len(h.cStorage.shards)
+  m := Manifest{Shards: shards}
+  files, err := unpack(r, tmp, shards, &m)
+  if err != nil {
+    return err
+  }
+  if m.IDs != h.ids.String() || m.Mapping != h.mapping.String() {
+    return fmt.Errorf("snapshot has %v ids and the %v mapping, but the handler %v ids and the %v mapping",
+      m.IDs, m.Mapping, h.ids, h.mapping)
+  }
+
+  for _, storage := range [...]*ShardedStorage{&h.cStorage, &h.iStorage} {
+    for id := 0; id < shards; id++ {
+      path := filepath.Join(tmp, ShardFileName(storage.name, uint32(id)))
+      if err := storage.replaceShard(uint32(id), path); err != nil {
+        return fmt.Errorf("%v: %v", ShardFileName(storage.name, uint32(id)), err)
+      }
+    }
+  }
+
+  variants := ""
+  for _, file := range files {
+    if file == VariantFileName {
+      variants = filepath.Join(tmp, file)
+    }
+  }
+  if err := h.variants.replace(variants); err != nil {
+    return err
+  }
+
+  h.raft.mu.Lock()
+  defer h.raft.mu.Unlock()
+  h.raft.urls = make(map[string]string)
+  for id, u := range m.Members {
+    h.raft.urls[id] = u
+  }
+  return nil
+}
+
+// The handler as seen by raft.
+type raftFSM struct {
+  h *Handler
+}
+
+func (f raftFSM) Apply(l *raft.Log) interface{} {
+  if f.h.raft.hasFailed() {
+    return fmt.Errorf("%w: raft: member restarting", ErrUnavailable)
+  }
+  var c raftCommand
+  err := json.Unmarshal(l.Data, &c)
+  if err == nil {
+    err = f.h.applyCommand(l.Index, c)
+  }
+  if err != nil {
+    log.Printf("raft: entry %v: %v, restarting the member", l.Index, err)
+    f.h.failRaft()
+    return err
+  }
+  return nil
+}
+
+// Snapshots are taken while later commands are applied, so they may
+// hold some of them already.  That does no harm, applying them again
+// gives the same result.
+func (f raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+  return raftSnapshot{f.h, f.h.raft.members()}, nil
+}
+
+func (f raftFSM) Restore(r io.ReadCloser) error {
+  defer r.Close()
+  return f.h.restoreSnapshot(r)
+}
+
+// A snapshot about to be written by backup.
+type raftSnapshot struct {
+  h       *Handler
+  members map[string]string
+}
+
+func (s raftSnapshot) Persist(sink raft.SnapshotSink) error {
+  if err := s.h.backup(sink, s.members); err != nil {
+    sink.Cancel()
+    return err
+  }
+  return sink.Close()
+}
+
+func (s raftSnapshot) Release() {}
+
+// Pass a request on to the leader of the raft group, unless this
+// member is the leader, and report whether it did.  The leader
+// makes sure it still is before serving a request, so that reads
+// see every committed change.  A request that was forwarded already
+// is never forwarded again, the members disagree on who leads.
+func (h *Handler) toLeader(w http.ResponseWriter, r *http.Request) bool {
+  if h.raft == nil {
+    return false
+  }
+  node, ready := h.raft.state()
+  if node == nil {
+    // Closed, or restarting after a failure, see failRaft.
+    w.WriteHeader(http.StatusServiceUnavailable)
+    fmt.Fprintf(w, "error: %v", ErrNotLeader)
+    return true
+  }
+  if ready && node.VerifyLeader().Error() == nil {
+    return false
+  }
+
+  id, u := h.raft.leader()
+  if r.Header.Get(RaftHeader) != "" || u == "" || id == h.raft.conf.ID {
+    w.WriteHeader(http.StatusServiceUnavailable)
+    fmt.Fprintf(w, "error: %v", ErrNotLeader)
+    return true
+  }
+  proxy(w, r, h.raft.client, []string{u}, RaftHeader, h.raft.conf.ID)
+  return true
+}
+
+// Make sure this member may serve a request that the leader of its
+// raft group would otherwise be passed, the way toLeader does.
+// Return ErrNotLeader naming the leader's URL, if known, for
+// anybody else.  Handlers outside raft groups serve everything.
+func (h *Handler) checkLeader() error {
+  if h.raft == nil {
+    return nil
+  }
+  node, ready := h.raft.state()
+  if node == nil {
+    return ErrClosed
+  }
+  if ready && node.VerifyLeader().Error() == nil {
+    return nil
+  }
+  if _, u := h.raft.leader(); u != "" {
+    return fmt.Errorf("%w, the leader is at %v", ErrNotLeader, u)
+  }
+  return ErrNotLeader
+}
+
+// Members returns the members of the raft group, the leader's id,
+// empty if there is none, and the id of this member.
+func (h *Handler) Members() ([]RaftPeer, string, error) {
+  if !h.begin() {
+    return nil, "", ErrClosed
+  }
+  defer h.leave()
+
+  if h.raft == nil {
+    return nil, "", fmt.Errorf("not a member of a raft group")
+  }
+  node, _ := h.raft.state()
+  if node == nil {
+    // Restarting after a failure, see failRaft.
+    return nil, "", ErrNotLeader
+  }
+  f := node.GetConfiguration()
+  if err := f.Error(); err != nil {
+    return nil, "", err
+  }
+
+  var peers []RaftPeer
+  for _, s := range f.Configuration().Servers {
+    peers = append(peers, RaftPeer{string(s.ID), string(s.Address)})
+  }
+  sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+  leader, _ := h.raft.leader()
+  return peers, leader, nil
+}
+
+// Join adds a member to the raft group, or changes its address.
+// The new member starts without peers and catches up with the
+// leader.  Only the leader changes the group.
+func (h *Handler) Join(peer RaftPeer) error {
+  if peer.ID == "" || peer.Address == "" {
+    return fmt.Errorf("members must have an id and an address")
+  }
+  return h.changeMembers(func(node *raft.Raft) raft.IndexFuture {
+    return node.AddVoter(raft.ServerID(peer.ID), raft.ServerAddress(peer.Address),
+      0, h.raft.conf.ApplyTimeout)
+  })
+}
+
+// Leave removes a member from the raft group.  Only the leader
+// changes the group; a leader removing itself steps down.
+func (h *Handler) Leave(id string) error {
+  return h.changeMembers(func(node *raft.Raft) raft.IndexFuture {
+    return node.RemoveServer(raft.ServerID(id), 0, h.raft.conf.ApplyTimeout)
+  })
+}
+
+// Let f change the members of the group.
+func (h *Handler) changeMembers(f func(*raft.Raft) raft.IndexFuture) error {
+  if !h.begin() {
+    return ErrClosed
+  }
+  defer h.leave()
+
+  if h.raft == nil {
+    return fmt.Errorf("not a member of a raft group")
+  }
+  node, ready := h.raft.state()
+  if !ready {
+    return ErrNotLeader
+  }
+  if err := f(node).Error(); err != nil {
+    if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+      return fmt.Errorf("%w: %v", ErrNotLeader, err)
+    }
+    return err
+  }
+  return nil
+}
+
+// This function is responsible for handling /raft/members queries.
+// It reports every member of the raft group, one per line as id,
+// address and leader or follower.
+func (h* Handler) RaftMembers(w http.ResponseWriter, r *http.Request) {
+  peers, leader, err := h.Members()
+  if err != nil {
+    writeStatus(w, err)
+    fmt.Fprintf(w, "error: %v", err)
+    return
+  }
+
+  fmt.Fprintf(w, "OK\n")
+  for _, peer := range peers {
+    role := "follower"
+    if peer.ID == leader {
+      role = "leader"
+    }
+    fmt.Fprintf(w, "%v %v %v\n", peer.ID, peer.Address, role)
+  }
+}
+
+// This function is responsible for handling /raft/join queries.  It
+// adds the member passed as id and address to the raft group, see
+// Join.  Only POST is accepted.
+func (h* Handler) RaftJoin(w http.ResponseWriter, r *http.Request) {
+  h.changeMembersHTTP(w, r, func() error {
+    q := r.URL.Query()
+    return h.Join(RaftPeer{q.Get("id"), q.Get("address")})
+  })
+}
+
+// This function is responsible for handling /raft/leave queries.
+// It removes the member passed as id from the raft group, see
+// Leave.  Only POST is accepted.
+func (h* Handler) RaftLeave(w http.ResponseWriter, r *http.Request) {
+  h.changeMembersHTTP(w, r, func() error {
+    id := r.URL.Query().Get("id")
+    if id == "" {
+      return fmt.Errorf("id missing")
+    }
+    return h.Leave(id)
+  })
+}
+
+// The body of RaftJoin and RaftLeave.  Members that do not lead
+// forward the request to the leader.
+func (h* Handler) changeMembersHTTP(w http.ResponseWriter, r *http.Request, f func() error) {
+  if r.Method != "POST" {
+    w.Header().Set("Allow", "POST")
+    w.WriteHeader(http.StatusMethodNotAllowed)
+    fmt.Fprintf(w, "error: changing members requires POST")
+    return
+  }
+  if h.toLeader(w, r) {
+    return
+  }
+
+  err := f()
+  if err != nil {
+    writeStatus(w, err)
+    fmt.Fprintf(w, "error: %v", err)
+    return
+  }
+  fmt.Fprintf(w, "OK\n")
+}
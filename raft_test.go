@@ -0,0 +1,413 @@
+package cart
+
+import (
+  "fmt"
+  "io/ioutil"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/boltdb/bolt"
+)
+
+// A member of a raft group started by tempRaft.
+type tempMember struct {
+  h   *Handler
+  srv *httptest.Server
+  dir string
+  // Where the member listens for raft traffic.
+  addr string
+}
+
+// Return a free address on localhost for raft traffic.
+func freeAddress(t *testing.T) string {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  defer l.Close()
+  return l.Addr().String()
+}
+
+// Start a member of a raft group on localhost, with short timeouts
+// and snapshots taken by hand only.  A member started without peers
+// waits to be added.
+func startMember(t *testing.T, id string, addr string, peers []RaftPeer) *tempMember {
+  dir, err := ioutil.TempDir("", "cart")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  mux := http.NewServeMux()
+  m := &tempMember{srv: httptest.NewServer(mux), dir: dir, addr: addr}
+
+  o := DefaultOptions()
+  o.Dir = dir
+  o.Shards = 4
+  o.Journal = true
+  o.Raft = &Raft{ID: id, Bind: addr, URL: m.srv.URL, Peers: peers,
+    HeartbeatTimeout: 200 * time.Millisecond, ElectionTimeout: 200 * time.Millisecond,
+    ApplyTimeout: 2 * time.Second, SnapshotInterval: time.Hour, SnapshotThreshold: 1 << 20,
+    TrailingLogs: 1}
+  if m.h, err = NewHandlerWithOptions(o); err != nil {
+    m.srv.Close()
+    os.RemoveAll(dir)
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  mux.HandleFunc("/add", m.h.Mod(AddToSet))
+  mux.HandleFunc("/list", m.h.List)
+  mux.HandleFunc("/raft/members", m.h.RaftMembers)
+  mux.HandleFunc("/raft/join", m.h.RaftJoin)
+  mux.HandleFunc("/raft/leave", m.h.RaftLeave)
+  return m
+}
+
+func (m *tempMember) cleanup() {
+  m.srv.Close()
+  m.h.Close()
+  os.RemoveAll(m.dir)
+}
+
+// Start a raft group of three members a, b and c on localhost.
+func tempRaft(t *testing.T) (map[string]*tempMember, func()) {
+  var peers []RaftPeer
+  for _, id := range []string{"a", "b", "c"} {
+    peers = append(peers, RaftPeer{id, freeAddress(t)})
+  }
+
+  members := make(map[string]*tempMember)
+  cleanup := func() {
+    for _, m := range members {
+      m.cleanup()
+    }
+  }
+  for _, peer := range peers {
+    members[peer.ID] = startMember(t, peer.ID, peer.Address, peers)
+  }
+  return members, cleanup
+}
+
+// Wait for one of the open members to lead the group and be ready
+// to take changes, and for the others to know where it is.  Return
+// the id of the leader.
+func waitLeader(t *testing.T, members map[string]*tempMember) string {
+  deadline := time.Now().Add(10 * time.Second)
+  for time.Now().Before(deadline) {
+    for id, m := range members {
+      if _, ready := m.h.raft.state(); ready && knowLeader(members, id) {
+        return id
+      }
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  t.Fatalf("no leader elected")
+  return ""
+}
+
+// Report whether every member knows the URL of the leader.
+func knowLeader(members map[string]*tempMember, leader string) bool {
+  for _, m := range members {
+    if id, u := m.h.raft.leader(); id != leader || u != members[leader].srv.URL {
+      return false
+    }
+  }
+  return true
+}
+
+// Wait for the member to hold the quantity in both of its indexes.
+func waitQty(t *testing.T, id string, m *tempMember, customer string, item string, qty uint32) {
+  deadline := time.Now().Add(10 * time.Second)
+  for {
+    cQty, err := m.h.cStorage.qty(customer, item)
+    if err != nil {
+      t.Fatalf("%v: unexpected error: %s", id, err)
+    }
+    iQty, err := m.h.iStorage.qty(item, customer)
+    if err != nil {
+      t.Fatalf("%v: unexpected error: %s", id, err)
+    }
+    if cQty == qty && iQty == qty {
+      return
+    }
+    if time.Now().After(deadline) {
+      t.Fatalf("%v: expected %v of item %v for customer %v, got %v and %v",
+        id, qty, item, customer, cQty, iQty)
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+}
+
+// Return the status and the response lines joined by |, sorted
+// after the status line.
+func raftDo(t *testing.T, method string, u string) (int, string) {
+  req, err := http.NewRequest(method, u, nil)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  defer resp.Body.Close()
+  body, _ := ioutil.ReadAll(resp.Body)
+  lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+  sort.Strings(lines[1:])
+  return resp.StatusCode, strings.Join(lines, "|")
+}
+
+// Return the ids of the members other than the leader.
+func followers(members map[string]*tempMember, leader string) []string {
+  var ids []string
+  for _, id := range []string{"a", "b", "c", "d"} {
+    if _, ok := members[id]; ok && id != leader {
+      ids = append(ids, id)
+    }
+  }
+  return ids
+}
+
+// Ensure changes sent to any member go through the leader and end up
+// on every member, and that the group survives losing its leader.
+func TestRaft(t *testing.T) {
+  members, cleanup := tempRaft(t)
+  defer cleanup()
+
+  leader := waitLeader(t, members)
+  others := followers(members, leader)
+
+  // Followers forward HTTP requests.
+  for _, path := range []string{"/add?customer=1&item=13", "/add?customer=1&item=13",
+    "/add?customer=2&item=10&variant=size:M"} {
+    if code, got := raftDo(t, "GET", members[others[0]].srv.URL + path); got != "OK" {
+      t.Fatalf("%v: expected `OK`, got %v %v", path, code, got)
+    }
+  }
+  if _, got := raftDo(t, "GET", members[others[1]].srv.URL + "/list?customer=1"); got != "OK|13 2" {
+    t.Fatalf("expected `OK|13 2`, got %v", got)
+  }
+  if _, got := raftDo(t, "GET", members[others[1]].srv.URL + "/list?item=10&variant=size:M"); got != "OK|2 1" {
+    t.Fatalf("expected `OK|2 1`, got %v", got)
+  }
+
+  // Every member applies every change and journals it under the
+  // same sequence number.
+  next := members[leader].h.journal.Next()
+  for id, m := range members {
+    waitQty(t, id, m, "1", "13", 2)
+    for deadline := time.Now().Add(10 * time.Second); m.h.journal.Next() != next; {
+      if time.Now().After(deadline) {
+        t.Fatalf("%v: expected the journal to reach %v, got %v", id, next, m.h.journal.Next())
+      }
+      time.Sleep(10 * time.Millisecond)
+    }
+  }
+  var journals []string
+  for _, id := range []string{"a", "b", "c"} {
+    var seqs []string
+    err := members[id].h.journal.Read(0, func(e JournalEntry) error {
+      seqs = append(seqs, fmt.Sprintf("%v:%v@%v", e.Customer.Value, e.Item.Value, e.Seq))
+      return nil
+    })
+    if err != nil {
+      t.Fatalf("%v: unexpected error: %s", id, err)
+    }
+    journals = append(journals, strings.Join(seqs, " "))
+  }
+  if journals[0] == "" || journals[0] != journals[1] || journals[0] != journals[2] {
+    t.Fatalf("expected equal journals, got %q", journals)
+  }
+
+  // Followers turn down changes through the Go API and requests
+  // forwarded already.
+  if err := members[others[0]].h.proposeItemIndex("1", "13", 5); err != ErrNotLeader {
+    t.Fatalf("expected ErrNotLeader, got %v", err)
+  }
+  req, _ := http.NewRequest("GET", members[others[0]].srv.URL + "/list?customer=1", nil)
+  req.Header.Set(RaftHeader, leader)
+  if resp, err := http.DefaultClient.Do(req); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  } else if resp.Body.Close(); resp.StatusCode != http.StatusServiceUnavailable {
+    t.Fatalf("expected status code 503, got %d", resp.StatusCode)
+  }
+
+  // Losing the leader, the others elect a new one and keep the data.
+  if err := members[leader].h.Close(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  old := members[leader]
+  delete(members, leader)
+  leader = waitLeader(t, members)
+  others = followers(members, leader)
+
+  if _, got := raftDo(t, "GET", members[others[0]].srv.URL + "/add?customer=3&item=13"); got != "OK" {
+    t.Fatalf("expected `OK`, got %v", got)
+  }
+  if _, got := raftDo(t, "GET", members[leader].srv.URL + "/list?item=13"); got != "OK|1 2|3 1" {
+    t.Fatalf("expected `OK|1 2|3 1`, got %v", got)
+  }
+
+  // The old leader catches up once it is back.
+  if err := old.h.Open(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  for _, id := range []string{"a", "b", "c"} {
+    if _, ok := members[id]; !ok {
+      members[id] = old
+    }
+  }
+  waitQty(t, "old leader", old, "3", "13", 1)
+}
+
+// Ensure a member joining after the log was compacted gets the
+// leader's snapshot, and that members can be removed.
+func TestRaft_Join(t *testing.T) {
+  members, cleanup := tempRaft(t)
+  defer cleanup()
+
+  leader := waitLeader(t, members)
+  for _, path := range []string{"/add?customer=1&item=13", "/add?customer=2&item=10&variant=size:M"} {
+    if _, got := raftDo(t, "GET", members[leader].srv.URL + path); got != "OK" {
+      t.Fatalf("%v: expected `OK`, got %v", path, got)
+    }
+  }
+  node, _ := members[leader].h.raft.state()
+  if err := node.Snapshot().Error(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if _, got := raftDo(t, "GET", members[leader].srv.URL + "/add?customer=3&item=13"); got != "OK" {
+    t.Fatalf("expected `OK`, got %v", got)
+  }
+
+  // Members are added through any member, and only through POST.
+  d := startMember(t, "d", freeAddress(t), nil)
+  members["d"] = d
+  follower := members[followers(members, leader)[0]]
+  join := follower.srv.URL + "/raft/join?id=d&address=" + d.addr
+  if code, _ := raftDo(t, "GET", join); code != http.StatusMethodNotAllowed {
+    t.Fatalf("expected status code 405, got %d", code)
+  }
+  if _, got := raftDo(t, "POST", join); got != "OK" {
+    t.Fatalf("expected `OK`, got %v", got)
+  }
+
+  waitQty(t, "d", d, "1", "13", 1)
+  waitQty(t, "d", d, "3", "13", 1)
+  item, err := d.h.ItemID(ItemKey{"10", map[string]string{"size": "M"}})
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  waitQty(t, "d", d, "2", item, 1)
+
+  // The new member knows where the leader is and forwards to it.
+  if _, got := raftDo(t, "GET", d.srv.URL + "/list?item=13"); got != "OK|1 1|3 1" {
+    t.Fatalf("expected `OK|1 1|3 1`, got %v", got)
+  }
+
+  if _, got := raftDo(t, "POST", d.srv.URL + "/raft/leave?id=d"); got != "OK" {
+    t.Fatalf("expected `OK`, got %v", got)
+  }
+  _, got := raftDo(t, "GET", members[leader].srv.URL + "/raft/members")
+  if strings.Count(got, "|") != 3 || strings.Contains(got, "d ") ||
+    !strings.Contains(got, leader + " " + members[leader].addr + " leader") {
+    t.Fatalf("expected three members led by %v, got %v", leader, got)
+  }
+}
+
+// Ensure a member failing to apply a committed change restarts and
+// catches up instead of going on without it.
+func TestRaft_ApplyFailure(t *testing.T) {
+  members, cleanup := tempRaft(t)
+  defer cleanup()
+
+  leader := waitLeader(t, members)
+  id := followers(members, leader)[0]
+  m := members[id]
+
+  // Another process holds on to the shard of customer 1.
+  m.h.cStorage.openTimeout = 50 * time.Millisecond
+  shard := m.h.cStorage.mapping.shard(m.h.ids, "1", len(m.h.cStorage.shards))
+  path := filepath.Join(m.dir, ShardFileName(CustomerStorage, shard))
+  db, err := bolt.Open(path, 0600, nil)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  if _, got := raftDo(t, "GET", members[leader].srv.URL + "/add?customer=1&item=13"); got != "OK" {
+    t.Fatalf("expected `OK`, got %v", got)
+  }
+  for deadline := time.Now().Add(10 * time.Second); !m.h.raft.hasFailed(); {
+    if time.Now().After(deadline) {
+      db.Close()
+      t.Fatalf("expected the member to fail")
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+
+  db.Close()
+  waitQty(t, id, m, "1", "13", 1)
+}
+
+// Ensure the leader stamps lines without a stamp on every member
+// alike.
+func TestRaft_SweepUnstamped(t *testing.T) {
+  members, cleanup := tempRaft(t)
+  defer cleanup()
+
+  leader := waitLeader(t, members)
+  for _, m := range members {
+    writeUnstampedCart(t, m.h)
+  }
+  m := members[leader]
+  m.h.expiry = Expiry{ItemTTL: time.Hour}
+  now := time.Now().UTC().Round(0)
+  if _, err := m.h.Sweep(now); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  for id, m := range members {
+    for deadline := time.Now().Add(10 * time.Second); ; {
+      lines, err := m.h.CartLines("1")
+      if err == nil && lines["10"].UpdatedAt.Equal(now) {
+        break
+      }
+      if time.Now().After(deadline) {
+        t.Fatalf("%v: expected the line stamped with %v, got %v, %v", id, now, lines, err)
+      }
+      time.Sleep(10 * time.Millisecond)
+    }
+  }
+}
+
+// Ensure a member that is restarting reports it has no group instead
+// of its members.
+func TestRaft_MembersRestarting(t *testing.T) {
+  members, cleanup := tempRaft(t)
+  defer cleanup()
+
+  m := members[waitLeader(t, members)]
+  m.h.mu.Lock()
+  err := m.h.stopRaft()
+  m.h.mu.Unlock()
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if _, _, err := m.h.Members(); err != ErrNotLeader {
+    t.Fatalf("expected %v, got %v", ErrNotLeader, err)
+  }
+
+  m.h.mu.Lock()
+  err = m.h.startRaft()
+  m.h.mu.Unlock()
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if peers, _, err := m.h.Members(); err != nil || len(peers) != len(members) {
+    t.Fatalf("expected %v members, got %v, %v", len(members), peers, err)
+  }
+}
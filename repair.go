@@ -0,0 +1,153 @@
+package cart
+
+import (
+  "fmt"
+  "os"
+)
+
+// Given a key of the storage, return the quantity stored for
+// value, or zero if there is none.
+func (s *ShardedStorage) qty(key string, value string) (uint32, error) {
+  var qty uint32
+  err := s.ObserveValue(key, func(set *setT) error {
+    qty = (*set)[value]
+    return nil
+  })
+  if err == ErrNoSuchKey {
+    return 0, nil
+  }
+  return qty, err
+}
+
+// Compare both indexes and make the item index agree with the
+// customer index, which is the source of truth.  f is called on
+// every mismatch that got repaired.  Safe to run while serving:
+// every pair is re-read and fixed while holding both shard locks,
+// so mismatches caused by concurrent writes are skipped.  The fixes
+// are not journaled, the journal records the carts they agree with.
+// Read-only followers return ErrReadOnly, members of a raft group
+// ErrNotLeader unless they lead it.
+func (h *Handler) Repair(f func(Mismatch) error) error {
+  var found []Mismatch
+  err := h.Verify(func(m Mismatch) error {
+    found = append(found, m)
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+
+  if !h.begin() {
+    return ErrClosed
+  }
+  defer h.leave()
+
+  if h.readOnly {
+    return ErrReadOnly
+  }
+  if h.following() {
+    return ErrNotLeader
+  }
+
+  for _, m := range found {
+    fixed, err := h.repair(m.Customer, m.Item)
+    if err != nil {
+      return fmt.Errorf("customer %v item %v: %v", m.Customer, m.Item, err)
+    }
+    if fixed == nil {
+      continue
+    }
+
+    if err := f(*fixed); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Make the item index agree with the customer index for a single
+// (customer, item) pair.  Return the mismatch if there was one.
+// The caller must be inside a request.
+func (h *Handler) repair(customer string, item string) (*Mismatch, error) {
+  if !h.lock(&h.cLock, customer) {
+    return nil, ErrBusy
+  }
+  defer h.cLock.MustUnlock(customer)
+
+  if !h.lock(&h.iLock, item) {
+    return nil, ErrBusy
+  }
+  defer h.iLock.MustUnlock(item)
+
+  m := Mismatch{Customer: customer, Item: item}
+
+  var err error
+  if m.CustomerQty, err = h.cStorage.qty(customer, item); err != nil {
+    return nil, err
+  }
+  if m.ItemQty, err = h.iStorage.qty(item, customer); err != nil {
+    return nil, err
+  }
+
+  // A write fixed it in the meantime.
+  if m.CustomerQty == m.ItemQty {
+    return nil, nil
+  }
+
+  if h.raft != nil {
+    err = h.proposeItemIndex(customer, item, m.CustomerQty)
+  } else {
+    err = h.iStorage.ChangeValue(item, customer, setQtyInSet(m.CustomerQty))
+  }
+  if err != nil {
+    return nil, err
+  }
+  return &m, nil
+}
+
+// Throw the item index away and rebuild it from the customer
+// index.  Unlike Repair, this also recovers from a corrupt item
+// index.  Requests wait for the rebuild to finish, so this is meant
+// to run offline.  Nodes of a cluster return ErrClustered,
+// members of a raft group ErrRaft.
+func (h *Handler) RebuildItemIndex() error {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  if h.closed {
+    return ErrClosed
+  }
+  if h.cluster != nil {
+    return ErrClustered
+  }
+  if h.raft != nil {
+    return ErrRaft
+  }
+
+  // Close the item shards and remove their files.
+  if err := h.iStorage.Close(); err != nil {
+    return err
+  }
+  paths, err := ShardFiles(h.dir, h.iStorage.name)
+  if err != nil {
+    return err
+  }
+  for _, path := range paths {
+    if err := os.Remove(path); err != nil {
+      return err
+    }
+  }
+  h.iStorage.startJanitor()
+
+  // Every cart line goes back into the item index.  Nothing
+  // else runs, so there is no need for the shard locks.
+  return h.cStorage.ForEach(func(customer string, set *setT) error {
+    for _, item := range set.sortedKeys() {
+      err := h.iStorage.ChangeValue(item, customer, setQtyInSet((*set)[item]))
+      if err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+}
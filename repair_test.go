@@ -0,0 +1,194 @@
+package cart
+
+import (
+  "errors"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "reflect"
+  "testing"
+  "time"
+
+  "github.com/boltdb/bolt"
+)
+
+// Return a handler keeping its shards in a fresh temporary
+// directory, and a function closing it and removing everything.
+func tempHandler(t *testing.T) (*Handler, func()) {
+  dir, err := ioutil.TempDir("", "cart")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  o := DefaultOptions()
+  o.Dir = dir
+  h, err := NewHandlerWithOptions(o)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  return h, func() { h.Close(); os.RemoveAll(dir) }
+}
+
+// Add some consistent lines, then break the item index in all
+// three possible ways.
+func breakItemIndex(t *testing.T, h *Handler) {
+  for _, l := range []struct {
+    customer, item string
+    qty uint32
+  }{{"1", "10", 2}, {"1", "11", 1}, {"2", "10", 1}} {
+    if err := h.Apply(l.customer, l.item, AddQtyToSet(l.qty)); err != nil {
+      t.Fatalf("unexpected error: %s", err)
+    }
+  }
+
+  for _, change := range []struct {
+    item, customer string
+    qty uint32
+  }{
+    {"10", "1", 5}, // Wrong quantity.
+    {"11", "1", 0}, // Missing line.
+    {"12", "3", 1}, // Line without a cart.
+  } {
+    err := h.iStorage.ChangeValue(change.item, change.customer, setQtyInSet(change.qty))
+    if err != nil {
+      t.Fatalf("unexpected error: %s", err)
+    }
+  }
+}
+
+// Collect the mismatches reported by Verify.
+func verify(t *testing.T, h *Handler) []Mismatch {
+  var found []Mismatch
+  err := h.Verify(func(m Mismatch) error {
+    found = append(found, m)
+    return nil
+  })
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  return found
+}
+
+// Ensure /admin/verify only repairs on POST.
+func TestHandler_AdminVerify(t *testing.T) {
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+  breakItemIndex(t, h)
+
+  w := httptest.NewRecorder()
+  h.AdminVerify(w, httptest.NewRequest("GET", "http://localhost/admin/verify?repair=true", nil))
+  if w.Code != http.StatusMethodNotAllowed {
+    t.Fatalf("expected a 405, got %v `%s`", w.Code, w.Body.String())
+  }
+  if found := verify(t, h); len(found) != 3 {
+    t.Fatalf("expected the index left as it is, got %v", found)
+  }
+
+  w = httptest.NewRecorder()
+  h.AdminVerify(w, httptest.NewRequest("POST", "http://localhost/admin/verify?repair=true", nil))
+  if w.Code != http.StatusOK {
+    t.Fatalf("expected a 200, got %v `%s`", w.Code, w.Body.String())
+  }
+  if found := verify(t, h); len(found) != 0 {
+    t.Fatalf("expected a consistent index, got %v", found)
+  }
+
+  // Followers get their item index from the leader.
+  breakItemIndex(t, h)
+  h.readOnly = true
+  err := h.Repair(func(Mismatch) error { return nil })
+  if err != ErrReadOnly {
+    t.Fatalf("expected %v, got %v", ErrReadOnly, err)
+  }
+  if found := verify(t, h); len(found) != 3 {
+    t.Fatalf("expected the index left as it is, got %v", found)
+  }
+}
+
+// Ensure a change the item index fails to take is taken out of the
+// cart again, and that the request can be tried again.
+func TestHandler_ItemIndexFailure(t *testing.T) {
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+
+  // Another process holds on to the shard of item 10.
+  h.iStorage.openTimeout = 50 * time.Millisecond
+  shard := h.iStorage.mapping.shard(h.ids, "10", len(h.iStorage.shards))
+  db, err := bolt.Open(filepath.Join(h.dir, ShardFileName(ItemStorage, shard)), 0600, nil)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  defer db.Close()
+
+  if err := h.Apply("1", "10", AddToSet); !errors.Is(err, ErrShardOpen) {
+    t.Fatalf("expected %v, got %v", ErrShardOpen, err)
+  }
+  if qty, _ := h.cStorage.qty("1", "10"); qty != 0 {
+    t.Fatalf("expected the cart put back, got %v", qty)
+  }
+
+  w := httptest.NewRecorder()
+  writeStatus(w, errors.Join(ErrBusy, errors.New("undo failed")))
+  if w.Code != http.StatusServiceUnavailable {
+    t.Fatalf("expected a 503, got %v", w.Code)
+  }
+}
+
+// Ensure every kind of mismatch gets reported and repaired.
+func TestHandler_Repair(t *testing.T) {
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+
+  breakItemIndex(t, h)
+
+  expected := []Mismatch{
+    {Customer: "1", Item: "10", CustomerQty: 2, ItemQty: 5},
+    {Customer: "1", Item: "11", CustomerQty: 1, ItemQty: 0},
+    {Customer: "3", Item: "12", CustomerQty: 0, ItemQty: 1},
+  }
+  if found := verify(t, h); !reflect.DeepEqual(found, expected) {
+    t.Fatalf("expected %v, got %v", expected, found)
+  }
+
+  var repaired []Mismatch
+  err := h.Repair(func(m Mismatch) error {
+    repaired = append(repaired, m)
+    return nil
+  })
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if !reflect.DeepEqual(repaired, expected) {
+    t.Fatalf("expected %v, got %v", expected, repaired)
+  }
+
+  if found := verify(t, h); len(found) != 0 {
+    t.Fatalf("expected no mismatches, got %v", found)
+  }
+}
+
+// Ensure the item index can be rebuilt from the customer index.
+func TestHandler_RebuildItemIndex(t *testing.T) {
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+
+  breakItemIndex(t, h)
+
+  if err := h.RebuildItemIndex(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if found := verify(t, h); len(found) != 0 {
+    t.Fatalf("expected no mismatches, got %v", found)
+  }
+
+  // The shard of the orphaned item is gone for good.
+  paths, err := ShardFiles(h.dir, ItemStorage)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if len(paths) != 2 {
+    t.Fatalf("expected the shards of items 10 and 11, got %v", paths)
+  }
+}
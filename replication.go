@@ -0,0 +1,385 @@
+package cart
+
+import (
+  "bufio"
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// The file next to the shards recording how far a follower got.
+const ReplicaFileName = "replica.json"
+
+// ErrReadOnly is returned for changes sent to a follower.
+var ErrReadOnly = errors.New("follower is read-only")
+
+// Errors out of replicate when the handler is busy closing.
+var errRetry = errors.New("retry later")
+
+// Makes the handler a read-only follower of a leader.  The follower
+// polls the change feed of the leader, all shards at once, and
+// applies every change to both of its indexes and to its own
+// journal, if enabled.  The last applied leader entry is kept in
+// ReplicaFileName, so a restarted follower resumes where it
+// stopped; a new follower starts at the first entry of the leader's
+// journal.  Replication is asynchronous: the follower lags behind
+// by up to a poll, which Promote catches up on if the leader is
+// still around.
+type Follow struct {
+  // The URL of the leader, e.g. http://10.0.0.1:8097.
+  Leader string
+
+  // How long a single poll waits for a change on the leader.
+  Wait time.Duration
+  // The first retry after a failure waits MinBackoff, every
+  // further one twice as long, up to MaxBackoff.
+  MinBackoff time.Duration
+  MaxBackoff time.Duration
+}
+
+// Validate makes sure the follower settings make sense.
+func (f Follow) Validate() error {
+  u, err := url.Parse(f.Leader)
+  if err != nil {
+    return fmt.Errorf("leader: %v", err)
+  }
+  if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+    return fmt.Errorf("leader url must be http or https")
+  }
+  if f.Wait <= 0 || f.Wait > MaxChangesWait {
+    return fmt.Errorf("wait must be positive and at most %v", MaxChangesWait)
+  }
+  if f.MinBackoff <= 0 || f.MaxBackoff < f.MinBackoff {
+    return fmt.Errorf("backoff must be positive, the maximum at least the minimum")
+  }
+  return nil
+}
+
+// How a follower stands with its leader, see ReplicaFileName.
+type ReplicaState struct {
+  Leader string `json:"leader"`
+  // The sequence number of the last leader entry applied.
+  Seq uint64 `json:"seq"`
+  // Set by Promote.  A promoted follower never follows again.
+  Promoted bool `json:"promoted,omitempty"`
+}
+
+// Read the replica file in dir.  No file at all is a follower that
+// has not started yet.
+func loadReplicaState(dir string) (ReplicaState, error) {
+  var s ReplicaState
+  path := filepath.Join(dir, ReplicaFileName)
+  data, err := ioutil.ReadFile(path)
+  if os.IsNotExist(err) {
+    return s, nil
+  }
+  if err != nil {
+    return s, err
+  }
+  if err := json.Unmarshal(data, &s); err != nil {
+    return s, fmt.Errorf("%v: %v", path, err)
+  }
+  return s, nil
+}
+
+// Write the replica file in dir.  The file is replaced atomically,
+// so a crash leaves the old or the new one.
+func (s ReplicaState) save(dir string) error {
+  data, err := json.Marshal(s)
+  if err != nil {
+    return err
+  }
+
+  path := filepath.Join(dir, ReplicaFileName)
+  tmp := path + ".tmp"
+  if err := ioutil.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+    return err
+  }
+  return os.Rename(tmp, path)
+}
+
+// Follows the leader in the background.
+type replicator struct {
+  follow Follow
+  dir    string
+  client http.Client
+  // Only touched by the replicator, or by Promote once it stopped.
+  state  ReplicaState
+
+  ctx    context.Context
+  cancel context.CancelFunc
+  done   chan struct{}
+}
+
+// Start following the leader, unless the follower got promoted.
+// Return whether the handler is read-only.  The caller must hold
+// the write lock.
+func (h *Handler) startReplicator() (bool, error) {
+  state, err := loadReplicaState(h.dir)
+  if err != nil {
+    return false, err
+  }
+  if state.Promoted {
+    return false, nil
+  }
+  if state.Leader != "" && state.Leader != h.follow.Leader {
+    return false, fmt.Errorf("%v follows %v, not %v", h.dir, state.Leader, h.follow.Leader)
+  }
+  state.Leader = h.follow.Leader
+  if err := state.save(h.dir); err != nil {
+    return false, err
+  }
+
+  r := &replicator{
+    follow: *h.follow,
+    dir: h.dir,
+    // Long enough for a poll that waits for changes.
+    client: http.Client{Timeout: h.follow.Wait + 10 * time.Second},
+    state: state,
+    done: make(chan struct{}),
+  }
+  r.ctx, r.cancel = context.WithCancel(context.Background())
+  h.replicator = r
+  go h.replicate(r)
+  return true, nil
+}
+
+// Stop following, abandoning the poll in flight, and wait for the
+// replicator to finish.
+func (h *Handler) stopReplicator() {
+  if h.replicator == nil {
+    return
+  }
+  h.replicator.cancel()
+  <-h.replicator.done
+  h.replicator = nil
+}
+
+// Apply the changes of the leader until stopped.
+func (h *Handler) replicate(r *replicator) {
+  defer close(r.done)
+
+  backoff := r.follow.MinBackoff
+  for {
+    entries, err := r.poll(r.follow.Wait)
+    if err == nil {
+      // Close and Promote stop us while holding the write lock,
+      // so we must never wait for the read lock.
+      err = errRetry
+      if h.mu.TryRLock() {
+        err = ErrClosed
+        if !h.closed {
+          err = h.applyChanges(r, entries)
+        }
+        h.mu.RUnlock()
+      }
+    }
+    if r.ctx.Err() != nil {
+      return
+    }
+    if err == nil {
+      backoff = r.follow.MinBackoff
+      continue
+    }
+
+    if err != errRetry && err != ErrBusy {
+      log.Printf("replication: %v", err)
+    }
+    if !r.sleep(backoff) {
+      return
+    }
+    if backoff *= 2; backoff > r.follow.MaxBackoff {
+      backoff = r.follow.MaxBackoff
+    }
+  }
+}
+
+// Ask the leader for the changes after the last one applied,
+// waiting up to the given duration for one.
+func (r *replicator) poll(wait time.Duration) ([]JournalEntry, error) {
+  q := url.Values{}
+  q.Set("after", strconv.FormatUint(r.state.Seq, 10))
+  q.Set("wait", wait.String())
+  req, err := http.NewRequestWithContext(r.ctx, "GET",
+    strings.TrimSuffix(r.follow.Leader, "/") + "/changes?" + q.Encode(), nil)
+  if err != nil {
+    return nil, err
+  }
+
+  resp, err := r.client.Do(req)
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+
+  br := bufio.NewReader(resp.Body)
+  status, err := br.ReadString('\n')
+  if status != "OK\n" {
+    if err == nil {
+      status, err = status + "...", nil
+    }
+    return nil, fmt.Errorf("%v responded with %v: %q", r.follow.Leader, resp.Status, status)
+  }
+
+  var entries []JournalEntry
+  err = ReadJournal(br, func(e JournalEntry) error {
+    entries = append(entries, e)
+    return nil
+  })
+  return entries, err
+}
+
+// Wait for the duration.  Return false if the replicator got
+// stopped first.
+func (r *replicator) sleep(wait time.Duration) bool {
+  timer := time.NewTimer(wait)
+  defer timer.Stop()
+
+  select {
+  case <-timer.C:
+    return true
+  case <-r.ctx.Done():
+    return false
+  }
+}
+
+// Apply the changes of the leader in order and remember the last
+// one applied.  A change that was applied already does no harm, as
+// every change carries the resulting quantity.  The caller must
+// hold either side of the handler lock.
+func (h *Handler) applyChanges(r *replicator, entries []JournalEntry) error {
+  var err error
+  for _, e := range entries {
+    if err = h.applyChange(e); err != nil {
+      if err != ErrBusy {
+        err = fmt.Errorf("leader entry %v: %v", e.Seq, err)
+      }
+      break
+    }
+    r.state.Seq = e.Seq
+  }
+
+  if len(entries) == 0 {
+    return err
+  }
+  return errors.Join(err, r.state.save(r.dir))
+}
+
+// Apply a single change of the leader to both indexes and journal
+// it.  The journal entry gets a sequence number of our own.
+func (h *Handler) applyChange(e JournalEntry) error {
+  item, err := h.variants.intern(ItemKey{e.Item.Value, e.Variant})
+  if err != nil {
+    return err
+  }
+  if err := h.set(e.Customer.Value, item, e.Qty, e.details(), e.Time); err != nil {
+    return err
+  }
+
+  if h.journal != nil {
+    if err := h.journal.Append(&e); err != nil {
+      return fmt.Errorf("journal: %v", err)
+    }
+  }
+  return nil
+}
+
+// Promote turns a follower into a leader accepting changes, for
+// good.  It stops following and applies whatever changes the leader
+// still has, if it can be reached.  Return how far the follower
+// got.  The follower keeps serving reads while it catches up.
+func (h *Handler) Promote() (ReplicaState, error) {
+  r, err := h.stopFollowing()
+  if err != nil {
+    return ReplicaState{}, err
+  }
+
+  // Catch up without waiting for new changes.  An unreachable
+  // leader is what promoting is usually for.  Like the replicator,
+  // only hold the read lock to apply what a poll returned.
+  r.ctx, r.cancel = context.WithCancel(context.Background())
+  defer r.cancel()
+  for {
+    entries, err := r.poll(0)
+    if err != nil {
+      log.Printf("promote: giving up on the leader: %v", err)
+      break
+    }
+    if len(entries) == 0 {
+      break
+    }
+    if !h.begin() {
+      return r.state, ErrClosed
+    }
+    err = h.applyChanges(r, entries)
+    h.leave()
+    if err != nil {
+      return r.state, err
+    }
+  }
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  // Reopened meanwhile, the replicator resumed where it stopped.
+  if h.closed || h.replicator != nil {
+    return r.state, ErrClosed
+  }
+  r.state.Promoted = true
+  if err := r.state.save(h.dir); err != nil {
+    return r.state, err
+  }
+  h.readOnly = false
+  h.startSweeper()
+  return r.state, nil
+}
+
+// Stop the replicator of a follower for Promote and return it.
+func (h *Handler) stopFollowing() (*replicator, error) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  if h.closed {
+    return nil, ErrClosed
+  }
+  if !h.readOnly {
+    return nil, fmt.Errorf("not a follower")
+  }
+  r := h.replicator
+  if r == nil {
+    return nil, fmt.Errorf("being promoted already")
+  }
+  h.stopReplicator()
+  return r, nil
+}
+
+// This function is responsible for handling /admin/promote queries.
+// It turns the follower into a leader, see Promote, and reports the
+// last leader entry it applied.  Only POST is accepted.
+func (h* Handler) AdminPromote(w http.ResponseWriter, r *http.Request) {
+  if r.Method != "POST" {
+    w.Header().Set("Allow", "POST")
+    w.WriteHeader(http.StatusMethodNotAllowed)
+    fmt.Fprintf(w, "error: promote requires POST")
+    return
+  }
+
+  state, err := h.Promote()
+  if err == ErrClosed {
+    w.WriteHeader(http.StatusServiceUnavailable)
+  }
+  if err != nil {
+    fmt.Fprintf(w, "error: %v", err)
+    return
+  }
+  fmt.Fprintf(w, "OK\n%v\n", state.Seq)
+}
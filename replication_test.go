@@ -0,0 +1,190 @@
+package cart
+
+import (
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "sync"
+  "testing"
+  "time"
+)
+
+// Ensure a follower applies every change of the leader, refuses
+// changes of its own until promoted, and stays promoted.
+func TestHandler_Follow(t *testing.T) {
+  leader, cleanup := tempHandler(t)
+  defer cleanup()
+  leader.Close()
+  leader.journaling = true
+  if err := leader.Open(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  srv := httptest.NewServer(http.HandlerFunc(leader.Feed))
+  defer srv.Close()
+
+  dir, err := ioutil.TempDir("", "cart")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  defer os.RemoveAll(dir)
+  o := DefaultOptions()
+  o.Dir = dir
+  o.Journal = true
+  o.Follow = &Follow{
+    Leader: srv.URL,
+    Wait: 50 * time.Millisecond,
+    MinBackoff: time.Millisecond,
+    MaxBackoff: 10 * time.Millisecond,
+  }
+  follower, err := NewHandlerWithOptions(o)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  defer func() { follower.Close() }()
+
+  // Wait for the follower to have the same lines as the leader,
+  // stamps included.  Lines without attributes may hold an empty
+  // map or none, so compare them as printed.
+  check := func(customer string) {
+    expected, err := leader.CartLines(customer)
+    if err != nil {
+      t.Fatalf("unexpected error: %s", err)
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+      got, _ := follower.CartLines(customer)
+      if fmt.Sprint(got) == fmt.Sprint(expected) {
+        return
+      }
+      if time.Now().After(deadline) {
+        t.Fatalf("expected %v, got %v", expected, got)
+      }
+      time.Sleep(10 * time.Millisecond)
+    }
+  }
+
+  item, err := leader.ItemID(ItemKey{"7", map[string]string{"size": "M"}})
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  err = leader.ApplyLine("1", item, AddQtyToSet(2), LineDetails{Price: 999, Currency: "EUR"})
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if err := leader.Apply("1", "8", AddToSet); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  check("1")
+  if found := verify(t, follower); len(found) != 0 {
+    t.Fatalf("expected consistent indexes, got %v", found)
+  }
+
+  // The follower refuses changes of its own.
+  if err := follower.Apply("1", "9", AddToSet); err != ErrReadOnly {
+    t.Fatalf("expected ErrReadOnly, got %v", err)
+  }
+  w := httptest.NewRecorder()
+  follower.Mod(AddToSet)(w, httptest.NewRequest("GET", "http://localhost/add?customer=2&item=9", nil))
+  if w.Body.String() != "error: " + ErrReadOnly.Error() {
+    t.Fatalf("expected a read-only error, got `%s`", w.Body.String())
+  }
+
+  // A restarted follower resumes, and changes made while it was
+  // down arrive once it is back.  Following another leader takes
+  // a fresh data directory.
+  follower.Close()
+  other := o
+  other.Follow = &Follow{"http://localhost:1", time.Second, time.Second, time.Second}
+  if h, err := NewHandlerWithOptions(other); err == nil {
+    h.Close()
+    t.Fatalf("expected an error following another leader")
+  }
+  if err := leader.ClearCart("1"); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if err := follower.Open(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  check("1")
+  if err := leader.Apply("2", "8", AddToSet); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  // Promoting catches up with the leader.
+  state, err := follower.Promote()
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  } else if state.Seq != leader.journal.Next() - 1 || !state.Promoted {
+    t.Fatalf("expected to be promoted at %v, got %+v", leader.journal.Next() - 1, state)
+  }
+  check("2")
+  if _, err := follower.Promote(); err == nil {
+    t.Fatalf("expected an error promoting twice")
+  }
+
+  // The promoted follower takes changes, even after a restart.
+  follower.Close()
+  if err := follower.Open(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if err := follower.Apply("3", "9", AddToSet); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+}
+
+// Ensure a follower serves reads while Promote waits for its leader.
+func TestHandler_PromoteSlowLeader(t *testing.T) {
+  // Only the poll of Promote waits for nothing, and hangs.
+  var once sync.Once
+  promoting := make(chan struct{})
+  release := make(chan struct{})
+  srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Query().Get("wait") == "0s" {
+      once.Do(func() { close(promoting) })
+      <-release
+    }
+    fmt.Fprintf(w, "OK\n")
+  }))
+  defer srv.Close()
+
+  dir, err := ioutil.TempDir("", "cart")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  defer os.RemoveAll(dir)
+  o := DefaultOptions()
+  o.Dir = dir
+  o.Follow = &Follow{Leader: srv.URL, Wait: 50 * time.Millisecond,
+    MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+  follower, err := NewHandlerWithOptions(o)
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  defer follower.Close()
+
+  done := make(chan error)
+  go func() {
+    _, err := follower.Promote()
+    done <- err
+  }()
+
+  <-promoting
+  read := make(chan error)
+  go func() {
+    _, err := follower.CartLines("1")
+    read <- err
+  }()
+  select {
+  case <-read:
+  case <-time.After(time.Second):
+    close(release)
+    t.Fatalf("expected reads to be served while promoting")
+  }
+
+  close(release)
+  if err := <-done; err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+}
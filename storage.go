@@ -1,57 +1,153 @@
 package cart
 
 import (
-  "log"
+  "container/list"
+  "errors"
   "fmt"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
 
 	"github.com/boltdb/bolt"
 )
 
 
+// ErrNoSuchKey is returned when observing a key that has no value.
+var ErrNoSuchKey = errors.New("no such key")
+
+// ErrShardOpen is returned when a shard file cannot be opened, e.g.
+// because another process holds it or there are no file descriptors
+// left.  Nothing was changed, trying again later may work.
+var ErrShardOpen = errors.New("cannot open shard")
+
 // The inner storage shard object.
 type storageShard struct {
 	shardN   uint32  // Shard number/id.
 	db      *bolt.DB // A pointer to BoltDB instance.
+  lastSync time.Time // When the shard was last flushed to disk.
+  dirty    bool      // Whether commits since lastSync skipped the fsync.
+  lastUsed time.Time // When the shard was last released.
+  refs     int       // Number of operations using the shard.
+  elem     *list.Element // Position in the LRU list.
+  lines    bool      // Whether values are carts, see line.go.
+  ids      IDMode    // How keys and values are encoded.
 }
 
-// TODO: Parameterize the storage location in order to
-//       facilitate testing
+// A key-value storage split into shards, each of them
+// backed by its own BoltDB file.
 type ShardedStorage struct {
   // A unique type identifier associated with am
   // instance.  This name has to be unique.  It
   // is used for uniquely storing files responsible
   // for each shard.
   name    string
+  // The directory holding the shard files.
   folder  string
-  // An array of storage shard objects.
-  shards  [NShards]*storageShard
+  // How the shards flush their writes to disk.
+  durability Durability
+  // A slice of storage shard objects, one per shard.
+  shards  []*storageShard
+  // Whether the values are carts of lines rather than sets of
+  // quantities, see line.go.  The functions observing and changing
+  // values get to see the quantities either way.
+  lines bool
+  // How keys map to shards and how they are encoded.
+  ids IDMode
+  mapping ShardMapping
+
+  // How long to wait for another process to release a shard
+  // file.  0 means forever.
+  openTimeout time.Duration
+
+  // How many shards may be open at once (0 means no limit) and
+  // how long an unused shard stays open (0 means forever).
+  maxOpen     int
+  idleTimeout time.Duration
+
+  // Protects shards, the LRU list and the metrics.  The sharded
+  // lock only covers a single index, while opening a shard might
+  // evict one at any other index.
+  mu      sync.Mutex
+  // Open shards, the most recently used one at the front.
+  lru     list.List
+  metrics ShardMetrics
+  // Closed to stop the shard janitor, which then closes done.
+  stop    chan struct{}
+  done    chan struct{}
+}
+
+// Return a new storage with n shards, keeping its files in
+// the given folder.
+func newShardedStorage(name string, folder string, n int) ShardedStorage {
+  return ShardedStorage{
+    name: name,
+    folder: folder,
+    shards: make([]*storageShard, n),
+  }
 }
 
 // Given a key, return the storage shard pointer associated
 // with it.
-func (s *ShardedStorage) getShard(key uint32) *storageShard {
-  // Since the key space is bigger, do the module
-  // arithmetic to get a proper index.
-  idx := key % NShards
+func (s *ShardedStorage) getShard(key string) (*storageShard, error) {
+  return s.getShardAt(s.mapping.shard(s.ids, key, len(s.shards)))
+}
+
+// Given a shard index, return the storage shard pointer.
+// The shard must be released with releaseShard.
+func (s *ShardedStorage) getShardAt(idx uint32) (*storageShard, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
 
   // If there is no shard associated with this index,
   // create a new one (or read the old one).
-  if s.shards[idx] == nil {
+  shard := s.shards[idx]
+  if shard == nil {
     //log.Print("shard: creating a new one")
-    s.shards[idx] = s.newStorageShard(idx)
+    var err error
+    shard, err = s.newStorageShard(idx)
+    if err != nil {
+      return nil, err
+    }
+    shard.elem = s.lru.PushFront(shard)
+    s.shards[idx] = shard
+    s.metrics.Opens++
+  } else {
+    s.lru.MoveToFront(shard.elem)
   }
 
-  return s.shards[idx]
+  // Pin the shard so that it doesn't get evicted while in use,
+  // and make room for it if we are over the limit.
+  shard.refs++
+  s.evictLocked()
+
+  return shard, nil
+}
+
+// Release a shard obtained from getShard or getShardAt.
+func (s *ShardedStorage) releaseShard(shard *storageShard) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  shard.refs--
+  shard.lastUsed = time.Now()
 }
 
 
 // Given a key, let the function f observe the value 
 // associated with it.
 func (s *ShardedStorage) ObserveValue(
-key uint32, f (func (*setT) error)) error {
+key string, f (func (*setT) error)) error {
 
-  var shard = s.getShard(key)
-  var e =  fmt.Errorf("no such key")
+  shard, err := s.getShard(key)
+  if err != nil {
+    return err
+  }
+  defer s.releaseShard(shard)
+  var e =  ErrNoSuchKey
 
   return shard.db.View(func(tx *bolt.Tx) error {
     // Get the bucket.
@@ -61,7 +157,7 @@ key uint32, f (func (*setT) error)) error {
     }
 
     // Get the key byte representation.
-    keyBuf, err := getBytes(key)
+    keyBuf, err := s.ids.keyBytes(key)
     if err != nil {
       return err
     }
@@ -73,7 +169,7 @@ key uint32, f (func (*setT) error)) error {
     }
 
     // Decode the value into its proper type.
-    set, err := extractValue(data)
+    set, _, err := shard.decode(tx, keyBuf, data)
     if err != nil {
       return err
     }
@@ -88,10 +184,33 @@ key uint32, f (func (*setT) error)) error {
 
 // Given a key, let the function f modify the value 
 // associated with it.
-func (s *ShardedStorage) ChangeValue(key uint32,
-value uint32, f (func (*setT, uint32) error)) error {
+func (s *ShardedStorage) ChangeValue(key string,
+value string, f (func (*setT, string) error)) error {
+  return s.changeValueAt(key, value, f, time.Now())
+}
+
+// Like ChangeValue, but remember the change as made at the given
+// time.
+func (s *ShardedStorage) changeValueAt(key string,
+value string, f (func (*setT, string) error), now time.Time) error {
+  _, err := s.changeLineAt(key, value, f, nil, false, now)
+  return err
+}
 
-  var shard = s.getShard(key)
+// Like changeValueAt, but for storages of carts also apply the
+// details to the line of value, if there is one after the change.
+// The details are merged into the line, see LineDetails.apply, or
+// replace those of the line altogether.  Return a copy of that
+// line.
+func (s *ShardedStorage) changeLineAt(key string,
+value string, f (func (*setT, string) error), details *LineDetails,
+replace bool, now time.Time) (Line, error) {
+
+  shard, err := s.getShard(key)
+  if err != nil {
+    return Line{}, err
+  }
+  defer s.releaseShard(shard)
 
   // From BoltDB documentation:
   // Individual transactions and all objects created from them (e.g.
@@ -99,7 +218,8 @@ value uint32, f (func (*setT, uint32) error)) error {
   // goroutines you must start a transaction for each one or use
   // locking to ensure only one goroutine accesses a transaction at a
   // time.  Creating transaction from the DB is thread safe.
-	return shard.db.Update(func(tx *bolt.Tx) error {
+  var line Line
+	err = shard.db.Update(func(tx *bolt.Tx) error {
     // Get the bucket, or create a new one if it does not exist.
     bucket, err := tx.CreateBucketIfNotExists([]byte("Cart"))
     if err != nil {
@@ -107,7 +227,7 @@ value uint32, f (func (*setT, uint32) error)) error {
     }
 
     // Get the key byte representation.
-    keyBuf, err := getBytes(key)
+    keyBuf, err := s.ids.keyBytes(key)
     if err != nil {
       return err
     }
@@ -116,41 +236,198 @@ value uint32, f (func (*setT, uint32) error)) error {
     var data = bucket.Get(keyBuf)
 
     // Decode the value into its proper type.
-    set, err := extractValue(data)
+    set, cart, err := shard.decode(tx, keyBuf, data)
     if err != nil {
       return err
     }
 
+    // Call the modifier, passing it the decoded value.
     err = f(set, value)
     if err != nil {
       return err
     }
 
-    // Call the modifier, passing it the decoded value.
-		setBuf, err := getBytes(set)
+    if !s.lines {
+      setBuf, err := s.ids.encodeSet(*set)
+      if err != nil {
+        return err
+      }
 
-    // Synchronize the change with the block storage.
-		err = bucket.Put(keyBuf, setBuf)
+      // Synchronize the change with the block storage.
+      return bucket.Put(keyBuf, setBuf)
+    }
+
+    // Carry the new quantities over to the lines.  Lines that do
+    // not know when they were changed expire counting from now.
+    cart.update(*set, now)
+    cart.stamp(now)
+    if l := cart[value]; l != nil {
+      if details != nil && replace {
+        details.replace(l)
+        l.UpdatedAt = now
+      } else if details != nil {
+        details.apply(l)
+        l.UpdatedAt = now
+      }
+      line = *l
+    }
 
-		return err
+    cartBuf, err := encodeCart(s.ids, cart)
+    if err != nil {
+      return err
+    }
+    if err := bucket.Put(keyBuf, cartBuf); err != nil {
+      return err
+    }
+    // Version 1 stamps are in the lines now.
+    return dropStamps(tx, keyBuf)
 	})
+  if err != nil {
+    return line, err
+  }
+
+  return line, s.maybeSync(shard)
+}
+
+// With the interval fsync strategy, commits skip the fsync and
+// the shard gets flushed by the first commit that happens after
+// the interval elapsed.  Without one, the janitor flushes it, see
+// syncLocked.
+func (s *ShardedStorage) maybeSync(shard *storageShard) error {
+  if s.durability.Fsync != FsyncInterval {
+    return nil
+  }
+
+  s.mu.Lock()
+  due := time.Since(shard.lastSync) >= s.durability.SyncInterval
+  if due {
+    shard.lastSync = time.Now()
+  }
+  shard.dirty = !due
+  s.mu.Unlock()
+
+  if !due {
+    return nil
+  }
+  return shard.db.Sync()
+}
+
+// Return the durability settings of the storage.
+func (s *ShardedStorage) Durability() Durability {
+  return s.durability
+}
+
+// Close every open shard and forget about it, so that a later
+// access reopens it.  The returned error aggregates the failures
+// of every shard.
+func (s *ShardedStorage) Close() error {
+  s.stopJanitor()
+
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  var errs []error
+  for _, shard := range s.shards {
+    if shard == nil {
+      continue
+    }
+
+    if err := s.closeShardLocked(shard); err != nil {
+      errs = append(errs, err)
+    }
+  }
+  return errors.Join(errs...)
 }
 
 // Return a new shard object pointer given the shard id.
-func (s *ShardedStorage) newStorageShard(id uint32) *storageShard {
-	ss := storageShard{shardN: id, db: NewBoltDB(id, s.name)}
-	return &ss
+func (s *ShardedStorage) newStorageShard(id uint32) (*storageShard, error) {
+  db, err := NewBoltDB(s.folder, id, s.name, &bolt.Options{Timeout: s.openTimeout})
+  if err != nil {
+    return nil, err
+  }
+	ss := storageShard{shardN: id, db: db, lines: s.lines, ids: s.ids}
+
+  // Apply the durability settings.  NoSync covers both the
+  // interval and the never fsync strategies.
+  ss.db.NoSync = s.durability.Fsync != FsyncAlways
+  ss.db.NoGrowSync = s.durability.NoGrowSync
+  ss.lastSync = time.Now()
+	return &ss, nil
+}
+
+// Flush any unsynced writes and close the underlying database.
+// The database is closed even if the flush fails.
+func (ss *storageShard) close() error {
+  var syncErr error
+  if ss.db.NoSync {
+    syncErr = ss.db.Sync()
+  }
+  return errors.Join(syncErr, ss.db.Close())
 }
 
 
-// Given a shard id and a shard type-name, either return
-// a fresh BoldDB instance or an existing one.
-func NewBoltDB(id uint32, name string) *bolt.DB {
-  dbPath := fmt.Sprintf("%v/%v-%v.db", ShardDirPath, name, id)
-  db, err := bolt.Open(dbPath, 0600, nil)
+// Given a directory, a shard id, a shard type-name and the bolt
+// options, either return a fresh BoldDB instance or an existing one.
+// Failing to open it is an ErrShardOpen.
+func NewBoltDB(dir string, id uint32, name string,
+o *bolt.Options) (*bolt.DB, error) {
+  dbPath := filepath.Join(dir, ShardFileName(name, id))
+  db, err := bolt.Open(dbPath, 0600, o)
   if err != nil {
-	  log.Fatal(err)
+    return nil, fmt.Errorf("%w %v: %v", ErrShardOpen, dbPath, err)
+  }
+	return db, nil
+}
+
+// Given a shard type-name and a shard id, return the name
+// of the file holding the shard.
+func ShardFileName(name string, id uint32) string {
+  return fmt.Sprintf("%v-%v.db", name, id)
+}
+
+// Given a file name, return the shard type-name and the
+// shard id it holds.  Return false if the name does not
+// follow the shard naming pattern.
+func ParseShardFileName(file string) (string, uint32, bool) {
+  base := strings.TrimSuffix(file, ".db")
+  sep := strings.LastIndex(base, "-")
+  if base == file || sep <= 0 {
+    return "", 0, false
+  }
+
+  id, err := strconv.ParseUint(base[sep+1:], 10, 32)
+  if err != nil {
+    return "", 0, false
+  }
+
+  // Only accept the canonical spelling of the id.
+  if ShardFileName(base[:sep], uint32(id)) != file {
+    return "", 0, false
+  }
+  return base[:sep], uint32(id), true
+}
+
+// Given a directory and a shard type-name, return the paths
+// of all the shard files of that storage.
+func ShardFiles(dir string, name string) ([]string, error) {
+  d, err := os.Open(dir)
+  if err != nil {
+    return nil, err
+  }
+  defer d.Close()
+
+  names, err := d.Readdirnames(-1)
+  if err != nil {
+    return nil, err
+  }
+
+  var paths []string
+  for _, file := range names {
+    if n, _, ok := ParseShardFileName(file); ok && n == name {
+      paths = append(paths, filepath.Join(dir, file))
+    }
   }
-	return db
+  sort.Strings(paths)
+  return paths, nil
 }
 
@@ -1,9 +1,11 @@
 package cart
 
 import (
+  "errors"
   "fmt"
   "os"
   "path/filepath"
+  "sort"
 
   "bytes"
   "encoding/gob"
@@ -22,31 +24,35 @@ func getBytes(key interface{}) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// Given a binary representation of an object, return its
+// Given a binary representation of a key, return its
 // decoded value using the gob decoder.
-func extractValue(data []byte) (*setT, error) {
-  var set setT
-
-  if data == nil {
-    //log.Print("no set associated with that key")
-    set = make(setT)
-    return &set, nil
-  }
+func extractKey(data []byte) (uint32, error) {
+  var key uint32
 
   buf := bytes.NewBuffer(data)
   dec := gob.NewDecoder(buf)
-  err := dec.Decode(&set)
+  err := dec.Decode(&key)
   if err != nil {
-    return nil, err
+    return 0, err
   }
 
-  return &set, nil
+  return key, nil
+}
+
+// Return the keys of the set in increasing order, see LessID.
+func (s setT) sortedKeys() []string {
+  keys := make([]string, 0, len(s))
+  for k := range s {
+    keys = append(keys, k)
+  }
+  sort.Slice(keys, func(i, j int) bool { return LessID(keys[i], keys[j]) })
+  return keys
 }
 
 // A helper function that adds an item to an existing set.
 // If item key is already there, it increments the count,
 // otherwise it initializes it to one..
-func AddToSet(s *setT, value uint32) error {
+func AddToSet(s *setT, value string) error {
   if _, ok := (*s)[value]; ok {
     (*s)[value] = (*s)[value] + 1
     return nil
@@ -56,13 +62,61 @@ func AddToSet(s *setT, value uint32) error {
   return nil
 }
 
+// Return a helper function that adds qty of an item to an
+// existing set at once.
+func AddQtyToSet(qty uint32) func(*setT, string) error {
+  return func(s *setT, value string) error {
+    if qty == 0 {
+      return fmt.Errorf("quantity must be positive")
+    }
+
+    (*s)[value] = (*s)[value] + qty
+    return nil
+  }
+}
+
+// The most units of an item a single /add or /remove changes.
+const MaxModQty = 1000
+
+// Return a helper function that lets f change the set qty times at
+// once, e.g. to add or remove qty units of an item.  Nothing
+// changes unless every time succeeds.
+func repeatInSet(f func(*setT, string) error, qty uint32) func(*setT, string) error {
+  return func(s *setT, value string) error {
+    for i := uint32(0); i < qty; i++ {
+      if err := f(s, value); err != nil {
+        return err
+      }
+    }
+    return nil
+  }
+}
+
+// Return a helper function that sets the quantity of an item
+// in an existing set, removing the item if qty is zero.
+func setQtyInSet(qty uint32) func(*setT, string) error {
+  return func(s *setT, value string) error {
+    if qty == 0 {
+      delete(*s, value)
+      return nil
+    }
+
+    (*s)[value] = qty
+    return nil
+  }
+}
+
+// ErrNotInCart is returned by RemoveFromSet for an item that is not
+// in the cart.
+var ErrNotInCart = errors.New("item not in the cart")
+
 // A helper function that removes an item from an existing set.
 // If the item is already there, it decrements the count,
 // otherwise it removes the item altogether.
-func RemoveFromSet(s *setT, value uint32) error {
+func RemoveFromSet(s *setT, value string) error {
   size, ok := (*s)[value]
   if !ok {
-    return fmt.Errorf("item not in the cart")
+    return ErrNotInCart
   }
 
   if size == 1 {
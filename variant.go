@@ -0,0 +1,379 @@
+package cart
+
+import (
+  "archive/tar"
+  "encoding/json"
+  "fmt"
+  "math"
+  "os"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+
+	"github.com/boltdb/bolt"
+)
+
+// The file next to the shards holding the variant registry.
+const VariantFileName = "variants.db"
+
+// The largest numeric item id clients use directly.  The ids
+// above it stand for variants of items and are handed out by the
+// variant registry, see ItemKey; data holding items of its own above
+// it is refused, see checkVariantIDs.  String variant ids start with
+// a character client ids never start with instead.
+const MaxItem = math.MaxInt32
+
+// An item, possibly narrowed down to a variant, e.g. SKU 7 in size
+// M.  An item without variant attributes is the SKU itself.
+type ItemKey struct {
+  SKU     string
+  Variant map[string]string
+}
+
+// Report whether the key stands for a variant rather than a SKU.
+func (k ItemKey) IsVariant() bool {
+  return len(k.Variant) > 0
+}
+
+// Return the variant attributes as name:value, in name order.
+func (k ItemKey) Attributes() []string {
+  attrs := make([]string, 0, len(k.Variant))
+  for name, value := range k.Variant {
+    attrs = append(attrs, name + ":" + value)
+  }
+  sort.Strings(attrs)
+  return attrs
+}
+
+func (k ItemKey) String() string {
+  return strings.Join(append([]string{k.SKU}, k.Attributes()...), " ")
+}
+
+// Return the identity of the key in the registry.  JSON encodes
+// maps in key order, so equal variants give equal strings.
+func (k ItemKey) canonical() (string, error) {
+  data, err := json.Marshal(k.Variant)
+  return k.SKU + " " + string(data), err
+}
+
+// How a variant is stored in the registry.
+type variantRecord struct {
+  SKU     ID                `json:"sku"`
+  Variant map[string]string `json:"variant"`
+}
+
+// Hands out an item id to every variant and remembers which one
+// stands for which, for good.  The ids are kept in VariantFileName
+// and in memory; the file is only created with the first variant.
+type variantRegistry struct {
+  path    string
+  timeout time.Duration
+  // How item ids look and how they are stored.
+  ids     IDMode
+
+  mu    sync.RWMutex
+  db    *bolt.DB
+  byKey map[string]string
+  keys  map[string]ItemKey
+  // The variant ids of every SKU, in increasing order.
+  bySKU map[string][]string
+}
+
+// Open the registry file if there is one and load it.
+func (r *variantRegistry) open() error {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  return r.loadLocked()
+}
+
+// The body of open.  The caller must hold r.mu.
+func (r *variantRegistry) loadLocked() error {
+  r.byKey = make(map[string]string)
+  r.keys = make(map[string]ItemKey)
+  r.bySKU = make(map[string][]string)
+
+  if _, err := os.Stat(r.path); os.IsNotExist(err) {
+    return nil
+  }
+  if err := r.openLocked(); err != nil {
+    return err
+  }
+
+  return r.db.View(func(tx *bolt.Tx) error {
+    bucket := tx.Bucket([]byte("Variant"))
+    if bucket == nil {
+      return nil
+    }
+
+    return bucket.ForEach(func(k, v []byte) error {
+      id, err := r.ids.extractKey(k)
+      if err != nil {
+        return err
+      }
+      var rec variantRecord
+      if err := json.Unmarshal(v, &rec); err != nil {
+        return fmt.Errorf("variant %v: %v", id, err)
+      }
+      return r.addLocked(id, ItemKey{rec.SKU.Value, rec.Variant})
+    })
+  })
+}
+
+// Open the registry file, creating it if needed.
+func (r *variantRegistry) openLocked() error {
+  db, err := bolt.Open(r.path, 0600, &bolt.Options{Timeout: r.timeout})
+  if err != nil {
+    return fmt.Errorf("%v: %v", r.path, err)
+  }
+  r.db = db
+  return nil
+}
+
+// Remember the id of the key in memory.
+func (r *variantRegistry) addLocked(id string, key ItemKey) error {
+  canonical, err := key.canonical()
+  if err != nil {
+    return err
+  }
+  r.byKey[canonical] = id
+  r.keys[id] = key
+
+  ids := append(r.bySKU[key.SKU], id)
+  sort.Slice(ids, func(i, j int) bool { return LessID(ids[i], ids[j]) })
+  r.bySKU[key.SKU] = ids
+  return nil
+}
+
+// Replace the registry with the registry file at path, moving the
+// file into place, or with an empty one if path is empty.
+func (r *variantRegistry) replace(path string) error {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  if r.db != nil {
+    if err := r.db.Close(); err != nil {
+      return err
+    }
+    r.db = nil
+  }
+
+  var err error
+  if path != "" {
+    err = os.Rename(path, r.path)
+  } else if err = os.Remove(r.path); os.IsNotExist(err) {
+    err = nil
+  }
+  if err != nil {
+    return err
+  }
+  return r.loadLocked()
+}
+
+// Close the registry file, if open.
+func (r *variantRegistry) close() error {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  if r.db == nil {
+    return nil
+  }
+  err := r.db.Close()
+  r.db = nil
+  return err
+}
+
+// Make sure the key can be registered.
+func (r *variantRegistry) validate(key ItemKey) error {
+  sku, err := r.ids.Parse(key.SKU)
+  if err != nil || sku != key.SKU || r.ids.isVariant(sku) {
+    return fmt.Errorf("invalid item id %q", key.SKU)
+  }
+  if len(key.Variant) > MaxAttributes {
+    return fmt.Errorf("too many variant attributes, at most %v allowed", MaxAttributes)
+  }
+  for name, value := range key.Variant {
+    if name == "" || value == "" {
+      return fmt.Errorf("variant attributes must have a name and a value")
+    }
+  }
+  return nil
+}
+
+// Return the item id of the key.  Return false if it is a variant
+// that was never registered.
+func (r *variantRegistry) lookup(key ItemKey) (string, bool, error) {
+  if !key.IsVariant() {
+    return key.SKU, true, nil
+  }
+
+  canonical, err := key.canonical()
+  if err != nil {
+    return "", false, err
+  }
+
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+  id, ok := r.byKey[canonical]
+  return id, ok, nil
+}
+
+// Return the item id of the key, registering the variant first if
+// it is new.
+func (r *variantRegistry) intern(key ItemKey) (string, error) {
+  if err := r.validate(key); err != nil {
+    return "", err
+  }
+  if id, ok, err := r.lookup(key); ok || err != nil {
+    return id, err
+  }
+
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  // Someone else may have registered it in the meantime.
+  canonical, err := key.canonical()
+  if err != nil {
+    return "", err
+  }
+  if id, ok := r.byKey[canonical]; ok {
+    return id, nil
+  }
+
+  if r.db == nil {
+    if err := r.openLocked(); err != nil {
+      return "", err
+    }
+  }
+
+  var id string
+  err = r.db.Update(func(tx *bolt.Tx) error {
+    bucket, err := tx.CreateBucketIfNotExists([]byte("Variant"))
+    if err != nil {
+      return err
+    }
+
+    seq, err := bucket.NextSequence()
+    if err != nil {
+      return err
+    }
+    if id, err = r.ids.variantID(seq); err != nil {
+      return err
+    }
+
+    keyBuf, err := r.ids.keyBytes(id)
+    if err != nil {
+      return err
+    }
+    data, err := json.Marshal(variantRecord{r.ids.ID(key.SKU), key.Variant})
+    if err != nil {
+      return err
+    }
+    return bucket.Put(keyBuf, data)
+  })
+  if err != nil {
+    return "", err
+  }
+
+  return id, r.addLocked(id, key)
+}
+
+// Return the key the item id stands for.  Return false if it is a
+// variant id that was never handed out.
+func (r *variantRegistry) key(item string) (ItemKey, bool) {
+  if !r.ids.isVariant(item) {
+    return ItemKey{SKU: item}, true
+  }
+
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+  key, ok := r.keys[item]
+  return key, ok
+}
+
+// Return the item ids of the SKU and of every variant of it.
+func (r *variantRegistry) items(sku string) []string {
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+  return append([]string{sku}, r.bySKU[sku]...)
+}
+
+// Write a snapshot of the registry into the archive, if there is
+// anything registered.
+func (r *variantRegistry) backup(tw *tar.Writer) error {
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+
+  if r.db == nil {
+    return nil
+  }
+  return r.db.View(func(tx *bolt.Tx) error {
+    hdr := &tar.Header{
+      Name: VariantFileName,
+      Mode: 0600,
+      Size: tx.Size(),
+      ModTime: time.Now(),
+    }
+    if err := tw.WriteHeader(hdr); err != nil {
+      return err
+    }
+
+    _, err := tx.WriteTo(tw)
+    return err
+  })
+}
+
+// ItemID returns the item id standing for the key, to be passed to
+// Apply and friends.  A variant seen for the first time gets a new
+// id above MaxItem.
+func (h *Handler) ItemID(key ItemKey) (string, error) {
+  if !h.begin() {
+    return "", ErrClosed
+  }
+  defer h.leave()
+
+  if h.readOnly {
+    if id, ok, err := h.variants.lookup(key); ok || err != nil {
+      return id, err
+    }
+    return "", ErrReadOnly
+  }
+
+  return h.variants.intern(key)
+}
+
+// LookupItem returns the key the item id stands for.
+func (h *Handler) LookupItem(item string) (ItemKey, error) {
+  if !h.begin() {
+    return ItemKey{}, ErrClosed
+  }
+  defer h.leave()
+
+  return h.itemKey(item)
+}
+
+// Return the item id of the key for a change made by f.  A variant
+// never registered is in no cart, so it only gets registered if f
+// changes an empty cart: removing it fails without leaving it in
+// the registry.  The caller must be inside a request.
+func (h *Handler) modItem(key ItemKey, f func(*setT, string) error) (string, error) {
+  if err := h.variants.validate(key); err != nil {
+    return "", err
+  }
+  if id, ok, err := h.variants.lookup(key); ok || err != nil {
+    return id, err
+  }
+  if err := f(&setT{}, key.SKU); err != nil {
+    return "", err
+  }
+  return h.variants.intern(key)
+}
+
+// The body of LookupItem.  The caller must be inside a request.
+func (h *Handler) itemKey(item string) (ItemKey, error) {
+  key, ok := h.variants.key(item)
+  if !ok {
+    return key, fmt.Errorf("unknown variant id %q", item)
+  }
+  return key, nil
+}
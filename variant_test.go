@@ -0,0 +1,168 @@
+package cart
+
+import (
+  "bytes"
+  "io/ioutil"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "testing"
+)
+
+// Ensure data written before variants existed is refused if it
+// holds items under ids that stand for variants now.
+func TestHandler_LegacyItemIDs(t *testing.T) {
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+
+  variant, err := h.ItemID(ItemKey{"7", map[string]string{"size": "M"}})
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if err := h.Apply("1", variant, AddToSet); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if err := h.iStorage.ChangeValue("3000000000", "2", setQtyInSet(1)); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  h.Close()
+
+  // As left by a version without variants.
+  path := filepath.Join(h.dir, LayoutFileName)
+  legacy := h.layout()
+  legacy.Variants = false
+  if err := writeLayout(path, legacy); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if err := h.Open(); err == nil || !strings.Contains(err.Error(), "3000000000") {
+    t.Fatalf("expected item 3000000000 refused, got %v", err)
+  }
+
+  // Without it, only registered variants are left.
+  if err := h.iStorage.ChangeValue("3000000000", "2", setQtyInSet(0)); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  h.iStorage.Close()
+  if err := h.Open(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if data, _ := ioutil.ReadFile(path); !strings.Contains(string(data), `"variants":true`) {
+    t.Fatalf("expected the check recorded, got `%s`", data)
+  }
+}
+
+// Ensure variants are kept apart in carts, and can be listed both
+// one by one and together with their SKU.
+func TestHandler_Variants(t *testing.T) {
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+
+  // Return the response lines, sorted after the status line.
+  do := func(path string) []string {
+    w := httptest.NewRecorder()
+    r := httptest.NewRequest("GET", "http://localhost" + path, nil)
+    if strings.HasPrefix(path, "/list") {
+      h.List(w, r)
+    } else {
+      h.Mod(AddToSet)(w, r)
+    }
+    lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+    sort.Strings(lines[1:])
+    return lines
+  }
+
+  for _, path := range []string{
+    "/add?customer=1&item=7&variant=size:M",
+    "/add?customer=2&item=7&variant=size:L",
+    "/add?customer=3&item=7",
+    "/add?customer=3&item=7&variant=size:M",
+    "/add?customer=3&item=7&variant=color:red&variant=size:M",
+  } {
+    if got := do(path); got[0] != "OK" {
+      t.Fatalf("%v: expected `OK`, got %v", path, got)
+    }
+  }
+
+  expected := map[string]string{
+    "/list?item=7": "OK 1 1|2 1|3 3",
+    "/list?item=7&variant=size:M": "OK 1 1|3 1",
+    "/list?item=7&variant=size:M&variant=color:red": "OK 3 1",
+    "/list?customer=3": "OK 7 1|7 1 color:red size:M|7 1 size:M",
+  }
+  check := func() {
+    for path, lines := range expected {
+      got := do(path)
+      if joined := got[0] + " " + strings.Join(got[1:], "|"); joined != lines {
+        t.Fatalf("%v: expected %v, got %v", path, lines, joined)
+      }
+    }
+  }
+  check()
+
+  for _, path := range []string{
+    "/list?item=7&variant=size:S",
+    "/list?customer=3&variant=size:M",
+    "/list?item=7&variant=size",
+    "/add?customer=1&item=7&variant=size:",
+    "/add?customer=1&item=2147483648",
+  } {
+    if got := do(path); !strings.HasPrefix(got[0], "error:") {
+      t.Fatalf("%v: expected an error, got %v", path, got)
+    }
+  }
+
+  // Rejected changes register no variant.
+  registered := len(h.variants.items("7"))
+  for _, tt := range []struct {
+    f    func(*setT, string) error
+    path string
+  }{
+    {RemoveFromSet, "/remove?customer=1&item=7&variant=size:XL"},
+    {AddToSet, "/add?customer=1&item=7&variant=size:XL&price=x"},
+  } {
+    w := httptest.NewRecorder()
+    h.Mod(tt.f)(w, httptest.NewRequest("GET", "http://localhost" + tt.path, nil))
+    if !strings.HasPrefix(w.Body.String(), "error:") {
+      t.Fatalf("%v: expected an error, got %v", tt.path, w.Body.String())
+    }
+  }
+  if n := len(h.variants.items("7")); n != registered {
+    t.Fatalf("expected %v item ids, got %v", registered, n)
+  }
+
+  // The ids survive a restart and a restore.
+  if err := h.Close(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if err := h.Open(); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  check()
+
+  var backup bytes.Buffer
+  if err := h.Backup(&backup); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  dir, err := ioutil.TempDir("", "cart")
+  if err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  defer os.RemoveAll(dir)
+  if _, err := Restore(&backup, dir, NShards); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  o := DefaultOptions()
+  o.Dir = dir
+  if h, err = NewHandlerWithOptions(o); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  defer h.Close()
+  check()
+
+  if found := verify(t, h); len(found) != 0 {
+    t.Fatalf("expected consistent indexes, got %v", found)
+  }
+}
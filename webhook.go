@@ -0,0 +1,356 @@
+package cart
+
+import (
+  "bytes"
+  "context"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "regexp"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// The events a webhook can subscribe to.
+const (
+  EventItemAdded   = "item.added"
+  EventItemRemoved = "item.removed"
+  EventCartEmptied = "cart.emptied"
+)
+
+// The header carrying the hex encoded HMAC-SHA256 of the request
+// body, prefixed with "sha256=".
+const SignatureHeader = "X-Cart-Signature"
+
+// How many journal entries a webhook reads at once.
+const webhookBatch = 100
+
+var webhookName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// A URL notified of cart changes.  Every change is POSTed as a
+// WebhookEvent, one per request, in journal order.  Deliveries
+// are retried until the URL answers with a 2xx status.  The last
+// delivered journal entry is kept in a file next to the shards,
+// so deliveries resume where they stopped after a restart.  An
+// event can arrive twice around a restart; receivers should drop
+// events whose ID they have seen.
+type Webhook struct {
+  // Identifies the delivery position file, webhook-<name>.pos.
+  Name string
+  URL string
+  // The key of the request signature.  Empty means unsigned.
+  Secret string
+  // The events to deliver.  Empty means all.
+  Events []string
+
+  // How long a single delivery may take.
+  Timeout time.Duration
+  // The first retry waits MinBackoff, every further one twice as
+  // long, up to MaxBackoff.
+  MinBackoff time.Duration
+  MaxBackoff time.Duration
+  // How often to try an event before dropping it.  0 means forever.
+  MaxAttempts int
+}
+
+// What a webhook receives.
+type WebhookEvent struct {
+  // Unique per event, so that receivers can drop duplicates.
+  ID       string    `json:"id"`
+  Event    string    `json:"event"`
+  Time     time.Time `json:"time"`
+  Customer ID        `json:"customer"`
+  Item     ID        `json:"item"`
+  Variant  map[string]string `json:"variant,omitempty"`
+  Qty      uint32    `json:"qty"`
+}
+
+// Validate makes sure the webhook settings make sense.
+func (w Webhook) Validate() error {
+  if !webhookName.MatchString(w.Name) {
+    return fmt.Errorf("webhook name %q must be lower case letters, digits, - and _", w.Name)
+  }
+
+  u, err := url.Parse(w.URL)
+  if err != nil {
+    return fmt.Errorf("webhook %v: %v", w.Name, err)
+  }
+  if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+    return fmt.Errorf("webhook %v: url must be http or https", w.Name)
+  }
+
+  for _, event := range w.Events {
+    switch event {
+    case EventItemAdded, EventItemRemoved, EventCartEmptied:
+    default:
+      return fmt.Errorf("webhook %v: unknown event %q", w.Name, event)
+    }
+  }
+
+  if w.Timeout <= 0 {
+    return fmt.Errorf("webhook %v: timeout must be positive", w.Name)
+  }
+  if w.MinBackoff <= 0 || w.MaxBackoff < w.MinBackoff {
+    return fmt.Errorf("webhook %v: backoff must be positive, the maximum at least the minimum", w.Name)
+  }
+  if w.MaxAttempts < 0 {
+    return fmt.Errorf("webhook %v: max attempts must not be negative", w.Name)
+  }
+  return nil
+}
+
+// Return the webhook events a journal entry stands for.
+func webhookEvents(e JournalEntry) []WebhookEvent {
+  event := WebhookEvent{
+    Time: e.Time,
+    Customer: e.Customer,
+    Item: e.Item,
+    Variant: e.Variant,
+    Qty: e.Qty,
+  }
+
+  var events []WebhookEvent
+  if e.Op == OpAdd {
+    event.Event = EventItemAdded
+  } else {
+    event.Event = EventItemRemoved
+  }
+  events = append(events, event)
+
+  if e.Op != OpAdd && e.Items == 0 {
+    event.Event = EventCartEmptied
+    events = append(events, event)
+  }
+
+  for i := range events {
+    events[i].ID = fmt.Sprintf("%v-%v", e.Seq, events[i].Event)
+  }
+  return events
+}
+
+// Return the signature header value of the body.
+func Sign(secret string, body []byte) string {
+  mac := hmac.New(sha256.New, []byte(secret))
+  mac.Write(body)
+  return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Delivers the journal to one webhook in the background.
+type dispatcher struct {
+  hook    Webhook
+  journal *Journal
+  // The file holding the last delivered sequence number.
+  pos     string
+  client  http.Client
+
+  ctx     context.Context
+  cancel  context.CancelFunc
+  done    chan struct{}
+}
+
+// Start delivering the journal to the webhook.
+func startDispatcher(hook Webhook, journal *Journal, dir string) (*dispatcher, error) {
+  d := &dispatcher{
+    hook: hook,
+    journal: journal,
+    pos: filepath.Join(dir, "webhook-" + hook.Name + ".pos"),
+    client: http.Client{Timeout: hook.Timeout},
+    done: make(chan struct{}),
+  }
+
+  // Before returning, so that a new webhook gets every change
+  // made from now on.
+  after, err := d.load()
+  if err != nil {
+    return nil, fmt.Errorf("webhook %v: %v", hook.Name, err)
+  }
+
+  d.ctx, d.cancel = context.WithCancel(context.Background())
+  go d.run(after)
+  return d, nil
+}
+
+// Stop delivering, abandoning the delivery in flight, and wait for
+// the dispatcher to finish.
+func (d *dispatcher) stop() {
+  d.cancel()
+  <-d.done
+}
+
+// Deliver every entry after the given one, until stopped.
+func (d *dispatcher) run(after uint64) {
+  defer close(d.done)
+
+  backoff := d.hook.MinBackoff
+  for {
+    changed := d.journal.Changed()
+
+    var batch []JournalEntry
+    err := d.journal.Read(after, func(e JournalEntry) error {
+      batch = append(batch, e)
+      if len(batch) == webhookBatch {
+        return errEnough
+      }
+      return nil
+    })
+    if err != nil && err != errEnough {
+      log.Printf("webhook %v: %v", d.hook.Name, err)
+      if !d.sleep(backoff) {
+        return
+      }
+      backoff = d.next(backoff)
+      continue
+    }
+    backoff = d.hook.MinBackoff
+
+    for _, e := range batch {
+      for _, event := range webhookEvents(e) {
+        if !d.deliver(event) {
+          return
+        }
+      }
+
+      after = e.Seq
+      if err := d.save(after); err != nil {
+        log.Printf("webhook %v: %v", d.hook.Name, err)
+      }
+    }
+
+    if len(batch) == 0 {
+      select {
+      case <-changed:
+      case <-d.ctx.Done():
+        return
+      }
+    }
+  }
+}
+
+// Deliver the event, retrying with backoff.  Return false if the
+// dispatcher got stopped first.
+func (d *dispatcher) deliver(event WebhookEvent) bool {
+  if len(d.hook.Events) > 0 && !contains(d.hook.Events, event.Event) {
+    return true
+  }
+
+  body, err := json.Marshal(event)
+  if err != nil {
+    log.Printf("webhook %v: %v", d.hook.Name, err)
+    return true
+  }
+
+  backoff := d.hook.MinBackoff
+  for attempt := 1; ; attempt++ {
+    err := d.post(event, body)
+    if err == nil {
+      return true
+    }
+    if d.ctx.Err() != nil {
+      return false
+    }
+
+    if d.hook.MaxAttempts > 0 && attempt >= d.hook.MaxAttempts {
+      log.Printf("webhook %v: dropping event %v after %v attempts: %v",
+        d.hook.Name, event.ID, attempt, err)
+      return true
+    }
+    if !d.sleep(backoff) {
+      return false
+    }
+    backoff = d.next(backoff)
+  }
+}
+
+// Make a single delivery attempt.
+func (d *dispatcher) post(event WebhookEvent, body []byte) error {
+  req, err := http.NewRequestWithContext(d.ctx, "POST", d.hook.URL, bytes.NewReader(body))
+  if err != nil {
+    return err
+  }
+  req.Header.Set("Content-Type", "application/json")
+  req.Header.Set("X-Cart-Event", event.Event)
+  req.Header.Set("X-Cart-Delivery", event.ID)
+  if d.hook.Secret != "" {
+    req.Header.Set(SignatureHeader, Sign(d.hook.Secret, body))
+  }
+
+  resp, err := d.client.Do(req)
+  if err != nil {
+    return err
+  }
+  io.Copy(ioutil.Discard, resp.Body)
+  resp.Body.Close()
+
+  if resp.StatusCode < 200 || resp.StatusCode > 299 {
+    return fmt.Errorf("%v responded with %v", d.hook.URL, resp.Status)
+  }
+  return nil
+}
+
+// Wait for the duration.  Return false if the dispatcher got
+// stopped first.
+func (d *dispatcher) sleep(wait time.Duration) bool {
+  timer := time.NewTimer(wait)
+  defer timer.Stop()
+
+  select {
+  case <-timer.C:
+    return true
+  case <-d.ctx.Done():
+    return false
+  }
+}
+
+// Return the backoff following the given one.
+func (d *dispatcher) next(backoff time.Duration) time.Duration {
+  backoff *= 2
+  if backoff > d.hook.MaxBackoff {
+    backoff = d.hook.MaxBackoff
+  }
+  return backoff
+}
+
+// Return the last delivered sequence number.  A new webhook starts
+// with the next change, rather than the whole history.
+func (d *dispatcher) load() (uint64, error) {
+  data, err := ioutil.ReadFile(d.pos)
+  if os.IsNotExist(err) {
+    after := d.journal.Next() - 1
+    return after, d.save(after)
+  }
+  if err != nil {
+    return 0, err
+  }
+  return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// Remember the last delivered sequence number.  The file is
+// replaced atomically, so a crash leaves the old or the new one.
+func (d *dispatcher) save(after uint64) error {
+  tmp := d.pos + ".tmp"
+  data := []byte(strconv.FormatUint(after, 10) + "\n")
+  if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+    return err
+  }
+  return os.Rename(tmp, d.pos)
+}
+
+// Report whether the list holds the string.
+func contains(list []string, s string) bool {
+  for _, v := range list {
+    if v == s {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,136 @@
+package cart
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "reflect"
+  "sync"
+  "testing"
+  "time"
+)
+
+// A webhook receiver failing the first few deliveries and
+// recording the events it accepted.
+type stubReceiver struct {
+  mu       sync.Mutex
+  failures int
+  attempts int
+  events   []string
+  seen     map[string]bool
+  secret   string
+  t        *testing.T
+}
+
+func (s *stubReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  body, _ := ioutil.ReadAll(r.Body)
+
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.attempts++
+  if s.failures > 0 {
+    s.failures--
+    w.WriteHeader(http.StatusInternalServerError)
+    return
+  }
+
+  if r.Header.Get(SignatureHeader) != Sign(s.secret, body) {
+    s.t.Errorf("bad signature %q", r.Header.Get(SignatureHeader))
+  }
+  var e WebhookEvent
+  if err := json.Unmarshal(body, &e); err != nil {
+    s.t.Errorf("unexpected error: %s", err)
+  }
+  // Deliveries are at least once.
+  if !s.seen[e.ID] {
+    s.seen[e.ID] = true
+    s.events = append(s.events, e.ID + " " + e.Event)
+  }
+}
+
+// Wait until the receiver got n events and return them.
+func (s *stubReceiver) wait(t *testing.T, n int) []string {
+  for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+    s.mu.Lock()
+    events := append([]string(nil), s.events...)
+    s.mu.Unlock()
+    if len(events) >= n {
+      return events
+    }
+    time.Sleep(time.Millisecond)
+  }
+  t.Fatalf("timed out waiting for %v events", n)
+  return nil
+}
+
+// Ensure changes are delivered signed and in order despite
+// failures, and that deliveries resume after a restart.
+func TestHandler_Webhook(t *testing.T) {
+  receiver := &stubReceiver{failures: 2, secret: "s3cret", seen: map[string]bool{}, t: t}
+  srv := httptest.NewServer(receiver)
+  defer srv.Close()
+
+  h, cleanup := tempHandler(t)
+  defer cleanup()
+
+  reopen := func() {
+    if err := h.Close(); err != nil {
+      t.Fatalf("unexpected error: %s", err)
+    }
+    if err := h.Open(); err != nil {
+      t.Fatalf("unexpected error: %s", err)
+    }
+  }
+
+  // Changes made before the webhook exists are not delivered.
+  h.journaling = true
+  reopen()
+  if err := h.Apply("1", "9", AddToSet); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  h.webhooks = []Webhook{{
+    Name: "stub",
+    URL: srv.URL,
+    Secret: receiver.secret,
+    Timeout: time.Second,
+    MinBackoff: time.Millisecond,
+    MaxBackoff: 4 * time.Millisecond,
+  }}
+  reopen()
+
+  if err := h.Apply("2", "10", AddQtyToSet(2)); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+  if err := h.ClearCart("2"); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  expected := []string{
+    "2-item.added item.added",
+    "3-item.removed item.removed",
+    "3-cart.emptied cart.emptied",
+  }
+  if got := receiver.wait(t, 3); !reflect.DeepEqual(got, expected) {
+    t.Fatalf("expected %v, got %v", expected, got)
+  }
+  receiver.mu.Lock()
+  attempts := receiver.attempts
+  receiver.mu.Unlock()
+  if attempts != 5 {
+    t.Fatalf("expected 5 attempts, got %v", attempts)
+  }
+
+  // Only the new change is delivered after a restart.
+  reopen()
+  if err := h.Apply("3", "11", AddToSet); err != nil {
+    t.Fatalf("unexpected error: %s", err)
+  }
+
+  expected = append(expected, "4-item.added item.added")
+  if got := receiver.wait(t, 4); !reflect.DeepEqual(got, expected) {
+    t.Fatalf("expected %v, got %v", expected, got)
+  }
+}